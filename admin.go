@@ -0,0 +1,205 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// readTokenFile reads a secret, such as the bearer token admin API requests
+// must present, from a file.
+func readTokenFile(fileName string) (string, error) {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(contents))
+	if token == "" {
+		return "", fmt.Errorf("token file %s is empty", fileName)
+	}
+	return token, nil
+}
+
+// requireToken only passes requests carrying the given bearer token on to h.
+func requireToken(token string, h http.Handler) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// seriesHandler deletes the series of a metric on DELETE requests. The name
+// parameter selects the metric, and the optional labels parameter, a comma
+// separated list of label=value pairs, the series to delete.
+type seriesHandler struct {
+	exporter *Exporter
+}
+
+func (h *seriesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "DELETE")
+		http.Error(w, "Only DELETE requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "Missing name parameter", http.StatusBadRequest)
+		return
+	}
+	labels, err := parseLabelsParam(r.URL.Query().Get("labels"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	h.exporter.registry.mtx.Lock()
+	deleted := h.exporter.registry.deleteSeries(name, labels)
+	h.exporter.registry.mtx.Unlock()
+	log.Infof("Deleted %d series of %s matching %v", deleted, name, labels)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"deleted": deleted}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// flushHandler hands the queued events over to the exporter on POST requests,
+// rather than waiting for the flush interval or threshold.
+type flushHandler struct {
+	queue *eventQueue
+}
+
+func (h *flushHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	h.queue.flush()
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// pauseHandler pauses ingestion on POST requests. The policy parameter
+// decides whether events received in the meantime are buffered, the
+// default, or dropped.
+type pauseHandler struct {
+	gate *ingestionGate
+}
+
+func (h *pauseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	policy := pausePolicy(r.URL.Query().Get("policy"))
+	if policy == "" {
+		policy = pausePolicyBuffer
+	}
+	if err := h.gate.pause(policy); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Infof("Ingestion paused, %s events", map[pausePolicy]string{pausePolicyBuffer: "buffering", pausePolicyDrop: "dropping"}[policy])
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// resumeHandler resumes ingestion on POST requests, processing the events
+// buffered in the meantime.
+type resumeHandler struct {
+	gate *ingestionGate
+}
+
+func (h *resumeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	resumed := h.gate.resume()
+	log.Infof("Ingestion resumed, processing %d buffered events", resumed)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]int{"resumed": resumed}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// logLevelHandler serves the log level on GET requests, and changes it to
+// the level parameter on PUT requests, such as to log the lines that can't be
+// parsed during an incident.
+type logLevelHandler struct {
+	mtx   sync.Mutex
+	level string
+}
+
+func (h *logLevelHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+	case http.MethodPost, http.MethodPut:
+		level := r.URL.Query().Get("level")
+		if !validLogLevel(level) {
+			http.Error(w, fmt.Sprintf("Invalid level %q, expected one of %s", level, strings.Join(logLevels, ", ")), http.StatusBadRequest)
+			return
+		}
+		if err := setLogLevel(level); err != nil {
+			http.Error(w, fmt.Sprintf("Error setting log level: %v", err), http.StatusInternalServerError)
+			return
+		}
+		log.With("previous", h.level).Warnln("Log level changed to", level)
+		h.level = level
+	default:
+		w.Header().Set("Allow", "GET, HEAD, POST, PUT")
+		http.Error(w, "Only GET, HEAD, POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"level": h.level}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// parseLabelsParam parses a comma separated list of label=value pairs.
+func parseLabelsParam(param string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	if param == "" {
+		return labels, nil
+	}
+	for _, pair := range strings.Split(param, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid label matcher %q, expected label=value", pair)
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxAggregatedTimers bounds the number of timer events held back during an
+// interval. Further events are dropped.
+const maxAggregatedTimers = 1000000
+
+// aggregator holds back counter and timer events until the end of an
+// interval, like StatsD does between flushes. Counter events for the same
+// metric and tags are summed up, except those of cumulative counters, whose
+// latest running total is kept.
+type aggregator struct {
+	interval time.Duration
+	counters map[string]*CounterEvent
+	// Keeps the order in which counters were first seen.
+	counterKeys []string
+	// Timer samples can't be summed up, as each of them is observed by a
+	// histogram or summary, so they are held back individually, up to
+	// maxTimers.
+	timers    Events
+	maxTimers int
+}
+
+func newAggregator(interval time.Duration) *aggregator {
+	return &aggregator{
+		interval:  interval,
+		counters:  make(map[string]*CounterEvent),
+		maxTimers: maxAggregatedTimers,
+	}
+}
+
+// add holds back the event if it is aggregated, and reports whether it was.
+// Cumulative tells whether a counter event holds the running total of a
+// client counter rather than an increment.
+func (a *aggregator) add(event Event, cumulative bool) bool {
+	switch ev := event.(type) {
+	case *CounterEvent:
+		key := aggregationKey(ev)
+		if c, ok := a.counters[key]; ok {
+			if cumulative {
+				c.value = ev.value
+			} else {
+				c.value += ev.value
+			}
+			return true
+		}
+		a.counters[key] = &CounterEvent{
+			metricName: ev.metricName,
+			value:      ev.value,
+			labels:     ev.labels,
+		}
+		a.counterKeys = append(a.counterKeys, key)
+		return true
+	case *TimerEvent:
+		if len(a.timers) >= a.maxTimers {
+			aggregatedTimersDropped.Inc()
+			return true
+		}
+		a.timers = append(a.timers, ev)
+		return true
+	}
+	return false
+}
+
+// flush returns the aggregated events of the interval and starts a new one.
+func (a *aggregator) flush() Events {
+	events := make(Events, 0, len(a.counterKeys)+len(a.timers))
+	for _, key := range a.counterKeys {
+		events = append(events, a.counters[key])
+	}
+	events = append(events, a.timers...)
+
+	a.counters = make(map[string]*CounterEvent)
+	a.counterKeys = nil
+	a.timers = nil
+	return events
+}
+
+func aggregationKey(event Event) string {
+	labels := event.Labels()
+	if len(labels) == 0 {
+		return event.MetricName()
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var sb strings.Builder
+	sb.WriteString(event.MetricName())
+	for _, name := range names {
+		sb.WriteByte(0xff)
+		sb.WriteString(name)
+		sb.WriteByte('=')
+		sb.WriteString(labels[name])
+	}
+	return sb.String()
+}
@@ -16,6 +16,7 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
 )
 
 func TestHandlePacket(t *testing.T) {
@@ -177,6 +178,20 @@ func TestHandlePacket(t *testing.T) {
 					labels:     map[string]string{"tag1": "bar", "tag2": "baz"},
 				},
 			},
+		}, {
+			name: "datadog timestamp",
+			in:   "foo:100|c|@0.5|#tag1:bar|T1600000000",
+			out: Events{
+				&CounterEvent{
+					metricName: "foo",
+					value:      200,
+					labels:     map[string]string{"tag1": "bar"},
+					timestamp:  time.Unix(1600000000, 0),
+				},
+			},
+		}, {
+			name: "datadog invalid timestamp",
+			in:   "foo:100|c|Tnow",
 		}, {
 			name: "datadog tag extension with # in all keys (as sent by datadog php client)",
 			in:   "foo:100|c|#tag1:bar,#tag2:baz",
@@ -396,6 +411,21 @@ func TestHandlePacket(t *testing.T) {
 			name: "empty component",
 			in:   "foo:1|c|",
 		},
+		{
+			name: "too many components",
+			in:   "foo:1|c|@1|#tag:a|T1|x",
+		},
+		{
+			name: "multiple metrics with an empty sample",
+			in:   "foo:1|c:",
+			out: Events{
+				&CounterEvent{
+					metricName: "foo",
+					value:      1,
+					labels:     map[string]string{},
+				},
+			},
+		},
 		{
 			name: "invalid utf8",
 			in:   "invalid\xc3\x28utf8:1|c",
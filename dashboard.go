@@ -0,0 +1,264 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+const (
+	dashboardPanelWidth  = 12
+	dashboardPanelHeight = 8
+)
+
+// namePlaceholderRE matches the placeholders of metric names, like $1 or
+// ${1}, which are filled in from the captures of the match.
+var namePlaceholderRE = regexp.MustCompile(`\$\{?[a-zA-Z0-9_]+\}?`)
+
+type dashboardTarget struct {
+	Expr         string `json:"expr"`
+	LegendFormat string `json:"legendFormat"`
+	RefID        string `json:"refId"`
+}
+
+type dashboardPanel struct {
+	ID          int               `json:"id"`
+	Type        string            `json:"type"`
+	Title       string            `json:"title"`
+	Description string            `json:"description,omitempty"`
+	Datasource  string            `json:"datasource"`
+	GridPos     map[string]int    `json:"gridPos"`
+	FieldConfig interface{}       `json:"fieldConfig"`
+	Targets     []dashboardTarget `json:"targets"`
+}
+
+// metricFamily is a metric produced by a mapping, as shown on a dashboard.
+type metricFamily struct {
+	name       string
+	metricType mapper.MetricType
+	timerType  mapper.TimerType
+	unit       mapper.UnitType
+	delta      bool
+	labels     []string
+	help       string
+}
+
+// metricFamilies returns the metrics produced by the mappings, fan-out
+// outputs included, in the order of the rules. Metrics produced by several
+// rules are only listed once, and mappings of unknown type are left out.
+func metricFamilies(m *mapper.MetricMapper) []metricFamily {
+	var families []metricFamily
+	seen := map[string]bool{}
+	add := func(mapping *mapper.MetricMapping, metricType mapper.MetricType) {
+		if metricType == "" || seen[mapping.Name] {
+			return
+		}
+		seen[mapping.Name] = true
+		timerType := mapping.TimerType
+		if timerType == mapper.TimerTypeDefault {
+			timerType = m.Defaults.TimerType
+		}
+		labels := make([]string, 0, len(mapping.Labels))
+		for label := range mapping.Labels {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		families = append(families, metricFamily{
+			name:       mapping.Name,
+			metricType: metricType,
+			timerType:  timerType,
+			unit:       mapping.Unit,
+			delta:      mapping.Temporality == mapper.TemporalityDelta,
+			labels:     labels,
+			help:       mapping.HelpText,
+		})
+	}
+	for i := range m.Mappings {
+		mapping := &m.Mappings[i]
+		if mapping.Action == mapper.ActionTypeDrop {
+			continue
+		}
+		metricType := mapping.MetricType
+		if metricType == "" {
+			metricType = mapping.MatchMetricType
+		}
+		add(mapping, metricType)
+		for j := range mapping.FanOut {
+			output := &mapping.FanOut[j]
+			outputType := output.MetricType
+			if outputType == "" {
+				outputType = metricType
+			}
+			add(output, outputType)
+		}
+	}
+	return families
+}
+
+// selector returns the PromQL selector of a metric, matching the name with a
+// regular expression if it has placeholders.
+func (f metricFamily) selector(suffix string, matchers ...string) string {
+	name := f.name + suffix
+	if namePlaceholderRE.MatchString(name) {
+		parts := namePlaceholderRE.Split(name, -1)
+		for i := range parts {
+			parts[i] = regexp.QuoteMeta(parts[i])
+		}
+		matchers = append([]string{fmt.Sprintf("__name__=~%q", strings.Join(parts, ".+"))}, matchers...)
+		return "{" + strings.Join(matchers, ", ") + "}"
+	}
+	if len(matchers) == 0 {
+		return name
+	}
+	return name + "{" + strings.Join(matchers, ", ") + "}"
+}
+
+// by returns the grouping of an aggregation by the labels of the mapping and
+// the extra ones.
+func (f metricFamily) by(extra ...string) string {
+	labels := append(extra, f.labels...)
+	if len(labels) == 0 {
+		return ""
+	}
+	return " by (" + strings.Join(labels, ", ") + ")"
+}
+
+// legend returns the legend format showing the labels of the mapping and the
+// extra ones.
+func (f metricFamily) legend(prefix string, extra ...string) string {
+	var parts []string
+	if prefix != "" {
+		parts = append(parts, prefix)
+	}
+	for _, label := range append(extra, f.labels...) {
+		parts = append(parts, fmt.Sprintf("%s={{%s}}", label, label))
+	}
+	if len(parts) == 0 {
+		return f.name
+	}
+	return strings.Join(parts, " ")
+}
+
+// grafanaUnit returns the Grafana unit of the values of a metric, converted
+// to their base unit, or of their rate.
+func grafanaUnit(unit mapper.UnitType, rate bool) string {
+	switch unit {
+	case mapper.UnitTypeMicroseconds, mapper.UnitTypeMilliseconds, mapper.UnitTypeSeconds:
+		if rate {
+			return "short"
+		}
+		return "s"
+	case mapper.UnitTypeBytes, mapper.UnitTypeKibibytes, mapper.UnitTypeMebibytes:
+		if rate {
+			return "Bps"
+		}
+		return "bytes"
+	case mapper.UnitTypePercent:
+		return "percentunit"
+	}
+	if rate {
+		return "ops"
+	}
+	return "short"
+}
+
+// targets returns the queries of the panel of a metric, and the unit of
+// their results.
+func (f metricFamily) targets() ([]dashboardTarget, string) {
+	var targets []dashboardTarget
+	add := func(expr, legend string) {
+		targets = append(targets, dashboardTarget{Expr: expr, LegendFormat: legend, RefID: string(rune('A' + len(targets)))})
+	}
+	switch {
+	case f.metricType == mapper.MetricTypeCounter && !f.delta:
+		add(fmt.Sprintf("sum%s (rate(%s[$__rate_interval]))", f.by(), f.selector("")), f.legend(""))
+		return targets, grafanaUnit(f.unit, true)
+	case f.metricType == mapper.MetricTypeTimer && f.timerType == mapper.TimerTypeHistogram:
+		for _, q := range []struct{ quantile, name string }{{"0.5", "p50"}, {"0.9", "p90"}, {"0.99", "p99"}} {
+			add(fmt.Sprintf("histogram_quantile(%s, sum%s (rate(%s[$__rate_interval])))", q.quantile, f.by("le"), f.selector("_bucket")), f.legend(q.name))
+		}
+	case f.metricType == mapper.MetricTypeTimer && f.timerType == mapper.TimerTypeStatistics:
+		for _, stat := range []string{"mean", "max"} {
+			add(fmt.Sprintf("max%s (%s)", f.by(), f.selector("", fmt.Sprintf("stat=%q", stat))), f.legend(stat))
+		}
+	case f.metricType == mapper.MetricTypeTimer:
+		add(fmt.Sprintf("max%s (%s)", f.by("quantile"), f.selector("")), f.legend("", "quantile"))
+	default:
+		add(fmt.Sprintf("avg%s (%s)", f.by(), f.selector("")), f.legend(""))
+	}
+	if f.metricType == mapper.MetricTypeTimer && f.unit == mapper.UnitTypeDefault {
+		// Timer samples are in milliseconds, and exposed in seconds.
+		return targets, "s"
+	}
+	return targets, grafanaUnit(f.unit, false)
+}
+
+// generateDashboard writes a Grafana dashboard with a panel per metric
+// produced by a mapping configuration, as a starting point to build on.
+func generateDashboard(fileName, title string, w io.Writer) error {
+	m := &mapper.MetricMapper{}
+	if err := m.InitFromFile(fileName, 0); err != nil {
+		return err
+	}
+
+	panels := []dashboardPanel{}
+	for i, f := range metricFamilies(m) {
+		targets, unit := f.targets()
+		panels = append(panels, dashboardPanel{
+			ID:          i + 1,
+			Type:        "timeseries",
+			Title:       f.name,
+			Description: f.help,
+			Datasource:  "$datasource",
+			GridPos: map[string]int{
+				"x": (i % 2) * dashboardPanelWidth,
+				"y": (i / 2) * dashboardPanelHeight,
+				"w": dashboardPanelWidth,
+				"h": dashboardPanelHeight,
+			},
+			FieldConfig: map[string]interface{}{
+				"defaults":  map[string]string{"unit": unit},
+				"overrides": []interface{}{},
+			},
+			Targets: targets,
+		})
+	}
+
+	dashboard := map[string]interface{}{
+		"title":         title,
+		"tags":          []string{"statsd_exporter"},
+		"editable":      true,
+		"schemaVersion": 27,
+		"time":          map[string]string{"from": "now-6h", "to": "now"},
+		"templating": map[string]interface{}{
+			"list": []map[string]interface{}{{
+				"name":  "datasource",
+				"label": "Data source",
+				"type":  "datasource",
+				"query": "prometheus",
+			}},
+		},
+		"panels": panels,
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(dashboard)
+}
@@ -0,0 +1,475 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// ruleUsage counts the metrics and series a mapping rule, or no rule, produced.
+type ruleUsage struct {
+	Metrics    int        `json:"metrics"`
+	Series     int        `json:"series"`
+	LastUpdate *time.Time `json:"last_update,omitempty"`
+}
+
+func (u *ruleUsage) add(metric metric) {
+	u.Metrics++
+	u.Series += len(metric.metrics)
+	for _, rm := range metric.metrics {
+		if u.LastUpdate == nil || rm.lastRegisteredAt().After(*u.LastUpdate) {
+			lastUpdate := rm.lastRegisteredAt()
+			u.LastUpdate = &lastUpdate
+		}
+	}
+}
+
+// ruleState is a loaded mapping rule along with its usage.
+type ruleState struct {
+	mapper.Rule
+	ruleUsage
+}
+
+// mappingState describes the mapping configuration the exporter applies.
+type mappingState struct {
+	Defaults string      `json:"defaults"`
+	Rules    []ruleState `json:"rules"`
+	Unmapped ruleUsage   `json:"unmapped"`
+}
+
+// mappingState returns the loaded mapping rules, and how many of the tracked
+// metrics and series each produced. Metrics are attributed to the rule their
+// StatsD metric maps to with the current configuration. The registry must be
+// locked.
+func (b *Exporter) mappingState() (mappingState, error) {
+	defaults, err := b.mapper.DefaultsConfig()
+	if err != nil {
+		return mappingState{}, err
+	}
+	rules, err := b.mapper.Rules()
+	if err != nil {
+		return mappingState{}, err
+	}
+	state := mappingState{Defaults: defaults, Rules: make([]ruleState, len(rules))}
+	for i, rule := range rules {
+		state.Rules[i].Rule = rule
+	}
+
+	for metricName, metric := range b.registry.metrics {
+		if len(metric.metrics) == 0 {
+			continue
+		}
+		origin, ok := b.registry.origins[metricName]
+		if !ok {
+			continue
+		}
+		mapping, _, present := b.mapper.GetMappingWithTags(origin.name, origin.metricType, origin.tags)
+		if !present || mapping == nil || mapping.Position() >= len(state.Rules) {
+			state.Unmapped.add(metric)
+			continue
+		}
+		state.Rules[mapping.Position()].add(metric)
+	}
+	return state, nil
+}
+
+// mappingsHandler serves the loaded mapping configuration and the usage of
+// each rule as JSON.
+type mappingsHandler struct {
+	exporter *Exporter
+}
+
+func (h *mappingsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.exporter.registry.mtx.RLock()
+	state, err := h.exporter.mappingState()
+	h.exporter.registry.mtx.RUnlock()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error rendering mappings: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(state); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// labelCardinality is the number of distinct values of a label of a metric.
+type labelCardinality struct {
+	Name   string `json:"name"`
+	Values int    `json:"values"`
+}
+
+// metricCardinality is the number of series of a metric, and the labels
+// multiplying them, those with the most values first.
+type metricCardinality struct {
+	Name   string             `json:"name"`
+	Series int                `json:"series"`
+	Labels []labelCardinality `json:"labels"`
+}
+
+// topCardinality returns the n metrics with the most series. The registry
+// must be locked.
+func (b *Exporter) topCardinality(n int) []metricCardinality {
+	names := make([]string, 0, len(b.registry.metrics))
+	for name, metric := range b.registry.metrics {
+		if len(metric.metrics) > 0 {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		si, sj := len(b.registry.metrics[names[i]].metrics), len(b.registry.metrics[names[j]].metrics)
+		if si != sj {
+			return si > sj
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > n {
+		names = names[:n]
+	}
+
+	top := make([]metricCardinality, 0, len(names))
+	for _, name := range names {
+		metric := b.registry.metrics[name]
+		values := map[string]map[string]struct{}{}
+		for _, rm := range metric.metrics {
+			for label, value := range rm.labels {
+				if values[label] == nil {
+					values[label] = map[string]struct{}{}
+				}
+				values[label][value] = struct{}{}
+			}
+		}
+		mc := metricCardinality{Name: name, Series: len(metric.metrics), Labels: []labelCardinality{}}
+		for label, v := range values {
+			mc.Labels = append(mc.Labels, labelCardinality{Name: label, Values: len(v)})
+		}
+		sort.Slice(mc.Labels, func(i, j int) bool {
+			if mc.Labels[i].Values != mc.Labels[j].Values {
+				return mc.Labels[i].Values > mc.Labels[j].Values
+			}
+			return mc.Labels[i].Name < mc.Labels[j].Name
+		})
+		top = append(top, mc)
+	}
+	return top
+}
+
+// cardinalityHandler serves the metrics with the most series as JSON, as
+// many as the limit parameter asks for, 10 by default.
+type cardinalityHandler struct {
+	exporter *Exporter
+}
+
+func (h *cardinalityHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.exporter.registry.mtx.RLock()
+	top := h.exporter.topCardinality(limit)
+	h.exporter.registry.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]metricCardinality{"metrics": top}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// logCardinality logs the metrics with the most series every interval, such
+// as "requests_total=1200 (path=400,code=3)".
+func (b *Exporter) logCardinality(interval time.Duration, n int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		b.registry.mtx.RLock()
+		top := b.topCardinality(n)
+		b.registry.mtx.RUnlock()
+		if len(top) == 0 {
+			continue
+		}
+		log.With("metrics", formatCardinality(top)).Infoln("Metrics with the most series")
+	}
+}
+
+func formatCardinality(top []metricCardinality) string {
+	metrics := make([]string, len(top))
+	for i, mc := range top {
+		labels := make([]string, len(mc.Labels))
+		for j, label := range mc.Labels {
+			labels[j] = fmt.Sprintf("%s=%d", label.Name, label.Values)
+		}
+		metrics[i] = fmt.Sprintf("%s=%d (%s)", mc.Name, mc.Series, strings.Join(labels, ","))
+	}
+	return strings.Join(metrics, " ")
+}
+
+var (
+	ruleSeriesDesc = prometheus.NewDesc(
+		"statsd_exporter_mapping_series",
+		"The number of series of the metrics each mapping rule produced, by the match and position of the rule. The rule of unmapped metrics is empty.",
+		[]string{"rule", "position"}, nil,
+	)
+	metricSeriesDesc = prometheus.NewDesc(
+		"statsd_exporter_metric_series",
+		"The number of series of each metric.",
+		[]string{"metric"}, nil,
+	)
+)
+
+// seriesCollector exposes the number of series each mapping rule, and
+// optionally each metric, has, as of the last update. Counting them looks the
+// mapping of every metric up, which is too costly to do on every scrape.
+type seriesCollector struct {
+	exporter  *Exporter
+	perMetric bool
+
+	mtx     sync.Mutex
+	metrics []prometheus.Metric
+}
+
+func newSeriesCollector(exporter *Exporter, perMetric bool) *seriesCollector {
+	return &seriesCollector{exporter: exporter, perMetric: perMetric}
+}
+
+// run updates the counts every interval.
+func (c *seriesCollector) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := c.update(); err != nil {
+			log.Warnln("Error counting the series of mapping rules:", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (c *seriesCollector) update() error {
+	b := c.exporter
+	b.registry.mtx.RLock()
+	state, err := b.mappingState()
+	var perMetric map[string]int
+	if err == nil && c.perMetric {
+		perMetric = make(map[string]int, len(b.registry.metrics))
+		for name, metric := range b.registry.metrics {
+			if len(metric.metrics) > 0 {
+				perMetric[name] = len(metric.metrics)
+			}
+		}
+	}
+	b.registry.mtx.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	metrics := make([]prometheus.Metric, 0, len(state.Rules)+1+len(perMetric))
+	for _, rule := range state.Rules {
+		metrics = append(metrics, prometheus.MustNewConstMetric(ruleSeriesDesc, prometheus.GaugeValue, float64(rule.Series), rule.Key, strconv.Itoa(rule.Position)))
+	}
+	metrics = append(metrics, prometheus.MustNewConstMetric(ruleSeriesDesc, prometheus.GaugeValue, float64(state.Unmapped.Series), "", ""))
+	for name, series := range perMetric {
+		metrics = append(metrics, prometheus.MustNewConstMetric(metricSeriesDesc, prometheus.GaugeValue, float64(series), name))
+	}
+
+	c.mtx.Lock()
+	c.metrics = metrics
+	c.mtx.Unlock()
+	return nil
+}
+
+func (c *seriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- ruleSeriesDesc
+	if c.perMetric {
+		ch <- metricSeriesDesc
+	}
+}
+
+func (c *seriesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	for _, m := range c.metrics {
+		ch <- m
+	}
+}
+
+// recentLines keeps the lines last received by each listener, if enabled.
+var recentLines *lineRecorder
+
+// receivedLine is a raw line received by a listener.
+type receivedLine struct {
+	Listener string    `json:"listener"`
+	Time     time.Time `json:"time"`
+	Line     string    `json:"line"`
+}
+
+// lineRecorder keeps the last lines received by each listener in ring
+// buffers, to check whether a metric is arriving at all.
+type lineRecorder struct {
+	mtx  sync.Mutex
+	size int
+	// The lines of each listener, the oldest at next once the buffer is
+	// full.
+	lines map[string][]receivedLine
+	next  map[string]int
+}
+
+func newLineRecorder(size int) *lineRecorder {
+	return &lineRecorder{size: size, lines: map[string][]receivedLine{}, next: map[string]int{}}
+}
+
+func (r *lineRecorder) record(listener, line string) {
+	now := time.Now()
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	lines := r.lines[listener]
+	if len(lines) < r.size {
+		r.lines[listener] = append(lines, receivedLine{Listener: listener, Time: now, Line: line})
+		return
+	}
+	lines[r.next[listener]] = receivedLine{Listener: listener, Time: now, Line: line}
+	r.next[listener] = (r.next[listener] + 1) % r.size
+}
+
+// recent returns the recorded lines of a listener, or of all if empty, whose
+// metric name contains name, from the oldest to the newest.
+func (r *lineRecorder) recent(listener, name string) []receivedLine {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	recent := []receivedLine{}
+	for l, lines := range r.lines {
+		if listener != "" && l != listener {
+			continue
+		}
+		next := r.next[l]
+		for _, rl := range append(lines[next:len(lines):len(lines)], lines[:next]...) {
+			metricName := rl.Line
+			if i := strings.IndexAny(metricName, ":|"); i >= 0 {
+				metricName = metricName[:i]
+			}
+			if strings.Contains(metricName, name) {
+				recent = append(recent, rl)
+			}
+		}
+	}
+	sort.SliceStable(recent, func(i, j int) bool { return recent[i].Time.Before(recent[j].Time) })
+	return recent
+}
+
+// recentLinesHandler serves the lines last received as JSON. The listener
+// parameter selects the lines of a listener, and the name parameter those
+// whose metric name contains it.
+type recentLinesHandler struct {
+	recorder *lineRecorder
+}
+
+func (h *recentLinesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	lines := h.recorder.recent(r.URL.Query().Get("listener"), r.URL.Query().Get("name"))
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]receivedLine{"lines": lines}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// metricUpdates is the approximate number of updates per second of a metric.
+type metricUpdates struct {
+	Name      string  `json:"name"`
+	PerSecond float64 `json:"per_second"`
+}
+
+// topUpdates returns the n metrics updated the most often recently. The
+// registry must be locked.
+func (b *Exporter) topUpdates(n int, now time.Time) []metricUpdates {
+	var top []metricUpdates
+	b.registry.forEachStripe(func(s *registryStripe) {
+		for name, u := range s.updates {
+			top = append(top, metricUpdates{Name: name, PerSecond: u.perSecond(now)})
+		}
+	})
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].PerSecond != top[j].PerSecond {
+			return top[i].PerSecond > top[j].PerSecond
+		}
+		return top[i].Name < top[j].Name
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// updatesHandler serves the metrics updated the most often as JSON, as many
+// as the limit parameter asks for, 10 by default.
+type updatesHandler struct {
+	exporter *Exporter
+}
+
+func (h *updatesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	h.exporter.registry.mtx.RLock()
+	top := h.exporter.topUpdates(limit, clock.Now())
+	h.exporter.registry.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]metricUpdates{"metrics": top}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
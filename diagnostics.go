@@ -0,0 +1,108 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime/pprof"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// queueStats is the state of the event queue in a diagnostic bundle.
+type queueStats struct {
+	Length        int `json:"length"`
+	Capacity      int `json:"capacity"`
+	PendingEvents int `json:"pending_events"`
+	HighWatermark int `json:"high_watermark"`
+}
+
+// diagnostics writes bundles of the state of the exporter, for postmortems.
+type diagnostics struct {
+	dir      string
+	exporter *Exporter
+	events   chan Events
+	queue    *eventQueue
+}
+
+// run writes a bundle every time one of the diagnostics signals is received.
+func (d *diagnostics) run() {
+	// Notifying no signals would notify them all.
+	if len(diagnosticsSignals) == 0 {
+		log.Warnln("Diagnostics can't be requested on this platform")
+		return
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, diagnosticsSignals...)
+	for s := range signals {
+		log.Infof("Received %s, writing diagnostics", s)
+		dir, err := d.write(time.Now())
+		if err != nil {
+			log.Errorln("Error writing diagnostics:", err)
+			continue
+		}
+		log.Infoln("Diagnostics written to", dir)
+	}
+}
+
+// write writes a bundle to a new directory named after the time, and returns
+// it. The bundle has the stacks of all goroutines, a heap profile, the state
+// of the event queue, and the metrics with the most series.
+func (d *diagnostics) write(now time.Time) (string, error) {
+	dir := filepath.Join(d.dir, "statsd_exporter-"+now.UTC().Format("20060102T150405.000Z"))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	d.exporter.registry.mtx.RLock()
+	top := d.exporter.topCardinality(50)
+	d.exporter.registry.mtx.RUnlock()
+	files := []struct {
+		name  string
+		write func(*os.File) error
+	}{
+		{"goroutines.txt", func(f *os.File) error { return pprof.Lookup("goroutine").WriteTo(f, 2) }},
+		{"heap.pprof", func(f *os.File) error { return pprof.Lookup("heap").WriteTo(f, 0) }},
+		{"queue.json", func(f *os.File) error {
+			return json.NewEncoder(f).Encode(queueStats{
+				Length:        len(d.events),
+				Capacity:      cap(d.events),
+				PendingEvents: d.queue.len(),
+				HighWatermark: d.queue.maxDepth(),
+			})
+		}},
+		{"cardinality.json", func(f *os.File) error {
+			return json.NewEncoder(f).Encode(map[string][]metricCardinality{"metrics": top})
+		}},
+	}
+	for _, file := range files {
+		f, err := os.Create(filepath.Join(dir, file.name))
+		if err != nil {
+			return "", err
+		}
+		err = file.write(f)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", fmt.Errorf("error writing %s: %v", file.name, err)
+		}
+	}
+	return dir, nil
+}
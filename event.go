@@ -26,50 +26,171 @@ type Event interface {
 	Value() float64
 	Labels() map[string]string
 	MetricType() mapper.MetricType
+	// Timestamp is the time the client sent with the sample, or the zero
+	// time if it didn't send one.
+	Timestamp() time.Time
 }
 
 type CounterEvent struct {
 	metricName string
 	value      float64
 	labels     map[string]string
+	timestamp  time.Time
 }
 
 func (c *CounterEvent) MetricName() string            { return c.metricName }
 func (c *CounterEvent) Value() float64                { return c.value }
 func (c *CounterEvent) Labels() map[string]string     { return c.labels }
 func (c *CounterEvent) MetricType() mapper.MetricType { return mapper.MetricTypeCounter }
+func (c *CounterEvent) Timestamp() time.Time          { return c.timestamp }
 
 type GaugeEvent struct {
 	metricName string
 	value      float64
 	relative   bool
 	labels     map[string]string
+	timestamp  time.Time
 }
 
 func (g *GaugeEvent) MetricName() string            { return g.metricName }
 func (g *GaugeEvent) Value() float64                { return g.value }
 func (c *GaugeEvent) Labels() map[string]string     { return c.labels }
 func (c *GaugeEvent) MetricType() mapper.MetricType { return mapper.MetricTypeGauge }
+func (c *GaugeEvent) Timestamp() time.Time          { return c.timestamp }
 
 type TimerEvent struct {
 	metricName string
 	value      float64
 	labels     map[string]string
+	timestamp  time.Time
 }
 
 func (t *TimerEvent) MetricName() string            { return t.metricName }
 func (t *TimerEvent) Value() float64                { return t.value }
 func (c *TimerEvent) Labels() map[string]string     { return c.labels }
 func (c *TimerEvent) MetricType() mapper.MetricType { return mapper.MetricTypeTimer }
+func (c *TimerEvent) Timestamp() time.Time          { return c.timestamp }
 
 type Events []Event
 
+// mappedEvent is an event after mapping, as published to Kafka.
+type mappedEvent struct {
+	Name      string            `json:"name"`
+	Labels    map[string]string `json:"labels"`
+	Type      string            `json:"type"`
+	Value     float64           `json:"value"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+// newMappedEvent returns an event with the metric name, type and labels it
+// was mapped to. The timestamp is that of the event, or else the current
+// time.
+func newMappedEvent(event Event, metricName string, metricType mapper.MetricType, labels map[string]string) mappedEvent {
+	timestamp := event.Timestamp()
+	if timestamp.IsZero() {
+		timestamp = clock.Now()
+	}
+	e := mappedEvent{
+		Name:      metricName,
+		Labels:    make(map[string]string, len(labels)),
+		Type:      string(metricType),
+		Value:     event.Value(),
+		Timestamp: timestamp,
+	}
+	for label, value := range labels {
+		e.Labels[label] = value
+	}
+	return e
+}
+
+// noLabels holds the labels of the events of lines without tags, rather than
+// an empty map allocated for each line. It is shared by all those events, so
+// it must never be modified: labels are added to a map of their own instead.
+var noLabels = map[string]string{}
+
+// withoutLabel returns a copy of an event without the given label.
+func withoutLabel(event Event, label string) Event {
+	labels := make(map[string]string, len(event.Labels()))
+	for k, v := range event.Labels() {
+		if k != label {
+			labels[k] = v
+		}
+	}
+	return withLabels(event, labels)
+}
+
+// withLabels returns a copy of an event with the given labels instead of its
+// own.
+func withLabels(event Event, labels map[string]string) Event {
+	switch e := event.(type) {
+	case *CounterEvent:
+		c := *e
+		c.labels = labels
+		return &c
+	case *GaugeEvent:
+		g := *e
+		g.labels = labels
+		return &g
+	case *TimerEvent:
+		t := *e
+		t.labels = labels
+		return &t
+	}
+	return event
+}
+
 type eventQueue struct {
 	c              chan Events
 	q              Events
 	m              sync.Mutex
 	flushThreshold int
 	flushTicker    *time.Ticker
+	// Whether the channel is closed, after which events are dropped.
+	closed bool
+	// The most batches seen in the channel recently.
+	watermark highWatermark
+}
+
+// queueWatermarkWindow is the period over which the high watermark of the
+// event queue is kept.
+const queueWatermarkWindow = time.Minute
+
+// highWatermark is the maximum of a value over the current window and the
+// previous one, so that it always covers at least a full window.
+type highWatermark struct {
+	mtx               sync.Mutex
+	start             time.Time
+	current, previous int
+}
+
+func (w *highWatermark) roll(now time.Time) {
+	switch elapsed := now.Sub(w.start); {
+	case elapsed >= 2*queueWatermarkWindow:
+		w.previous, w.current = 0, 0
+		w.start = now
+	case elapsed >= queueWatermarkWindow:
+		w.previous, w.current = w.current, 0
+		w.start = w.start.Add(queueWatermarkWindow)
+	}
+}
+
+func (w *highWatermark) observe(v int, now time.Time) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.roll(now)
+	if v > w.current {
+		w.current = v
+	}
+}
+
+func (w *highWatermark) get(now time.Time) int {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	w.roll(now)
+	if w.previous > w.current {
+		return w.previous
+	}
+	return w.current
 }
 
 type eventHandler interface {
@@ -94,8 +215,12 @@ func newEventQueue(c chan Events, flushThreshold int, flushInterval time.Duratio
 }
 
 func (eq *eventQueue) queue(events Events) {
+	eventsQueued.Add(float64(len(events)))
 	eq.m.Lock()
 	defer eq.m.Unlock()
+	if eq.closed {
+		return
+	}
 
 	for _, e := range events {
 		eq.q = append(eq.q, e)
@@ -108,11 +233,38 @@ func (eq *eventQueue) queue(events Events) {
 func (eq *eventQueue) flush() {
 	eq.m.Lock()
 	defer eq.m.Unlock()
+	if eq.closed {
+		return
+	}
 	eq.flushUnlocked()
 }
 
+// close flushes the queued events and closes the channel, so that the
+// exporter returns once it has processed them. Events queued afterwards, such
+// as by connections still open on shutdown, are dropped.
+func (eq *eventQueue) close() {
+	eq.m.Lock()
+	defer eq.m.Unlock()
+	if eq.closed {
+		return
+	}
+	eq.flushUnlocked()
+	close(eq.c)
+	eq.closed = true
+}
+
+// flushUnlocked sends the queued events to the channel, accounting the time
+// spent waiting when it is full.
 func (eq *eventQueue) flushUnlocked() {
-	eq.c <- eq.q
+	select {
+	case eq.c <- eq.q:
+	default:
+		eventQueueBlocks.Inc()
+		start := time.Now()
+		eq.c <- eq.q
+		eventQueueBlockedTime.Add(time.Since(start).Seconds())
+	}
+	eq.watermark.observe(len(eq.c), time.Now())
 	eq.q = make([]Event, 0, cap(eq.q))
 	eventsFlushed.Inc()
 }
@@ -124,10 +276,17 @@ func (eq *eventQueue) len() int {
 	return len(eq.q)
 }
 
+// maxDepth returns the most batches seen in the channel over the last one to
+// two watermark windows.
+func (eq *eventQueue) maxDepth() int {
+	return eq.watermark.get(time.Now())
+}
+
 type unbufferedEventHandler struct {
 	c chan Events
 }
 
 func (ueh *unbufferedEventHandler) queue(events Events) {
+	eventsQueued.Add(float64(len(events)))
 	ueh.c <- events
 }
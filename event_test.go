@@ -14,6 +14,8 @@
 package main
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
@@ -78,3 +80,94 @@ func TestEventIntervalFlush(t *testing.T) {
 	}
 
 }
+
+func TestFlushHandler(t *testing.T) {
+	c := make(chan Events, 100)
+	eq := newEventQueue(c, 1000, time.Second*1000)
+	eq.queue(make(Events, 10))
+
+	handler := &flushHandler{queue: eq}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/admin/flush", nil))
+	if rec.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("Expected GET to be rejected, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/api/v1/admin/flush", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected flush to succeed, got %d", rec.Code)
+	}
+	if eq.len() != 0 {
+		t.Fatal("Expected 0 events to be queued, but got", eq.len())
+	}
+	if events := <-c; len(events) != 10 {
+		t.Fatal("Expected 10 events in the event channel, but got", len(events))
+	}
+}
+
+func TestEventQueueClose(t *testing.T) {
+	c := make(chan Events, 100)
+	eq := newEventQueue(c, 1000, time.Second*1000)
+	eq.queue(make(Events, 10))
+	eq.close()
+	eq.queue(make(Events, 5))
+	eq.flush()
+	eq.close()
+
+	if events := <-c; len(events) != 10 {
+		t.Fatal("Expected 10 events in the event channel, but got", len(events))
+	}
+	if events, ok := <-c; ok {
+		t.Fatal("Expected the event channel to be closed, but got", len(events), "events")
+	}
+}
+
+func TestEventQueueSaturation(t *testing.T) {
+	c := make(chan Events, 2)
+	eq := newEventQueue(c, 1, time.Second*1000)
+	blocks := getTelemetryCounterValue(eventQueueBlocks)
+	blockedTime := getTelemetryCounterValue(eventQueueBlockedTime)
+
+	eq.queue(make(Events, 2))
+	if depth := eq.maxDepth(); depth != 2 {
+		t.Fatal("Expected a high watermark of 2, but got", depth)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		eq.queue(make(Events, 1))
+		close(done)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	<-c
+	<-done
+	<-c
+	<-c
+	if v := getTelemetryCounterValue(eventQueueBlocks) - blocks; v != 1 {
+		t.Fatal("Expected 1 blocked flush, but got", v)
+	}
+	if v := getTelemetryCounterValue(eventQueueBlockedTime) - blockedTime; v < 0.01 {
+		t.Fatal("Expected at least 10ms spent blocked, but got", v)
+	}
+}
+
+func TestHighWatermark(t *testing.T) {
+	w := &highWatermark{}
+	start := time.Unix(1000, 0)
+	w.observe(3, start)
+	w.observe(1, start.Add(30*time.Second))
+	if v := w.get(start.Add(30 * time.Second)); v != 3 {
+		t.Fatal("Expected a high watermark of 3, but got", v)
+	}
+	w.observe(2, start.Add(70*time.Second))
+	if v := w.get(start.Add(90 * time.Second)); v != 3 {
+		t.Fatal("Expected the high watermark of the previous window, but got", v)
+	}
+	if v := w.get(start.Add(150 * time.Second)); v != 2 {
+		t.Fatal("Expected the high watermark of the last window, but got", v)
+	}
+	if v := w.get(start.Add(300 * time.Second)); v != 0 {
+		t.Fatal("Expected the high watermark to be reset, but got", v)
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// eventWorkers shard events by StatsD metric, each worker taking the events
+// of a share of the StatsD metrics, so that the events of a metric are handled
+// in the order they were received. The workers look up mappings and record
+// events in parallel, only waiting for each other to create series.
+type eventWorkers struct {
+	queues []chan Events
+	wg     sync.WaitGroup
+	// The batches dispatched and not handled yet.
+	pending sync.WaitGroup
+	// The number of workers events are dispatched to, which is only below
+	// the number of workers when autoscaling.
+	active int
+	// If set, the number of active workers is adjusted this often.
+	scaleInterval time.Duration
+	lastScaled    time.Time
+	// The most batches waiting for a worker since the last adjustment.
+	peak int
+}
+
+// newEventWorkers starts n workers handling events with the given function.
+// Up to queueSize batches wait for each worker, beyond which the exporter's
+// Listen loop blocks.
+func newEventWorkers(n, queueSize int, handle func(Events)) *eventWorkers {
+	w := &eventWorkers{queues: make([]chan Events, n), active: n}
+	eventWorkersActive.Set(float64(n))
+	for i := range w.queues {
+		queue := make(chan Events, queueSize)
+		w.queues[i] = queue
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for events := range queue {
+				runRecovered("event_worker", func() { handle(events) })
+				w.pending.Done()
+			}
+		}()
+	}
+	return w
+}
+
+// autoscale starts with a single active worker, whose number is then
+// adjusted at the given interval.
+func (w *eventWorkers) autoscale(interval time.Duration) {
+	w.active = 1
+	w.scaleInterval = interval
+	w.lastScaled = time.Now()
+	eventWorkersActive.Set(1)
+}
+
+// shard returns the worker handling the events of a StatsD metric.
+func (w *eventWorkers) shard(metricName string) int {
+	h := fnv.New32a()
+	h.Write([]byte(metricName))
+	return int(h.Sum32() % uint32(w.active))
+}
+
+// dispatch splits a batch of events between the active workers.
+func (w *eventWorkers) dispatch(events Events) {
+	if len(events) == 0 {
+		return
+	}
+	if w.scaleInterval > 0 {
+		w.scale(time.Now())
+	}
+	batches := make([]Events, w.active)
+	for _, event := range events {
+		i := w.shard(event.MetricName())
+		batches[i] = append(batches[i], event)
+	}
+	for i, batch := range batches {
+		if len(batch) == 0 {
+			continue
+		}
+		if waiting := len(w.queues[i]) + 1; waiting > w.peak {
+			w.peak = waiting
+		}
+		w.pending.Add(1)
+		w.queues[i] <- batch
+	}
+}
+
+// scale adjusts the number of active workers once per interval, doubling it
+// when batches filled half the queue of a worker, and decreasing it by one
+// when they never waited behind another.
+func (w *eventWorkers) scale(now time.Time) {
+	if now.Sub(w.lastScaled) < w.scaleInterval {
+		return
+	}
+	active := w.active
+	switch {
+	case w.peak > cap(w.queues[0])/2 && active < len(w.queues):
+		active *= 2
+		if active > len(w.queues) {
+			active = len(w.queues)
+		}
+	case w.peak <= 1 && active > 1:
+		active--
+	}
+	w.lastScaled, w.peak = now, 0
+	if active == w.active {
+		return
+	}
+	// The events of a metric may move to another worker, so those already
+	// dispatched are handled first, to keep them in order.
+	w.pending.Wait()
+	w.active = active
+	eventWorkersActive.Set(float64(active))
+}
+
+// close stops the workers once they have handled the events dispatched so
+// far.
+func (w *eventWorkers) close() {
+	for _, queue := range w.queues {
+		close(queue)
+	}
+	w.wg.Wait()
+}
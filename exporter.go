@@ -15,11 +15,16 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"math"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 	"unicode/utf8"
 
@@ -46,9 +51,57 @@ func (u uncheckedCollector) Collect(c chan<- prometheus.Metric) {
 	u.c.Collect(c)
 }
 
+const (
+	unmappedCounterName = "statsd_unmapped_total"
+	unmappedGaugeName   = "statsd_unmapped_value"
+	unmappedTimerName   = "statsd_unmapped_timer"
+	unmappedNameLabel   = "statsd_metric"
+)
+
 type Exporter struct {
 	mapper   *mapper.MetricMapper
 	registry *registry
+	// When set, unmapped events are recorded into one generic metric per
+	// type, with their original name as a label, instead of into a metric
+	// named after them.
+	unmappedAsLabel bool
+	// If set, counter and timer events only take effect at the end of each
+	// aggregation interval.
+	aggregator *aggregator
+	// If set, the values covering an interval, such as the increases of
+	// delta counters, are published this often. Otherwise they are only
+	// published by calls to publishWindows.
+	publishInterval time.Duration
+	// If set, timestamped events are held back for the reorder window, and
+	// applied in the order of their timestamps.
+	reorder *reorderBuffer
+	// If set, the metrics of mappings without wildcards are created when
+	// the mapping configuration is loaded.
+	preregister bool
+	// Holds back events while ingestion is paused through the admin API.
+	gate *ingestionGate
+	// Tags attached to counters and histograms as exemplars, rather than
+	// as labels.
+	exemplarTags []string
+	// If set, mapped events are also published to Kafka through a REST
+	// proxy.
+	kafkaREST *kafkaRESTPublisher
+	// The gRPC clients streaming the updates of metrics.
+	subscriptions *subscriptions
+	// The last scrape of the scrapers asking for changed series only.
+	scrapes *scrapeTracker
+	// Labels, such as job and instance, added to every series that doesn't
+	// have them from its tags or mapping.
+	sourceLabels prometheus.Labels
+	// If set, events with this tag are recorded in the registry of the
+	// tenant it names, rather than in the main one.
+	tenantTag string
+	tenants   *tenants
+	// If set, events are handled by several workers in parallel, rather
+	// than by the Listen loop.
+	workers *eventWorkers
+	// The outcome of the last load of the mapping configuration.
+	reloads reloadStatus
 }
 
 // Replace invalid characters in the metric name with "_"
@@ -106,31 +159,224 @@ func escapeMetricName(metricName string) string {
 	return sb.String()
 }
 
-// Listen handles all events sent to the given channel sequentially. It
-// terminates when the channel is closed.
+// Listen handles all events sent to the given channel, sequentially unless
+// there are event workers. It terminates when the channel is closed, and the
+// events taken from it are handled.
 func (b *Exporter) Listen(e <-chan Events) {
 	removeStaleMetricsTicker := clock.NewTicker(time.Second)
+	defer removeStaleMetricsTicker.Stop()
+
+	var aggregationTicks <-chan time.Time
+	if b.aggregator != nil {
+		aggregationTicker := time.NewTicker(b.aggregator.interval)
+		defer aggregationTicker.Stop()
+		aggregationTicks = aggregationTicker.C
+	}
+
+	var publishTicks <-chan time.Time
+	if b.publishInterval > 0 {
+		publishTicker := time.NewTicker(b.publishInterval)
+		defer publishTicker.Stop()
+		publishTicks = publishTicker.C
+	}
 
 	for {
 		select {
 		case <-removeStaleMetricsTicker.C:
-			b.registry.removeStaleMetrics()
+			b.registry.mtx.Lock()
+			b.registry.removeStaleShard()
+			b.registry.mtx.Unlock()
+			b.forEachTenant(func(t *Exporter) {
+				t.registry.mtx.Lock()
+				t.registry.removeStaleShard()
+				t.registry.mtx.Unlock()
+			})
+			if b.reorder != nil {
+				b.process(b.reorder.release(clock.Now()))
+			}
+		case <-aggregationTicks:
+			b.dispatch(b.aggregator.flush())
+		case <-publishTicks:
+			b.publishWindows()
+		case events := <-b.gate.resumed:
+			b.ingest(events)
 		case events, ok := <-e:
 			if !ok {
 				log.Debug("Channel is closed. Break out of Exporter.Listener.")
-				removeStaleMetricsTicker.Stop()
+				if b.reorder != nil {
+					b.process(b.reorder.drain())
+				}
+				if b.aggregator != nil {
+					b.dispatch(b.aggregator.flush())
+				}
+				if b.workers != nil {
+					b.workers.close()
+				}
+				b.gate.close()
 				return
 			}
-			for _, event := range events {
-				b.handleEvent(event)
+			atomic.AddUint64(&batchesTaken, 1)
+			start := time.Now()
+			b.ingest(b.gate.admit(events))
+			eventBatchDuration.Observe(time.Since(start).Seconds())
+		}
+	}
+}
+
+// ingest processes newly received events, once the reorder buffer, if
+// enabled, releases them.
+func (b *Exporter) ingest(events Events) {
+	if b.reorder != nil {
+		events = b.holdBack(events)
+	}
+	b.process(events)
+}
+
+// process handles events, or hands them to the aggregator if it is enabled.
+func (b *Exporter) process(events Events) {
+	if b.aggregator != nil {
+		events = b.aggregate(events)
+	}
+	b.dispatch(events)
+}
+
+// holdBack passes timestamped events to the reorder buffer, and returns the
+// events released by it along with the events without timestamps.
+func (b *Exporter) holdBack(events Events) Events {
+	now := clock.Now()
+	remaining := events[:0]
+	for _, event := range events {
+		if !b.reorder.add(event, now) {
+			remaining = append(remaining, event)
+		}
+	}
+	return append(b.reorder.release(now), remaining...)
+}
+
+// aggregate holds back the events handled by the aggregator, and returns the
+// others.
+func (b *Exporter) aggregate(events Events) Events {
+	remaining := events[:0]
+	for _, event := range events {
+		if !b.aggregator.add(event, b.cumulative(event)) {
+			remaining = append(remaining, event)
+		}
+	}
+	return remaining
+}
+
+// cumulative reports whether an event is a counter event mapped to a
+// cumulative counter, whose values are running totals.
+func (b *Exporter) cumulative(event Event) bool {
+	if _, ok := event.(*CounterEvent); !ok {
+		return false
+	}
+	mapping, _, present := b.mapper.GetMappingWithTags(event.MetricName(), event.MetricType(), event.Labels())
+	return present && mapping.CounterMode == mapper.CounterModeCumulative
+}
+
+// dispatch handles events, spread over the event workers if there are
+// several.
+func (b *Exporter) dispatch(events Events) {
+	if b.workers != nil {
+		b.workers.dispatch(events)
+		return
+	}
+	b.handleEvents(events)
+}
+
+// mappingResult is the mapping of an event, looked up ahead of handling it.
+type mappingResult struct {
+	mapping *mapper.MetricMapping
+	labels  prometheus.Labels
+	present bool
+}
+
+func (b *Exporter) handleEvents(events Events) {
+	// Mappings are looked up ahead of recording the events, which takes the
+	// registry's locks per event.
+	results := make([]mappingResult, len(events))
+	for i, event := range events {
+		if _, ok := b.tenantName(event); !ok {
+			results[i].mapping, results[i].labels, results[i].present = b.mapper.GetMappingWithTags(event.MetricName(), event.MetricType(), event.Labels())
+		}
+	}
+
+	if len(events) > 0 {
+		b.registry.startWindow()
+	}
+	for i, event := range events {
+		if ingestTracer != nil {
+			if trace := ingestTracer.take(event); trace != nil {
+				b.handleTracedEvent(event, trace)
+				continue
 			}
 		}
+		b.handleMappedEvent(event, &results[i])
+	}
+}
+
+// metricsHandler wraps the handler serving scrapes so that the metrics are
+// prepared for each scrape.
+func (b *Exporter) metricsHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.prepareCollection()
+		h.ServeHTTP(w, r)
+	})
+}
+
+// prepareCollection removes expired series right before the metrics are
+// collected, rather than exposing them until the next periodic sweep. When
+// expiry is scanned incrementally, collections leave expiry to the periodic
+// sweep, as checking every series is what it avoids.
+func (b *Exporter) prepareCollection() {
+	b.registry.mtx.Lock()
+	defer b.registry.mtx.Unlock()
+	if b.registry.expiryShards == nil {
+		b.registry.removeStaleMetrics()
 	}
 }
 
+// publishWindows publishes the values of the exporter and its tenants that
+// cover the interval since the previous call, and starts a new interval.
+// Collections don't, so that scrapes and pushes don't take the increases of
+// delta counters and rates, or the samples of aggregated gauges and timer
+// statistics, from each other.
+func (b *Exporter) publishWindows() {
+	b.registry.mtx.Lock()
+	b.registry.publishWindows()
+	b.registry.mtx.Unlock()
+	b.forEachTenant(func(t *Exporter) {
+		t.registry.mtx.Lock()
+		t.registry.publishWindows()
+		t.registry.mtx.Unlock()
+	})
+}
+
 // handleEvent processes a single Event according to the configured mapping.
 func (b *Exporter) handleEvent(event Event) {
-	mapping, labels, present := b.mapper.GetMapping(event.MetricName(), event.MetricType())
+	b.handleMappedEvent(event, nil)
+}
+
+// handleMappedEvent processes an event whose mapping was looked up already,
+// unless the result is nil.
+func (b *Exporter) handleMappedEvent(event Event, result *mappingResult) {
+	if name, event, ok := b.tenantOf(event); ok {
+		t, ok := b.tenant(name)
+		if !ok {
+			tenantEventsDropped.Inc()
+			return
+		}
+		t.registry.startWindow()
+		t.handleEvent(event)
+		return
+	}
+
+	if result == nil {
+		result = &mappingResult{}
+		result.mapping, result.labels, result.present = b.mapper.GetMappingWithTags(event.MetricName(), event.MetricType(), event.Labels())
+	}
+	mapping, labels, present := result.mapping, result.labels, result.present
 	if mapping == nil {
 		mapping = &mapper.MetricMapping{}
 		if b.mapper.Defaults.Ttl != 0 {
@@ -143,64 +389,284 @@ func (b *Exporter) handleEvent(event Event) {
 		return
 	}
 
-	help := defaultHelp
-	if mapping.HelpText != "" {
-		help = mapping.HelpText
+	if !present {
+		eventsUnmapped.Inc()
+		if b.unmappedAsLabel {
+			b.recordUnmappedEvent(event, mapping)
+			return
+		}
+		b.recordEvent(event, mapping, escapeMetricName(event.MetricName()), event.Labels())
+		return
 	}
 
-	metricName := ""
-	prometheusLabels := event.Labels()
-	if present {
-		if mapping.Name == "" {
-			log.Debugf("The mapping of '%s' for match '%s' generates an empty metric name", event.MetricName(), mapping.Match)
-			errorEventStats.WithLabelValues("empty_metric_name").Inc()
+	eventsMapped.Inc()
+	if mapping.Name == "" {
+		log.Debugf("The mapping of '%s' for match '%s' generates an empty metric name", event.MetricName(), mapping.Match)
+		errorEventStats.WithLabelValues("empty_metric_name").Inc()
+		return
+	}
+
+	metricName := mapping.Name
+	for _, rule := range mapping.ValueRules {
+		if !rule.When.Matches(event.Value()) {
+			continue
+		}
+		if rule.Action == mapper.ActionTypeDrop {
+			eventsActions.WithLabelValues("drop").Inc()
 			return
 		}
-		metricName = escapeMetricName(mapping.Name)
-		for label, value := range labels {
-			prometheusLabels[label] = value
+		metricName = rule.Name
+		break
+	}
+	eventsActions.WithLabelValues(string(mapping.Action)).Inc()
+
+	// The fan-out outputs need their own label sets, so build them before
+	// the event's labels are extended for the primary metric below.
+	for i := range mapping.FanOut {
+		output := &mapping.FanOut[i]
+		outputLabels := make(prometheus.Labels, len(event.Labels())+len(output.Labels))
+		for label, value := range event.Labels() {
+			outputLabels[label] = value
+		}
+		for label, value := range output.Labels {
+			outputLabels[label] = value
 		}
-		eventsActions.WithLabelValues(string(mapping.Action)).Inc()
+		b.recordEvent(event, output, escapeMetricName(output.Name), outputLabels)
+	}
+
+	prometheusLabels := event.Labels()
+	if len(prometheusLabels) == 0 && len(labels) > 0 {
+		prometheusLabels = make(prometheus.Labels, len(labels))
+	}
+	for label, value := range labels {
+		prometheusLabels[label] = value
+	}
+	b.recordEvent(event, mapping, escapeMetricName(metricName), prometheusLabels)
+}
+
+// recordUnmappedEvent records an unmapped event into the generic metric for
+// its type, with its name as a label.
+func (b *Exporter) recordUnmappedEvent(event Event, mapping *mapper.MetricMapping) {
+	var metricName string
+	switch event.MetricType() {
+	case mapper.MetricTypeCounter:
+		metricName = unmappedCounterName
+	case mapper.MetricTypeGauge:
+		metricName = unmappedGaugeName
+	default:
+		metricName = unmappedTimerName
+	}
+
+	labels := make(prometheus.Labels, len(event.Labels())+1)
+	for label, value := range event.Labels() {
+		labels[label] = value
+	}
+	labels[unmappedNameLabel] = event.MetricName()
+	b.recordEvent(event, mapping, metricName, labels)
+}
+
+// addSourceLabels adds the source labels the series doesn't have yet.
+func (b *Exporter) addSourceLabels(labels prometheus.Labels) prometheus.Labels {
+	if len(b.sourceLabels) == 0 {
+		return labels
+	}
+	if len(labels) == 0 {
+		labels = make(prometheus.Labels, len(b.sourceLabels))
+	}
+	for label, value := range b.sourceLabels {
+		if _, ok := labels[label]; !ok {
+			labels[label] = value
+		}
+	}
+	return labels
+}
+
+// publishMapped passes a mapped event on to the Kafka REST proxy.
+func (b *Exporter) publishMapped(event Event, metricName string, metricType mapper.MetricType, labels prometheus.Labels) {
+	// JSON has no representation of NaN and infinite values.
+	if math.IsNaN(event.Value()) || math.IsInf(event.Value(), 0) {
+		kafkaRESTRecords.WithLabelValues("dropped").Inc()
+		return
+	}
+	b.kafkaREST.publish(newMappedEvent(event, metricName, metricType, labels))
+}
+
+// recordEvent updates the metric with the given name and labels from a
+// single event. The metric type is that of the event unless the mapping
+// overrides it.
+func (b *Exporter) recordEvent(event Event, mapping *mapper.MetricMapping, metricName string, prometheusLabels prometheus.Labels) {
+	for i := range mapping.LabelTransforms {
+		transform := &mapping.LabelTransforms[i]
+		if value, ok := prometheusLabels[transform.Label]; ok {
+			prometheusLabels[transform.Label] = transform.Apply(value)
+		}
+	}
+
+	exemplarLabels := b.extractExemplar(prometheusLabels)
+	prometheusLabels = b.addSourceLabels(prometheusLabels)
+	b.registry.countUpdate(metricName, clock.Now())
+
+	help := defaultHelp
+	if mapping.HelpText != "" {
+		help = mapping.HelpText
+	}
+
+	metricType := mapping.MetricType
+	if metricType == "" {
+		metricType = event.MetricType()
+	}
+	if b.kafkaREST != nil {
+		b.publishMapped(event, metricName, metricType, prometheusLabels)
+	}
+	if b.subscriptions.active() {
+		b.subscriptions.publish(event, metricName, metricType, prometheusLabels)
+	}
+
+	s := seriesEvent{
+		event:          event,
+		mapping:        mapping,
+		metricName:     metricName,
+		metricType:     metricType,
+		labels:         prometheusLabels,
+		exemplarLabels: exemplarLabels,
+		help:           help,
+	}
+	// Most events update series that exist already, which only needs the
+	// read lock. The others are recorded again under the write lock.
+	if !b.recordSeries(&s, false) {
+		b.recordSeries(&s, true)
+	}
+}
+
+// seriesEvent is an event along with the metric it updates.
+type seriesEvent struct {
+	event          Event
+	mapping        *mapper.MetricMapping
+	metricName     string
+	metricType     mapper.MetricType
+	labels         prometheus.Labels
+	exemplarLabels prometheus.Labels
+	help           string
+}
+
+// recordSeries updates the series of an event. Unless create is set, it
+// holds the registry's read lock, and returns false without having recorded
+// anything if the event needs a series or metric that doesn't exist yet.
+// Hence all series are looked up before any of them is updated.
+func (b *Exporter) recordSeries(s *seriesEvent, create bool) bool {
+	if create {
+		b.registry.mtx.Lock()
+		// Unlocked even if the event panics, for processing to be restarted.
+		defer b.registry.mtx.Unlock()
 	} else {
-		eventsUnmapped.Inc()
-		metricName = escapeMetricName(event.MetricName())
+		b.registry.mtx.RLock()
+		defer b.registry.mtx.RUnlock()
+	}
+	if err := b.registry.recordOrigin(s.metricName, s.event, create); err != nil {
+		return false
 	}
 
-	switch ev := event.(type) {
-	case *CounterEvent:
+	event, mapping, metricName, prometheusLabels, help := s.event, s.mapping, s.metricName, s.labels, s.help
+	switch s.metricType {
+	case mapper.MetricTypeCounter:
+		// Counters record the value of StatsD counters, and count the
+		// samples of any other type.
+		value := 1.0
+		if _, ok := event.(*CounterEvent); ok {
+			value = event.Value() * mapping.Unit.Scale()
+		}
 		// We don't accept negative values for counters. Incrementing the counter with a negative number
 		// will cause the exporter to panic. Instead we will warn and continue to the next event.
-		if event.Value() < 0.0 {
-			log.Debugf("Counter %q is: '%f' (counter must be non-negative value)", metricName, event.Value())
+		if value < 0.0 {
+			log.Debugf("Counter %q is: '%f' (counter must be non-negative value)", metricName, value)
 			errorEventStats.WithLabelValues("illegal_negative_counter").Inc()
-			return
+			return true
 		}
 
-		counter, err := b.registry.getCounter(metricName, prometheusLabels, help, mapping)
-		if err == nil {
-			counter.Add(event.Value())
-			eventStats.WithLabelValues("counter").Inc()
+		var (
+			gauge   prometheus.Gauge
+			counter prometheus.Counter
+			err     error
+		)
+		if mapping.Temporality == mapper.TemporalityDelta {
+			gauge, err = b.registry.getGauge(metricName, prometheusLabels, help, mapping, create)
 		} else {
-			log.Debugf(regErrF, metricName, err)
-			conflictingEventStats.WithLabelValues("counter").Inc()
+			counter, err = b.registry.getCounter(metricName, prometheusLabels, help, mapping, create)
+		}
+		if err == errNeedsWriteLock {
+			return false
+		}
+		if err != nil {
+			recordRegistryError(metricName, "counter", err)
+			return true
+		}
+		var (
+			rateName string
+			rate     prometheus.Gauge
+			rateErr  error
+		)
+		if mapping.ExportRate {
+			rateName = rateMetricName(metricName)
+			rate, rateErr = b.registry.getGauge(rateName, prometheusLabels, "Per-second rate of "+metricName, mapping, create)
+			if rateErr == errNeedsWriteLock {
+				return false
+			}
 		}
 
-	case *GaugeEvent:
-		gauge, err := b.registry.getGauge(metricName, prometheusLabels, help, mapping)
+		if gauge != nil {
+			if mapping.CounterMode == mapper.CounterModeCumulative {
+				value = b.registry.clientIncrement(gauge, value)
+			}
+			b.registry.addDelta(gauge, value)
+		} else {
+			if mapping.CounterMode == mapper.CounterModeCumulative {
+				value = b.registry.clientIncrement(counter, value)
+			}
+			counter.Add(value)
+			b.registry.recordExemplar(counter, math.Inf(1), s.exemplarLabels, value)
+		}
+		eventStats.WithLabelValues("counter").Inc()
+
+		if mapping.ExportRate {
+			if rateErr != nil {
+				recordRegistryError(rateName, "counter", rateErr)
+				return true
+			}
+			b.registry.addRate(rate, value)
+		}
+
+	case mapper.MetricTypeGauge:
+		gauge, err := b.registry.getGauge(metricName, prometheusLabels, help, mapping, create)
+		if err == errNeedsWriteLock {
+			return false
+		}
 
 		if err == nil {
-			if ev.relative {
-				gauge.Add(event.Value())
-			} else {
-				gauge.Set(event.Value())
+			value := event.Value() * mapping.Unit.Scale()
+			ev, ok := event.(*GaugeEvent)
+			relative := ok && ev.relative
+			switch {
+			case mapping.MinUpdateInterval > 0,
+				mapping.GaugeAggregation != mapper.GaugeAggregationDefault && mapping.GaugeAggregation != mapper.GaugeAggregationLast:
+				b.registry.observeGauge(gauge, mapping, value, relative)
+			case relative:
+				gauge.Add(value)
+			default:
+				gauge.Set(value)
 			}
 			eventStats.WithLabelValues("gauge").Inc()
 		} else {
-			log.Debugf(regErrF, metricName, err)
-			conflictingEventStats.WithLabelValues("gauge").Inc()
+			recordRegistryError(metricName, "gauge", err)
+		}
+
+	case mapper.MetricTypeTimer:
+		value := event.Value()
+		if mapping.Unit != mapper.UnitTypeDefault {
+			value *= mapping.Unit.Scale()
+		} else if _, ok := event.(*TimerEvent); ok {
+			value /= 1000 // prometheus presumes seconds, statsd millisecond
 		}
 
-	case *TimerEvent:
 		t := mapper.TimerTypeDefault
 		if mapping != nil {
 			t = mapping.TimerType
@@ -209,51 +675,112 @@ func (b *Exporter) handleEvent(event Event) {
 			t = b.mapper.Defaults.TimerType
 		}
 
+		var (
+			histogram prometheus.Observer
+			summary   prometheus.Observer
+			stats     []prometheus.Gauge
+			err       error
+		)
 		switch t {
 		case mapper.TimerTypeHistogram:
-			histogram, err := b.registry.getHistogram(metricName, prometheusLabels, help, mapping)
-			if err == nil {
-				histogram.Observe(event.Value() / 1000) // prometheus presumes seconds, statsd millisecond
-				eventStats.WithLabelValues("timer").Inc()
-			} else {
-				log.Debugf(regErrF, metricName, err)
-				conflictingEventStats.WithLabelValues("timer").Inc()
-			}
-
+			histogram, err = b.registry.getHistogram(metricName, prometheusLabels, help, mapping, create)
 		case mapper.TimerTypeDefault, mapper.TimerTypeSummary:
-			summary, err := b.registry.getSummary(metricName, prometheusLabels, help, mapping)
-			if err == nil {
-				summary.Observe(event.Value() / 1000) // prometheus presumes seconds, statsd millisecond
-				eventStats.WithLabelValues("timer").Inc()
-			} else {
-				log.Debugf(regErrF, metricName, err)
-				conflictingEventStats.WithLabelValues("timer").Inc()
+			summary, err = b.registry.getSummary(metricName, prometheusLabels, help, mapping, create)
+		case mapper.TimerTypeStatistics:
+			stats, err = b.registry.timerStatisticsGauges(metricName, prometheusLabels, help, mapping, create)
+		default:
+			panic(fmt.Sprintf("unknown timer type '%s'", t))
+		}
+		if err == errNeedsWriteLock {
+			return false
+		}
+		var (
+			statsName  string
+			extraStats []prometheus.Gauge
+			statsErr   error
+		)
+		if mapping.ExportStatistics && t != mapper.TimerTypeStatistics {
+			statsName = statisticsMetricName(metricName)
+			extraStats, statsErr = b.registry.timerStatisticsGauges(statsName, prometheusLabels, "Statistics of "+metricName, mapping, create)
+			if statsErr == errNeedsWriteLock {
+				return false
 			}
+		}
 
+		switch {
+		case err != nil:
+			recordRegistryError(metricName, "timer", err)
+		case histogram != nil:
+			histogram.Observe(value)
+			b.registry.recordExemplar(histogram, bucketBound(b.registry.histogramBuckets(mapping), value), s.exemplarLabels, value)
+			eventStats.WithLabelValues("timer").Inc()
+		case summary != nil:
+			summary.Observe(value)
+			eventStats.WithLabelValues("timer").Inc()
 		default:
-			panic(fmt.Sprintf("unknown timer type '%s'", t))
+			b.registry.observeTimerStatistics(stats, value)
+			eventStats.WithLabelValues("timer").Inc()
+		}
+
+		if statsErr != nil {
+			recordRegistryError(statsName, "timer", statsErr)
+		} else if extraStats != nil {
+			b.registry.observeTimerStatistics(extraStats, value)
 		}
 
 	default:
 		log.Debugln("Unsupported event type")
 		eventStats.WithLabelValues("illegal").Inc()
 	}
+	return true
+}
+
+// rateMetricName returns the name of the gauge exposing the rate of a
+// counter.
+func rateMetricName(counterName string) string {
+	return strings.TrimSuffix(counterName, "_total") + "_per_second"
+}
+
+// statisticsMetricName returns the name of the gauge exposing the statistics
+// of a timer next to its summary or histogram.
+func statisticsMetricName(timerName string) string {
+	return timerName + "_stats"
+}
+
+// recordRegistryError accounts for an event that the registry couldn't
+// record.
+func recordRegistryError(metricName, eventType string, err error) {
+	log.Debugf(regErrF, metricName, err)
+	switch err {
+	case errSeriesLimit:
+		errorEventStats.WithLabelValues("series_limit").Inc()
+		return
+	case errMemoryLimit:
+		errorEventStats.WithLabelValues("memory_limit").Inc()
+		return
+	}
+	conflictingEventStats.WithLabelValues(eventType).Inc()
 }
 
 func NewExporter(mapper *mapper.MetricMapper) *Exporter {
 	return &Exporter{
-		mapper:   mapper,
-		registry: newRegistry(mapper),
+		mapper:        mapper,
+		registry:      newRegistry(mapper),
+		gate:          newIngestionGate(),
+		tenants:       newTenants(),
+		scrapes:       newScrapeTracker(),
+		subscriptions: newSubscriptions(),
 	}
 }
 
-func buildEvent(statType, metric string, value float64, relative bool, labels map[string]string) (Event, error) {
+func buildEvent(statType, metric string, value float64, relative bool, labels map[string]string, timestamp time.Time) (Event, error) {
 	switch statType {
 	case "c":
 		return &CounterEvent{
 			metricName: metric,
 			value:      float64(value),
 			labels:     labels,
+			timestamp:  timestamp,
 		}, nil
 	case "g":
 		return &GaugeEvent{
@@ -261,12 +788,14 @@ func buildEvent(statType, metric string, value float64, relative bool, labels ma
 			value:      float64(value),
 			relative:   relative,
 			labels:     labels,
+			timestamp:  timestamp,
 		}, nil
 	case "ms", "h", "d":
 		return &TimerEvent{
 			metricName: metric,
 			value:      float64(value),
 			labels:     labels,
+			timestamp:  timestamp,
 		}, nil
 	case "s":
 		return nil, fmt.Errorf("no support for StatsD sets")
@@ -275,10 +804,10 @@ func buildEvent(statType, metric string, value float64, relative bool, labels ma
 	}
 }
 
-func parseTag(component, tag string, separator rune, labels map[string]string) {
+func parseTag(listener, component, tag string, separator rune, labels map[string]string) {
 	// Entirely empty tag is an error
 	if len(tag) == 0 {
-		tagErrors.Inc()
+		tagErrors.WithLabelValues(listener).Inc()
 		log.Debugf("Empty name tag in component %s", component)
 		return
 	}
@@ -290,34 +819,34 @@ func parseTag(component, tag string, separator rune, labels map[string]string) {
 
 			if len(k) == 0 || len(v) == 0 {
 				// Empty key or value is an error
-				tagErrors.Inc()
+				tagErrors.WithLabelValues(listener).Inc()
 				log.Debugf("Malformed name tag %s=%s in component %s", k, v, component)
 			} else {
-				labels[escapeMetricName(k)] = v
+				labels[interned.intern(escapeMetricName(k))] = interned.intern(v)
 			}
 			return
 		}
 	}
 
 	// Missing separator (no value) is an error
-	tagErrors.Inc()
+	tagErrors.WithLabelValues(listener).Inc()
 	log.Debugf("Malformed name tag %s in component %s", tag, component)
 }
 
-func parseNameTags(component string, labels map[string]string) {
+func parseNameTags(listener, component string, labels map[string]string) {
 	lastTagEndIndex := 0
 	for i, c := range component {
 		if c == ',' {
 			tag := component[lastTagEndIndex:i]
 			lastTagEndIndex = i + 1
-			parseTag(component, tag, '=', labels)
+			parseTag(listener, component, tag, '=', labels)
 		}
 	}
 
 	// If we're not off the end of the string, add the last tag
 	if lastTagEndIndex < len(component) {
 		tag := component[lastTagEndIndex:]
-		parseTag(component, tag, '=', labels)
+		parseTag(listener, component, tag, '=', labels)
 	}
 }
 
@@ -328,77 +857,107 @@ func trimLeftHash(s string) string {
 	return s
 }
 
-func parseDogStatsDTags(component string, labels map[string]string) {
+func parseDogStatsDTags(listener, component string, labels map[string]string) {
 	lastTagEndIndex := 0
 	for i, c := range component {
 		if c == ',' {
 			tag := component[lastTagEndIndex:i]
 			lastTagEndIndex = i + 1
-			parseTag(component, trimLeftHash(tag), ':', labels)
+			parseTag(listener, component, trimLeftHash(tag), ':', labels)
 		}
 	}
 
 	// If we're not off the end of the string, add the last tag
 	if lastTagEndIndex < len(component) {
 		tag := component[lastTagEndIndex:]
-		parseTag(component, trimLeftHash(tag), ':', labels)
+		parseTag(listener, component, trimLeftHash(tag), ':', labels)
 	}
 }
 
-func parseNameAndTags(name string, labels map[string]string) string {
+func parseNameAndTags(listener, name string, labels map[string]string) string {
 	for i, c := range name {
 		// `#` delimits start of tags by Librato
 		// https://www.librato.com/docs/kb/collect/collection_agents/stastd/#stat-level-tags
 		// `,` delimits start of tags by InfluxDB
 		// https://www.influxdata.com/blog/getting-started-with-sending-statsd-metrics-to-telegraf-influxdb/#introducing-influx-statsd
 		if c == '#' || c == ',' {
-			parseNameTags(name[i+1:], labels)
+			parseNameTags(listener, name[i+1:], labels)
 			return name[:i]
 		}
 	}
 	return name
 }
 
-func lineToEvents(line string) Events {
+// maxSampleComponents is the most components a sample has: its value and
+// type, then its sampling factor, tags and timestamp.
+const maxSampleComponents = 5
+
+// splitComponents splits a sample at its pipes into the given array rather
+// than a newly allocated slice, failing if there are too many components.
+func splitComponents(sample string, parts *[maxSampleComponents]string) ([]string, bool) {
+	for n := range parts {
+		i := strings.IndexByte(sample, '|')
+		if i < 0 {
+			parts[n] = sample
+			return parts[:n+1], true
+		}
+		parts[n] = sample[:i]
+		sample = sample[i+1:]
+	}
+	return nil, false
+}
+
+func lineToEvents(listener, line string) Events {
 	events := Events{}
 	if line == "" {
 		return events
 	}
 
-	elements := strings.SplitN(line, ":", 2)
-	if len(elements) < 2 || len(elements[0]) == 0 || !utf8.ValidString(line) {
-		sampleErrors.WithLabelValues("malformed_line").Inc()
-		log.Debugln("Bad line from StatsD:", line)
+	// The line is split in place, as slicing it doesn't allocate.
+	nameEnd := strings.IndexByte(line, ':')
+	if nameEnd <= 0 || !utf8.ValidString(line) {
+		sampleErrors.WithLabelValues(listener, "malformed_line").Inc()
+		logMalformedLine(log.With("line", line), "Bad line from StatsD")
 		return events
 	}
 
-	labels := map[string]string{}
-	metric := parseNameAndTags(elements[0], labels)
-
-	var samples []string
-	if strings.Contains(elements[1], "|#") {
+	counters := lineCountersFor(listener)
+	rest := line[nameEnd+1:]
+	dogStatsD := strings.Contains(rest, "|#")
+	labels := noLabels
+	if dogStatsD || strings.ContainsAny(line[:nameEnd], "#,") {
+		labels = map[string]string{}
+	}
+	metric := interned.intern(parseNameAndTags(listener, line[:nameEnd], labels))
+	if dogStatsD {
 		// using DogStatsD tags
 
 		// don't allow mixed tagging styles
 		if len(labels) > 0 {
-			sampleErrors.WithLabelValues("mixed_tagging_styles").Inc()
-			log.Debugln("Bad line (multiple tagging styles) from StatsD:", line)
+			sampleErrors.WithLabelValues(listener, "mixed_tagging_styles").Inc()
+			logMalformedLine(log.With("line", line), "Bad line (multiple tagging styles) from StatsD")
 			return events
 		}
-
-		// disable multi-metrics
-		samples = elements[1:]
-	} else {
-		samples = strings.Split(elements[1], ":")
 	}
+	var parts [maxSampleComponents]string
 samples:
-	for _, sample := range samples {
-		samplesReceived.Inc()
-		components := strings.Split(sample, "|")
+	for more := true; more; {
+		sample := rest
+		more = false
+		// Multi-metric lines carry samples separated by colons, which are
+		// disabled with DogStatsD tags.
+		if !dogStatsD {
+			if i := strings.IndexByte(rest, ':'); i >= 0 {
+				sample, rest, more = rest[:i], rest[i+1:], true
+			}
+		}
+		counters.samples.Inc()
+		components, ok := splitComponents(sample, &parts)
 		samplingFactor := 1.0
-		if len(components) < 2 || len(components) > 4 {
-			sampleErrors.WithLabelValues("malformed_component").Inc()
-			log.Debugln("Bad component on line:", line)
+		var timestamp time.Time
+		if !ok || len(components) < 2 {
+			sampleErrors.WithLabelValues(listener, "malformed_component").Inc()
+			logMalformedLine(log.With("line", line), "Bad component on line")
 			continue
 		}
 		valueStr, statType := components[0], components[1]
@@ -410,8 +969,8 @@ samples:
 
 		value, err := strconv.ParseFloat(valueStr, 64)
 		if err != nil {
-			log.Debugf("Bad value %s on line: %s", valueStr, line)
-			sampleErrors.WithLabelValues("malformed_value").Inc()
+			logMalformedLine(log.With("line", line).With("value", valueStr), "Bad value on line")
+			sampleErrors.WithLabelValues(listener, "malformed_value").Inc()
 			continue
 		}
 
@@ -419,8 +978,8 @@ samples:
 		if len(components) >= 3 {
 			for _, component := range components[2:] {
 				if len(component) == 0 {
-					log.Debugln("Empty component on line: ", line)
-					sampleErrors.WithLabelValues("malformed_component").Inc()
+					logMalformedLine(log.With("line", line), "Empty component on line")
+					sampleErrors.WithLabelValues(listener, "malformed_component").Inc()
 					continue samples
 				}
 			}
@@ -431,8 +990,8 @@ samples:
 
 					samplingFactor, err = strconv.ParseFloat(component[1:], 64)
 					if err != nil {
-						log.Debugf("Invalid sampling factor %s on line %s", component[1:], line)
-						sampleErrors.WithLabelValues("invalid_sample_factor").Inc()
+						logMalformedLine(log.With("line", line).With("sampling_factor", component[1:]), "Invalid sampling factor on line")
+						sampleErrors.WithLabelValues(listener, "invalid_sample_factor").Inc()
 					}
 					if samplingFactor == 0 {
 						samplingFactor = 1
@@ -446,24 +1005,33 @@ samples:
 						multiplyEvents = int(1 / samplingFactor)
 					}
 				case '#':
-					parseDogStatsDTags(component[1:], labels)
+					parseDogStatsDTags(listener, component[1:], labels)
+				case 'T':
+					// DogStatsD timestamp, in seconds since the epoch.
+					seconds, err := strconv.ParseInt(component[1:], 10, 64)
+					if err != nil {
+						logMalformedLine(log.With("line", line).With("timestamp", component[1:]), "Invalid timestamp on line")
+						sampleErrors.WithLabelValues(listener, "invalid_timestamp").Inc()
+						continue samples
+					}
+					timestamp = time.Unix(seconds, 0)
 				default:
-					log.Debugf("Invalid sampling factor or tag section %s on line %s", components[2], line)
-					sampleErrors.WithLabelValues("invalid_sample_factor").Inc()
+					logMalformedLine(log.With("line", line).With("section", components[2]), "Invalid sampling factor or tag section on line")
+					sampleErrors.WithLabelValues(listener, "invalid_sample_factor").Inc()
 					continue
 				}
 			}
 		}
 
 		if len(labels) > 0 {
-			tagsReceived.Inc()
+			counters.tags.Inc()
 		}
 
 		for i := 0; i < multiplyEvents; i++ {
-			event, err := buildEvent(statType, metric, value, relative, labels)
+			event, err := buildEvent(statType, metric, value, relative, labels, timestamp)
 			if err != nil {
-				log.Debugf("Error building event on line %s: %s", line, err)
-				sampleErrors.WithLabelValues("illegal_event").Inc()
+				logMalformedLine(log.With("line", line).With("err", err), "Error building event on line")
+				sampleErrors.WithLabelValues(listener, "illegal_event").Inc()
 				continue
 			}
 			events = append(events, event)
@@ -472,6 +1040,36 @@ samples:
 	return events
 }
 
+// parseLine parses a line received by a listener from a source address,
+// accounting for it.
+func parseLine(listener, source, line string) Events {
+	counters := lineCountersFor(listener)
+	counters.lines.Inc()
+	atomic.AddUint64(&linesRead, 1)
+	if recentLines != nil && line != "" {
+		recentLines.record(listener, line)
+	}
+	traced := ingestTracer != nil && line != "" && ingestTracer.sample()
+	var received time.Time
+	if traced {
+		received = time.Now()
+	}
+	events := lineToEvents(listener, line)
+	if line == "" {
+		return events
+	}
+	observeSkew(listener, source, events)
+	if traced && len(events) > 0 {
+		ingestTracer.begin(listener, line, events, received)
+	}
+	if len(events) == 0 {
+		counters.errored.Inc()
+	} else {
+		counters.parsed.Inc()
+	}
+	return events
+}
+
 type StatsDUDPListener struct {
 	conn         *net.UDPConn
 	eventHandler eventHandler
@@ -484,7 +1082,7 @@ func (l *StatsDUDPListener) SetEventHandler(eh eventHandler) {
 func (l *StatsDUDPListener) Listen() {
 	buf := make([]byte, 65535)
 	for {
-		n, _, err := l.conn.ReadFromUDP(buf)
+		n, addr, err := l.conn.ReadFromUDP(buf)
 		if err != nil {
 			// https://github.com/golang/go/issues/4373
 			// ignore net: errClosing error as it will occur during shutdown
@@ -494,22 +1092,71 @@ func (l *StatsDUDPListener) Listen() {
 			log.Error(err)
 			return
 		}
-		l.handlePacket(buf[0:n])
+		if topSources != nil {
+			topSources.add(addr.IP.String(), countLines(buf[:n]), n)
+		}
+		l.handlePacketFrom(addr.IP.String(), buf[0:n])
 	}
 }
 
+// countLines returns the number of lines of a packet, the last of which may
+// not end with a newline.
+func countLines(packet []byte) int {
+	lines := bytes.Count(packet, []byte("\n"))
+	if len(packet) > 0 && packet[len(packet)-1] != '\n' {
+		lines++
+	}
+	return lines
+}
+
 func (l *StatsDUDPListener) handlePacket(packet []byte) {
+	l.handlePacketFrom("", packet)
+}
+
+// handlePacketFrom handles a packet received from a source address.
+func (l *StatsDUDPListener) handlePacketFrom(source string, packet []byte) {
 	udpPackets.Inc()
-	lines := strings.Split(string(packet), "\n")
-	for _, line := range lines {
-		linesReceived.Inc()
-		l.eventHandler.queue(lineToEvents(line))
+	l.eventHandler.queue(parsePacket("udp", source, packet))
+}
+
+// parsePacket parses the lines of a packet, the last of which may be empty,
+// into a single batch of events. The packet is copied into a string the
+// lines are sliced from, as events keep parts of them while the read buffer
+// is reused.
+func parsePacket(listener, source string, packet []byte) Events {
+	lines := string(packet)
+	var events Events
+	for {
+		line := lines
+		i := strings.IndexByte(lines, '\n')
+		if i >= 0 {
+			line, lines = lines[:i], lines[i+1:]
+		}
+		if parsed := parseLine(listener, source, line); events == nil {
+			events = parsed
+		} else {
+			events = append(events, parsed...)
+		}
+		if i < 0 {
+			return events
+		}
 	}
 }
 
+// tcpBatchSize is the most events of a TCP connection queued together.
+const tcpBatchSize = 1000
+
+// tcpReaders are the read buffers of TCP connections, reused across them
+// rather than allocated for each.
+var tcpReaders = sync.Pool{
+	New: func() interface{} { return bufio.NewReader(nil) },
+}
+
 type StatsDTCPListener struct {
 	conn         *net.TCPListener
 	eventHandler eventHandler
+	// If set, connections without lines for this long are closed.
+	idleTimeout time.Duration
 }
 
 func (l *StatsDTCPListener) SetEventHandler(eh eventHandler) {
@@ -527,32 +1174,62 @@ func (l *StatsDTCPListener) Listen() {
 			}
 			log.Fatalf("AcceptTCP failed: %v", err)
 		}
-		go l.handleConn(c)
+		// A connection failing doesn't affect the others.
+		go runRecovered("tcp_connection", func() { l.handleConn(c) })
 	}
 }
 
 func (l *StatsDTCPListener) handleConn(c *net.TCPConn) {
 	defer c.Close()
 
-	tcpConnections.Inc()
+	tcpConnections.WithLabelValues("tcp").Inc()
+	tcpOpenConnections.WithLabelValues("tcp").Inc()
+	defer tcpOpenConnections.WithLabelValues("tcp").Dec()
 
-	r := bufio.NewReader(c)
+	var source string
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		source = addr.IP.String()
+	}
+	r := tcpReaders.Get().(*bufio.Reader)
+	r.Reset(c)
+	defer func() {
+		r.Reset(nil)
+		tcpReaders.Put(r)
+	}()
+	var batch Events
 	for {
+		if l.idleTimeout > 0 {
+			c.SetReadDeadline(time.Now().Add(l.idleTimeout))
+		}
 		line, isPrefix, err := r.ReadLine()
 		if err != nil {
-			if err != io.EOF {
-				tcpErrors.Inc()
-				log.Debugf("Read %s failed: %v", c.RemoteAddr(), err)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				tcpIdleTimeouts.WithLabelValues("tcp").Inc()
+				log.With("remote_addr", c.RemoteAddr()).Debugln("Closing idle connection")
+			} else if err != io.EOF {
+				tcpErrors.WithLabelValues("tcp").Inc()
+				log.With("remote_addr", c.RemoteAddr()).With("err", err).Debugln("Read failed")
 			}
 			break
 		}
 		if isPrefix {
-			tcpLineTooLong.Inc()
-			log.Debugf("Read %s failed: line too long", c.RemoteAddr())
+			tcpLineTooLong.WithLabelValues("tcp").Inc()
+			log.With("remote_addr", c.RemoteAddr()).Debugln("Read failed: line too long")
 			break
 		}
-		linesReceived.Inc()
-		l.eventHandler.queue(lineToEvents(string(line)))
+		if topSources != nil {
+			topSources.add(source, 1, len(line)+1)
+		}
+		// The lines read from the connection at once are queued together,
+		// up to a batch, rather than waiting for more.
+		batch = append(batch, parseLine("tcp", source, string(line))...)
+		if r.Buffered() == 0 || len(batch) >= tcpBatchSize {
+			l.eventHandler.queue(batch)
+			batch = nil
+		}
+	}
+	if len(batch) > 0 {
+		l.eventHandler.queue(batch)
 	}
 }
 
@@ -583,9 +1260,5 @@ func (l *StatsDUnixgramListener) Listen() {
 
 func (l *StatsDUnixgramListener) handlePacket(packet []byte) {
 	unixgramPackets.Inc()
-	lines := strings.Split(string(packet), "\n")
-	for _, line := range lines {
-		linesReceived.Inc()
-		l.eventHandler.queue(lineToEvents(string(line)))
-	}
+	l.eventHandler.queue(parsePacket("unixgram", "", packet))
 }
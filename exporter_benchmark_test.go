@@ -151,3 +151,17 @@ mappings:
 		ex.Listen(ec)
 	}
 }
+
+func BenchmarkLineToEventsUntagged(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		lineToEvents("udp", "foo1:2|c")
+	}
+}
+
+func BenchmarkLineToEventsTagged(b *testing.B) {
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		lineToEvents("udp", "foo4:100|c|#tag1:bar,tag2:baz")
+	}
+}
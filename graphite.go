@@ -0,0 +1,135 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// graphiteTimeout bounds connecting and writing to the Carbon server.
+const graphiteTimeout = 10 * time.Second
+
+// graphiteWriter periodically sends the samples of the exporter to a Carbon
+// server in the plaintext protocol.
+type graphiteWriter struct {
+	address  string
+	interval time.Duration
+	// Prepended to every metric path.
+	prefix string
+	// Whether labels are sent as Graphite tags, rather than as path
+	// components.
+	tagged   bool
+	exporter *Exporter
+	gatherer prometheus.Gatherer
+}
+
+// run sends the samples every interval.
+func (g *graphiteWriter) run() {
+	ticker := time.NewTicker(g.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := g.write(); err != nil {
+			log.Warnln("Error writing to Graphite:", err)
+		}
+	}
+}
+
+// write sends the current value of every series.
+func (g *graphiteWriter) write() error {
+	g.exporter.prepareCollection()
+	families, err := g.gatherer.Gather()
+	if err != nil {
+		log.Warnln("Error gathering metrics to write to Graphite:", err)
+	}
+	series := flattenFamilies(families)
+	timestamp := strconv.FormatInt(clock.Now().Unix(), 10)
+
+	conn, err := net.DialTimeout("tcp", g.address, graphiteTimeout)
+	if err != nil {
+		graphiteSamples.WithLabelValues("failed").Add(float64(len(series)))
+		return err
+	}
+	defer conn.Close()
+	conn.SetWriteDeadline(time.Now().Add(graphiteTimeout))
+
+	w := bufio.NewWriter(conn)
+	for _, s := range series {
+		w.WriteString(g.path(s))
+		w.WriteString(" " + formatFloat(s.value) + " " + timestamp + "\n")
+	}
+	if err := w.Flush(); err != nil {
+		graphiteSamples.WithLabelValues("failed").Add(float64(len(series)))
+		return err
+	}
+	graphiteSamples.WithLabelValues("sent").Add(float64(len(series)))
+	return nil
+}
+
+// path returns the Graphite path of a series, with its labels as tags, like
+// prefix.name;label=value, or as path components holding their values, in
+// the order of their names, like prefix.name.value.
+func (g *graphiteWriter) path(s remoteWriteSeries) string {
+	var name string
+	var components []string
+	for _, label := range s.labels {
+		if label.GetName() == model.MetricNameLabel {
+			name = label.GetValue()
+			continue
+		}
+		if g.tagged {
+			components = append(components, ";"+label.GetName()+"="+graphiteTagValue(label.GetValue()))
+		} else {
+			components = append(components, "."+graphitePathComponent(label.GetValue()))
+		}
+	}
+	return g.prefix + name + strings.Join(components, "")
+}
+
+// graphitePathComponent replaces the characters with a special meaning in
+// Graphite paths.
+func graphitePathComponent(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ' ', ';', '=', '~', '(', ')', '{', '}', '[', ']', '*', '?', ',', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// graphiteTagValue replaces the characters not allowed in Graphite tag
+// values.
+func graphiteTagValue(s string) string {
+	if s == "" {
+		// Graphite rejects empty tag values.
+		return "_"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case ';', ' ', '~', '\n':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,80 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// logHTTPRequests enables the access log of the HTTP endpoints.
+var logHTTPRequests bool
+
+// statusRecorder records the status and size of a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	n, err := r.ResponseWriter.Write(b)
+	r.bytes += n
+	return n, err
+}
+
+// Flush lets streaming handlers flush through the recorder.
+func (r *statusRecorder) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// instrumentHTTP counts and times the requests served by mux, by the pattern
+// of the handler serving them, and logs them if the access log is enabled.
+func instrumentHTTP(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "none"
+		}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		mux.ServeHTTP(rec, r)
+		duration := time.Since(start)
+
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(pattern, status).Inc()
+		httpRequestDuration.WithLabelValues(pattern).Observe(duration.Seconds())
+		if !logHTTPRequests {
+			return
+		}
+		log.With("remote_addr", r.RemoteAddr).
+			With("method", r.Method).
+			With("uri", r.RequestURI).
+			With("status", rec.status).
+			With("bytes", rec.bytes).
+			With("duration", duration.String()).
+			With("user_agent", r.UserAgent()).
+			Infoln("HTTP request")
+	})
+}
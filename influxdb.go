@@ -0,0 +1,137 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// influxDBTimeout is the timeout of writes to InfluxDB.
+const influxDBTimeout = 10 * time.Second
+
+// influxDBWriter periodically writes the samples of the exporter to an
+// InfluxDB write endpoint in the line protocol.
+type influxDBWriter struct {
+	// The write URL, including the database or bucket parameters.
+	url      string
+	interval time.Duration
+	client   *http.Client
+	// The value of the Authorization header of requests, if any.
+	authorization string
+	exporter      *Exporter
+	gatherer      prometheus.Gatherer
+}
+
+// run writes the samples every interval.
+func (iw *influxDBWriter) run() {
+	ticker := time.NewTicker(iw.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := iw.write(); err != nil {
+			log.Warnln("Error writing to InfluxDB:", err)
+		}
+	}
+}
+
+// write sends the current value of every series, with nanosecond precision
+// timestamps.
+func (iw *influxDBWriter) write() error {
+	iw.exporter.prepareCollection()
+	families, err := iw.gatherer.Gather()
+	if err != nil {
+		log.Warnln("Error gathering metrics to write to InfluxDB:", err)
+	}
+	series := flattenFamilies(families)
+	timestamp := strconv.FormatInt(clock.Now().UnixNano(), 10)
+
+	var body bytes.Buffer
+	written := 0
+	for _, s := range series {
+		// InfluxDB can't store NaN or infinite field values.
+		if math.IsNaN(s.value) || math.IsInf(s.value, 0) {
+			continue
+		}
+		body.WriteString(influxDBLine(s))
+		body.WriteString(" value=" + strconv.FormatFloat(s.value, 'g', -1, 64) + " " + timestamp + "\n")
+		written++
+	}
+
+	req, err := http.NewRequest(http.MethodPost, iw.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	req.Header.Set("User-Agent", "statsd_exporter/"+version.Version)
+	if iw.authorization != "" {
+		req.Header.Set("Authorization", iw.authorization)
+	}
+	resp, err := iw.client.Do(req)
+	if err != nil {
+		influxDBSamples.WithLabelValues("failed").Add(float64(written))
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		influxDBSamples.WithLabelValues("failed").Add(float64(written))
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	influxDBSamples.WithLabelValues("sent").Add(float64(written))
+	return nil
+}
+
+var (
+	influxDBMeasurementEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+	influxDBTagEscaper         = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+)
+
+// influxDBLine returns the measurement and tags of a series, named after its
+// metric and labels. Tags with empty values are left out, as InfluxDB
+// rejects them.
+func influxDBLine(s remoteWriteSeries) string {
+	var measurement string
+	var tags []string
+	for _, label := range s.labels {
+		if label.GetName() == model.MetricNameLabel {
+			measurement = influxDBMeasurementEscaper.Replace(label.GetValue())
+			continue
+		}
+		if label.GetValue() == "" {
+			continue
+		}
+		tags = append(tags, influxDBTagEscaper.Replace(label.GetName())+"="+influxDBTagEscaper.Replace(label.GetValue()))
+	}
+	if len(tags) == 0 {
+		return measurement
+	}
+	return measurement + "," + strings.Join(tags, ",")
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"sync"
+)
+
+// interned holds the metric names, label names and label values of parsed
+// lines, unless nil.
+var interned *stringInterner
+
+var (
+	internHits   = internedLookups.WithLabelValues("hit")
+	internMisses = internedLookups.WithLabelValues("miss")
+)
+
+// stringInterner shares a single copy of strings seen again and again, so
+// that events and the series they update don't each hold their own, or keep
+// the whole packet they were sliced from alive.
+type stringInterner struct {
+	mtx     sync.RWMutex
+	strings map[string]string
+	// Once this many strings are held, they are dropped to start over, so
+	// that strings seen once don't accumulate.
+	limit int
+}
+
+func newStringInterner(limit int) *stringInterner {
+	return &stringInterner{strings: make(map[string]string), limit: limit}
+}
+
+// intern returns the shared copy of a string, which it becomes if there is
+// none yet.
+func (i *stringInterner) intern(s string) string {
+	if i == nil || s == "" {
+		return s
+	}
+	i.mtx.RLock()
+	shared, ok := i.strings[s]
+	i.mtx.RUnlock()
+	if ok {
+		internHits.Inc()
+		return shared
+	}
+	internMisses.Inc()
+
+	var b strings.Builder
+	b.Grow(len(s))
+	b.WriteString(s)
+	shared = b.String()
+
+	i.mtx.Lock()
+	defer i.mtx.Unlock()
+	if len(i.strings) >= i.limit {
+		i.strings = make(map[string]string)
+	}
+	i.strings[shared] = shared
+	return shared
+}
+
+// len returns the number of strings held.
+func (i *stringInterner) len() int {
+	i.mtx.RLock()
+	defer i.mtx.RUnlock()
+	return len(i.strings)
+}
@@ -0,0 +1,158 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+// kafkaRESTTimeout is the timeout of requests to the Kafka REST proxy.
+const kafkaRESTTimeout = 10 * time.Second
+
+// kafkaRESTPublisher publishes mapped events to a Kafka topic through a REST
+// proxy speaking the Confluent REST Proxy API, in batches. The native Kafka
+// protocol isn't spoken, so a proxy is required. Events are queued
+// without blocking the exporter, and dropped when the queue is full.
+type kafkaRESTPublisher struct {
+	// The URL records of the topic are posted to.
+	url       string
+	batchSize int
+	interval  time.Duration
+	client    *http.Client
+	records   chan mappedEvent
+	// Closed to stop publishing, and once the last batch is sent.
+	stop, done chan struct{}
+}
+
+func newKafkaRESTPublisher(proxyURL, topic string, batchSize, queueSize int, interval time.Duration) *kafkaRESTPublisher {
+	return &kafkaRESTPublisher{
+		url:       strings.TrimSuffix(proxyURL, "/") + "/topics/" + url.PathEscape(topic),
+		batchSize: batchSize,
+		interval:  interval,
+		client:    &http.Client{Timeout: kafkaRESTTimeout},
+		records:   make(chan mappedEvent, queueSize),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// publish queues a mapped event.
+func (p *kafkaRESTPublisher) publish(record mappedEvent) {
+	select {
+	case p.records <- record:
+	default:
+		kafkaRESTRecords.WithLabelValues("dropped").Inc()
+	}
+}
+
+// run sends the queued records whenever a batch is full, and at least every
+// interval, until stopped by close.
+func (p *kafkaRESTPublisher) run() {
+	defer close(p.done)
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	batch := make([]mappedEvent, 0, p.batchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := p.send(batch); err != nil {
+			log.Warnf("Error publishing %d events to the Kafka REST proxy: %v", len(batch), err)
+			kafkaRESTRecords.WithLabelValues("failed").Add(float64(len(batch)))
+		} else {
+			kafkaRESTRecords.WithLabelValues("sent").Add(float64(len(batch)))
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case record := <-p.records:
+			batch = append(batch, record)
+			if len(batch) >= p.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-p.stop:
+			for {
+				select {
+				case record := <-p.records:
+					batch = append(batch, record)
+					if len(batch) >= p.batchSize {
+						flush()
+					}
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// close returns once the queued records are sent. Records published after
+// it is called may be left out.
+func (p *kafkaRESTPublisher) close() {
+	close(p.stop)
+	<-p.done
+}
+
+// send posts a batch of records, keyed by metric name so that the events of
+// a metric stay in order on a single partition.
+func (p *kafkaRESTPublisher) send(batch []mappedEvent) error {
+	type proxyRecord struct {
+		Key   string      `json:"key"`
+		Value mappedEvent `json:"value"`
+	}
+	records := make([]proxyRecord, len(batch))
+	for i, record := range batch {
+		records[i] = proxyRecord{Key: record.Name, Value: record}
+	}
+	body, err := json.Marshal(map[string][]proxyRecord{"records": records})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+	req.Header.Set("User-Agent", "statsd_exporter/"+version.Version)
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	return nil
+}
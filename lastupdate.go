@@ -0,0 +1,166 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+const lastUpdateSuffix = "_last_update_timestamp_seconds"
+
+// lastUpdateCollector exposes, for every series of the registry, a gauge with
+// the time it was last updated by a sample. The gauges are derived from the
+// registry when collected rather than stored as series of their own.
+type lastUpdateCollector struct {
+	registry *registry
+}
+
+func (c lastUpdateCollector) Describe(_ chan<- *prometheus.Desc) {}
+
+func (c lastUpdateCollector) Collect(ch chan<- prometheus.Metric) {
+	c.registry.mtx.RLock()
+	defer c.registry.mtx.RUnlock()
+
+	for metricName, metric := range c.registry.metrics {
+		for _, rm := range metric.metrics {
+			names := make([]string, 0, len(rm.labels))
+			for name := range rm.labels {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			values := make([]string, len(names))
+			for i, name := range names {
+				values[i] = rm.labels[name]
+			}
+			desc := prometheus.NewDesc(metricName+lastUpdateSuffix, "Time of the last sample received for the series of "+metricName+".", names, nil)
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, float64(rm.lastRegisteredAt().UnixNano())/1e9, values...)
+		}
+	}
+}
+
+// timestampGatherer sets the timestamp of the samples of the registry's
+// series to the time they were last updated by a sample. Series of other
+// collectors are left without timestamp.
+type timestampGatherer struct {
+	gatherer prometheus.Gatherer
+	registry *registry
+}
+
+func (g timestampGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+
+	g.registry.mtx.RLock()
+	defer g.registry.mtx.RUnlock()
+	for _, family := range families {
+		for _, m := range family.Metric {
+			if rm := g.registry.lookup(family.GetName(), m.Label); rm != nil {
+				m.TimestampMs = proto.Int64(rm.lastRegisteredAt().UnixNano() / 1e6)
+			}
+		}
+	}
+	return families, err
+}
+
+// maxScrapers is the number of scrapers whose last scrape is remembered for
+// the changed-only exposition. Beyond it, the longest idle one is forgotten.
+const maxScrapers = 1000
+
+// scrapeTracker remembers when each scraper using the changed-only
+// exposition last scraped.
+type scrapeTracker struct {
+	mtx  sync.Mutex
+	last map[string]time.Time
+}
+
+func newScrapeTracker() *scrapeTracker {
+	return &scrapeTracker{last: make(map[string]time.Time)}
+}
+
+// scraped records a scrape at now, returning the time of the scraper's
+// previous scrape, or the zero time for its first one.
+func (t *scrapeTracker) scraped(scraper string, now time.Time) time.Time {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	previous, ok := t.last[scraper]
+	if !ok && len(t.last) >= maxScrapers {
+		var idlest string
+		for name, last := range t.last {
+			if idlest == "" || last.Before(t.last[idlest]) {
+				idlest = name
+			}
+		}
+		delete(t.last, idlest)
+	}
+	t.last[scraper] = now
+	return previous
+}
+
+// changedGatherer leaves out the registry's series that weren't updated
+// since a given time. Series of other collectors, which have no update
+// time, are always passed on.
+type changedGatherer struct {
+	gatherer prometheus.Gatherer
+	registry *registry
+	since    time.Time
+}
+
+func (g changedGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+
+	g.registry.mtx.RLock()
+	defer g.registry.mtx.RUnlock()
+	selected := families[:0]
+	for _, family := range families {
+		metrics := family.Metric[:0]
+		for _, m := range family.Metric {
+			if rm := g.registry.lookup(family.GetName(), m.Label); rm == nil || !rm.lastRegisteredAt().Before(g.since) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) > 0 {
+			family.Metric = metrics
+			selected = append(selected, family)
+		}
+	}
+	return selected, err
+}
+
+// changedHandler serves the metrics of the gatherer with the handler expose
+// returns for it. Scrapes identifying themselves with the scraper parameter
+// only get the series updated since their previous scrape.
+func (b *Exporter) changedHandler(g prometheus.Gatherer, expose func(prometheus.Gatherer) http.Handler) http.Handler {
+	all := expose(g)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		scraper := r.URL.Query().Get("scraper")
+		if scraper == "" {
+			all.ServeHTTP(w, r)
+			return
+		}
+		since := b.scrapes.scraped(scraper, clock.Now())
+		if since.IsZero() {
+			all.ServeHTTP(w, r)
+			return
+		}
+		expose(changedGatherer{gatherer: g, registry: b.registry, since: since}).ServeHTTP(w, r)
+	})
+}
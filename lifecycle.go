@@ -0,0 +1,381 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// reloadReport describes the effect a new mapping configuration would have.
+type reloadReport struct {
+	Rules mapper.MappingDiff `json:"rules"`
+	// AffectedMetrics are the currently tracked metrics whose StatsD
+	// metrics would be mapped differently.
+	AffectedMetrics []string `json:"affected_metrics"`
+}
+
+// reloadReport compares the current mapping configuration with a candidate
+// one without applying it.
+func (b *Exporter) reloadReport(candidate *mapper.MetricMapper) reloadReport {
+	report := reloadReport{
+		Rules:           b.mapper.Diff(candidate),
+		AffectedMetrics: []string{},
+	}
+
+	b.registry.mtx.RLock()
+	defer b.registry.mtx.RUnlock()
+	for metricName, origin := range b.registry.origins {
+		current, currentLabels, _ := b.mapper.GetMappingWithTags(origin.name, origin.metricType, origin.tags)
+		next, nextLabels, _ := candidate.GetMappingWithTags(origin.name, origin.metricType, origin.tags)
+		if !mapper.SameResult(current, currentLabels, next, nextLabels) {
+			report.AffectedMetrics = append(report.AffectedMetrics, metricName)
+		}
+	}
+	sort.Strings(report.AffectedMetrics)
+	return report
+}
+
+// reloadResult is the outcome of the last load of the mapping configuration.
+type reloadResult struct {
+	Time    time.Time `json:"time"`
+	Success bool      `json:"success"`
+	Error   string    `json:"error,omitempty"`
+	// LastSuccess is the time of the last successful load, which is the
+	// configuration in effect.
+	LastSuccess time.Time `json:"last_success"`
+}
+
+// reloadStatus keeps the outcome of the last load of the mapping
+// configuration, so that it can be checked that a reload took effect.
+type reloadStatus struct {
+	mtx  sync.Mutex
+	last reloadResult
+}
+
+// record records the outcome of a load, with err nil if it succeeded.
+func (s *reloadStatus) record(now time.Time, err error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.last.Time = now
+	s.last.Success = err == nil
+	s.last.Error = ""
+	if err != nil {
+		s.last.Error = err.Error()
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+	s.last.LastSuccess = now
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccess.Set(float64(now.UnixNano()) / 1e9)
+}
+
+func (s *reloadStatus) get() reloadResult {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.last
+}
+
+// reloadStatusHandler serves the outcome of the last load of the mapping
+// configuration as JSON.
+type reloadStatusHandler struct {
+	status *reloadStatus
+}
+
+func (h *reloadStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.status.get()); err != nil {
+		log.Errorln("Error writing reload status:", err)
+	}
+}
+
+// reloadConfig reloads the mapping configuration from the given file.
+func (b *Exporter) reloadConfig(fileName string, cacheSize int) error {
+	err := b.mapper.InitFromFile(fileName, cacheSize)
+	b.reloads.record(clock.Now(), err)
+	if err != nil {
+		log.Errorln("Error reloading config:", err)
+		configLoads.WithLabelValues("failure").Inc()
+		return err
+	}
+	log.Infoln("Config reloaded successfully")
+	configLoads.WithLabelValues("success").Inc()
+	if b.preregister {
+		b.preregisterMetrics()
+	}
+	return nil
+}
+
+// reloadHandler reloads the mapping configuration on POST requests. With the
+// dry_run parameter set, it only reports what the reload would change.
+type reloadHandler struct {
+	fileName  string
+	cacheSize int
+	exporter  *Exporter
+}
+
+func (h *reloadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodPut {
+		w.Header().Set("Allow", "POST, PUT")
+		http.Error(w, "Only POST or PUT requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if h.fileName == "" {
+		http.Error(w, "No mapping config to reload", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid dry_run parameter: %v", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if !dryRun {
+		log.Infoln("Received reload request, attempting reload")
+		if err := h.exporter.reloadConfig(h.fileName, h.cacheSize); err != nil {
+			http.Error(w, fmt.Sprintf("Error reloading config: %v", err), http.StatusInternalServerError)
+		}
+		return
+	}
+
+	// The defaults set by flags are part of the mappings being compared.
+	candidate := &mapper.MetricMapper{
+		DefaultTtl:       h.exporter.mapper.DefaultTtl,
+		DefaultBuckets:   h.exporter.mapper.DefaultBuckets,
+		DefaultQuantiles: h.exporter.mapper.DefaultQuantiles,
+	}
+	if err := candidate.InitFromFile(h.fileName, 0); err != nil {
+		http.Error(w, fmt.Sprintf("Error loading config: %v", err), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.exporter.reloadReport(candidate)); err != nil {
+		log.Errorln("Error writing reload report:", err)
+	}
+}
+
+// healthyHandler reports that the exporter is running.
+func healthyHandler(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("StatsD Exporter is Healthy.\n"))
+}
+
+// readiness serves whether the exporter is ready to receive samples, with its
+// listeners bound and its mapping configuration loaded.
+type readiness struct {
+	ready int32
+
+	mtx sync.Mutex
+	// The conditions not met yet, such as listeners not bound.
+	waiting map[string]bool
+}
+
+func (rd *readiness) set(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&rd.ready, v)
+}
+
+// wait makes the exporter not ready until the condition is done.
+func (rd *readiness) wait(condition string) {
+	rd.mtx.Lock()
+	defer rd.mtx.Unlock()
+	if rd.waiting == nil {
+		rd.waiting = map[string]bool{}
+	}
+	rd.waiting[condition] = true
+}
+
+func (rd *readiness) done(condition string) {
+	rd.mtx.Lock()
+	defer rd.mtx.Unlock()
+	delete(rd.waiting, condition)
+}
+
+// pending returns the conditions not met yet.
+func (rd *readiness) pending() []string {
+	rd.mtx.Lock()
+	defer rd.mtx.Unlock()
+	conditions := make([]string, 0, len(rd.waiting))
+	for condition := range rd.waiting {
+		conditions = append(conditions, condition)
+	}
+	sort.Strings(conditions)
+	return conditions
+}
+
+func (rd *readiness) isReady() bool {
+	return atomic.LoadInt32(&rd.ready) == 1 && len(rd.pending()) == 0
+}
+
+func (rd *readiness) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if pending := rd.pending(); len(pending) > 0 {
+		http.Error(w, fmt.Sprintf("StatsD Exporter is not ready, waiting for: %s.", strings.Join(pending, ", ")), http.StatusServiceUnavailable)
+		return
+	}
+	if !rd.isReady() {
+		http.Error(w, "StatsD Exporter is not ready.", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("StatsD Exporter is Ready.\n"))
+}
+
+// bindRetryInterval is how often binding a listener that failed to bind is
+// retried.
+var bindRetryInterval = 5 * time.Second
+
+// bindListener binds a listener and starts receiving on it with the given
+// function. If it fails, the exporter either exits, or isn't ready until
+// the listener is bound, which is retried in the background.
+func bindListener(name string, bind func() error, exitOnFailure bool, ready *readiness) {
+	err := bind()
+	if err == nil {
+		return
+	}
+	if exitOnFailure {
+		log.Fatalf("Error binding the %s listener: %v", name, err)
+	}
+	condition := name + " listener"
+	log.Errorf("Error binding the %s listener, retrying every %s: %v", name, bindRetryInterval, err)
+	ready.wait(condition)
+	go func() {
+		for {
+			time.Sleep(bindRetryInterval)
+			if err := bind(); err != nil {
+				log.Debugf("Error binding the %s listener: %v", name, err)
+				continue
+			}
+			log.Infof("Bound the %s listener", name)
+			ready.done(condition)
+			return
+		}
+	}()
+}
+
+// closers are the connections of the listeners, closed on shutdown.
+type closers struct {
+	mtx    sync.Mutex
+	items  []io.Closer
+	closed bool
+}
+
+// add adds a connection, closing it right away if the others were closed
+// already.
+func (c *closers) add(closer io.Closer) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.closed {
+		closer.Close()
+		return
+	}
+	c.items = append(c.items, closer)
+}
+
+func (c *closers) close() {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.closed = true
+	for _, closer := range c.items {
+		closer.Close()
+	}
+}
+
+// closerFunc is a function called on shutdown, as if it closed a connection.
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// secretFlags are the flags whose values are redacted from the effective
+// configuration. Secrets given as files only have their path shown.
+var secretFlags = map[string]bool{
+	"otlp.header": true,
+}
+
+// flagValues returns the value of every visible flag of an application, with
+// secrets and the passwords of URLs redacted.
+func flagValues(app *kingpin.ApplicationModel) map[string]string {
+	values := map[string]string{}
+	for _, f := range app.Flags {
+		if f.Hidden {
+			continue
+		}
+		value := f.Value.String()
+		if secretFlags[f.Name] && value != "" && value != "map[]" {
+			value = "<secret>"
+		} else if u, err := url.Parse(value); err == nil && u.User != nil {
+			if _, ok := u.User.Password(); ok {
+				u.User = url.UserPassword(u.User.Username(), "xxxxx")
+				value = u.String()
+			}
+		}
+		values[f.Name] = value
+	}
+	return values
+}
+
+// configHandler serves the effective configuration as JSON: the value of
+// every flag, and the loaded mapping configuration.
+type configHandler struct {
+	flags  map[string]string
+	mapper *mapper.MetricMapper
+}
+
+func (h *configHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	mappingConfig, err := h.mapper.Config()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error rendering mapping config: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	config := struct {
+		Flags         map[string]string `json:"flags"`
+		MappingConfig string            `json:"mapping_config"`
+	}{h.flags, mappingConfig}
+	if err := json.NewEncoder(w).Encode(config); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"unsafe"
+
+	"github.com/prometheus/common/log"
+	"github.com/sirupsen/logrus"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+// The formats log messages can be written in.
+const (
+	logFormatLogfmt = "logfmt"
+	logFormatJSON   = "json"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error", "fatal"}
+
+func validLogLevel(level string) bool {
+	for _, l := range logLevels {
+		if l == level {
+			return true
+		}
+	}
+	return false
+}
+
+// setupLogging sets the level and format of the messages logged to stderr.
+// Each message is a single record, with its level, source and any fields
+// given with log.With as keys of their own. The logger URLs accepted by
+// --log.format before, such as "logger:syslog?appname=statsd_exporter" or
+// "logger:stdout?json=true", still choose the destination and format.
+func setupLogging(level, format string) error {
+	if !validLogLevel(level) {
+		return fmt.Errorf("unknown log level %q", level)
+	}
+	if err := setLogLevel(level); err != nil {
+		return err
+	}
+	logger := log.Base()
+	switch {
+	case format == logFormatLogfmt:
+		return logger.SetFormat("logger:stderr")
+	case format == logFormatJSON:
+		return logger.SetFormat("logger:stderr?json=true")
+	case strings.HasPrefix(format, "logger:"):
+		return logger.SetFormat(format)
+	default:
+		return fmt.Errorf("unknown log format %q", format)
+	}
+}
+
+// setLogLevel changes the level of the base logger. The Logger interface sets
+// the level of the logrus logger behind it without synchronization, while
+// goroutines logging read it atomically, so it is set on that logger
+// directly.
+func setLogLevel(level string) error {
+	lvl, err := logrus.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	baseLogrusLogger().SetLevel(lvl)
+	return nil
+}
+
+// baseLogrusLogger returns the logrus logger the base logger writes to,
+// which it doesn't expose.
+func baseLogrusLogger() *logrus.Logger {
+	base := reflect.ValueOf(log.Base())
+	v := reflect.New(base.Type()).Elem()
+	v.Set(base)
+	entry := v.FieldByName("entry")
+	return reflect.NewAt(entry.Type(), unsafe.Pointer(entry.UnsafeAddr())).Elem().Interface().(*logrus.Entry).Logger
+}
+
+// lineSampler limits the number of malformed lines logged per minute.
+type lineSampler struct {
+	mtx        sync.Mutex
+	limit      int
+	window     time.Time
+	logged     int
+	suppressed int
+}
+
+// malformedLines samples the malformed lines logged as warnings. The others
+// are only logged at the debug level.
+var malformedLines = &lineSampler{}
+
+func (s *lineSampler) setLimit(limit int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.limit = limit
+}
+
+// allow reports whether a line can be logged in the current minute, and if
+// so, how many lines weren't since the last one that was.
+func (s *lineSampler) allow(now time.Time) (bool, int) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if now.Sub(s.window) >= time.Minute {
+		s.window = now
+		s.logged = 0
+	}
+	if s.logged >= s.limit {
+		s.suppressed++
+		return false, 0
+	}
+	s.logged++
+	suppressed := s.suppressed
+	s.suppressed = 0
+	return true, suppressed
+}
+
+// logMalformedLine logs a line that couldn't be parsed, as a warning if the
+// sampler allows it, or else at the debug level.
+func logMalformedLine(logger log.Logger, msg string) {
+	ok, suppressed := malformedLines.allow(clock.Now())
+	if !ok {
+		logger.Debugln(msg)
+		return
+	}
+	if suppressed > 0 {
+		logger = logger.With("suppressed", suppressed)
+	}
+	logger.Warnln(msg)
+}
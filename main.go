@@ -15,39 +15,124 @@ package main
 
 import (
 	"bufio"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	_ "net/http/pprof"
+	"net/http/pprof"
 	"os"
 	"os/signal"
+	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
+	"google.golang.org/grpc"
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/subscription"
 )
 
 func init() {
 	prometheus.MustRegister(version.NewCollector("statsd_exporter"))
 }
 
-func serveHTTP(listenAddress, metricsEndpoint string) {
-	http.Handle(metricsEndpoint, promhttp.Handler())
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte(`<html>
-			<head><title>StatsD Exporter</title></head>
-			<body>
-			<h1>StatsD Exporter</h1>
-			<p><a href="` + metricsEndpoint + `">Metrics</a></p>
-			</body>
-			</html>`))
+// serveHTTP serves the handlers of mux, the metrics on the given path, and a
+// landing page linking to them and to the given pages on /, unless the
+// metrics are served there.
+func serveHTTP(listener net.Listener, mux *http.ServeMux, metricsEndpoint string, metricsHandler http.Handler, links []landingLink) {
+	mux.Handle(metricsEndpoint, metricsHandler)
+	if metricsEndpoint != "/" {
+		mux.Handle("/", landingPage(append([]landingLink{{metricsEndpoint, "Metrics"}}, links...)))
+	}
+	serve(listener, instrumentHTTP(mux))
+}
+
+// landingLink is a link of the landing page.
+type landingLink struct {
+	path string
+	text string
+}
+
+// landingPage serves a page linking to the pages the exporter serves, on /
+// only.
+func landingPage(links []landingLink) http.Handler {
+	var page strings.Builder
+	page.WriteString("<html>\n<head><title>StatsD Exporter</title></head>\n<body>\n<h1>StatsD Exporter</h1>\n")
+	for _, link := range links {
+		fmt.Fprintf(&page, "<p><a href=\"%s\">%s</a></p>\n", html.EscapeString(link.path), html.EscapeString(link.text))
+	}
+	page.WriteString("</body>\n</html>\n")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(page.String()))
 	})
-	log.Fatal(http.ListenAndServe(listenAddress, nil))
+}
+
+// serve serves HTTP requests until the listener is closed on shutdown.
+func serve(listener net.Listener, handler http.Handler) {
+	err := http.Serve(listener, handler)
+	// https://github.com/golang/go/issues/4373
+	if !strings.HasSuffix(err.Error(), "use of closed network connection") {
+		log.Fatal(err)
+	}
+}
+
+// serveInternalHTTP serves the exporter's own metrics, apart from the
+// generated ones, and the handlers of mux.
+func serveInternalHTTP(listener net.Listener, mux *http.ServeMux, metricsEndpoint string) {
+	mux.Handle(metricsEndpoint, promhttp.Handler())
+	serve(listener, instrumentHTTP(mux))
+}
+
+// handlePprof registers the runtime profiling handlers below /debug/pprof/,
+// and the command line of the process if withCmdline is set.
+func handlePprof(mux *http.ServeMux, withCmdline bool) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	if withCmdline {
+		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	}
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+}
+
+// listenHTTP listens on a TCP address, or on a unix socket given as a
+// unix:// path, which is removed when the listener is closed.
+func listenHTTP(listenAddress, unixSocketMode string) (net.Listener, error) {
+	path := strings.TrimPrefix(listenAddress, "unix://")
+	if path == listenAddress {
+		return net.Listen("tcp", listenAddress)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		return nil, fmt.Errorf("unix socket %q already exists", path)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	perm, err := strconv.ParseInt("0"+unixSocketMode, 8, 32)
+	if err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("bad permission %s: %v", unixSocketMode, err)
+	}
+	if err := os.Chmod(path, os.FileMode(perm)); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
 }
 
 func ipPortFromString(addr string) (*net.IPAddr, int) {
@@ -90,7 +175,7 @@ func tcpAddrFromString(addr string) *net.TCPAddr {
 	}
 }
 
-func configReloader(fileName string, mapper *mapper.MetricMapper, cacheSize int) {
+func configReloader(fileName string, exporter *Exporter, cacheSize int) {
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, syscall.SIGHUP)
@@ -101,14 +186,7 @@ func configReloader(fileName string, mapper *mapper.MetricMapper, cacheSize int)
 			continue
 		}
 		log.Infof("Received %s, attempting reload", s)
-		err := mapper.InitFromFile(fileName, cacheSize)
-		if err != nil {
-			log.Errorln("Error reloading config:", err)
-			configLoads.WithLabelValues("failure").Inc()
-		} else {
-			log.Infoln("Config reloaded successfully")
-			configLoads.WithLabelValues("success").Inc()
-		}
+		exporter.reloadConfig(fileName, cacheSize)
 	}
 }
 
@@ -126,119 +204,312 @@ func dumpFSM(mapper *mapper.MetricMapper, dumpFilename string) error {
 	return nil
 }
 
+// convertConfig writes the YAML equivalent of a mapping configuration in the
+// legacy format.
+func convertConfig(fileName string, w io.Writer) error {
+	contents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return err
+	}
+	if !mapper.IsLegacyConfig(string(contents)) {
+		return fmt.Errorf("%s is not in the legacy mapping format", fileName)
+	}
+	converted, err := mapper.ConvertLegacyConfig(string(contents))
+	if err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, converted)
+	return err
+}
+
 func main() {
 	var (
-		listenAddress        = kingpin.Flag("web.listen-address", "The address on which to expose the web interface and generated Prometheus metrics.").Default(":9102").String()
-		metricsEndpoint      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+		listenAddress        = kingpin.Flag("web.listen-address", "The address on which to expose the web interface and generated Prometheus metrics, or a unix socket as unix:///path/to/socket.").Default(":9102").String()
+		webUnixSocketMode    = kingpin.Flag("web.unixsocket-mode", "The permission mode of the unix socket of the web interface.").Default("660").String()
+		metricsEndpoint      = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics, such as /statsd/metrics behind a path-based proxy.").Default("/metrics").String()
+		internalAddress      = kingpin.Flag("web.internal-listen-address", "If set, address on which to expose the exporter's own metrics, which are then left out of the generated metrics.").Default("").String()
 		statsdListenUDP      = kingpin.Flag("statsd.listen-udp", "The UDP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
 		statsdListenTCP      = kingpin.Flag("statsd.listen-tcp", "The TCP address on which to receive statsd metric lines. \"\" disables it.").Default(":9125").String()
+		tcpIdleTimeout       = kingpin.Flag("statsd.tcp-idle-timeout", "If set, TCP connections without lines for this long are closed. 0 disables it.").Default("0s").Duration()
 		statsdListenUnixgram = kingpin.Flag("statsd.listen-unixgram", "The Unixgram socket path to receive statsd metric lines in datagram. \"\" disables it.").Default("").String()
 		// not using Int here because flag diplays default in decimal, 0755 will show as 493
 		statsdUnixSocketMode = kingpin.Flag("statsd.unixsocket-mode", "The permission mode of the unix socket.").Default("755").String()
 		mappingConfig        = kingpin.Flag("statsd.mapping-config", "Metric mapping configuration file name.").String()
 		readBuffer           = kingpin.Flag("statsd.read-buffer", "Size (in bytes) of the operating system's transmit read buffer associated with the UDP or Unixgram connection. Please make sure the kernel parameters net.core.rmem_max is set to a value greater than the value specified.").Int()
+		defaultTtl           = kingpin.Flag("statsd.default-ttl", "Expiration time of metrics that stop receiving samples, unless the mapping config sets one. 0 disables expiration.").Default("0s").Duration()
+		defaultBuckets       = kingpin.Flag("statsd.default-buckets", "Comma separated histogram buckets, used unless the mapping config sets some. Defaults to the client library's buckets, suited to HTTP latencies in seconds.").String()
+		defaultQuantiles     = kingpin.Flag("statsd.default-quantiles", "Comma separated quantiles of summaries, each optionally followed by a colon and its allowed error, used unless the mapping config sets some.").Default("0.5,0.9,0.99").String()
 		cacheSize            = kingpin.Flag("statsd.cache-size", "Maximum size of your metric mapping cache. Relies on least recently used replacement policy if max size is reached.").Default("1000").Int()
-		eventQueueSize       = kingpin.Flag("statsd.event-queue-size", "Size of internal queue for processing events").Default("10000").Int()
+		eventQueueSize       = kingpin.Flag("statsd.event-queue-size", "Number of batches of events waiting to be processed, absorbing bursts of traffic at the cost of memory. When full, listeners block.").Default("10000").Int()
 		eventFlushThreshold  = kingpin.Flag("statsd.event-flush-threshold", "Number of events to hold in queue before flushing").Default("1000").Int()
 		eventFlushInterval   = kingpin.Flag("statsd.event-flush-interval", "Number of events to hold in queue before flushing").Default("200ms").Duration()
+		internedStrings      = kingpin.Flag("statsd.interned-strings", "Number of metric names, label names and label values of parsed lines held to be shared by the events and series using them. They are dropped to start over when full. 0 disables it.").Default("100000").Int()
+		eventWorkers         = kingpin.Flag("statsd.event-workers", "Number of workers handling events, each taking the events of a share of the StatsD metrics, so that the events of a metric keep their order. Events are mapped and recorded in parallel, only one at a time when they create series. 0 uses one per CPU the process may use, as set by GOMAXPROCS.").Default("0").Int()
+		workerScaleInterval  = kingpin.Flag("statsd.event-workers-scale-interval", "If set, events start out handled by a single worker, and the number of workers in use is adjusted this often, up to --statsd.event-workers, as their queues fill up or stay empty. 0 disables it.").Default("0s").Duration()
+		workerQueueSize      = kingpin.Flag("statsd.event-worker-queue-size", "Number of batches of events waiting for each event worker, beyond which the event queue is no longer drained.").Default("100").Int()
+		maxSeries            = kingpin.Flag("statsd.max-series", "Maximum number of series to track. 0 means no limit.").Default("0").Int()
+		maxSeriesPolicy      = kingpin.Flag("statsd.max-series-policy", "What to do with new series once the maximum is reached: \"reject\" them, or \"evict\" the least recently updated series.").Default(string(seriesLimitReject)).Enum(string(seriesLimitReject), string(seriesLimitEvict))
+		aggregationInterval  = kingpin.Flag("statsd.aggregation-interval", "If set, counter and timer samples are aggregated, and only take effect at the end of each interval, like in StatsD. 0 disables it.").Default("0s").Duration()
+		publishInterval      = kingpin.Flag("statsd.publish-interval", "Interval over which the increases of delta counters, counter rates, aggregated gauges and timer statistics are computed. Scrapes and pushes in between all see the values of the last complete interval.").Default("15s").Duration()
+		expiryShards         = kingpin.Flag("statsd.expiry-shards", "Number of shards the series with a ttl are spread over. Each second, the series of one shard are checked for expiry, instead of all series. 1 checks all series every second.").Default("1").Int()
+		memoryLimit          = kingpin.Flag("statsd.memory-limit", "Heap size to stay under, by dropping caches, expiring series early and finally rejecting new series as it is approached. 0 disables it.").Default("0").Bytes()
+		reorderWindow        = kingpin.Flag("statsd.reorder-window", "If set, timestamped samples are held back for this long and applied in the order of their timestamps. Older samples are dropped. 0 disables it.").Default("0s").Duration()
+		skewThreshold        = kingpin.Flag("statsd.clock-skew-threshold", "Sources sending timestamps further than this from the local time are logged and listed on /debug/skew. 0 disables it.").Default("5m").Duration()
+		preregister          = kingpin.Flag("statsd.preregister-metrics", "Expose the metrics of mappings without wildcards with zero values, before any sample is received.").Default("false").Bool()
+		exportLastUpdate     = kingpin.Flag("statsd.export-last-update", "Expose the time of the last sample of every series, in a gauge named after its metric with a \"_last_update_timestamp_seconds\" suffix.").Default("false").Bool()
+		exportTimestamps     = kingpin.Flag("statsd.export-timestamps", "Expose samples with the time of the last update of their series, rather than without timestamp.").Default("false").Bool()
+		jobLabel             = kingpin.Flag("statsd.job", "If set, job label of all series that don't have one, for federation into hierarchies expecting it at the source.").Default("").String()
+		instanceLabel        = kingpin.Flag("statsd.instance", "If set, instance label of all series that don't have one.").Default("").String()
+		instanceHostname     = kingpin.Flag("statsd.instance-from-hostname", "Set the instance label of all series that don't have one to the hostname.").Bool()
+		exemplarTags         = kingpin.Flag("statsd.exemplar-tags", "Comma separated tags, such as trace IDs, attached to counters and histograms as OpenMetrics exemplars instead of labels.").String()
+		tenantTag            = kingpin.Flag("statsd.tenant-tag", "If set, samples with this tag are exposed on an endpoint of the tenant it names, below the telemetry path, rather than with the other metrics.").Default("").String()
+		maxTenants           = kingpin.Flag("statsd.max-tenants", "Maximum number of tenants named by --statsd.tenant-tag. The samples of further tenants are dropped. 0 means no limit.").Default("100").Int()
+		isolateListeners     = kingpin.Flag("statsd.isolate-listeners", "Keep the samples of each listener in a registry of its own, exposed on an endpoint named after the listener below the telemetry path.").Bool()
+		unmappedAsLabel      = kingpin.Flag("statsd.unmapped-as-label", "Record unmapped metrics into one generic metric per type, with the original name in the \"statsd_metric\" label.").Default("false").Bool()
+		enableLifecycle      = kingpin.Flag("web.enable-lifecycle", "Enable reloading the mapping config via HTTP request.").Default("false").Bool()
+		enableAdminAPI       = kingpin.Flag("web.enable-admin-api", "Enable the API endpoints for admin control actions.").Default("false").Bool()
+		adminTokenFile       = kingpin.Flag("web.admin-token-file", "File containing the bearer token required by the admin API.").Default("").String()
+		remoteWriteURL       = kingpin.Flag("remote-write.url", "If set, URL of a Prometheus remote write endpoint the samples are pushed to.").Default("").String()
+		remoteWriteInterval  = kingpin.Flag("remote-write.interval", "Interval between two pushes to the remote write endpoint.").Default("15s").Duration()
+		remoteWriteTimeout   = kingpin.Flag("remote-write.timeout", "Timeout of requests to the remote write endpoint.").Default("10s").Duration()
+		remoteWriteBatchSize = kingpin.Flag("remote-write.batch-size", "Maximum number of samples sent to the remote write endpoint in a single request.").Default("500").Int()
+		remoteWriteCapacity  = kingpin.Flag("remote-write.queue-capacity", "Number of samples waiting to be sent to the remote write endpoint, beyond which the oldest are dropped.").Default("10000").Int()
+		remoteWriteRetries   = kingpin.Flag("remote-write.max-retries", "Number of times a request to the remote write endpoint is retried after a recoverable error.").Default("3").Int()
+		remoteWriteMinDelay  = kingpin.Flag("remote-write.min-backoff", "Initial delay before retrying a request to the remote write endpoint, doubled with every retry.").Default("100ms").Duration()
+		remoteWriteMaxDelay  = kingpin.Flag("remote-write.max-backoff", "Maximum delay before retrying a request to the remote write endpoint.").Default("5s").Duration()
+		remoteWriteCompress  = kingpin.Flag("remote-write.compress", "Compress the requests to the remote write endpoint. Otherwise, samples are only framed in the snappy format, which costs less CPU.").Default("true").Bool()
+		remoteWriteToken     = kingpin.Flag("remote-write.bearer-token-file", "File containing the bearer token sent to the remote write endpoint.").Default("").String()
+		remoteWriteUsername  = kingpin.Flag("remote-write.basic-auth-username", "Username of basic authentication with the remote write endpoint.").Default("").String()
+		remoteWritePassword  = kingpin.Flag("remote-write.basic-auth-password-file", "File containing the password of basic authentication with the remote write endpoint.").Default("").String()
+		otlpEndpoint         = kingpin.Flag("otlp.endpoint", "If set, base URL of an OTLP/HTTP endpoint the metrics are exported to, such as http://otel-collector:4318. OTLP over gRPC is not supported.").Default("").String()
+		otlpInterval         = kingpin.Flag("otlp.interval", "Interval between two exports to the OTLP endpoint.").Default("15s").Duration()
+		otlpHeaders          = kingpin.Flag("otlp.header", "Header sent with exports to the OTLP endpoint, as name=value. Can be repeated.").StringMap()
+		otlpResource         = kingpin.Flag("otlp.resource-attribute", "Attribute of the resource of the metrics exported to the OTLP endpoint, as name=value. Can be repeated.").StringMap()
+		tracingEndpoint      = kingpin.Flag("tracing.otlp-endpoint", "If set, base URL of an OTLP/HTTP endpoint traces of sampled lines through parsing, queueing, mapping and recording are exported to. The headers and resource attributes of --otlp.header and --otlp.resource-attribute apply.").Default("").String()
+		tracingSampleRatio   = kingpin.Flag("tracing.sample-ratio", "Ratio of the received lines traced, between 0 and 1.").Default("0.001").Float64()
+		graphiteAddress      = kingpin.Flag("graphite.address", "If set, host:port of a Carbon server the samples are written to in the plaintext protocol.").Default("").String()
+		graphiteInterval     = kingpin.Flag("graphite.interval", "Interval between two writes to Graphite.").Default("10s").Duration()
+		graphitePrefix       = kingpin.Flag("graphite.prefix", "Prefix of the Graphite paths, such as \"statsd.\".").Default("").String()
+		graphiteTagged       = kingpin.Flag("graphite.tagged", "Send labels as Graphite tags. Otherwise, label values are appended to the path in the order of the label names.").Default("true").Bool()
+		influxDBURL          = kingpin.Flag("influxdb.url", "If set, InfluxDB write URL the samples are written to in the line protocol, such as http://influxdb:8086/api/v2/write?org=example&bucket=statsd.").Default("").String()
+		influxDBInterval     = kingpin.Flag("influxdb.interval", "Interval between two writes to InfluxDB.").Default("10s").Duration()
+		influxDBToken        = kingpin.Flag("influxdb.token-file", "File containing the API token of InfluxDB.").Default("").String()
+		kafkaProxyURL        = kingpin.Flag("kafka-rest-proxy.url", "If set, URL of a Kafka REST proxy, speaking the Confluent REST Proxy v2 API, the mapped events are published through. The native Kafka protocol is not supported.").Default("").String()
+		kafkaTopic           = kingpin.Flag("kafka-rest-proxy.topic", "Kafka topic the mapped events are published to through the REST proxy.").Default("statsd").String()
+		kafkaBatchSize       = kingpin.Flag("kafka-rest-proxy.batch-size", "Maximum number of events published to the Kafka REST proxy in a single request.").Default("500").Int()
+		kafkaQueueSize       = kingpin.Flag("kafka-rest-proxy.queue-size", "Number of events waiting to be published to the Kafka REST proxy, beyond which new events are dropped.").Default("10000").Int()
+		kafkaFlushInterval   = kingpin.Flag("kafka-rest-proxy.flush-interval", "Maximum time events wait before being published to the Kafka REST proxy.").Default("1s").Duration()
+		grpcListenAddress    = kingpin.Flag("grpc.listen-address", "If set, address on which to serve the gRPC API streaming the updates of metrics to subscribers as events are recorded.").Default("").String()
+		pushgatewayURL       = kingpin.Flag("pushgateway.url", "If set, URL of a Pushgateway the metrics are pushed to.").Default("").String()
+		pushgatewayJob       = kingpin.Flag("pushgateway.job", "Job label of the metrics pushed to the Pushgateway.").Default("statsd_exporter").String()
+		pushgatewayGrouping  = kingpin.Flag("pushgateway.grouping", "Grouping label of the metrics pushed to the Pushgateway, as name=value. Can be repeated.").StringMap()
+		pushgatewayInterval  = kingpin.Flag("pushgateway.interval", "Interval between two pushes to the Pushgateway. The metrics are also pushed on shutdown.").Default("15s").Duration()
+		snapshotPath         = kingpin.Flag("statsd.snapshot-path", "File to periodically save counters and gauges to, and restore them from on startup. \"\" disables it.").Default("").String()
+		snapshotInterval     = kingpin.Flag("statsd.snapshot-interval", "Interval between snapshots of counters and gauges.").Default("1m").Duration()
+		enablePprof          = kingpin.Flag("web.enable-pprof", "Expose runtime profiles on /debug/pprof/, on the internal listen address if set. The command line, which may hold secrets, is only exposed on the internal listen address.").Default("true").Bool()
+		stallTimeout         = kingpin.Flag("statsd.stall-timeout", "Time after which processing is considered stalled if no event was processed while lines were received. 0 disables the watchdog.").Default("1m").Duration()
+		exitOnStall          = kingpin.Flag("statsd.exit-on-stall", "Exit when processing stalls, for the process to be restarted.").Default("false").Bool()
+		exitOnBindError      = kingpin.Flag("statsd.exit-on-bind-failure", "Exit when a listener can't be bound. Otherwise, binding is retried in the background, and the exporter isn't ready until all listeners are bound.").Default("true").Bool()
+		shutdownTimeout      = kingpin.Flag("statsd.shutdown-timeout", "Maximum time to wait on shutdown for the received events to be processed, and the last pushes, remote writes, Kafka REST proxy events and snapshot.").Default("10s").Duration()
+		cardinalityInterval  = kingpin.Flag("debug.cardinality-log-interval", "If set, interval at which the 10 metrics with the most series are logged. 0 disables it.").Default("0s").Duration()
+		seriesInterval       = kingpin.Flag("statsd.series-count-interval", "Interval at which the series of each mapping rule are counted, exposed as statsd_exporter_mapping_series. 0 disables it.").Default("1m").Duration()
+		seriesPerMetric      = kingpin.Flag("statsd.series-count-per-metric", "Also expose the number of series of each metric, as statsd_exporter_metric_series.").Default("false").Bool()
+		recentLinesSize      = kingpin.Flag("debug.recent-lines", "Number of lines last received by each listener kept to be listed on /debug/lines, served on the internal listen address if set, or else behind the admin token. 0 disables it.").Default("0").Int()
+		topSourcesSize       = kingpin.Flag("debug.top-sources", "Number of source addresses sending the most lines tracked to be listed on /debug/sources, served on the internal listen address if set, or else behind the admin token. 0 disables it.").Default("0").Int()
+		diagnosticsDir       = kingpin.Flag("debug.diagnostics-dir", "If set, directory a diagnostic bundle of goroutines, heap profile, queue state and metrics with the most series is written to on SIGUSR1.").Default("").String()
 		dumpFSMPath          = kingpin.Flag("debug.dump-fsm", "The path to dump internal FSM generated for glob matching as Dot file.").Default("").String()
+		accessLog            = kingpin.Flag("web.access-log", "Log every HTTP request, with its client, status and duration, at the info level.").Default("false").Bool()
+		logLevel             = kingpin.Flag("log.level", "Only log messages with the given severity or above. One of: [debug, info, warn, error, fatal]").Default("info").String()
+		logFormat            = kingpin.Flag("log.format", "Output format of log messages. One of: [logfmt, json], or a logger URL such as \"logger:syslog?appname=bob&local=7\" or \"logger:stdout?json=true\".").Default(logFormatLogfmt).String()
+		malformedLinesRate   = kingpin.Flag("log.malformed-lines-per-minute", "Number of lines that can't be parsed logged as warnings per minute, with the number of lines left out since. The others are logged at the debug level.").Default("10").Int()
 	)
 
-	log.AddFlags(kingpin.CommandLine)
+	kingpin.Command("serve", "Run the exporter. This is the default command.").Default()
+	convertCmd := kingpin.Command("convert-config", "Convert a mapping config in the legacy format to YAML, and print it.")
+	convertFile := convertCmd.Arg("file", "Mapping config file in the legacy format.").Required().String()
+	dashboardCmd := kingpin.Command("generate-dashboard", "Generate a Grafana dashboard with a panel per metric of a mapping config, and print it.")
+	dashboardFile := dashboardCmd.Arg("file", "Mapping config file.").Required().String()
+	dashboardTitle := dashboardCmd.Flag("title", "Title of the dashboard.").Default("StatsD Exporter").String()
+
 	kingpin.Version(version.Print("statsd_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	command := kingpin.Parse()
+	if err := setupLogging(*logLevel, *logFormat); err != nil {
+		log.Fatalln("Error setting up logging:", err)
+	}
+	malformedLines.setLimit(*malformedLinesRate)
+	logHTTPRequests = *accessLog
+	if command == convertCmd.FullCommand() {
+		if err := convertConfig(*convertFile, os.Stdout); err != nil {
+			log.Fatal("Error converting config:", err)
+		}
+		return
+	}
+	if command == dashboardCmd.FullCommand() {
+		if err := generateDashboard(*dashboardFile, *dashboardTitle, os.Stdout); err != nil {
+			log.Fatal("Error generating dashboard:", err)
+		}
+		return
+	}
 
 	if *statsdListenUDP == "" && *statsdListenTCP == "" && *statsdListenUnixgram == "" {
 		log.Fatalln("At least one of UDP/TCP/Unixgram listeners must be specified.")
 	}
+	if !strings.HasPrefix(*metricsEndpoint, "/") {
+		log.Fatalf("The metrics path %q must start with /", *metricsEndpoint)
+	}
+	if *tracingSampleRatio < 0 || *tracingSampleRatio > 1 {
+		log.Fatalln("The tracing sample ratio must be between 0 and 1.")
+	}
+	if *tenantTag != "" && *isolateListeners {
+		log.Fatalln("--statsd.tenant-tag and --statsd.isolate-listeners are mutually exclusive.")
+	}
+	if *metricsEndpoint == "/" && (*tenantTag != "" || *isolateListeners) {
+		log.Fatalln("The metrics of tenants can't be exposed with the metrics path /.")
+	}
 
 	log.Infoln("Starting StatsD -> Prometheus Exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 	log.Infof("Accepting StatsD Traffic: UDP %v, TCP %v, Unixgram %v", *statsdListenUDP, *statsdListenTCP, *statsdListenUnixgram)
 	log.Infoln("Accepting Prometheus Requests on", *listenAddress)
 
-	go serveHTTP(*listenAddress, *metricsEndpoint)
+	if *topSourcesSize > 0 {
+		topSources = newSourceCounter(*topSourcesSize)
+	}
+	if *recentLinesSize > 0 {
+		recentLines = newLineRecorder(*recentLinesSize)
+	}
+	if *internedStrings > 0 {
+		interned = newStringInterner(*internedStrings)
+		registerInternerMetrics(interned)
+	}
+	if *skewThreshold > 0 {
+		clockSkew = newSkewTracker(*skewThreshold)
+	}
+	if *tracingEndpoint != "" {
+		ingestTracer = newTracer(*tracingEndpoint, *tracingSampleRatio, *otlpHeaders, *otlpResource)
+		go ingestTracer.run()
+	}
 
 	events := make(chan Events, *eventQueueSize)
-	defer close(events)
 	eventQueue := newEventQueue(events, *eventFlushThreshold, *eventFlushInterval)
-
-	if *statsdListenUDP != "" {
-		udpListenAddr := udpAddrFromString(*statsdListenUDP)
-		uconn, err := net.ListenUDP("udp", udpListenAddr)
-		if err != nil {
-			log.Fatal(err)
+	registerQueueMetrics(events, eventQueue)
+	// listenerHandler returns the handler of the events of a listener.
+	listenerHandler := func(listener string) eventHandler {
+		if *isolateListeners {
+			return &listenerTagger{listener: listener, eventHandler: eventQueue}
 		}
+		return eventQueue
+	}
+
+	ready := &readiness{}
+	ready.wait("mapping config")
 
-		if *readBuffer != 0 {
-			err = uconn.SetReadBuffer(*readBuffer)
+	// The connections of the listeners, closed on shutdown.
+	statsdConns := &closers{}
+	if *statsdListenUDP != "" {
+		bindListener("udp", func() error {
+			udpListenAddr := udpAddrFromString(*statsdListenUDP)
+			uconn, err := net.ListenUDP("udp", udpListenAddr)
 			if err != nil {
-				log.Fatal("Error setting UDP read buffer:", err)
+				return err
 			}
-		}
 
-		ul := &StatsDUDPListener{conn: uconn, eventHandler: eventQueue}
-		go ul.Listen()
+			if *readBuffer != 0 {
+				err = uconn.SetReadBuffer(*readBuffer)
+				if err != nil {
+					log.Fatal("Error setting UDP read buffer:", err)
+				}
+			}
+
+			if c, err := newUDPSocketCollector(uconn); err != nil {
+				log.Infoln("Kernel drops of the UDP socket are not available:", err)
+			} else {
+				prometheus.MustRegister(c)
+			}
+
+			statsdConns.add(uconn)
+			ul := &StatsDUDPListener{conn: uconn, eventHandler: listenerHandler("udp")}
+			go runWorker("udp", ul.Listen)
+			return nil
+		}, *exitOnBindError, ready)
 	}
 
 	if *statsdListenTCP != "" {
-		tcpListenAddr := tcpAddrFromString(*statsdListenTCP)
-		tconn, err := net.ListenTCP("tcp", tcpListenAddr)
-		if err != nil {
-			log.Fatal(err)
-		}
-		defer tconn.Close()
+		bindListener("tcp", func() error {
+			tcpListenAddr := tcpAddrFromString(*statsdListenTCP)
+			tconn, err := net.ListenTCP("tcp", tcpListenAddr)
+			if err != nil {
+				return err
+			}
+			statsdConns.add(tconn)
 
-		tl := &StatsDTCPListener{conn: tconn, eventHandler: eventQueue}
-		go tl.Listen()
+			tl := &StatsDTCPListener{conn: tconn, eventHandler: listenerHandler("tcp"), idleTimeout: *tcpIdleTimeout}
+			go runWorker("tcp", tl.Listen)
+			return nil
+		}, *exitOnBindError, ready)
 	}
 
 	if *statsdListenUnixgram != "" {
-		var err error
-		if _, err = os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			log.Fatalf("Unixgram socket \"%s\" already exists", *statsdListenUnixgram)
-		}
-		uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
-			Net:  "unixgram",
-			Name: *statsdListenUnixgram,
-		})
-		if err != nil {
-			log.Fatal(err)
-		}
+		bindListener("unixgram", func() error {
+			var err error
+			if _, err = os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
+				return fmt.Errorf("unixgram socket %q already exists", *statsdListenUnixgram)
+			}
+			uxgconn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{
+				Net:  "unixgram",
+				Name: *statsdListenUnixgram,
+			})
+			if err != nil {
+				return err
+			}
 
-		defer uxgconn.Close()
+			statsdConns.add(uxgconn)
 
-		if *readBuffer != 0 {
-			err = uxgconn.SetReadBuffer(*readBuffer)
-			if err != nil {
-				log.Fatal("Error setting Unixgram read buffer:", err)
+			if *readBuffer != 0 {
+				err = uxgconn.SetReadBuffer(*readBuffer)
+				if err != nil {
+					log.Fatal("Error setting Unixgram read buffer:", err)
+				}
 			}
-		}
 
-		ul := &StatsDUnixgramListener{conn: uxgconn, eventHandler: eventQueue}
-		go ul.Listen()
+			ul := &StatsDUnixgramListener{conn: uxgconn, eventHandler: listenerHandler("unixgram")}
+			go runWorker("unixgram", ul.Listen)
 
-		// if it's an abstract unix domain socket, it won't exist on fs
-		// so we can't chmod it either
-		if _, err := os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
-			defer os.Remove(*statsdListenUnixgram)
+			// if it's an abstract unix domain socket, it won't exist on fs
+			// so we can't chmod it either
+			if _, err := os.Stat(*statsdListenUnixgram); !os.IsNotExist(err) {
+				statsdConns.add(closerFunc(func() error { return os.Remove(*statsdListenUnixgram) }))
 
-			// convert the string to octet
-			perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
-			if err != nil {
-				log.Warnf("Bad permission %s: %v, ignoring\n", *statsdUnixSocketMode, err)
-			} else {
-				err = os.Chmod(*statsdListenUnixgram, os.FileMode(perm))
+				// convert the string to octet
+				perm, err := strconv.ParseInt("0"+string(*statsdUnixSocketMode), 8, 32)
 				if err != nil {
-					log.Warnf("Failed to change unixgram socket permission: %v", err)
+					log.Warnf("Bad permission %s: %v, ignoring\n", *statsdUnixSocketMode, err)
+				} else {
+					err = os.Chmod(*statsdListenUnixgram, os.FileMode(perm))
+					if err != nil {
+						log.Warnf("Failed to change unixgram socket permission: %v", err)
+					}
 				}
 			}
+			return nil
+		}, *exitOnBindError, ready)
+	}
+
+	var buckets []float64
+	if *defaultBuckets != "" {
+		var err error
+		if buckets, err = mapper.ParseBuckets(*defaultBuckets); err != nil {
+			log.Fatalf("Invalid default buckets: %v", err)
 		}
+	}
 
+	quantiles, err := mapper.ParseQuantiles(*defaultQuantiles)
+	if err != nil {
+		log.Fatalf("Invalid default quantiles: %v", err)
 	}
 
-	mapper := &mapper.MetricMapper{MappingsCount: mappingsCount}
+	mapper := &mapper.MetricMapper{MappingsCount: mappingsCount, DefaultTtl: *defaultTtl, DefaultBuckets: buckets, DefaultQuantiles: quantiles}
 	if *mappingConfig != "" {
 		err := mapper.InitFromFile(*mappingConfig, *cacheSize)
 		if err != nil {
@@ -250,18 +521,385 @@ func main() {
 				log.Fatal("Error dumping FSM:", err)
 			}
 		}
-	} else {
-		mapper.InitCache(*cacheSize)
+	} else if err := mapper.InitFromYAMLString("", *cacheSize); err != nil {
+		log.Fatal("Error initializing mapper:", err)
 	}
-
-	go configReloader(*mappingConfig, mapper, *cacheSize)
+	ready.done("mapping config")
 
 	exporter := NewExporter(mapper)
+	exporter.reloads.record(time.Now(), nil)
+	// With a separate internal address, the generated metrics get a registry
+	// of their own, leaving the exporter's metrics in the default one.
+	var gatherer prometheus.Gatherer = prometheus.DefaultGatherer
+	if *internalAddress != "" {
+		metricsRegistry := prometheus.NewRegistry()
+		exporter.registry.registerer = metricsRegistry
+		gatherer = metricsRegistry
+	}
+	exporter.unmappedAsLabel = *unmappedAsLabel
+	if *kafkaProxyURL != "" {
+		if *kafkaBatchSize < 1 {
+			log.Fatalln("The Kafka REST proxy batch size must be positive.")
+		}
+		exporter.kafkaREST = newKafkaRESTPublisher(*kafkaProxyURL, *kafkaTopic, *kafkaBatchSize, *kafkaQueueSize, *kafkaFlushInterval)
+		go exporter.kafkaREST.run()
+	}
+	exporter.tenantTag = *tenantTag
+	if *maxTenants < 0 {
+		log.Fatalln("The maximum number of tenants can't be negative.")
+	}
+	if *tenantTag != "" {
+		exporter.tenants.max = *maxTenants
+	}
+	if *instanceHostname {
+		if *instanceLabel != "" {
+			log.Fatalln("--statsd.instance and --statsd.instance-from-hostname are mutually exclusive.")
+		}
+		hostname, err := os.Hostname()
+		if err != nil {
+			log.Fatal("Error getting the hostname:", err)
+		}
+		*instanceLabel = hostname
+	}
+	exporter.sourceLabels = prometheus.Labels{}
+	if *jobLabel != "" {
+		exporter.sourceLabels[model.JobLabel] = *jobLabel
+	}
+	if *instanceLabel != "" {
+		exporter.sourceLabels[model.InstanceLabel] = *instanceLabel
+	}
+	if *exemplarTags != "" {
+		exporter.exemplarTags = strings.Split(*exemplarTags, ",")
+	}
+	exporter.registry.setSeriesLimit(*maxSeries, seriesLimitPolicy(*maxSeriesPolicy))
+	exporter.registry.setExpiryShards(*expiryShards)
+	if *memoryLimit > 0 {
+		go exporter.watchMemory(uint64(*memoryLimit))
+	}
+	if *reorderWindow > 0 {
+		exporter.reorder = newReorderBuffer(*reorderWindow)
+	}
+	if *publishInterval <= 0 {
+		log.Fatalln("--statsd.publish-interval must be positive.")
+	}
+	exporter.publishInterval = *publishInterval
+	if *aggregationInterval > 0 {
+		exporter.aggregator = newAggregator(*aggregationInterval)
+	}
+	if *eventWorkers < 0 {
+		log.Fatalln("The number of event workers can't be negative.")
+	}
+	if *eventWorkers == 0 {
+		*eventWorkers = runtime.GOMAXPROCS(0)
+	}
+	if *workerQueueSize < 0 {
+		log.Fatalln("The size of the queues of event workers can't be negative.")
+	}
+	if *eventWorkers > 1 {
+		exporter.workers = newEventWorkers(*eventWorkers, *workerQueueSize, exporter.handleEvents)
+		if *workerScaleInterval > 0 {
+			exporter.workers.autoscale(*workerScaleInterval)
+		}
+	}
+
+	if *snapshotPath != "" {
+		if err := exporter.loadSnapshot(*snapshotPath); err != nil {
+			log.Errorln("Error loading snapshot, starting without it:", err)
+		}
+		go exporter.snapshotLoop(*snapshotPath, *snapshotInterval)
+	}
+	if *exportLastUpdate {
+		exporter.registry.registerer.MustRegister(lastUpdateCollector{registry: exporter.registry})
+	}
+	exporter.preregister = *preregister
+	if *preregister {
+		exporter.preregisterMetrics()
+	}
+
+	if *seriesInterval > 0 {
+		c := newSeriesCollector(exporter, *seriesPerMetric)
+		prometheus.MustRegister(c)
+		go c.run(*seriesInterval)
+	}
+	if *diagnosticsDir != "" {
+		d := &diagnostics{dir: *diagnosticsDir, exporter: exporter, events: events, queue: eventQueue}
+		go d.run()
+	}
+	if *cardinalityInterval > 0 {
+		go exporter.logCardinality(*cardinalityInterval, 10)
+	}
+
+	go configReloader(*mappingConfig, exporter, *cacheSize)
+
+	mux := http.NewServeMux()
+	// The pages linked from the landing page, besides the metrics.
+	links := []landingLink{
+		{"/api/v1/metrics", "Metrics as JSON"},
+		{"/api/v1/metadata", "Metadata"},
+		{"/debug/mappings", "Mapping rules"},
+		{"/debug/cardinality", "Metrics with the most series"},
+		{"/debug/updates", "Metrics updated the most often"},
+		{"/-/healthy", "Health"},
+		{"/-/ready", "Readiness"},
+		{"/-/config", "Configuration"},
+		{"/api/v1/status/reload", "Last configuration reload"},
+	}
+	mux.HandleFunc("/-/healthy", healthyHandler)
+	mux.Handle("/-/ready", ready)
+	mux.Handle("/-/config", &configHandler{flags: flagValues(kingpin.CommandLine.Model()), mapper: exporter.mapper})
+	mux.Handle("/api/v1/status/reload", &reloadStatusHandler{status: &exporter.reloads})
+	mux.Handle("/api/v1/metrics", &metricsAPIHandler{exporter: exporter})
+	mux.Handle("/api/v1/metadata", &metadataHandler{exporter: exporter})
+	mux.Handle("/debug/mappings", &mappingsHandler{exporter: exporter})
+	mux.Handle("/debug/cardinality", &cardinalityHandler{exporter: exporter})
+	mux.Handle("/debug/updates", &updatesHandler{exporter: exporter})
+
+	var internalMux *http.ServeMux
+	if *internalAddress != "" {
+		internalMux = http.NewServeMux()
+	}
+	var adminToken string
+	if *adminTokenFile != "" {
+		token, err := readTokenFile(*adminTokenFile)
+		if err != nil {
+			log.Fatal("Error reading admin token:", err)
+		}
+		adminToken = token
+	}
+	// Received lines and the addresses of clients may be sensitive, so they
+	// are only served on the internal address, or else behind the admin
+	// token.
+	handleSensitive := func(path, title string, h http.Handler) {
+		switch {
+		case internalMux != nil:
+			internalMux.Handle(path, h)
+		case adminToken != "":
+			mux.Handle(path, requireToken(adminToken, h))
+			links = append(links, landingLink{path, title})
+		default:
+			log.Fatalf("Serving %s requires --web.internal-listen-address or --web.admin-token-file to be set", path)
+		}
+	}
+	if recentLines != nil {
+		handleSensitive("/debug/lines", "Recently received lines", &recentLinesHandler{recorder: recentLines})
+	}
+	if topSources != nil {
+		handleSensitive("/debug/sources", "Sources sending the most lines", &sourcesHandler{counter: topSources})
+	}
+	if clockSkew != nil {
+		mux.Handle("/debug/skew", &skewHandler{tracker: clockSkew})
+		links = append(links, landingLink{"/debug/skew", "Sources with skewed clocks"})
+	}
+
+	if *enableLifecycle {
+		mux.Handle("/-/reload", &reloadHandler{
+			fileName:  *mappingConfig,
+			cacheSize: *cacheSize,
+			exporter:  exporter,
+		})
+	}
+
+	if *enableAdminAPI {
+		if adminToken == "" {
+			log.Fatal("The admin API requires --web.admin-token-file to be set")
+		}
+		mux.Handle("/api/v1/admin/series", requireToken(adminToken, &seriesHandler{exporter: exporter}))
+		mux.Handle("/api/v1/admin/flush", requireToken(adminToken, &flushHandler{queue: eventQueue}))
+		mux.Handle("/api/v1/admin/pause", requireToken(adminToken, &pauseHandler{gate: exporter.gate}))
+		mux.Handle("/api/v1/admin/resume", requireToken(adminToken, &resumeHandler{gate: exporter.gate}))
+		mux.Handle("/-/loglevel", requireToken(adminToken, &logLevelHandler{level: *logLevel}))
+	}
+
+	var remoteWrite *remoteWriter
+	if *remoteWriteURL != "" {
+		authorization, err := remoteWriteAuthorization(*remoteWriteToken, *remoteWriteUsername, *remoteWritePassword)
+		if err != nil {
+			log.Fatal("Error setting up remote write authentication:", err)
+		}
+		rw := &remoteWriter{
+			url:           *remoteWriteURL,
+			interval:      *remoteWriteInterval,
+			client:        &http.Client{Timeout: *remoteWriteTimeout},
+			authorization: authorization,
+			exporter:      exporter,
+			gatherer:      gatherer,
+			batchSize:     *remoteWriteBatchSize,
+			queueCapacity: *remoteWriteCapacity,
+			maxRetries:    *remoteWriteRetries,
+			minBackoff:    *remoteWriteMinDelay,
+			maxBackoff:    *remoteWriteMaxDelay,
+			compress:      *remoteWriteCompress,
+		}
+		if rw.batchSize < 1 {
+			log.Fatalln("The remote write batch size must be positive.")
+		}
+		rw.newQueue()
+		go rw.run()
+		remoteWrite = rw
+	}
+
+	if *otlpEndpoint != "" {
+		go newOTLPExporter(*otlpEndpoint, *otlpInterval, *otlpHeaders, *otlpResource, exporter, gatherer).run()
+	}
+
+	if *graphiteAddress != "" {
+		gw := &graphiteWriter{
+			address:  *graphiteAddress,
+			interval: *graphiteInterval,
+			prefix:   *graphitePrefix,
+			tagged:   *graphiteTagged,
+			exporter: exporter,
+			gatherer: gatherer,
+		}
+		go gw.run()
+	}
+
+	if *influxDBURL != "" {
+		iw := &influxDBWriter{
+			url:      *influxDBURL,
+			interval: *influxDBInterval,
+			client:   &http.Client{Timeout: influxDBTimeout},
+			exporter: exporter,
+			gatherer: gatherer,
+		}
+		if *influxDBToken != "" {
+			token, err := readTokenFile(*influxDBToken)
+			if err != nil {
+				log.Fatal("Error reading InfluxDB token:", err)
+			}
+			iw.authorization = "Token " + token
+		}
+		go iw.run()
+	}
+
+	var pusher *pushgatewayPusher
+	if *pushgatewayURL != "" {
+		groupURL, err := pushgatewayGroupURL(*pushgatewayURL, *pushgatewayJob, *pushgatewayGrouping)
+		if err != nil {
+			log.Fatal("Error setting up the Pushgateway:", err)
+		}
+		pusher = &pushgatewayPusher{
+			url:      groupURL,
+			interval: *pushgatewayInterval,
+			client:   &http.Client{Timeout: pushgatewayTimeout},
+			exporter: exporter,
+			gatherer: gatherer,
+		}
+		go pusher.run()
+	}
+
+	httpListener, err := listenHTTP(*listenAddress, *webUnixSocketMode)
+	if err != nil {
+		log.Fatal("Error listening for HTTP requests:", err)
+	}
+	defer httpListener.Close()
+	if *tenantTag != "" || *isolateListeners {
+		prometheus.MustRegister(tenantSeriesCollector{exporter: exporter})
+		prefix := strings.TrimSuffix(*metricsEndpoint, "/") + "/"
+		mux.Handle(prefix, exporter.tenantsHandler(prefix))
+		links = append(links, landingLink{prefix, "Tenants"})
+	}
+	if *internalAddress != "" {
+		internalListener, err := listenHTTP(*internalAddress, *webUnixSocketMode)
+		if err != nil {
+			log.Fatal("Error listening for HTTP requests for the exporter's metrics:", err)
+		}
+		defer internalListener.Close()
+		if *enablePprof {
+			handlePprof(internalMux, true)
+		}
+		go serveInternalHTTP(internalListener, internalMux, *metricsEndpoint)
+	} else if *enablePprof {
+		// The command line may hold secrets, like OTLP headers, so it is
+		// only served on the internal address.
+		handlePprof(mux, false)
+		links = append(links, landingLink{"/debug/pprof/", "Profiles"})
+	}
+	if *exportTimestamps {
+		gatherer = timestampGatherer{gatherer: gatherer, registry: exporter.registry}
+	}
+	expose := func(g prometheus.Gatherer) http.Handler {
+		return exporter.protobufHandler(g, exporter.openMetricsHandler(g, promhttp.HandlerFor(g, promhttp.HandlerOpts{})))
+	}
+	handler := promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, selectionHandler(gatherer, func(g prometheus.Gatherer) http.Handler {
+		return exporter.changedHandler(g, expose)
+	}))
+	go serveHTTP(httpListener, mux, *metricsEndpoint, exporter.metricsHandler(handler), links)
+
+	var grpcServer *grpc.Server
+	if *grpcListenAddress != "" {
+		grpcListener, err := net.Listen("tcp", *grpcListenAddress)
+		if err != nil {
+			log.Fatal("Error listening for gRPC requests:", err)
+		}
+		grpcServer = grpc.NewServer()
+		subscription.RegisterSubscriptionsServer(grpcServer, &subscriptionServer{subscriptions: exporter.subscriptions})
+		go func() {
+			if err := grpcServer.Serve(grpcListener); err != nil {
+				log.Errorln("Error serving gRPC requests:", err)
+			}
+		}()
+	}
 
 	signals := make(chan os.Signal, 1)
 	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
 
-	go exporter.Listen(events)
+	if *stallTimeout > 0 {
+		go newStallWatchdog(*stallTimeout, *exitOnStall).run()
+	}
 
-	<-signals
+	processed := make(chan struct{})
+	go func() {
+		runWorker("events", func() { exporter.Listen(events) })
+		close(processed)
+	}()
+	ready.set(true)
+
+	s := <-signals
+	log.Infof("Received %s, shutting down", s)
+	ready.set(false)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Stop receiving, and wait for the events received so far to be
+		// processed before the last push and snapshot.
+		statsdConns.close()
+		eventQueue.close()
+		<-processed
+
+		if pusher != nil {
+			if err := pusher.push(); err != nil {
+				log.Errorln("Error pushing to the Pushgateway:", err)
+			}
+		}
+		if remoteWrite != nil {
+			remoteWrite.close()
+		}
+		if exporter.kafkaREST != nil {
+			exporter.kafkaREST.close()
+		}
+		if grpcServer != nil {
+			// Streams only end when clients cancel them.
+			grpcServer.Stop()
+		}
+
+		if ingestTracer != nil {
+			if err := ingestTracer.export(); err != nil {
+				log.Errorln("Error exporting traces to OTLP:", err)
+			}
+		}
+
+		if *snapshotPath != "" {
+			if err := exporter.writeSnapshot(*snapshotPath); err != nil {
+				log.Errorln("Error writing snapshot:", err)
+			}
+		}
+	}()
+	select {
+	case <-done:
+		log.Infoln("Shutdown complete")
+	case <-time.After(*shutdownTimeout):
+		log.Warnf("Shutdown didn't complete within %s, exiting", *shutdownTimeout)
+	}
 }
@@ -0,0 +1,91 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"runtime"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// memoryPressure grades the heap usage against the memory limit. Each level
+// adds a measure to relieve the pressure to those of the levels below.
+type memoryPressure int
+
+const (
+	memoryPressureNone memoryPressure = iota
+	// The mapping cache is emptied.
+	memoryPressureHigh
+	// Series expire after half their ttl.
+	memoryPressureCritical
+	// New series are rejected.
+	memoryPressureExceeded
+)
+
+// How often the heap is measured. Measuring stops the world briefly.
+const memoryCheckInterval = 5 * time.Second
+
+var errMemoryLimit = errors.New("memory limit reached")
+
+// pressureFor returns the memory pressure for the given heap usage.
+func pressureFor(heap, limit uint64) memoryPressure {
+	switch {
+	case limit == 0 || heap < limit/10*8:
+		return memoryPressureNone
+	case heap < limit/10*9:
+		return memoryPressureHigh
+	case heap < limit:
+		return memoryPressureCritical
+	default:
+		return memoryPressureExceeded
+	}
+}
+
+// watchMemory periodically measures the heap, and applies the measures of
+// the resulting memory pressure.
+func (b *Exporter) watchMemory(limit uint64) {
+	memoryLimitBytes.Set(float64(limit))
+	ticker := time.NewTicker(memoryCheckInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		var stats runtime.MemStats
+		runtime.ReadMemStats(&stats)
+		b.setMemoryPressure(pressureFor(stats.HeapAlloc, limit))
+	}
+}
+
+func (b *Exporter) setMemoryPressure(pressure memoryPressure) {
+	b.registry.mtx.Lock()
+	defer b.registry.mtx.Unlock()
+
+	previous := b.registry.pressure
+	b.registry.pressure = pressure
+	memoryPressureLevel.Set(float64(pressure))
+	if pressure == previous {
+		return
+	}
+	if pressure > previous {
+		log.Warnf("Memory pressure increased to level %d", pressure)
+	} else {
+		log.Infof("Memory pressure decreased to level %d", pressure)
+	}
+	if pressure >= memoryPressureHigh && previous < memoryPressureHigh {
+		b.mapper.PurgeCache()
+	}
+	if pressure >= memoryPressureCritical && previous < memoryPressureCritical {
+		b.registry.removeStaleMetrics()
+	}
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// metricState is the current state of a series, as served by the metrics
+// API. Counters and gauges have a value, histograms and summaries a count,
+// a sum, and their buckets or quantiles.
+type metricState struct {
+	Name       string             `json:"name"`
+	Type       string             `json:"type"`
+	Help       string             `json:"help"`
+	Labels     prometheus.Labels  `json:"labels"`
+	Value      *float64           `json:"value,omitempty"`
+	Count      *uint64            `json:"count,omitempty"`
+	Sum        *float64           `json:"sum,omitempty"`
+	Buckets    map[string]uint64  `json:"buckets,omitempty"`
+	Quantiles  map[string]float64 `json:"quantiles,omitempty"`
+	LastUpdate time.Time          `json:"last_update"`
+	// The creation time of counters, histograms and summaries, telling
+	// resets apart from new series.
+	Created *time.Time `json:"created,omitempty"`
+}
+
+var metricTypeNames = map[metricType]string{
+	CounterMetricType:   "counter",
+	GaugeMetricType:     "gauge",
+	SummaryMetricType:   "summary",
+	HistogramMetricType: "histogram",
+}
+
+// metricStates returns the state of all series of the registry, ordered by
+// metric name and labels.
+func (r *registry) metricStates() []metricState {
+	states := []metricState{}
+	for metricName, metric := range r.metrics {
+		for _, rm := range metric.metrics {
+			var m dto.Metric
+			if err := rm.metric.(prometheus.Metric).Write(&m); err != nil {
+				log.Debugf("Failed to read metric %q: %s", metricName, err)
+				continue
+			}
+			state := metricState{
+				Name:       metricName,
+				Type:       metricTypeNames[metric.metricType],
+				Help:       metric.help,
+				Labels:     rm.labels,
+				LastUpdate: rm.lastRegisteredAt(),
+			}
+			if metric.metricType != GaugeMetricType {
+				created := rm.createdAt
+				state.Created = &created
+			}
+			switch {
+			case m.Counter != nil:
+				state.Value = m.Counter.Value
+			case m.Gauge != nil:
+				state.Value = m.Gauge.Value
+			case m.Histogram != nil:
+				state.Count, state.Sum = m.Histogram.SampleCount, m.Histogram.SampleSum
+				state.Buckets = make(map[string]uint64, len(m.Histogram.Bucket))
+				for _, b := range m.Histogram.Bucket {
+					state.Buckets[formatFloat(b.GetUpperBound())] = b.GetCumulativeCount()
+				}
+			case m.Summary != nil:
+				state.Count, state.Sum = m.Summary.SampleCount, m.Summary.SampleSum
+				state.Quantiles = make(map[string]float64, len(m.Summary.Quantile))
+				for _, q := range m.Summary.Quantile {
+					state.Quantiles[formatFloat(q.GetQuantile())] = q.GetValue()
+				}
+			}
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool {
+		if states[i].Name != states[j].Name {
+			return states[i].Name < states[j].Name
+		}
+		// Printing maps orders them by key.
+		return fmt.Sprint(states[i].Labels) < fmt.Sprint(states[j].Labels)
+	})
+	return states
+}
+
+// metricsAPIHandler serves the current state of the exporter's series as
+// JSON, for tools that would rather not parse the exposition format.
+type metricsAPIHandler struct {
+	exporter *Exporter
+}
+
+func (h *metricsAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Remove expired series as a scrape would.
+	h.exporter.prepareCollection()
+	h.exporter.registry.mtx.RLock()
+	states := h.exporter.registry.metricStates()
+	h.exporter.registry.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]metricState{"metrics": states}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
+
+// metricMetadata describes a metric tracked by the exporter, as served by
+// the metadata API.
+type metricMetadata struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	Help string `json:"help"`
+	// The match of the mapping rule the metric was first produced by, or
+	// empty if it wasn't mapped.
+	Mapping string   `json:"mapping"`
+	Labels  []string `json:"labels"`
+	Series  int      `json:"series"`
+}
+
+// metadata describes the metrics of the registry, ordered by name.
+func (b *Exporter) metadata() []metricMetadata {
+	metadata := []metricMetadata{}
+	for metricName, metric := range b.registry.metrics {
+		// Metrics whose series all expired are no longer exported.
+		if len(metric.metrics) == 0 {
+			continue
+		}
+		md := metricMetadata{
+			Name:   metricName,
+			Type:   metricTypeNames[metric.metricType],
+			Help:   metric.help,
+			Labels: []string{},
+			Series: len(metric.metrics),
+		}
+		if origin, ok := b.registry.origins[metricName]; ok {
+			mapping, _, present := b.mapper.GetMappingWithTags(origin.name, origin.metricType, origin.tags)
+			if present && mapping != nil {
+				md.Mapping = mapping.Match
+			}
+		}
+		labels := map[string]bool{}
+		for _, rm := range metric.metrics {
+			for label := range rm.labels {
+				if !labels[label] {
+					labels[label] = true
+					md.Labels = append(md.Labels, label)
+				}
+			}
+		}
+		sort.Strings(md.Labels)
+		metadata = append(metadata, md)
+	}
+	sort.Slice(metadata, func(i, j int) bool { return metadata[i].Name < metadata[j].Name })
+	return metadata
+}
+
+// metadataHandler serves the description of the metrics the exporter
+// currently tracks as JSON.
+type metadataHandler struct {
+	exporter *Exporter
+}
+
+func (h *metadataHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.exporter.registry.mtx.RLock()
+	metadata := h.exporter.metadata()
+	h.exporter.registry.mtx.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]metricMetadata{"metrics": metadata}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
@@ -0,0 +1,437 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// The schemas of native buckets range from -4, where each bucket is 2^16
+// times as wide as the previous one, to 8, where it is 2^(2^-8) times as
+// wide.
+const (
+	minNativeSchema = -4
+	maxNativeSchema = 8
+)
+
+// defaultNativeZeroThreshold is the bound of the zero bucket of native
+// histograms unless the histogram options set it, the same as the client
+// library's.
+const defaultNativeZeroThreshold = 2.938735877055719e-39 // 2^-128
+
+// nativeBucketBounds holds, for each positive schema, the fractions of
+// the powers of two at which buckets start, as returned by math.Frexp.
+var nativeBucketBounds = func() [][]float64 {
+	bounds := make([][]float64, maxNativeSchema+1)
+	for schema := 1; schema <= maxNativeSchema; schema++ {
+		n := 1 << uint(schema)
+		bounds[schema] = make([]float64, n)
+		for i := range bounds[schema] {
+			bounds[schema][i] = math.Exp2(float64(i)/float64(n)) / 2
+		}
+	}
+	return bounds
+}()
+
+// nativeSchema returns the schema whose buckets are the widest ones not
+// growing by more than the bucket factor.
+func nativeSchema(bucketFactor float64) int32 {
+	floor := math.Floor(math.Log2(math.Log2(bucketFactor)))
+	switch {
+	case floor <= -maxNativeSchema:
+		return maxNativeSchema
+	case floor >= -minNativeSchema:
+		return minNativeSchema
+	}
+	return -int32(floor)
+}
+
+// nativeBucketKey returns the index of the native bucket of a positive value.
+// Bucket i holds the values greater than base^(i-1) and up to base^i, the
+// base being 2^(2^-schema).
+func nativeBucketKey(v float64, schema int32) int {
+	frac, exp := math.Frexp(v)
+	if schema > 0 {
+		bounds := nativeBucketBounds[schema]
+		return sort.SearchFloat64s(bounds, frac) + (exp-1)*len(bounds)
+	}
+	key := exp
+	if frac == 0.5 {
+		// Powers of two are the upper bound of their bucket.
+		key--
+	}
+	offset := (1 << uint(-schema)) - 1
+	return (key + offset) >> uint(-schema)
+}
+
+// nativeHistogram is a histogram with native buckets, whose bounds are the
+// powers of a base set by its schema, next to its classic buckets, if any.
+type nativeHistogram struct {
+	mtx         sync.Mutex
+	labelValues []string
+	// The upper bounds of the classic buckets, without +Inf, and the number
+	// of observations falling into each.
+	upperBounds  []float64
+	bucketCounts []uint64
+	sum          float64
+	count        uint64
+
+	schema        int32
+	zeroThreshold float64
+	maxBuckets    uint32
+	zeroCount     uint64
+	positive      map[int]uint64
+	negative      map[int]uint64
+}
+
+func (h *nativeHistogram) Observe(v float64) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if i := sort.SearchFloat64s(h.upperBounds, v); i < len(h.bucketCounts) {
+		h.bucketCounts[i]++
+	}
+	h.sum += v
+	h.count++
+
+	switch {
+	case math.IsNaN(v), math.IsInf(v, 0):
+		// Only counted in the count and sum, like the client library does
+		// for NaN.
+		return
+	case math.Abs(v) <= h.zeroThreshold:
+		h.zeroCount++
+		return
+	case v > 0:
+		h.positive[nativeBucketKey(v, h.schema)]++
+	default:
+		h.negative[nativeBucketKey(-v, h.schema)]++
+	}
+	for h.maxBuckets > 0 && len(h.positive)+len(h.negative) > int(h.maxBuckets) && h.schema > minNativeSchema {
+		h.halveResolution()
+	}
+}
+
+// halveResolution merges every pair of adjacent native buckets, by moving to
+// the next lower schema.
+func (h *nativeHistogram) halveResolution() {
+	h.schema--
+	h.positive = mergeBucketPairs(h.positive)
+	h.negative = mergeBucketPairs(h.negative)
+}
+
+// mergeBucketPairs returns the buckets of the next lower schema. Bucket i
+// covers the buckets 2i-1 and 2i of the higher schema.
+func mergeBucketPairs(buckets map[int]uint64) map[int]uint64 {
+	merged := make(map[int]uint64, len(buckets))
+	for key, count := range buckets {
+		merged[(key+1)>>1] += count
+	}
+	return merged
+}
+
+// cumulativeCounts returns the cumulative counts of the classic buckets, by
+// upper bound.
+func (h *nativeHistogram) cumulativeCounts() map[float64]uint64 {
+	buckets := make(map[float64]uint64, len(h.upperBounds))
+	var cumulative uint64
+	for i, bound := range h.upperBounds {
+		cumulative += h.bucketCounts[i]
+		buckets[bound] = cumulative
+	}
+	return buckets
+}
+
+// encode encodes the histogram, native buckets included, as a Histogram
+// message of the protobuf exposition format. All of it is taken at once, so
+// that the buckets add up to the count.
+func (h *nativeHistogram) encode() *proto.Buffer {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+
+	// Histogram: sample_count = 1, sample_sum = 2, bucket = 3, schema = 5,
+	// zero_threshold = 6, zero_count = 7, negative_span = 9,
+	// negative_delta = 10, positive_span = 12, positive_delta = 13.
+	b := proto.NewBuffer(nil)
+	pbVarint(b, 1, h.count)
+	pbDouble(b, 2, h.sum)
+	var cumulative uint64
+	for i, bound := range h.upperBounds {
+		cumulative += h.bucketCounts[i]
+		// Bucket: cumulative_count = 1, upper_bound = 2.
+		bucket := proto.NewBuffer(nil)
+		pbVarint(bucket, 1, cumulative)
+		pbDouble(bucket, 2, bound)
+		pbMessage(b, 3, bucket)
+	}
+	b.EncodeVarint(5<<3 | proto.WireVarint)
+	b.EncodeZigzag32(uint64(h.schema))
+	pbDouble(b, 6, h.zeroThreshold)
+	pbVarint(b, 7, h.zeroCount)
+	encodeNativeBuckets(b, 9, 10, h.negative)
+	encodeNativeBuckets(b, 12, 13, h.positive)
+	return b
+}
+
+// encodeNativeBuckets encodes native buckets as spans of consecutive buckets,
+// and the differences between the counts of each bucket and the previous one.
+func encodeNativeBuckets(b *proto.Buffer, spanField, deltaField uint64, buckets map[int]uint64) {
+	if len(buckets) == 0 {
+		return
+	}
+	keys := sortedIndexes(buckets)
+	deltas := proto.NewBuffer(nil)
+	var previousCount uint64
+	spanStart := 0
+	for i, key := range keys {
+		deltas.EncodeZigzag64(uint64(int64(buckets[key]) - int64(previousCount)))
+		previousCount = buckets[key]
+		if i+1 < len(keys) && keys[i+1] == key+1 {
+			continue
+		}
+		// BucketSpan: offset = 1, length = 2. The offset of the first span
+		// is the index of its first bucket, that of the others the number of
+		// buckets since the end of the previous span.
+		offset := keys[spanStart]
+		if spanStart > 0 {
+			offset -= keys[spanStart-1] + 1
+		}
+		span := proto.NewBuffer(nil)
+		span.EncodeVarint(1<<3 | proto.WireVarint)
+		span.EncodeZigzag32(uint64(offset))
+		pbVarint(span, 2, uint64(i+1-spanStart))
+		pbMessage(b, spanField, span)
+		spanStart = i + 1
+	}
+	pbMessage(b, deltaField, deltas)
+}
+
+// nativeHistogramVec is the counterpart of a HistogramVec for histograms
+// with native buckets.
+type nativeHistogramVec struct {
+	desc       *prometheus.Desc
+	labelNames []string
+	// The upper bounds of classic buckets, without +Inf.
+	upperBounds []float64
+	options     mapper.HistogramOptions
+
+	mtx        sync.Mutex
+	histograms map[string]*nativeHistogram
+}
+
+func newNativeHistogramVec(name, help string, labelNames []string, buckets []float64, options mapper.HistogramOptions) *nativeHistogramVec {
+	var upperBounds []float64
+	for _, bound := range buckets {
+		if !math.IsInf(bound, 1) {
+			upperBounds = append(upperBounds, bound)
+		}
+	}
+	sort.Float64s(upperBounds)
+	return &nativeHistogramVec{
+		desc:        prometheus.NewDesc(name, help, labelNames, nil),
+		labelNames:  labelNames,
+		upperBounds: upperBounds,
+		options:     options,
+		histograms:  make(map[string]*nativeHistogram),
+	}
+}
+
+func (v *nativeHistogramVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	values, err := vecLabelValues(v.labelNames, labels)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if h, ok := v.histograms[key]; ok {
+		return h, nil
+	}
+	zeroThreshold := v.options.NativeZeroThreshold
+	if zeroThreshold == 0 {
+		zeroThreshold = defaultNativeZeroThreshold
+	}
+	h := &nativeHistogram{
+		labelValues:   values,
+		upperBounds:   v.upperBounds,
+		bucketCounts:  make([]uint64, len(v.upperBounds)),
+		schema:        nativeSchema(v.options.NativeBucketFactor),
+		zeroThreshold: zeroThreshold,
+		maxBuckets:    v.options.NativeMaxBuckets,
+		positive:      make(map[int]uint64),
+		negative:      make(map[int]uint64),
+	}
+	v.histograms[key] = h
+	return h, nil
+}
+
+func (v *nativeHistogramVec) Delete(labels prometheus.Labels) bool {
+	values, err := vecLabelValues(v.labelNames, labels)
+	if err != nil {
+		return false
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if _, ok := v.histograms[key]; !ok {
+		return false
+	}
+	delete(v.histograms, key)
+	return true
+}
+
+func (v *nativeHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+// Collect sends the classic buckets of the histograms. The native buckets
+// are added by the protobuf exposition.
+func (v *nativeHistogramVec) Collect(ch chan<- prometheus.Metric) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for _, h := range v.histograms {
+		h.mtx.Lock()
+		ch <- prometheus.MustNewConstHistogram(v.desc, h.count, h.sum, h.cumulativeCounts(), h.labelValues...)
+		h.mtx.Unlock()
+	}
+}
+
+// prefersProtobuf reports whether the client prefers the delimited protobuf
+// format, the only one carrying native buckets, to the text formats.
+func prefersProtobuf(r *http.Request) bool {
+	if expfmt.Negotiate(r.Header) != expfmt.FmtProtoDelim {
+		return false
+	}
+	// OpenMetrics is unknown to the negotiation of the client library.
+	protobuf, openMetrics := 0.0, 0.0
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		params := strings.Split(accepted, ";")
+		q := 1.0
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if f, err := strconv.ParseFloat(strings.TrimPrefix(param, "q="), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		switch strings.TrimSpace(params[0]) {
+		case expfmt.ProtoType:
+			protobuf = math.Max(protobuf, q)
+		case "application/openmetrics-text":
+			openMetrics = math.Max(openMetrics, q)
+		}
+	}
+	return protobuf >= openMetrics
+}
+
+// protobufHandler serves the metrics of the gatherer in the delimited
+// protobuf format to clients preferring it, with the native buckets of the
+// exporter's histograms, and passes other requests on to h.
+func (b *Exporter) protobufHandler(g prometheus.Gatherer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !prefersProtobuf(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		families, err := g.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred while gathering metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The exposition is encoded before writing it to the client, so that
+		// a slow client doesn't hold the registry's lock.
+		var buf bytes.Buffer
+		b.registry.mtx.RLock()
+		for _, family := range families {
+			if err = b.registry.writeProtobufFamily(&buf, family); err != nil {
+				break
+			}
+		}
+		b.registry.mtx.RUnlock()
+		if err != nil {
+			http.Error(w, "An error has occurred while encoding metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", string(expfmt.FmtProtoDelim))
+		var out io.Writer = w
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		if _, err := buf.WriteTo(out); err != nil {
+			log.Debugln("Error writing protobuf metrics:", err)
+		}
+	})
+}
+
+// writeProtobufFamily writes a length-delimited metric family, replacing
+// the histograms of series with native buckets.
+func (r *registry) writeProtobufFamily(w *bytes.Buffer, family *dto.MetricFamily) error {
+	header, err := proto.Marshal(&dto.MetricFamily{Name: family.Name, Help: family.Help, Type: family.Type})
+	if err != nil {
+		return err
+	}
+	// MetricFamily: metric = 4.
+	b := proto.NewBuffer(header)
+	for _, m := range family.Metric {
+		var native *nativeHistogram
+		if family.GetType() == dto.MetricType_HISTOGRAM {
+			if rm := r.lookup(family.GetName(), m.Label); rm != nil {
+				native, _ = rm.metric.(*nativeHistogram)
+			}
+		}
+		if native == nil {
+			metric, err := proto.Marshal(m)
+			if err != nil {
+				return err
+			}
+			pbBytes(b, 4, metric)
+			continue
+		}
+		metric, err := proto.Marshal(&dto.Metric{Label: m.Label, TimestampMs: m.TimestampMs})
+		if err != nil {
+			return err
+		}
+		// Metric: histogram = 7.
+		mb := proto.NewBuffer(metric)
+		pbMessage(mb, 7, native.encode())
+		pbMessage(b, 4, mb)
+	}
+	out := proto.NewBuffer(nil)
+	out.EncodeRawBytes(b.Bytes())
+	w.Write(out.Bytes())
+	return nil
+}
@@ -0,0 +1,294 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+const openMetricsContentType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// maxExemplarLabelRunes is the OpenMetrics limit on the combined length of
+// the names and values of the labels of an exemplar.
+const maxExemplarLabelRunes = 128
+
+// exemplar references an individual sample, typically the trace it was part
+// of.
+type exemplar struct {
+	labels    prometheus.Labels
+	value     float64
+	timestamp time.Time
+}
+
+// extractExemplar removes the exemplar tags from the labels, and returns them
+// as the labels of an exemplar, or nil if there are none.
+func (b *Exporter) extractExemplar(labels prometheus.Labels) prometheus.Labels {
+	var exemplarLabels prometheus.Labels
+	runes := 0
+	for _, tag := range b.exemplarTags {
+		value, ok := labels[tag]
+		if !ok {
+			continue
+		}
+		delete(labels, tag)
+		runes += utf8.RuneCountInString(tag) + utf8.RuneCountInString(value)
+		if exemplarLabels == nil {
+			exemplarLabels = prometheus.Labels{}
+		}
+		exemplarLabels[tag] = value
+	}
+	if runes > maxExemplarLabelRunes {
+		return nil
+	}
+	return exemplarLabels
+}
+
+// recordExemplar attaches an exemplar to a counter, or to the bucket with the
+// given upper bound of a histogram.
+func (r *registry) recordExemplar(mh metricHolder, bound float64, labels prometheus.Labels, value float64) {
+	if labels == nil {
+		return
+	}
+	s := r.seriesStripe(mh)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	byBound, ok := s.exemplars[mh]
+	if !ok {
+		byBound = map[float64]exemplar{}
+		s.exemplars[mh] = byBound
+	}
+	byBound[bound] = exemplar{labels: labels, value: value, timestamp: clock.Now()}
+}
+
+// exemplarsOf returns a copy of the exemplars of a counter or histogram, which
+// events may replace while they are written.
+func (r *registry) exemplarsOf(mh metricHolder) map[float64]exemplar {
+	s := r.seriesStripe(mh)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	byBound, ok := s.exemplars[mh]
+	if !ok {
+		return nil
+	}
+	exemplars := make(map[float64]exemplar, len(byBound))
+	for bound, e := range byBound {
+		exemplars[bound] = e
+	}
+	return exemplars
+}
+
+// bucketBound returns the upper bound of the histogram bucket counting value.
+func bucketBound(buckets []float64, value float64) float64 {
+	i := sort.SearchFloat64s(buckets, value)
+	if i == len(buckets) {
+		return math.Inf(1)
+	}
+	return buckets[i]
+}
+
+// lookup returns the registered series of a metric with the given labels, if
+// any.
+func (r *registry) lookup(metricName string, pairs []*dto.LabelPair) *registeredMetric {
+	labels := make(prometheus.Labels, len(pairs))
+	for _, pair := range pairs {
+		labels[pair.GetName()] = pair.GetValue()
+	}
+	return r.series(metricName, labels)
+}
+
+// series returns the registered series of a metric with the given labels, if
+// any. It only needs the registry's read lock.
+func (r *registry) series(metricName string, labels prometheus.Labels) *registeredMetric {
+	metric, ok := r.metrics[metricName]
+	if !ok {
+		return nil
+	}
+	return metric.metrics[r.hashLabels(labels).values]
+}
+
+// acceptsOpenMetrics reports whether the client asked for OpenMetrics.
+func acceptsOpenMetrics(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		if strings.HasPrefix(strings.TrimSpace(accepted), "application/openmetrics-text") {
+			return true
+		}
+	}
+	return false
+}
+
+// openMetricsHandler serves the metrics of the gatherer in the OpenMetrics
+// format to clients asking for it, with the exemplars and creation times of
+// the exporter's series, and passes other requests on to h.
+func (b *Exporter) openMetricsHandler(g prometheus.Gatherer, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !acceptsOpenMetrics(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		families, err := g.Gather()
+		if err != nil {
+			http.Error(w, "An error has occurred while gathering metrics:\n\n"+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// The exposition is rendered before writing it to the client, so that
+		// a slow client doesn't hold the registry's lock.
+		var buf bytes.Buffer
+		b.registry.mtx.RLock()
+		for _, family := range families {
+			b.registry.writeOpenMetricsFamily(&buf, family)
+		}
+		b.registry.mtx.RUnlock()
+		buf.WriteString("# EOF\n")
+
+		w.Header().Set("Content-Type", openMetricsContentType)
+		var out io.Writer = w
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			defer gz.Close()
+			out = gz
+		}
+		if _, err := buf.WriteTo(out); err != nil {
+			log.Debugln("Error writing OpenMetrics:", err)
+		}
+	})
+}
+
+// writeOpenMetricsFamily writes a metric family in the OpenMetrics format.
+func (r *registry) writeOpenMetricsFamily(w *bytes.Buffer, family *dto.MetricFamily) {
+	name := family.GetName()
+	familyName := name
+	typ := "unknown"
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		typ = "counter"
+		familyName = strings.TrimSuffix(name, "_total")
+	case dto.MetricType_GAUGE:
+		typ = "gauge"
+	case dto.MetricType_SUMMARY:
+		typ = "summary"
+	case dto.MetricType_HISTOGRAM:
+		typ = "histogram"
+	}
+	w.WriteString("# TYPE " + familyName + " " + typ + "\n")
+	if family.Help != nil {
+		w.WriteString("# HELP " + familyName + " " + escapeOpenMetrics(family.GetHelp()) + "\n")
+	}
+
+	for _, m := range family.Metric {
+		var exemplars map[float64]exemplar
+		var created time.Time
+		if rm := r.lookup(name, m.Label); rm != nil {
+			exemplars = r.exemplarsOf(rm.metric)
+			created = rm.createdAt
+		}
+
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			writeOpenMetricsSample(w, familyName+"_total", m, "", 0, m.GetCounter().GetValue(), exemplars, math.Inf(1))
+		case dto.MetricType_GAUGE:
+			writeOpenMetricsSample(w, name, m, "", 0, m.GetGauge().GetValue(), nil, 0)
+		case dto.MetricType_SUMMARY:
+			s := m.GetSummary()
+			for _, q := range s.Quantile {
+				writeOpenMetricsSample(w, name, m, "quantile", q.GetQuantile(), q.GetValue(), nil, 0)
+			}
+			writeOpenMetricsSample(w, name+"_sum", m, "", 0, s.GetSampleSum(), nil, 0)
+			writeOpenMetricsSample(w, name+"_count", m, "", 0, float64(s.GetSampleCount()), nil, 0)
+		case dto.MetricType_HISTOGRAM:
+			h := m.GetHistogram()
+			for _, bucket := range h.Bucket {
+				if math.IsInf(bucket.GetUpperBound(), 1) {
+					continue
+				}
+				writeOpenMetricsSample(w, name+"_bucket", m, "le", bucket.GetUpperBound(), float64(bucket.GetCumulativeCount()), exemplars, bucket.GetUpperBound())
+			}
+			writeOpenMetricsSample(w, name+"_bucket", m, "le", math.Inf(1), float64(h.GetSampleCount()), exemplars, math.Inf(1))
+			writeOpenMetricsSample(w, name+"_sum", m, "", 0, h.GetSampleSum(), nil, 0)
+			writeOpenMetricsSample(w, name+"_count", m, "", 0, float64(h.GetSampleCount()), nil, 0)
+		default:
+			writeOpenMetricsSample(w, name, m, "", 0, m.GetUntyped().GetValue(), nil, 0)
+		}
+
+		if !created.IsZero() && (typ == "counter" || typ == "summary" || typ == "histogram") {
+			writeOpenMetricsSample(w, familyName+"_created", m, "", 0, float64(created.UnixNano())/1e9, nil, 0)
+		}
+	}
+}
+
+// writeOpenMetricsSample writes a sample line of a metric, with an additional
+// label if extraLabel is set, and the exemplar of the given bound if there is
+// one.
+func writeOpenMetricsSample(w *bytes.Buffer, name string, m *dto.Metric, extraLabel string, extraValue, value float64, exemplars map[float64]exemplar, bound float64) {
+	w.WriteString(name)
+	labels := make([]string, 0, len(m.Label)+1)
+	for _, pair := range m.Label {
+		labels = append(labels, pair.GetName()+`="`+escapeOpenMetrics(pair.GetValue())+`"`)
+	}
+	if extraLabel != "" {
+		labels = append(labels, extraLabel+`="`+formatFloat(extraValue)+`"`)
+	}
+	if len(labels) > 0 {
+		w.WriteString("{" + strings.Join(labels, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(value))
+	if m.TimestampMs != nil {
+		w.WriteString(" " + formatFloat(float64(m.GetTimestampMs())/1e3))
+	}
+
+	if e, ok := exemplars[bound]; ok {
+		exemplarLabels := make([]string, 0, len(e.labels))
+		for k, v := range e.labels {
+			exemplarLabels = append(exemplarLabels, k+`="`+escapeOpenMetrics(v)+`"`)
+		}
+		sort.Strings(exemplarLabels)
+		w.WriteString(" # {" + strings.Join(exemplarLabels, ",") + "} " + formatFloat(e.value))
+		w.WriteString(" " + formatFloat(float64(e.timestamp.UnixNano())/1e9))
+	}
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+
+func escapeOpenMetrics(s string) string {
+	return openMetricsEscaper.Replace(s)
+}
@@ -0,0 +1,336 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+const (
+	// otlpTimeout is the timeout of exports to the OTLP endpoint.
+	otlpTimeout = 10 * time.Second
+
+	otlpTemporalityDelta      = 1
+	otlpTemporalityCumulative = 2
+)
+
+// otlpExporter periodically exports the metrics of the exporter to an
+// OpenTelemetry collector, with the OTLP/HTTP protocol.
+type otlpExporter struct {
+	// The URL metrics are posted to, ending in /v1/metrics.
+	url      string
+	interval time.Duration
+	client   *http.Client
+	// Additional headers of the requests, such as Authorization.
+	headers map[string]string
+	// Attributes of the resource all metrics belong to.
+	resource map[string]string
+	exporter *Exporter
+	gatherer prometheus.Gatherer
+	// The start of the series without creation time.
+	startTime time.Time
+	// The end of the last publish interval whose delta counters were
+	// exported, so that the increases of each interval are exported once.
+	deltasExported time.Time
+}
+
+func newOTLPExporter(endpoint string, interval time.Duration, headers, resource map[string]string, exporter *Exporter, gatherer prometheus.Gatherer) *otlpExporter {
+	attributes := map[string]string{"service.name": "statsd_exporter"}
+	for k, v := range resource {
+		attributes[k] = v
+	}
+	return &otlpExporter{
+		url:       strings.TrimSuffix(endpoint, "/") + "/v1/metrics",
+		interval:  interval,
+		client:    &http.Client{Timeout: otlpTimeout},
+		headers:   headers,
+		resource:  attributes,
+		exporter:  exporter,
+		gatherer:  gatherer,
+		startTime: clock.Now(),
+	}
+}
+
+// run exports the metrics every interval.
+func (o *otlpExporter) run() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := o.export(); err != nil {
+			log.Warnln("Error exporting to OTLP:", err)
+		}
+	}
+}
+
+// export sends the current state of the metrics.
+func (o *otlpExporter) export() error {
+	o.exporter.prepareCollection()
+	families, err := o.gatherer.Gather()
+	if err != nil {
+		log.Warnln("Error gathering metrics to export to OTLP:", err)
+	}
+	now := clock.Now()
+	body := o.encode(families, now)
+
+	req, err := http.NewRequest(http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "statsd_exporter/"+version.Version)
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := o.client.Do(req)
+	if err != nil {
+		otlpExports.WithLabelValues("failed").Inc()
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		otlpExports.WithLabelValues("failed").Inc()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	otlpExports.WithLabelValues("succeeded").Inc()
+	return nil
+}
+
+// encode translates metric families into an ExportMetricsServiceRequest.
+// Counters become cumulative sums, delta counters delta sums, and the other
+// types their OpenTelemetry equivalent.
+func (o *otlpExporter) encode(families []*dto.MetricFamily, now time.Time) []byte {
+	// ScopeMetrics: scope = 1, metrics = 2.
+	scopeMetrics := proto.NewBuffer(nil)
+	scope := proto.NewBuffer(nil)
+	pbString(scope, 1, "statsd_exporter")
+	pbString(scope, 2, version.Version)
+	pbMessage(scopeMetrics, 1, scope)
+
+	r := o.exporter.registry
+	r.mtx.RLock()
+	for _, family := range families {
+		if metric := o.encodeMetric(r, family, now); metric != nil {
+			pbMessage(scopeMetrics, 2, metric)
+		}
+	}
+	o.deltasExported = r.publishedEnd
+	r.mtx.RUnlock()
+
+	// ResourceMetrics: resource = 1, scope_metrics = 2.
+	resourceMetrics := proto.NewBuffer(nil)
+	pbMessage(resourceMetrics, 1, otlpResource(o.resource))
+	pbMessage(resourceMetrics, 2, scopeMetrics)
+
+	// ExportMetricsServiceRequest: resource_metrics = 1.
+	request := proto.NewBuffer(nil)
+	pbMessage(request, 1, resourceMetrics)
+	return request.Bytes()
+}
+
+// encodeMetric encodes a metric family as a Metric message: name = 1,
+// description = 2, and gauge = 5, sum = 7, histogram = 9 or summary = 11.
+// It returns nil for delta counters without a new interval to export.
+func (o *otlpExporter) encodeMetric(r *registry, family *dto.MetricFamily, now time.Time) *proto.Buffer {
+	metric := proto.NewBuffer(nil)
+	pbString(metric, 1, family.GetName())
+	if family.GetHelp() != "" {
+		pbString(metric, 2, family.GetHelp())
+	}
+
+	// The start of a cumulative series is its creation.
+	start := func(m *dto.Metric) time.Time {
+		if rm := r.lookup(family.GetName(), m.Label); rm != nil {
+			return rm.createdAt
+		}
+		return o.startTime
+	}
+
+	data := proto.NewBuffer(nil)
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		// Sum: data_points = 1, aggregation_temporality = 2, is_monotonic = 3.
+		for _, m := range family.Metric {
+			pbMessage(data, 1, otlpNumberPoint(m.Label, start(m), now, m.GetCounter().GetValue()))
+		}
+		pbVarint(data, 2, otlpTemporalityCumulative)
+		pbVarint(data, 3, 1)
+		pbMessage(metric, 7, data)
+
+	case dto.MetricType_GAUGE:
+		if len(family.Metric) > 0 && r.isDeltaCounter(family.GetName(), family.Metric[0].Label) {
+			// The increases cover the last publish interval, which is left
+			// out if it was exported already or is yet to end.
+			if !r.publishedEnd.After(o.deltasExported) {
+				return nil
+			}
+			for _, m := range family.Metric {
+				pbMessage(data, 1, otlpNumberPoint(m.Label, r.publishedStart, r.publishedEnd, m.GetGauge().GetValue()))
+			}
+			pbVarint(data, 2, otlpTemporalityDelta)
+			pbVarint(data, 3, 1)
+			pbMessage(metric, 7, data)
+			break
+		}
+		// Gauge: data_points = 1.
+		for _, m := range family.Metric {
+			pbMessage(data, 1, otlpNumberPoint(m.Label, time.Time{}, now, m.GetGauge().GetValue()))
+		}
+		pbMessage(metric, 5, data)
+
+	case dto.MetricType_SUMMARY:
+		// Summary: data_points = 1.
+		for _, m := range family.Metric {
+			s := m.GetSummary()
+			// SummaryDataPoint: start_time_unix_nano = 2, time_unix_nano = 3,
+			// count = 4, sum = 5, quantile_values = 6, attributes = 7.
+			point := proto.NewBuffer(nil)
+			pbFixed64(point, 2, uint64(start(m).UnixNano()))
+			pbFixed64(point, 3, uint64(now.UnixNano()))
+			pbFixed64(point, 4, s.GetSampleCount())
+			pbDouble(point, 5, s.GetSampleSum())
+			for _, q := range s.Quantile {
+				// ValueAtQuantile: quantile = 1, value = 2.
+				quantile := proto.NewBuffer(nil)
+				pbDouble(quantile, 1, q.GetQuantile())
+				pbDouble(quantile, 2, q.GetValue())
+				pbMessage(point, 6, quantile)
+			}
+			for _, label := range m.Label {
+				pbMessage(point, 7, otlpAttribute(label.GetName(), label.GetValue()))
+			}
+			pbMessage(data, 1, point)
+		}
+		pbMessage(metric, 11, data)
+
+	case dto.MetricType_HISTOGRAM:
+		// Histogram: data_points = 1, aggregation_temporality = 2.
+		for _, m := range family.Metric {
+			h := m.GetHistogram()
+			var bounds, counts []uint64
+			var previous uint64
+			for _, b := range h.Bucket {
+				if math.IsInf(b.GetUpperBound(), 1) {
+					continue
+				}
+				bounds = append(bounds, math.Float64bits(b.GetUpperBound()))
+				counts = append(counts, b.GetCumulativeCount()-previous)
+				previous = b.GetCumulativeCount()
+			}
+			counts = append(counts, h.GetSampleCount()-previous)
+
+			// HistogramDataPoint: start_time_unix_nano = 2,
+			// time_unix_nano = 3, count = 4, sum = 5, bucket_counts = 6,
+			// explicit_bounds = 7, attributes = 9.
+			point := proto.NewBuffer(nil)
+			pbFixed64(point, 2, uint64(start(m).UnixNano()))
+			pbFixed64(point, 3, uint64(now.UnixNano()))
+			pbFixed64(point, 4, h.GetSampleCount())
+			pbDouble(point, 5, h.GetSampleSum())
+			pbPackedFixed64(point, 6, counts)
+			pbPackedFixed64(point, 7, bounds)
+			for _, label := range m.Label {
+				pbMessage(point, 9, otlpAttribute(label.GetName(), label.GetValue()))
+			}
+			pbMessage(data, 1, point)
+		}
+		pbVarint(data, 2, otlpTemporalityCumulative)
+		pbMessage(metric, 9, data)
+
+	default:
+		for _, m := range family.Metric {
+			pbMessage(data, 1, otlpNumberPoint(m.Label, time.Time{}, now, m.GetUntyped().GetValue()))
+		}
+		pbMessage(metric, 5, data)
+	}
+	return metric
+}
+
+// isDeltaCounter reports whether the series of a metric with the given
+// labels exposes a delta counter.
+func (r *registry) isDeltaCounter(metricName string, pairs []*dto.LabelPair) bool {
+	rm := r.lookup(metricName, pairs)
+	if rm == nil {
+		return false
+	}
+	g, ok := rm.metric.(prometheus.Gauge)
+	if !ok {
+		return false
+	}
+	s := r.seriesStripe(g)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	_, ok = s.deltas[g]
+	return ok
+}
+
+// otlpNumberPoint encodes a NumberDataPoint: start_time_unix_nano = 2,
+// time_unix_nano = 3, as_double = 4, attributes = 7. A zero start is left
+// out.
+func otlpNumberPoint(labels []*dto.LabelPair, start, now time.Time, value float64) *proto.Buffer {
+	point := proto.NewBuffer(nil)
+	if !start.IsZero() {
+		pbFixed64(point, 2, uint64(start.UnixNano()))
+	}
+	pbFixed64(point, 3, uint64(now.UnixNano()))
+	pbDouble(point, 4, value)
+	for _, label := range labels {
+		pbMessage(point, 7, otlpAttribute(label.GetName(), label.GetValue()))
+	}
+	return point
+}
+
+// otlpResource encodes a Resource: attributes = 1.
+func otlpResource(attributes map[string]string) *proto.Buffer {
+	resource := proto.NewBuffer(nil)
+	keys := make([]string, 0, len(attributes))
+	for k := range attributes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		pbMessage(resource, 1, otlpAttribute(k, attributes[k]))
+	}
+	return resource
+}
+
+// otlpAttribute encodes a KeyValue with a string value: key = 1, value = 2,
+// and AnyValue: string_value = 1.
+func otlpAttribute(key, value string) *proto.Buffer {
+	anyValue := proto.NewBuffer(nil)
+	pbString(anyValue, 1, value)
+	kv := proto.NewBuffer(nil)
+	pbString(kv, 1, key)
+	pbMessage(kv, 2, anyValue)
+	return kv
+}
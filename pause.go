@@ -0,0 +1,118 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// pausePolicy decides what happens to the events received while ingestion
+// is paused.
+type pausePolicy string
+
+const (
+	pausePolicyBuffer pausePolicy = "buffer"
+	pausePolicyDrop   pausePolicy = "drop"
+)
+
+// maxPausedEvents bounds the number of events buffered while paused. Further
+// events are dropped.
+const maxPausedEvents = 1000000
+
+// ingestionGate holds back the events received while ingestion is paused.
+type ingestionGate struct {
+	mtx      sync.Mutex
+	paused   bool
+	policy   pausePolicy
+	buffered Events
+	// Events buffered during a pause, handed back to the exporter when
+	// ingestion resumes.
+	resumed chan Events
+	// Closed once the exporter stopped taking events, so that resuming
+	// doesn't wait for it forever.
+	done chan struct{}
+	// Serializes resumes, so that buffered events are handed back in order.
+	resuming sync.Mutex
+}
+
+func newIngestionGate() *ingestionGate {
+	return &ingestionGate{resumed: make(chan Events), done: make(chan struct{})}
+}
+
+func (g *ingestionGate) pause(policy pausePolicy) error {
+	if policy != pausePolicyBuffer && policy != pausePolicyDrop {
+		return fmt.Errorf("invalid pause policy %q", policy)
+	}
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	g.paused = true
+	g.policy = policy
+	ingestionPaused.Set(1)
+	return nil
+}
+
+// resume lets events through again, and hands the buffered ones back to the
+// exporter. The gate stays closed until the exporter took all of them, so
+// that events received in the meantime are buffered behind them rather than
+// overtaking them. It returns the number of buffered events.
+func (g *ingestionGate) resume() int {
+	g.resuming.Lock()
+	defer g.resuming.Unlock()
+	resumed := 0
+	for {
+		g.mtx.Lock()
+		buffered := g.buffered
+		g.buffered = nil
+		if len(buffered) == 0 {
+			g.paused = false
+			ingestionPaused.Set(0)
+			g.mtx.Unlock()
+			return resumed
+		}
+		g.mtx.Unlock()
+
+		select {
+		case g.resumed <- buffered:
+			resumed += len(buffered)
+		case <-g.done:
+			pausedEventsDropped.Add(float64(len(buffered)))
+		}
+	}
+}
+
+// close tells resumes that the exporter stopped taking events.
+func (g *ingestionGate) close() {
+	close(g.done)
+}
+
+// admit returns the events to process now, holding back or dropping them
+// while paused.
+func (g *ingestionGate) admit(events Events) Events {
+	g.mtx.Lock()
+	defer g.mtx.Unlock()
+	if !g.paused {
+		return events
+	}
+	if g.policy == pausePolicyBuffer {
+		room := maxPausedEvents - len(g.buffered)
+		if room > len(events) {
+			room = len(events)
+		}
+		g.buffered = append(g.buffered, events[:room]...)
+		events = events[room:]
+	}
+	pausedEventsDropped.Add(float64(len(events)))
+	return nil
+}
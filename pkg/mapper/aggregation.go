@@ -0,0 +1,46 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import "fmt"
+
+// GaugeAggregation decides how the gauge samples received over a publish
+// interval combine into the exposed value.
+type GaugeAggregation string
+
+const (
+	GaugeAggregationLast    GaugeAggregation = "last"
+	GaugeAggregationMin     GaugeAggregation = "min"
+	GaugeAggregationMax     GaugeAggregation = "max"
+	GaugeAggregationMean    GaugeAggregation = "mean"
+	GaugeAggregationSum     GaugeAggregation = "sum"
+	GaugeAggregationDefault GaugeAggregation = ""
+)
+
+func (a *GaugeAggregation) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch GaugeAggregation(v) {
+	case GaugeAggregationLast, GaugeAggregationDefault:
+		*a = GaugeAggregationLast
+	case GaugeAggregationMin, GaugeAggregationMax, GaugeAggregationMean, GaugeAggregationSum:
+		*a = GaugeAggregation(v)
+	default:
+		return fmt.Errorf("invalid gauge aggregation '%s'", v)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxGeneratedBuckets protects against specifications generating absurd
+// numbers of buckets by mistake.
+const maxGeneratedBuckets = 200
+
+type BucketSpecType string
+
+const (
+	// Each bucket is larger than the previous one by a constant factor.
+	BucketSpecTypeExponential BucketSpecType = "exponential"
+	// Buckets are spaced linearly between consecutive powers of a factor,
+	// like 1, 2, ... 9, 10, 20, ... 90, 100.
+	BucketSpecTypeLogLinear BucketSpecType = "log_linear"
+)
+
+// BucketSpec generates histogram buckets between a minimum and a maximum.
+type BucketSpec struct {
+	Type BucketSpecType `yaml:"type"`
+	Min  float64        `yaml:"min"`
+	Max  float64        `yaml:"max"`
+	// Factor between consecutive buckets, or between consecutive powers
+	// for log-linear buckets. Defaults to 2, or 10 for log-linear buckets.
+	Factor float64 `yaml:"factor"`
+	// Steps is the number of log-linear buckets per power of the factor.
+	// Defaults to the factor minus one.
+	Steps int `yaml:"steps"`
+}
+
+// Buckets returns the upper bounds of the buckets, from the minimum up to
+// the first bound reaching the maximum.
+func (s *BucketSpec) Buckets() ([]float64, error) {
+	if s.Min <= 0 {
+		return nil, fmt.Errorf("bucket_spec min must be positive")
+	}
+	if s.Max <= s.Min {
+		return nil, fmt.Errorf("bucket_spec max must be larger than min")
+	}
+
+	var buckets []float64
+	switch s.Type {
+	case BucketSpecTypeExponential:
+		factor := s.Factor
+		if factor == 0 {
+			factor = 2
+		}
+		if factor <= 1 {
+			return nil, fmt.Errorf("bucket_spec factor must be larger than 1")
+		}
+		for bound := s.Min; ; bound *= factor {
+			buckets = append(buckets, roundBound(bound))
+			if bound >= s.Max || len(buckets) > maxGeneratedBuckets {
+				break
+			}
+		}
+	case BucketSpecTypeLogLinear:
+		factor := s.Factor
+		if factor == 0 {
+			factor = 10
+		}
+		if factor <= 1 {
+			return nil, fmt.Errorf("bucket_spec factor must be larger than 1")
+		}
+		steps := s.Steps
+		if steps == 0 {
+			steps = int(factor) - 1
+		}
+		if steps < 1 {
+			return nil, fmt.Errorf("bucket_spec steps must be positive")
+		}
+	powers:
+		for power := s.Min; ; power *= factor {
+			for j := 0; j < steps; j++ {
+				bound := power * (1 + float64(j)*(factor-1)/float64(steps))
+				buckets = append(buckets, roundBound(bound))
+				if bound >= s.Max || len(buckets) > maxGeneratedBuckets {
+					break powers
+				}
+			}
+		}
+	default:
+		return nil, fmt.Errorf("invalid bucket_spec type '%s'", s.Type)
+	}
+
+	if len(buckets) > maxGeneratedBuckets {
+		return nil, fmt.Errorf("bucket_spec generates more than %d buckets", maxGeneratedBuckets)
+	}
+	return buckets, nil
+}
+
+// roundBound removes the floating point noise from generated bounds, so
+// that they are exposed as 0.3 rather than 0.30000000000000004.
+func roundBound(bound float64) float64 {
+	rounded, _ := strconv.ParseFloat(strconv.FormatFloat(bound, 'g', 12, 64), 64)
+	return rounded
+}
+
+// resolveBuckets returns the buckets generated by spec, if set, or the
+// explicit ones.
+func resolveBuckets(buckets []float64, spec *BucketSpec) ([]float64, error) {
+	if spec == nil {
+		return buckets, nil
+	}
+	if len(buckets) > 0 {
+		return nil, fmt.Errorf("buckets and bucket_spec cannot both be set")
+	}
+	return spec.Buckets()
+}
+
+// ParseBuckets parses a comma separated list of increasing bucket bounds.
+func ParseBuckets(list string) ([]float64, error) {
+	var buckets []float64
+	for _, field := range strings.Split(list, ",") {
+		bound, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bucket bound %q", field)
+		}
+		if len(buckets) > 0 && bound <= buckets[len(buckets)-1] {
+			return nil, fmt.Errorf("bucket bounds must be in increasing order")
+		}
+		buckets = append(buckets, bound)
+	}
+	return buckets, nil
+}
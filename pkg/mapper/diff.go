@@ -0,0 +1,120 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// MappingDiff lists the mapping rules that differ between two
+// configurations. Rules are identified by what they match, see RuleKey.
+type MappingDiff struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+	Changed []string `json:"changed"`
+}
+
+// Diff compares the mappings of m with those of n, reporting the rules that
+// n adds, removes or changes.
+func (m *MetricMapper) Diff(n *MetricMapper) MappingDiff {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	n.mutex.RLock()
+	defer n.mutex.RUnlock()
+
+	oldRules := rulesByKey(m.Mappings)
+	newRules := rulesByKey(n.Mappings)
+
+	diff := MappingDiff{Added: []string{}, Removed: []string{}, Changed: []string{}}
+	for key, mapping := range newRules {
+		oldMapping, ok := oldRules[key]
+		if !ok {
+			diff.Added = append(diff.Added, key)
+		} else if !sameRule(oldMapping, mapping) {
+			diff.Changed = append(diff.Changed, key)
+		}
+	}
+	for key := range oldRules {
+		if _, ok := newRules[key]; !ok {
+			diff.Removed = append(diff.Removed, key)
+		}
+	}
+	sort.Strings(diff.Added)
+	sort.Strings(diff.Removed)
+	sort.Strings(diff.Changed)
+	return diff
+}
+
+// SameResult reports whether two results of GetMapping would produce the same
+// metric.
+func SameResult(a *MetricMapping, aLabels prometheus.Labels, b *MetricMapping, bLabels prometheus.Labels) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	if len(aLabels) != len(bLabels) || (len(aLabels) > 0 && !reflect.DeepEqual(aLabels, bLabels)) {
+		return false
+	}
+	return sameRule(a, b)
+}
+
+// RuleKey identifies a mapping rule by its match expression, match type,
+// metric type and tag matchers.
+func RuleKey(m *MetricMapping) string {
+	key := m.Match
+	if m.MatchType == MatchTypeRegex {
+		key += " (regex)"
+	}
+	if m.MatchMetricType != "" {
+		key += " [" + string(m.MatchMetricType) + "]"
+	}
+	if len(m.MatchTags) > 0 {
+		tags := make([]string, 0, len(m.MatchTags))
+		for k, v := range m.MatchTags {
+			tags = append(tags, k+"="+v)
+		}
+		sort.Strings(tags)
+		key += " {" + strings.Join(tags, ",") + "}"
+	}
+	return key
+}
+
+// rulesByKey indexes mappings by RuleKey. Rules sharing a key are told apart
+// by their position among them.
+func rulesByKey(mappings []MetricMapping) map[string]*MetricMapping {
+	rules := make(map[string]*MetricMapping, len(mappings))
+	seen := map[string]int{}
+	for i := range mappings {
+		key := RuleKey(&mappings[i])
+		seen[key]++
+		if n := seen[key]; n > 1 {
+			key = fmt.Sprintf("%s #%d", key, n)
+		}
+		rules[key] = &mappings[i]
+	}
+	return rules
+}
+
+// sameRule compares the configurable settings of two mappings.
+func sameRule(a, b *MetricMapping) bool {
+	aYAML, aErr := yaml.Marshal(a)
+	bYAML, bErr := yaml.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aYAML, bYAML)
+}
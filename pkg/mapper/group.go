@@ -0,0 +1,105 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// MappingGroup is a named set of mappings sharing labels and defaults.
+type MappingGroup struct {
+	Name     string               `yaml:"name"`
+	Labels   prometheus.Labels    `yaml:"labels"`
+	Defaults mappingGroupDefaults `yaml:"defaults"`
+	Mappings []MetricMapping      `yaml:"mappings"`
+}
+
+type mappingGroupDefaults struct {
+	TimerType  TimerType         `yaml:"timer_type"`
+	Buckets    []float64         `yaml:"buckets"`
+	BucketSpec *BucketSpec       `yaml:"bucket_spec"`
+	Quantiles  []metricObjective `yaml:"quantiles"`
+	MatchType  MatchType         `yaml:"match_type"`
+	Ttl        time.Duration     `yaml:"ttl"`
+}
+
+// flattenGroups appends the mappings of all groups to the top-level ones,
+// applying the labels and defaults of their group.
+func flattenGroups(mappings []MetricMapping, groups []MappingGroup) ([]MetricMapping, error) {
+	names := map[string]struct{}{}
+	for _, group := range groups {
+		if group.Name == "" {
+			return nil, fmt.Errorf("mapping group didn't set a name")
+		}
+		if _, ok := names[group.Name]; ok {
+			return nil, fmt.Errorf("duplicate mapping group %q", group.Name)
+		}
+		names[group.Name] = struct{}{}
+
+		for k := range group.Labels {
+			if !labelNameRE.MatchString(k) {
+				return nil, fmt.Errorf("group %q: invalid label key: %s", group.Name, k)
+			}
+		}
+
+		for i, mapping := range group.Mappings {
+			mapping.position = fmt.Sprintf("group %q mapping %d", group.Name, i+1)
+			group.apply(&mapping)
+			for j := range mapping.FanOut {
+				mapping.FanOut[j].Labels = group.withLabels(mapping.FanOut[j].Labels)
+			}
+			mappings = append(mappings, mapping)
+		}
+	}
+	return mappings, nil
+}
+
+// apply fills in the settings a mapping doesn't set from its group.
+func (g *MappingGroup) apply(mapping *MetricMapping) {
+	mapping.Labels = g.withLabels(mapping.Labels)
+	if mapping.TimerType == "" {
+		mapping.TimerType = g.Defaults.TimerType
+	}
+	if len(mapping.Buckets) == 0 && mapping.BucketSpec == nil {
+		mapping.Buckets = g.Defaults.Buckets
+		mapping.BucketSpec = g.Defaults.BucketSpec
+	}
+	if len(mapping.Quantiles) == 0 {
+		mapping.Quantiles = g.Defaults.Quantiles
+	}
+	if mapping.MatchType == "" {
+		mapping.MatchType = g.Defaults.MatchType
+	}
+	if mapping.Ttl == 0 {
+		mapping.Ttl = g.Defaults.Ttl
+	}
+}
+
+// withLabels returns the group labels overridden by the given ones.
+func (g *MappingGroup) withLabels(labels prometheus.Labels) prometheus.Labels {
+	if len(g.Labels) == 0 {
+		return labels
+	}
+	merged := make(prometheus.Labels, len(g.Labels)+len(labels))
+	for k, v := range g.Labels {
+		merged[k] = v
+	}
+	for k, v := range labels {
+		merged[k] = v
+	}
+	return merged
+}
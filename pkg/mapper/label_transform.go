@@ -0,0 +1,54 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// LabelTransform rewrites the value of a label using a regular expression,
+// much like a Prometheus relabeling rule with the "replace" action.
+type LabelTransform struct {
+	Label       string `yaml:"label"`
+	Regex       string `yaml:"regex"`
+	Replacement string `yaml:"replacement"`
+	regex       *regexp.Regexp
+}
+
+func (t *LabelTransform) init() error {
+	if !labelNameRE.MatchString(t.Label) {
+		return fmt.Errorf("invalid label key in label_transforms: %s", t.Label)
+	}
+	// Anchor the expression to the whole value, as Prometheus does.
+	regex, err := regexp.Compile("^(?:" + t.Regex + ")$")
+	if err != nil {
+		return fmt.Errorf("invalid regex %s in label_transforms: %v", t.Regex, err)
+	}
+	t.regex = regex
+	if t.Replacement == "" {
+		t.Replacement = "$1"
+	}
+	return nil
+}
+
+// Apply returns the transformed label value. Values not matching the regular
+// expression are returned unchanged.
+func (t *LabelTransform) Apply(value string) string {
+	matches := t.regex.FindStringSubmatchIndex(value)
+	if matches == nil {
+		return value
+	}
+	return string(t.regex.ExpandString([]byte{}, t.Replacement, value, matches))
+}
@@ -0,0 +1,108 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// The legacy format, used before v0.5.0, is a list of definitions separated
+// by empty lines. Each definition is a glob match followed by label="value"
+// lines, where the "name" label sets the metric name:
+//
+//   test.dispatcher.*.*.*
+//   name="dispatcher_events_total"
+//   processor="$1"
+
+var legacyLabelLineRE = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_]*)\s*=\s*"(.*)"$`)
+
+// IsLegacyConfig reports whether a mapping configuration uses the legacy
+// line-based format.
+func IsLegacyConfig(contents string) bool {
+	for _, line := range strings.Split(contents, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		return metricLineRE.MatchString(line)
+	}
+	return false
+}
+
+// ConvertLegacyConfig converts a mapping configuration in the legacy format
+// into the equivalent YAML configuration.
+func ConvertLegacyConfig(contents string) (string, error) {
+	var (
+		mappings []yaml.MapSlice
+		labels   yaml.MapSlice
+		name     string
+		match    string
+	)
+
+	finish := func(lineNumber int) error {
+		if match == "" {
+			return nil
+		}
+		if name == "" {
+			return fmt.Errorf("line %d: metric mapping didn't set a metric name", lineNumber)
+		}
+		mapping := yaml.MapSlice{{Key: "match", Value: match}, {Key: "name", Value: name}}
+		if len(labels) > 0 {
+			mapping = append(mapping, yaml.MapItem{Key: "labels", Value: labels})
+		}
+		mappings = append(mappings, mapping)
+		match, name, labels = "", "", nil
+		return nil
+	}
+
+	lines := strings.Split(contents, "\n")
+	for i, line := range lines {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "#"):
+		case line == "":
+			if err := finish(i + 1); err != nil {
+				return "", err
+			}
+		case match == "":
+			if !metricLineRE.MatchString(line) {
+				return "", fmt.Errorf("line %d: expected metric match line, got: %s", i+1, line)
+			}
+			match = line
+		default:
+			matches := legacyLabelLineRE.FindStringSubmatch(line)
+			if len(matches) != 3 {
+				return "", fmt.Errorf("line %d: expected label mapping line, got: %s", i+1, line)
+			}
+			if matches[1] == "name" {
+				name = matches[2]
+			} else {
+				labels = append(labels, yaml.MapItem{Key: matches[1], Value: matches[2]})
+			}
+		}
+	}
+	if err := finish(len(lines)); err != nil {
+		return "", err
+	}
+
+	out, err := yaml.Marshal(yaml.MapSlice{{Key: "mappings", Value: mappings}})
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -14,9 +14,14 @@
 package mapper
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"path/filepath"
 	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -38,20 +43,42 @@ var (
 type mapperConfigDefaults struct {
 	TimerType           TimerType         `yaml:"timer_type"`
 	Buckets             []float64         `yaml:"buckets"`
+	BucketSpec          *BucketSpec       `yaml:"bucket_spec"`
 	Quantiles           []metricObjective `yaml:"quantiles"`
 	MatchType           MatchType         `yaml:"match_type"`
 	GlobDisableOrdering bool              `yaml:"glob_disable_ordering"`
 	Ttl                 time.Duration     `yaml:"ttl"`
+	SummaryOptions      SummaryOptions    `yaml:"summary_options"`
+	HistogramOptions    HistogramOptions  `yaml:"histogram_options"`
 }
 
 type MetricMapper struct {
 	Defaults mapperConfigDefaults `yaml:"defaults"`
 	Mappings []MetricMapping      `yaml:"mappings"`
-	FSM      *fsm.FSM
-	doFSM    bool
-	doRegex  bool
-	cache    MetricMapperCache
-	mutex    sync.RWMutex
+	// Groups are flattened into Mappings, after the top-level mappings, when
+	// the configuration is loaded.
+	Groups  []MappingGroup `yaml:"groups"`
+	FSM     *fsm.FSM
+	doFSM   bool
+	doRegex bool
+	cache   MetricMapperCache
+	// Mappings that only apply to events carrying certain tags are kept out
+	// of the FSM and matched in order against the event's tags.
+	tagMappings []*MetricMapping
+	// All tag keys referenced by tagMappings, sorted. They are part of the
+	// cache key, since they influence which mapping is chosen.
+	tagKeys []string
+	mutex   sync.RWMutex
+
+	// DefaultTtl is used as the ttl of all metrics when the configuration
+	// doesn't set one in its defaults.
+	DefaultTtl time.Duration `yaml:"-"`
+	// DefaultBuckets are used as the buckets of all histograms when the
+	// configuration doesn't set any in its defaults.
+	DefaultBuckets []float64 `yaml:"-"`
+	// DefaultQuantiles are used as the quantiles of all summaries when the
+	// configuration doesn't set any in its defaults.
+	DefaultQuantiles []metricObjective `yaml:"-"`
 
 	MappingsCount prometheus.Gauge
 }
@@ -66,12 +93,134 @@ type MetricMapping struct {
 	labelFormatters []*fsm.TemplateFormatter
 	TimerType       TimerType         `yaml:"timer_type"`
 	Buckets         []float64         `yaml:"buckets"`
+	BucketSpec      *BucketSpec       `yaml:"bucket_spec"`
 	Quantiles       []metricObjective `yaml:"quantiles"`
+	SummaryOptions  SummaryOptions    `yaml:"summary_options"`
 	MatchType       MatchType         `yaml:"match_type"`
 	HelpText        string            `yaml:"help"`
 	Action          ActionType        `yaml:"action"`
 	MatchMetricType MetricType        `yaml:"match_metric_type"`
+	MatchTags       map[string]string `yaml:"match_tags"`
+	MetricType      MetricType        `yaml:"metric_type"`
+	Unit            UnitType          `yaml:"unit"`
 	Ttl             time.Duration     `yaml:"ttl"`
+	// Temporality only applies to counters. Delta counters are exposed as
+	// gauges holding the increase over the last publish interval.
+	Temporality Temporality `yaml:"temporality"`
+	// CounterMode only applies to StatsD counters. Cumulative counter values
+	// are converted into increments, treating a decrease as a client reset.
+	CounterMode CounterMode `yaml:"counter_mode"`
+	// ExportRate adds a gauge of the per-second rate of counters over each
+	// publish interval.
+	ExportRate bool `yaml:"export_rate"`
+	// ExportStatistics adds a gauge of the classic StatsD statistics of
+	// timers over each publish interval, next to their summary or histogram.
+	ExportStatistics bool `yaml:"export_statistics"`
+	// HistogramOptions add native buckets to histograms, next to or instead
+	// of their classic buckets.
+	HistogramOptions HistogramOptions `yaml:"histogram_options"`
+	// GaugeAggregation combines the gauge samples received over each publish
+	// interval. By default, the last sample wins.
+	GaugeAggregation GaugeAggregation `yaml:"gauge_aggregation"`
+	// MinUpdateInterval coalesces the gauge samples received within the
+	// interval, aggregated with GaugeAggregation, into a single update.
+	MinUpdateInterval time.Duration `yaml:"min_update_interval"`
+	// FanOut lists additional metrics to record for every event matching
+	// this mapping. In the mappings returned by GetMapping, the outputs carry
+	// their expanded name and labels.
+	FanOut []MetricMapping `yaml:"fan_out"`
+	// ValueRules are checked in order against every sample value. The first
+	// matching rule drops the sample or renames the metric. In the mappings
+	// returned by GetMapping, the rule names are expanded.
+	ValueRules []ValueRule `yaml:"value_rules"`
+	// LabelTransforms are applied to the final label values, including
+	// those taken from tags.
+	LabelTransforms []LabelTransform `yaml:"label_transforms"`
+	// Priority overrides the position of the mapping in the configuration.
+	// Mappings with a higher priority are tried first; mappings with the
+	// same priority keep their relative order.
+	Priority int `yaml:"priority"`
+	// order is the position of the mapping once sorted by priority. When
+	// several mappings match, the one with the lowest order wins.
+	order int
+	// position names the mapping in the configuration file for errors,
+	// such as "mapping 3" or "group \"api\" mapping 1", counting from 1.
+	position string
+}
+
+// SummaryOptions tune the sliding window over which summaries compute their
+// quantiles, and how they estimate them. Unset options keep the client
+// library defaults.
+type SummaryOptions struct {
+	MaxAge     time.Duration `yaml:"max_age"`
+	AgeBuckets uint32        `yaml:"age_buckets"`
+	BufCap     uint32        `yaml:"buf_cap"`
+	// Algorithm estimating the quantiles, CKMS unless set.
+	Algorithm QuantileAlgorithm `yaml:"algorithm"`
+	// RelativeAccuracy bounds the error of DDSketch quantiles, relative
+	// to their value.
+	RelativeAccuracy float64 `yaml:"relative_accuracy"`
+}
+
+// HistogramOptions add native buckets to histograms, next to or instead of
+// their classic buckets. The bounds of native buckets are powers of a base
+// picked from the bucket factor, so that they need no configuration.
+type HistogramOptions struct {
+	// NativeBucketFactor is the largest ratio allowed between the bounds of
+	// a native bucket. Native buckets are only kept when it is greater
+	// than 1.
+	NativeBucketFactor float64 `yaml:"native_bucket_factor"`
+	// NativeZeroThreshold is the bound of the native bucket holding the
+	// values closest to zero, 2^-128 unless set.
+	NativeZeroThreshold float64 `yaml:"native_zero_threshold"`
+	// NativeMaxBuckets limits the number of native buckets of a series by
+	// halving their resolution. Unless set, they are not limited.
+	NativeMaxBuckets uint32 `yaml:"native_max_buckets"`
+	// NativeOnly leaves out the classic buckets of histograms with native
+	// buckets.
+	NativeOnly bool `yaml:"native_only"`
+}
+
+// Native reports whether histograms have native buckets.
+func (o HistogramOptions) Native() bool {
+	return o.NativeBucketFactor > 1
+}
+
+// withDefaults returns the options, with unset ones taken from defaults.
+func (o HistogramOptions) withDefaults(defaults HistogramOptions) HistogramOptions {
+	if o.NativeBucketFactor == 0 {
+		o.NativeBucketFactor = defaults.NativeBucketFactor
+	}
+	if o.NativeZeroThreshold == 0 {
+		o.NativeZeroThreshold = defaults.NativeZeroThreshold
+	}
+	if o.NativeMaxBuckets == 0 {
+		o.NativeMaxBuckets = defaults.NativeMaxBuckets
+	}
+	if !o.NativeOnly {
+		o.NativeOnly = defaults.NativeOnly
+	}
+	return o
+}
+
+// withDefaults returns the options, with unset ones taken from defaults.
+func (o SummaryOptions) withDefaults(defaults SummaryOptions) SummaryOptions {
+	if o.MaxAge == 0 {
+		o.MaxAge = defaults.MaxAge
+	}
+	if o.AgeBuckets == 0 {
+		o.AgeBuckets = defaults.AgeBuckets
+	}
+	if o.BufCap == 0 {
+		o.BufCap = defaults.BufCap
+	}
+	if o.Algorithm == "" {
+		o.Algorithm = defaults.Algorithm
+	}
+	if o.RelativeAccuracy == 0 {
+		o.RelativeAccuracy = defaults.RelativeAccuracy
+	}
+	return o
 }
 
 type metricObjective struct {
@@ -92,27 +241,59 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int) er
 		return err
 	}
 
+	var err error
+	if n.Defaults.Buckets, err = resolveBuckets(n.Defaults.Buckets, n.Defaults.BucketSpec); err != nil {
+		return fmt.Errorf("defaults: %v", err)
+	}
+	if len(n.Defaults.Buckets) == 0 {
+		n.Defaults.Buckets = m.DefaultBuckets
+	}
 	if n.Defaults.Buckets == nil || len(n.Defaults.Buckets) == 0 {
 		n.Defaults.Buckets = prometheus.DefBuckets
 	}
 
+	if len(n.Defaults.Quantiles) == 0 {
+		n.Defaults.Quantiles = m.DefaultQuantiles
+	}
 	if n.Defaults.Quantiles == nil || len(n.Defaults.Quantiles) == 0 {
 		n.Defaults.Quantiles = defaultQuantiles
 	}
 
+	if n.Defaults.Ttl == 0 {
+		n.Defaults.Ttl = m.DefaultTtl
+	}
+
 	if n.Defaults.MatchType == MatchTypeDefault {
 		n.Defaults.MatchType = MatchTypeGlob
 	}
 
+	for i := range n.Mappings {
+		n.Mappings[i].position = fmt.Sprintf("mapping %d", i+1)
+	}
+	mappings, err := flattenGroups(n.Mappings, n.Groups)
+	if err != nil {
+		return err
+	}
+	n.Mappings = mappings
+	n.Groups = nil
+
+	sort.SliceStable(n.Mappings, func(i, j int) bool {
+		return n.Mappings[i].Priority > n.Mappings[j].Priority
+	})
+
 	remainingMappingsCount := len(n.Mappings)
 
 	n.FSM = fsm.NewFSM([]string{string(MetricTypeCounter), string(MetricTypeGauge), string(MetricTypeTimer)},
 		remainingMappingsCount, n.Defaults.GlobDisableOrdering)
 
+	tagKeys := map[string]struct{}{}
+
 	for i := range n.Mappings {
 		remainingMappingsCount--
 
 		currentMapping := &n.Mappings[i]
+		currentMapping.order = i
+		captureCount := 0
 
 		// check that label is correct
 		for k := range currentMapping.Labels {
@@ -122,42 +303,65 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int) er
 		}
 
 		if currentMapping.Name == "" {
-			return fmt.Errorf("line %d: metric mapping didn't set a metric name", i)
+			return fmt.Errorf("%s: metric mapping didn't set a metric name", currentMapping.position)
 		}
 
 		if !metricNameRE.MatchString(currentMapping.Name) {
 			return fmt.Errorf("metric name '%s' doesn't match regex '%s'", currentMapping.Name, metricNameRE)
 		}
+		currentMapping.Name = withUnitSuffix(currentMapping.Name, currentMapping.Unit)
 
 		if currentMapping.MatchType == "" {
 			currentMapping.MatchType = n.Defaults.MatchType
 		}
 
+		if currentMapping.MatchType == MatchTypeGlob {
+			if err := currentMapping.expandPlaceholders(); err != nil {
+				return fmt.Errorf("%s: %v", currentMapping.position, err)
+			}
+		}
+
 		if currentMapping.Action == "" {
 			currentMapping.Action = ActionTypeMap
 		}
 
-		if currentMapping.MatchType == MatchTypeGlob {
+		for k := range currentMapping.MatchTags {
+			if !labelNameRE.MatchString(k) {
+				return fmt.Errorf("invalid tag key in match_tags: %s", k)
+			}
+			tagKeys[k] = struct{}{}
+		}
+
+		if len(currentMapping.MatchTags) > 0 {
+			// Tag-conditioned mappings are matched with a regular expression,
+			// since several of them may share the same match expression.
+			match := currentMapping.Match
+			if currentMapping.MatchType == MatchTypeGlob {
+				if !metricLineRE.MatchString(match) {
+					return fmt.Errorf("invalid match: %s", match)
+				}
+				captureCount = strings.Count(match, "*")
+				currentMapping.nameFormatter = fsm.NewTemplateFormatter(currentMapping.Name, captureCount)
+				currentMapping.labelKeys, currentMapping.labelFormatters = newLabelFormatters(currentMapping.Labels, captureCount)
+				match = globToRegex(match)
+			}
+			regex, err := regexp.Compile(match)
+			if err != nil {
+				return fmt.Errorf("invalid regex %s in mapping: %v", currentMapping.Match, err)
+			}
+			currentMapping.regex = regex
+			n.tagMappings = append(n.tagMappings, currentMapping)
+		} else if currentMapping.MatchType == MatchTypeGlob {
 			n.doFSM = true
 			if !metricLineRE.MatchString(currentMapping.Match) {
 				return fmt.Errorf("invalid match: %s", currentMapping.Match)
 			}
 
-			captureCount := n.FSM.AddState(currentMapping.Match, string(currentMapping.MatchMetricType),
+			captureCount = n.FSM.AddState(currentMapping.Match, string(currentMapping.MatchMetricType),
 				remainingMappingsCount, currentMapping)
 
 			currentMapping.nameFormatter = fsm.NewTemplateFormatter(currentMapping.Name, captureCount)
-
-			labelKeys := make([]string, len(currentMapping.Labels))
-			labelFormatters := make([]*fsm.TemplateFormatter, len(currentMapping.Labels))
-			labelIndex := 0
-			for label, valueExpr := range currentMapping.Labels {
-				labelKeys[labelIndex] = label
-				labelFormatters[labelIndex] = fsm.NewTemplateFormatter(valueExpr, captureCount)
-				labelIndex++
-			}
-			currentMapping.labelFormatters = labelFormatters
-			currentMapping.labelKeys = labelKeys
+			currentMapping.labelKeys, currentMapping.labelFormatters = newLabelFormatters(currentMapping.Labels, captureCount)
 
 		} else {
 			if regex, err := regexp.Compile(currentMapping.Match); err != nil {
@@ -172,6 +376,9 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int) er
 			currentMapping.TimerType = n.Defaults.TimerType
 		}
 
+		if currentMapping.Buckets, err = resolveBuckets(currentMapping.Buckets, currentMapping.BucketSpec); err != nil {
+			return fmt.Errorf("%s: %v", currentMapping.position, err)
+		}
 		if currentMapping.Buckets == nil || len(currentMapping.Buckets) == 0 {
 			currentMapping.Buckets = n.Defaults.Buckets
 		}
@@ -180,17 +387,74 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int) er
 			currentMapping.Quantiles = n.Defaults.Quantiles
 		}
 
+		currentMapping.SummaryOptions = currentMapping.SummaryOptions.withDefaults(n.Defaults.SummaryOptions)
+		if currentMapping.SummaryOptions.MaxAge < 0 {
+			return fmt.Errorf("%s: summary max_age must not be negative", currentMapping.position)
+		}
+		if currentMapping.MinUpdateInterval < 0 {
+			return fmt.Errorf("%s: min_update_interval must not be negative", currentMapping.position)
+		}
+		if a := currentMapping.SummaryOptions.RelativeAccuracy; a < 0 || a >= 1 {
+			return fmt.Errorf("%s: summary relative_accuracy must be between 0 and 1", currentMapping.position)
+		}
+
+		currentMapping.HistogramOptions = currentMapping.HistogramOptions.withDefaults(n.Defaults.HistogramOptions)
+		if f := currentMapping.HistogramOptions.NativeBucketFactor; f != 0 && f <= 1 {
+			return fmt.Errorf("%s: histogram native_bucket_factor must be greater than 1", currentMapping.position)
+		}
+		if currentMapping.HistogramOptions.NativeZeroThreshold < 0 {
+			return fmt.Errorf("%s: histogram native_zero_threshold must not be negative", currentMapping.position)
+		}
+
 		if currentMapping.Ttl == 0 && n.Defaults.Ttl > 0 {
 			currentMapping.Ttl = n.Defaults.Ttl
 		}
 
+		for j := range currentMapping.LabelTransforms {
+			if err := currentMapping.LabelTransforms[j].init(); err != nil {
+				return fmt.Errorf("%s: %v", currentMapping.position, err)
+			}
+		}
+
+		for j := range currentMapping.ValueRules {
+			rule := &currentMapping.ValueRules[j]
+			if rule.When.op == "" {
+				return fmt.Errorf("%s: value rule %d didn't set a condition", currentMapping.position, j+1)
+			}
+			switch rule.Action {
+			case ActionTypeDrop:
+			case ActionTypeMap, ActionTypeDefault:
+				rule.Action = ActionTypeMap
+				if rule.Name == "" {
+					return fmt.Errorf("%s: value rule %d neither drops nor renames", currentMapping.position, j+1)
+				}
+				if !metricNameRE.MatchString(rule.Name) {
+					return fmt.Errorf("metric name '%s' doesn't match regex '%s'", rule.Name, metricNameRE)
+				}
+				rule.Name = withUnitSuffix(rule.Name, currentMapping.Unit)
+				rule.nameFormatter = fsm.NewTemplateFormatter(rule.Name, captureCount)
+			}
+		}
+
+		for j := range currentMapping.FanOut {
+			if err := initFanOut(currentMapping, &currentMapping.FanOut[j], captureCount); err != nil {
+				return fmt.Errorf("%s: %v", currentMapping.position, err)
+			}
+		}
+	}
+
+	for k := range tagKeys {
+		n.tagKeys = append(n.tagKeys, k)
 	}
+	sort.Strings(n.tagKeys)
 
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
 	m.Defaults = n.Defaults
 	m.Mappings = n.Mappings
+	m.tagMappings = n.tagMappings
+	m.tagKeys = n.tagKeys
 	m.InitCache(cacheSize)
 
 	if n.doFSM {
@@ -213,15 +477,162 @@ func (m *MetricMapper) InitFromYAMLString(fileContents string, cacheSize int) er
 	return nil
 }
 
+// expandPlaceholders replaces the <label> components of a glob match with
+// wildcards, adding a label set to the captured value unless the mapping
+// already defines it.
+func (m *MetricMapping) expandPlaceholders() error {
+	if !strings.Contains(m.Match, "<") {
+		return nil
+	}
+	components := strings.Split(m.Match, ".")
+	captures := 0
+	for i, component := range components {
+		if component == "*" {
+			captures++
+			continue
+		}
+		if !strings.HasPrefix(component, "<") || !strings.HasSuffix(component, ">") {
+			continue
+		}
+		label := component[1 : len(component)-1]
+		if !labelNameRE.MatchString(label) {
+			return fmt.Errorf("invalid label placeholder %s in match %s", component, m.Match)
+		}
+		captures++
+		components[i] = "*"
+		if _, ok := m.Labels[label]; ok {
+			continue
+		}
+		if m.Labels == nil {
+			m.Labels = prometheus.Labels{}
+		}
+		m.Labels[label] = fmt.Sprintf("${%d}", captures)
+	}
+	m.Match = strings.Join(components, ".")
+	return nil
+}
+
+// initFanOut validates a fan-out output and fills in the settings it
+// inherits from its parent mapping.
+func initFanOut(parent, output *MetricMapping, captureCount int) error {
+	if len(output.FanOut) > 0 {
+		return fmt.Errorf("fan_out of %q cannot be nested", output.Name)
+	}
+	if len(output.ValueRules) > 0 {
+		return fmt.Errorf("fan_out of %q cannot have value rules", output.Name)
+	}
+	if output.Name == "" {
+		return fmt.Errorf("fan_out of %q didn't set a metric name", parent.Match)
+	}
+	if !metricNameRE.MatchString(output.Name) {
+		return fmt.Errorf("metric name '%s' doesn't match regex '%s'", output.Name, metricNameRE)
+	}
+	output.Name = withUnitSuffix(output.Name, output.Unit)
+	for k := range output.Labels {
+		if !labelNameRE.MatchString(k) {
+			return fmt.Errorf("invalid label key: %s", k)
+		}
+	}
+
+	output.Match = parent.Match
+	output.MatchType = parent.MatchType
+	output.MatchMetricType = parent.MatchMetricType
+	output.MatchTags = parent.MatchTags
+	output.Action = ActionTypeMap
+	output.regex = parent.regex
+	output.order = parent.order
+	output.Priority = parent.Priority
+
+	if output.TimerType == "" {
+		output.TimerType = parent.TimerType
+	}
+	var err error
+	if output.Buckets, err = resolveBuckets(output.Buckets, output.BucketSpec); err != nil {
+		return fmt.Errorf("fan_out %q: %v", output.Name, err)
+	}
+	if len(output.Buckets) == 0 {
+		output.Buckets = parent.Buckets
+	}
+	if len(output.Quantiles) == 0 {
+		output.Quantiles = parent.Quantiles
+	}
+	if output.Ttl == 0 {
+		output.Ttl = parent.Ttl
+	}
+	if output.Temporality == "" {
+		output.Temporality = parent.Temporality
+	}
+	if output.CounterMode == "" {
+		output.CounterMode = parent.CounterMode
+	}
+	if output.GaugeAggregation == "" {
+		output.GaugeAggregation = parent.GaugeAggregation
+	}
+	if output.MinUpdateInterval == 0 {
+		output.MinUpdateInterval = parent.MinUpdateInterval
+	}
+	output.SummaryOptions = output.SummaryOptions.withDefaults(parent.SummaryOptions)
+	output.HistogramOptions = output.HistogramOptions.withDefaults(parent.HistogramOptions)
+	if len(output.LabelTransforms) == 0 {
+		output.LabelTransforms = parent.LabelTransforms
+	} else {
+		for j := range output.LabelTransforms {
+			if err := output.LabelTransforms[j].init(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if output.MatchType == MatchTypeGlob {
+		output.nameFormatter = fsm.NewTemplateFormatter(output.Name, captureCount)
+		output.labelKeys, output.labelFormatters = newLabelFormatters(output.Labels, captureCount)
+	}
+	return nil
+}
+
+// InitFromJSONString loads a mapping configuration written in JSON. It uses
+// the same schema as the YAML configuration.
+func (m *MetricMapper) InitFromJSONString(fileContents string, cacheSize int) error {
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, []byte(fileContents)); err != nil {
+		return fmt.Errorf("invalid JSON mapping config: %v", err)
+	}
+	// JSON is a subset of YAML once insignificant whitespace, such as
+	// tabs used for indentation, is removed.
+	return m.InitFromYAMLString(compact.String(), cacheSize)
+}
+
+// InitFromFile loads a mapping configuration from a file. Files with a .json
+// extension, or whose contents are a JSON object, are read as JSON, files in
+// the legacy format are converted, and anything else is read as YAML.
 func (m *MetricMapper) InitFromFile(fileName string, cacheSize int) error {
 	mappingStr, err := ioutil.ReadFile(fileName)
 	if err != nil {
 		return err
 	}
 
+	if isJSONConfig(fileName, mappingStr) {
+		return m.InitFromJSONString(string(mappingStr), cacheSize)
+	}
+	if IsLegacyConfig(string(mappingStr)) {
+		log.Warnf("Mapping config %s uses the deprecated legacy format, convert it to YAML with the convert-config command", fileName)
+		converted, err := ConvertLegacyConfig(string(mappingStr))
+		if err != nil {
+			return err
+		}
+		return m.InitFromYAMLString(converted, cacheSize)
+	}
 	return m.InitFromYAMLString(string(mappingStr), cacheSize)
 }
 
+func isJSONConfig(fileName string, contents []byte) bool {
+	if strings.EqualFold(filepath.Ext(fileName), ".json") {
+		return true
+	}
+	trimmed := bytes.TrimSpace(contents)
+	return len(trimmed) > 0 && trimmed[0] == '{' && json.Valid(trimmed)
+}
+
 func (m *MetricMapper) InitCache(cacheSize int) {
 	if cacheSize == 0 {
 		m.cache = NewMetricMapperNoopCache()
@@ -234,39 +645,156 @@ func (m *MetricMapper) InitCache(cacheSize int) {
 	}
 }
 
+// StaticMappings returns the mappings that match a single StatsD metric
+// name, and whose metric name and labels are therefore known in advance.
+func (m *MetricMapper) StaticMappings() []MetricMapping {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	var mappings []MetricMapping
+	for _, mapping := range m.Mappings {
+		if mapping.Action == ActionTypeDrop || mapping.MatchType == MatchTypeRegex || len(mapping.ValueRules) > 0 {
+			continue
+		}
+		if strings.ContainsAny(mapping.Match, "*<") {
+			continue
+		}
+		mappings = append(mappings, mapping)
+	}
+	return mappings
+}
+
+// PurgeCache empties the mapping cache, if its implementation allows it.
+func (m *MetricMapper) PurgeCache() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if c, ok := m.cache.(interface{ Purge() }); ok {
+		c.Purge()
+	}
+}
+
+// GetMapping returns the mapping for a StatsD metric, ignoring any mappings
+// that are conditioned on tags.
 func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricType) (*MetricMapping, prometheus.Labels, bool) {
+	return m.GetMappingWithTags(statsdMetric, statsdMetricType, nil)
+}
+
+// GetMappingWithTags returns the mapping for a StatsD metric, also taking
+// into account mappings that only apply to events with certain tags.
+func (m *MetricMapper) GetMappingWithTags(statsdMetric string, statsdMetricType MetricType, tags map[string]string) (*MetricMapping, prometheus.Labels, bool) {
 	m.mutex.RLock()
 	defer m.mutex.RUnlock()
-	result, cached := m.cache.Get(statsdMetric, statsdMetricType)
+	cacheKey := statsdMetric
+	if len(m.tagKeys) > 0 {
+		cacheKey = formatTagsKey(statsdMetric, m.tagKeys, tags)
+	}
+	result, cached := m.cache.Get(cacheKey, statsdMetricType)
 	if cached {
 		return result.Mapping, result.Labels, result.Matched
 	}
+
+	start := time.Now()
+	mapping, labels, present := m.matchMapping(statsdMetric, statsdMetricType, tags, cacheKey)
+	matchType := "none"
+	if present {
+		matchType = string(mapping.MatchType)
+		if len(mapping.MatchTags) > 0 {
+			matchType = "tags"
+		}
+	}
+	matchDuration.WithLabelValues(matchType).Observe(time.Since(start).Seconds())
+	return mapping, labels, present
+}
+
+// matchMapping finds the mapping of a StatsD metric that isn't cached, and
+// caches it. The mapper must be locked.
+func (m *MetricMapper) matchMapping(statsdMetric string, statsdMetricType MetricType, tags map[string]string, cacheKey string) (*MetricMapping, prometheus.Labels, bool) {
+	tagMapping, tagLabels := m.getTagMapping(statsdMetric, statsdMetricType, tags)
+
 	// glob matching
 	if m.doFSM {
 		finalState, captures := m.FSM.GetMapping(statsdMetric, string(statsdMetricType))
 		if finalState != nil && finalState.Result != nil {
-			result := finalState.Result.(*MetricMapping)
-			result.Name = result.nameFormatter.Format(captures)
-
-			labels := prometheus.Labels{}
-			for index, formatter := range result.labelFormatters {
-				labels[result.labelKeys[index]] = formatter.Format(captures)
+			mapping := finalState.Result.(*MetricMapping)
+			if tagMapping != nil && tagMapping.order < mapping.order {
+				m.cache.AddMatch(cacheKey, statsdMetricType, tagMapping, tagLabels)
+				return tagMapping, tagLabels, true
+			}
+			// Glob matches take precedence over regex mappings, unless
+			// those have a higher priority.
+			for i := 0; m.doRegex && i < mapping.order; i++ {
+				if m.Mappings[i].Priority <= mapping.Priority {
+					break
+				}
+				if result, labels, ok := m.Mappings[i].matchRegex(statsdMetric, statsdMetricType); ok {
+					m.cache.AddMatch(cacheKey, statsdMetricType, result, labels)
+					return result, labels, true
+				}
 			}
+			result, labels := mapping.expandGlob(captures)
 
-			m.cache.AddMatch(statsdMetric, statsdMetricType, result, labels)
+			m.cache.AddMatch(cacheKey, statsdMetricType, result, labels)
 
 			return result, labels, true
-		} else if !m.doRegex {
+		} else if !m.doRegex && tagMapping == nil {
 			// if there's no regex match type, return immediately
-			m.cache.AddMiss(statsdMetric, statsdMetricType)
+			m.cache.AddMiss(cacheKey, statsdMetricType)
 			return nil, nil, false
 		}
 	}
 
 	// regex matching
-	for _, mapping := range m.Mappings {
-		// if a rule don't have regex matching type, the regex field is unset
-		if mapping.regex == nil {
+	for i := range m.Mappings {
+		// a tag-conditioned mapping matched earlier in the configuration
+		if tagMapping != nil && tagMapping.order < m.Mappings[i].order {
+			break
+		}
+		result, labels, ok := m.Mappings[i].matchRegex(statsdMetric, statsdMetricType)
+		if !ok {
+			continue
+		}
+
+		m.cache.AddMatch(cacheKey, statsdMetricType, result, labels)
+
+		return result, labels, true
+	}
+
+	if tagMapping != nil {
+		m.cache.AddMatch(cacheKey, statsdMetricType, tagMapping, tagLabels)
+		return tagMapping, tagLabels, true
+	}
+
+	m.cache.AddMiss(cacheKey, statsdMetricType)
+	return nil, nil, false
+}
+
+// matchRegex returns a copy of the mapping expanded for the given metric if it
+// is a regex mapping matching it.
+func (m *MetricMapping) matchRegex(statsdMetric string, statsdMetricType MetricType) (*MetricMapping, prometheus.Labels, bool) {
+	// if a rule don't have regex matching type, the regex field is unset
+	if m.regex == nil || len(m.MatchTags) > 0 {
+		return nil, nil, false
+	}
+	if mt := m.MatchMetricType; mt != "" && mt != statsdMetricType {
+		return nil, nil, false
+	}
+	matches := m.regex.FindStringSubmatchIndex(statsdMetric)
+	if len(matches) == 0 {
+		return nil, nil, false
+	}
+
+	result, labels := m.expandRegex(statsdMetric, matches)
+	return result, labels, true
+}
+
+// getTagMapping returns a copy of the first tag-conditioned mapping matching
+// the given metric and tags, with its name and labels expanded.
+func (m *MetricMapper) getTagMapping(statsdMetric string, statsdMetricType MetricType, tags map[string]string) (*MetricMapping, prometheus.Labels) {
+	for _, mapping := range m.tagMappings {
+		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
+			continue
+		}
+		if !mapping.matchesTags(tags) {
 			continue
 		}
 		matches := mapping.regex.FindStringSubmatchIndex(statsdMetric)
@@ -274,28 +802,121 @@ func (m *MetricMapper) GetMapping(statsdMetric string, statsdMetricType MetricTy
 			continue
 		}
 
-		mapping.Name = string(mapping.regex.ExpandString(
-			[]byte{},
-			mapping.Name,
-			statsdMetric,
-			matches,
-		))
+		if mapping.MatchType == MatchTypeGlob {
+			return mapping.expandGlob(mapping.regex.FindStringSubmatch(statsdMetric)[1:])
+		}
+		return mapping.expandRegex(statsdMetric, matches)
+	}
+	return nil, nil
+}
 
-		if mt := mapping.MatchMetricType; mt != "" && mt != statsdMetricType {
-			continue
+// expandGlob returns a copy of the mapping with its name and fan-out outputs
+// formatted from the captures of a glob match, along with its labels.
+func (m *MetricMapping) expandGlob(captures []string) (*MetricMapping, prometheus.Labels) {
+	result := *m
+	result.Name = m.nameFormatter.Format(captures)
+
+	labels := prometheus.Labels{}
+	for index, formatter := range m.labelFormatters {
+		labels[m.labelKeys[index]] = formatter.Format(captures)
+	}
+
+	if len(m.FanOut) > 0 {
+		result.FanOut = make([]MetricMapping, len(m.FanOut))
+		for i := range m.FanOut {
+			output, outputLabels := m.FanOut[i].expandGlob(captures)
+			output.Labels = outputLabels
+			result.FanOut[i] = *output
 		}
+	}
 
-		labels := prometheus.Labels{}
-		for label, valueExpr := range mapping.Labels {
-			value := mapping.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
-			labels[label] = string(value)
+	if len(m.ValueRules) > 0 {
+		result.ValueRules = make([]ValueRule, len(m.ValueRules))
+		for i, rule := range m.ValueRules {
+			if rule.nameFormatter != nil {
+				rule.Name = rule.nameFormatter.Format(captures)
+			}
+			result.ValueRules[i] = rule
 		}
+	}
+	return &result, labels
+}
 
-		m.cache.AddMatch(statsdMetric, statsdMetricType, &mapping, labels)
+// expandRegex returns a copy of the mapping with its name and fan-out
+// outputs expanded from the submatches of a regex match, along with its
+// labels.
+func (m *MetricMapping) expandRegex(statsdMetric string, matches []int) (*MetricMapping, prometheus.Labels) {
+	result := *m
+	result.Name = string(m.regex.ExpandString([]byte{}, m.Name, statsdMetric, matches))
+
+	labels := prometheus.Labels{}
+	for label, valueExpr := range m.Labels {
+		value := m.regex.ExpandString([]byte{}, valueExpr, statsdMetric, matches)
+		labels[label] = string(value)
+	}
 
-		return &mapping, labels, true
+	if len(m.FanOut) > 0 {
+		result.FanOut = make([]MetricMapping, len(m.FanOut))
+		for i := range m.FanOut {
+			output, outputLabels := m.FanOut[i].expandRegex(statsdMetric, matches)
+			output.Labels = outputLabels
+			result.FanOut[i] = *output
+		}
 	}
 
-	m.cache.AddMiss(statsdMetric, statsdMetricType)
-	return nil, nil, false
+	if len(m.ValueRules) > 0 {
+		result.ValueRules = make([]ValueRule, len(m.ValueRules))
+		for i, rule := range m.ValueRules {
+			rule.Name = string(m.regex.ExpandString([]byte{}, rule.Name, statsdMetric, matches))
+			result.ValueRules[i] = rule
+		}
+	}
+	return &result, labels
+}
+
+// matchesTags reports whether the given tags satisfy all of the mapping's tag
+// matchers. A matcher value of "*" only requires the tag to be present.
+func (m *MetricMapping) matchesTags(tags map[string]string) bool {
+	for k, v := range m.MatchTags {
+		tv, ok := tags[k]
+		if !ok || (v != "*" && v != tv) {
+			return false
+		}
+	}
+	return true
+}
+
+func newLabelFormatters(labels prometheus.Labels, captureCount int) ([]string, []*fsm.TemplateFormatter) {
+	labelKeys := make([]string, len(labels))
+	labelFormatters := make([]*fsm.TemplateFormatter, len(labels))
+	labelIndex := 0
+	for label, valueExpr := range labels {
+		labelKeys[labelIndex] = label
+		labelFormatters[labelIndex] = fsm.NewTemplateFormatter(valueExpr, captureCount)
+		labelIndex++
+	}
+	return labelKeys, labelFormatters
+}
+
+// globToRegex translates a glob match into an anchored regular expression
+// with one capture group per wildcard.
+func globToRegex(match string) string {
+	return "^" + strings.Replace(regexp.QuoteMeta(match), `\*`, `([^.]*)`, -1) + "$"
+}
+
+// formatTagsKey appends the values of the given tag keys to a metric name so
+// that events differing only in those tags are cached separately.
+func formatTagsKey(statsdMetric string, keys []string, tags map[string]string) string {
+	var sb strings.Builder
+	sb.WriteString(statsdMetric)
+	for _, k := range keys {
+		// 0xff never occurs in valid UTF-8 and cannot be part of a metric line
+		sb.WriteByte(0xff)
+		if v, ok := tags[k]; ok {
+			sb.WriteString(k)
+			sb.WriteByte('=')
+			sb.WriteString(v)
+		}
+	}
+	return sb.String()
 }
@@ -26,6 +26,27 @@ var (
 			Help: "The count of unique metrics currently cached.",
 		},
 	)
+	cacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_cache_lookups_total",
+			Help: "The number of lookups of metrics in the mapping cache, by whether they were a hit or a miss.",
+		},
+		[]string{"result"},
+	)
+	cacheEvictions = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_cache_evictions_total",
+			Help: "The number of metrics evicted from the mapping cache to make room for others.",
+		},
+	)
+	matchDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "statsd_exporter_mapping_match_duration_seconds",
+			Help:    "Time taken to match metrics that weren't cached against the mapping rules, by the match type of the rule that matched, or none.",
+			Buckets: prometheus.ExponentialBuckets(0.000001, 4, 10),
+		},
+		[]string{"match_type"},
+	)
 )
 
 type MetricMapperCacheResult struct {
@@ -60,20 +81,34 @@ func NewMetricMapperCache(size int) (*MetricMapperLRUCache, error) {
 
 func (m *MetricMapperLRUCache) Get(metricString string, metricType MetricType) (*MetricMapperCacheResult, bool) {
 	if result, ok := m.cache.Get(formatKey(metricString, metricType)); ok {
+		cacheLookups.WithLabelValues("hit").Inc()
 		return result.(*MetricMapperCacheResult), true
 	} else {
+		cacheLookups.WithLabelValues("miss").Inc()
 		return nil, false
 	}
 }
 
 func (m *MetricMapperLRUCache) AddMatch(metricString string, metricType MetricType, mapping *MetricMapping, labels prometheus.Labels) {
 	go m.trackCacheLength()
-	m.cache.Add(formatKey(metricString, metricType), &MetricMapperCacheResult{Mapping: mapping, Matched: true, Labels: labels})
+	m.add(formatKey(metricString, metricType), &MetricMapperCacheResult{Mapping: mapping, Matched: true, Labels: labels})
 }
 
 func (m *MetricMapperLRUCache) AddMiss(metricString string, metricType MetricType) {
 	go m.trackCacheLength()
-	m.cache.Add(formatKey(metricString, metricType), &MetricMapperCacheResult{Matched: false})
+	m.add(formatKey(metricString, metricType), &MetricMapperCacheResult{Matched: false})
+}
+
+func (m *MetricMapperLRUCache) add(key string, result *MetricMapperCacheResult) {
+	if m.cache.Add(key, result) {
+		cacheEvictions.Inc()
+	}
+}
+
+// Purge removes all entries from the cache.
+func (m *MetricMapperLRUCache) Purge() {
+	m.cache.Purge()
+	m.trackCacheLength()
 }
 
 func (m *MetricMapperLRUCache) trackCacheLength() {
@@ -103,4 +138,7 @@ func (m *MetricMapperNoopCache) AddMiss(metricString string, metricType MetricTy
 
 func init() {
 	prometheus.MustRegister(cacheLength)
+	prometheus.MustRegister(cacheLookups)
+	prometheus.MustRegister(cacheEvictions)
+	prometheus.MustRegister(matchDuration)
 }
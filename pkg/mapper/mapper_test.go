@@ -14,12 +14,21 @@
 package mapper
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 type mappings []struct {
 	statsdMetric string
+	tags         map[string]string
 	name         string
 	labels       map[string]string
 	quantiles    []metricObjective
@@ -735,6 +744,375 @@ mappings:
 				},
 			},
 		},
+		// Config with tag-conditioned mappings.
+		{
+			config: `mappings:
+- match: request.*
+  name: "prod_requests"
+  match_tags:
+    env: prod
+  labels:
+    handler: "$1"
+- match: "request\\.(.*)"
+  match_type: regex
+  name: "canary_requests"
+  match_tags:
+    canary: "*"
+  labels:
+    handler: "$1"
+- match: request.*
+  name: "requests"
+  labels:
+    handler: "$1"
+- match: other.*
+  name: "other"
+- match: other.*
+  name: "never"
+  match_tags:
+    env: prod`,
+			mappings: mappings{
+				{
+					statsdMetric: "request.foo",
+					tags:         map[string]string{"env": "prod"},
+					name:         "prod_requests",
+					labels: map[string]string{
+						"handler": "foo",
+					},
+				},
+				{
+					statsdMetric: "request.foo",
+					tags:         map[string]string{"env": "dev", "canary": "true"},
+					name:         "canary_requests",
+					labels: map[string]string{
+						"handler": "foo",
+					},
+				},
+				{
+					statsdMetric: "request.foo",
+					tags:         map[string]string{"env": "dev"},
+					name:         "requests",
+					labels: map[string]string{
+						"handler": "foo",
+					},
+				},
+				{
+					statsdMetric: "request.bar",
+					name:         "requests",
+					labels: map[string]string{
+						"handler": "bar",
+					},
+				},
+				{
+					statsdMetric: "other.foo",
+					tags:         map[string]string{"env": "prod"},
+					name:         "other",
+				},
+			},
+		},
+		// Config with an invalid tag key.
+		{
+			config: `mappings:
+- match: request.*
+  name: "requests"
+  match_tags:
+    "bad-key": prod`,
+			configBad: true,
+		},
+		// Config with a fan-out mapping.
+		{
+			config: `mappings:
+- match: fanout.*.*
+  name: "fanout_duration"
+  labels:
+    handler: "$1"
+  fan_out:
+  - name: "fanout_${2}_total"
+    metric_type: counter
+    labels:
+      handler: "$1"`,
+			mappings: mappings{
+				{
+					statsdMetric: "fanout.login.status",
+					name:         "fanout_duration",
+					labels: map[string]string{
+						"handler": "login",
+					},
+				},
+			},
+		},
+		// Config with a fan-out output without a name.
+		{
+			config: `mappings:
+- match: fanout.*
+  name: "fanout"
+  fan_out:
+  - metric_type: counter`,
+			configBad: true,
+		},
+		// Config with a nested fan-out.
+		{
+			config: `mappings:
+- match: fanout.*
+  name: "fanout"
+  fan_out:
+  - name: "fanout_a"
+    fan_out:
+    - name: "fanout_b"`,
+			configBad: true,
+		},
+		// Config with unit conversions.
+		{
+			config: `mappings:
+- match: unit.duration
+  name: "request_duration"
+  unit: ms
+- match: unit.received
+  name: "received_total"
+  unit: KiB
+- match: unit.cpu
+  name: "cpu_usage"
+  unit: percent
+- match: unit.size
+  name: "size_bytes"
+  unit: bytes`,
+			mappings: mappings{
+				{
+					statsdMetric: "unit.duration",
+					name:         "request_duration_seconds",
+				},
+				{
+					statsdMetric: "unit.received",
+					name:         "received_bytes_total",
+				},
+				{
+					statsdMetric: "unit.cpu",
+					name:         "cpu_usage_ratio",
+				},
+				{
+					statsdMetric: "unit.size",
+					name:         "size_bytes",
+				},
+			},
+		},
+		// Config with an invalid unit.
+		{
+			config: `mappings:
+- match: unit.duration
+  name: "request_duration"
+  unit: fortnights`,
+			configBad: true,
+		},
+		// Config with an invalid value condition.
+		{
+			config: `mappings:
+- match: vendor.*
+  name: "vendor"
+  value_rules:
+  - when: "~ 5"
+    action: drop`,
+			configBad: true,
+		},
+		// Config with a value rule that does nothing.
+		{
+			config: `mappings:
+- match: vendor.*
+  name: "vendor"
+  value_rules:
+  - when: "< 0"`,
+			configBad: true,
+		},
+		// Config with priorities overriding the file order.
+		{
+			config: `mappings:
+- match: prio.*.*
+  name: "prio_catch_all"
+  labels:
+    service: "$1"
+    action: "$2"
+- match: prio.api.*
+  name: "prio_api"
+  priority: 10
+  labels:
+    action: "$1"
+- match: prio\.(.*)\.login
+  match_type: regex
+  name: "prio_login"
+  priority: 20
+  labels:
+    service: "$1"
+- match: prio\.(.*)\.logout
+  match_type: regex
+  name: "prio_logout"
+  labels:
+    service: "$1"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "prio.web.view",
+					name:         "prio_catch_all",
+					labels:       map[string]string{"service": "web", "action": "view"},
+				},
+				{
+					statsdMetric: "prio.api.view",
+					name:         "prio_api",
+					labels:       map[string]string{"action": "view"},
+				},
+				{
+					statsdMetric: "prio.api.login",
+					name:         "prio_login",
+					labels:       map[string]string{"service": "api"},
+				},
+				{
+					statsdMetric: "prio.web.logout",
+					name:         "prio_catch_all",
+					labels:       map[string]string{"service": "web", "action": "logout"},
+				},
+			},
+		},
+		// Config with mapping groups.
+		{
+			config: `mappings:
+- match: group.top.*
+  name: "group_top"
+groups:
+- name: team-a
+  labels:
+    team: "a"
+  defaults:
+    ttl: 1h
+  mappings:
+  - match: group.alpha.*
+    name: "group_a"
+    labels:
+      handler: "$1"
+  - match: group.shared.*
+    name: "group_shared"
+    ttl: 5m
+    labels:
+      team: "shared"
+- name: team-b
+  labels:
+    team: "b"
+  mappings:
+  - match: group.*.*
+    name: "group_b"
+    labels:
+      service: "$1"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "group.top.x",
+					name:         "group_top",
+					labels:       map[string]string{},
+				},
+				{
+					statsdMetric: "group.alpha.login",
+					name:         "group_a",
+					labels:       map[string]string{"team": "a", "handler": "login"},
+					ttl:          time.Hour,
+				},
+				{
+					statsdMetric: "group.shared.x",
+					name:         "group_shared",
+					labels:       map[string]string{"team": "shared"},
+					ttl:          5 * time.Minute,
+				},
+				{
+					statsdMetric: "group.web.x",
+					name:         "group_b",
+					labels:       map[string]string{"team": "b", "service": "web"},
+				},
+			},
+		},
+		// Config with a mapping group without a name.
+		{
+			config: `groups:
+- mappings:
+  - match: group.*
+    name: "group"`,
+			configBad: true,
+		},
+		// Config with duplicate mapping groups.
+		{
+			config: `groups:
+- name: team-a
+  mappings:
+  - match: group.alpha.*
+    name: "group_a"
+- name: team-a
+  mappings:
+  - match: group.beta.*
+    name: "group_b"`,
+			configBad: true,
+		},
+		// Config with label placeholders in glob matches.
+		{
+			config: `mappings:
+- match: servers.<host>.<service>.cpu
+  name: "cpu"
+- match: servers.*.<service>.mem
+  name: "mem"
+  labels:
+    host: "$1"
+- match: jobs.<job>.*.duration
+  name: "${2}_job_duration"
+  labels:
+    job: "job_$1"
+`,
+			mappings: mappings{
+				{
+					statsdMetric: "servers.web01.nginx.cpu",
+					name:         "cpu",
+					labels:       map[string]string{"host": "web01", "service": "nginx"},
+				},
+				{
+					statsdMetric: "servers.web01.nginx.mem",
+					name:         "mem",
+					labels:       map[string]string{"host": "web01", "service": "nginx"},
+				},
+				{
+					statsdMetric: "jobs.backup.nightly.duration",
+					name:         "nightly_job_duration",
+					labels:       map[string]string{"job": "job_backup"},
+				},
+			},
+		},
+		// Config with an invalid label placeholder.
+		{
+			config: `mappings:
+- match: servers.<host-name>.cpu
+  name: "cpu"`,
+			configBad: true,
+		},
+		// Config with an unknown quantile algorithm.
+		{
+			config: `mappings:
+- match: sketch.*
+  name: "sketch"
+  summary_options:
+    algorithm: tdigest`,
+			configBad: true,
+		},
+		// Config with an out of range relative accuracy.
+		{
+			config: `mappings:
+- match: sketch.*
+  name: "sketch"
+  summary_options:
+    algorithm: ddsketch
+    relative_accuracy: 1.5`,
+			configBad: true,
+		},
+		// Config with an invalid label transform regex.
+		{
+			config: `mappings:
+- match: transform.*
+  name: "transform"
+  label_transforms:
+  - label: pod
+    regex: "(.*"`,
+			configBad: true,
+		},
 	}
 
 	mapper := MetricMapper{}
@@ -754,7 +1132,7 @@ mappings:
 			if mapType == "" {
 				mapType = MetricTypeCounter
 			}
-			m, labels, present := mapper.GetMapping(mapping.statsdMetric, mapType)
+			m, labels, present := mapper.GetMappingWithTags(mapping.statsdMetric, mapType, mapping.tags)
 			if present && mapping.name != "" && m.Name != mapping.name {
 				t.Fatalf("%d.%q: Expected name %v, got %v", i, metric, m.Name, mapping.name)
 			}
@@ -793,6 +1171,415 @@ mappings:
 	}
 }
 
+func TestFanOutExpansion(t *testing.T) {
+	config := `mappings:
+- match: fanout.*.*
+  name: "fanout_duration"
+  labels:
+    handler: "$1"
+  fan_out:
+  - name: "fanout_${2}_total"
+    metric_type: counter
+    labels:
+      handler: "$1"
+- match: fanregex\.(.*)\.(.*)
+  match_type: regex
+  name: "fanregex_duration"
+  fan_out:
+  - name: "fanregex_${2}_total"
+    labels:
+      handler: "$1"`
+
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 1000); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	scenarios := []struct {
+		statsdMetric string
+		name         string
+		outputName   string
+		outputLabels map[string]string
+	}{
+		{"fanout.login.status", "fanout_duration", "fanout_status_total", map[string]string{"handler": "login"}},
+		{"fanout.logout.result", "fanout_duration", "fanout_result_total", map[string]string{"handler": "logout"}},
+		{"fanregex.login.status", "fanregex_duration", "fanregex_status_total", map[string]string{"handler": "login"}},
+	}
+	// Run twice to also exercise cached results.
+	for run := 0; run < 2; run++ {
+		for i, s := range scenarios {
+			m, _, present := mapper.GetMapping(s.statsdMetric, MetricTypeTimer)
+			if !present {
+				t.Fatalf("%d.%d: Expected %s to match", run, i, s.statsdMetric)
+			}
+			if m.Name != s.name {
+				t.Fatalf("%d.%d: Expected name %s, got %s", run, i, s.name, m.Name)
+			}
+			if len(m.FanOut) != 1 {
+				t.Fatalf("%d.%d: Expected 1 fan-out output, got %d", run, i, len(m.FanOut))
+			}
+			output := m.FanOut[0]
+			if output.Name != s.outputName {
+				t.Fatalf("%d.%d: Expected output name %s, got %s", run, i, s.outputName, output.Name)
+			}
+			if len(output.Labels) != len(s.outputLabels) {
+				t.Fatalf("%d.%d: Expected output labels %v, got %v", run, i, s.outputLabels, output.Labels)
+			}
+			for label, value := range s.outputLabels {
+				if output.Labels[label] != value {
+					t.Fatalf("%d.%d: Expected output labels %v, got %v", run, i, s.outputLabels, output.Labels)
+				}
+			}
+		}
+	}
+}
+
+func TestJSONConfig(t *testing.T) {
+	config := `{
+	"defaults": {"ttl": "1m"},
+	"mappings": [
+		{
+			"match": "json.*.requests",
+			"name": "json_requests_total",
+			"labels": {"service": "$1"}
+		}
+	]
+}`
+
+	dir, err := ioutil.TempDir("", "mapper")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, fileName := range []string{"mapping.json", "mapping.conf"} {
+		path := filepath.Join(dir, fileName)
+		if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		mapper := MetricMapper{}
+		if err := mapper.InitFromFile(path, 0); err != nil {
+			t.Fatalf("%s: Config load error: %s", fileName, err)
+		}
+		m, labels, present := mapper.GetMapping("json.api.requests", MetricTypeCounter)
+		if !present {
+			t.Fatalf("%s: Expected json.api.requests to match", fileName)
+		}
+		if m.Name != "json_requests_total" || labels["service"] != "api" {
+			t.Fatalf("%s: Unexpected mapping %s %v", fileName, m.Name, labels)
+		}
+		if m.Ttl != time.Minute {
+			t.Fatalf("%s: Expected ttl of 1m, got %s", fileName, m.Ttl)
+		}
+	}
+
+	mapper := MetricMapper{}
+	if err := mapper.InitFromJSONString(`{"mappings": [}`, 0); err == nil {
+		t.Fatalf("Expected invalid JSON to be rejected")
+	}
+}
+
+func TestConvertLegacyConfig(t *testing.T) {
+	legacy := `# Dispatcher events
+test.dispatcher.*.*.*
+name="dispatcher_events_total"
+processor="$1"
+action="$2"
+
+*.signup.*.*
+name="signup_events_total"
+job="${1}_server"
+`
+	if !IsLegacyConfig(legacy) {
+		t.Fatalf("Expected config to be detected as legacy")
+	}
+	config, err := ConvertLegacyConfig(legacy)
+	if err != nil {
+		t.Fatalf("Conversion error: %s", err)
+	}
+	if IsLegacyConfig(config) {
+		t.Fatalf("Expected converted config not to be detected as legacy: %s", config)
+	}
+
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+	scenarios := []struct {
+		statsdMetric string
+		name         string
+		labels       map[string]string
+	}{
+		{"test.dispatcher.FooProcessor.send.success", "dispatcher_events_total", map[string]string{"processor": "FooProcessor", "action": "send"}},
+		{"foo_product.signup.facebook.failure", "signup_events_total", map[string]string{"job": "foo_product_server"}},
+	}
+	for i, s := range scenarios {
+		m, labels, present := mapper.GetMapping(s.statsdMetric, MetricTypeCounter)
+		if !present {
+			t.Fatalf("%d: Expected %s to match", i, s.statsdMetric)
+		}
+		if m.Name != s.name {
+			t.Fatalf("%d: Expected name %s, got %s", i, s.name, m.Name)
+		}
+		if len(labels) != len(s.labels) {
+			t.Fatalf("%d: Expected labels %v, got %v", i, s.labels, labels)
+		}
+		for label, value := range s.labels {
+			if labels[label] != value {
+				t.Fatalf("%d: Expected labels %v, got %v", i, s.labels, labels)
+			}
+		}
+	}
+
+	for _, bad := range []string{
+		"test.dispatcher.*\nprocessor=\"$1\"\n",
+		"test.dispatcher.*\nname=dispatcher\n",
+	} {
+		if _, err := ConvertLegacyConfig(bad); err == nil {
+			t.Fatalf("Expected conversion of %q to fail", bad)
+		}
+	}
+
+	// The mapping ends on the empty third line.
+	_, err = ConvertLegacyConfig("test.dispatcher.*\nprocessor=\"$1\"\n\ntest.other.*\nname=other\n")
+	if err == nil || !strings.HasPrefix(err.Error(), "line 3:") {
+		t.Fatalf("Expected an error on line 3, got %v", err)
+	}
+}
+
+func TestMappingErrorPosition(t *testing.T) {
+	scenarios := []struct {
+		config string
+		prefix string
+	}{
+		{
+			// The second mapping is tried first, but keeps its position.
+			config: "mappings:\n- match: test.api.*\n  name: a\n- match: test.web.*\n  priority: 1\n",
+			prefix: "mapping 2:",
+		},
+		{
+			config: "mappings:\n- match: test.api.*\n  name: a\n  value_rules:\n  - name: a_big\n  - when: \">1\"\n",
+			prefix: "mapping 1: value rule 1 ",
+		},
+		{
+			config: "groups:\n- name: api\n  mappings:\n  - match: test.api.*\n    name: a\n  - match: test.web.*\n    name: b\n    min_update_interval: -1s\n",
+			prefix: "group \"api\" mapping 2:",
+		},
+	}
+
+	for i, s := range scenarios {
+		mapper := MetricMapper{}
+		err := mapper.InitFromYAMLString(s.config, 0)
+		if err == nil || !strings.HasPrefix(err.Error(), s.prefix) {
+			t.Fatalf("%d: Expected an error starting with %q, got %v", i, s.prefix, err)
+		}
+	}
+}
+
+func TestDefaultTtl(t *testing.T) {
+	scenarios := []struct {
+		config string
+		ttl    time.Duration
+	}{
+		{"", time.Minute},
+		{"mappings:\n- match: ttl.*\n  name: \"ttl\"", time.Minute},
+		{"defaults:\n  ttl: 1h\nmappings:\n- match: ttl.*\n  name: \"ttl\"", time.Hour},
+		{"mappings:\n- match: ttl.*\n  name: \"ttl\"\n  ttl: 5s", 5 * time.Second},
+	}
+
+	for i, s := range scenarios {
+		mapper := MetricMapper{DefaultTtl: time.Minute}
+		if err := mapper.InitFromYAMLString(s.config, 0); err != nil {
+			t.Fatalf("%d: Config load error: %s %s", i, s.config, err)
+		}
+		ttl := mapper.Defaults.Ttl
+		if m, _, present := mapper.GetMapping("ttl.test", MetricTypeGauge); present {
+			ttl = m.Ttl
+		}
+		if ttl != s.ttl {
+			t.Fatalf("%d: Expected ttl of %s, got %s", i, s.ttl, ttl)
+		}
+	}
+}
+
+func TestDefaultBuckets(t *testing.T) {
+	buckets, err := ParseBuckets("0.5, 1,5")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing buckets: %v", err)
+	}
+	if !reflect.DeepEqual(buckets, []float64{0.5, 1, 5}) {
+		t.Fatalf("Unexpected buckets %v", buckets)
+	}
+	for _, bad := range []string{"", "1,a", "5,1", "1,1"} {
+		if _, err := ParseBuckets(bad); err == nil {
+			t.Fatalf("Expected buckets %q to be rejected", bad)
+		}
+	}
+
+	scenarios := []struct {
+		config  string
+		buckets []float64
+	}{
+		{"", buckets},
+		{"mappings:\n- match: buckets.*\n  name: \"buckets\"", buckets},
+		{"defaults:\n  buckets: [1, 2]\nmappings:\n- match: buckets.*\n  name: \"buckets\"", []float64{1, 2}},
+		{"mappings:\n- match: buckets.*\n  name: \"buckets\"\n  buckets: [3]", []float64{3}},
+	}
+
+	for i, s := range scenarios {
+		mapper := MetricMapper{DefaultBuckets: buckets}
+		if err := mapper.InitFromYAMLString(s.config, 0); err != nil {
+			t.Fatalf("%d: Config load error: %s %s", i, s.config, err)
+		}
+		got := mapper.Defaults.Buckets
+		if m, _, present := mapper.GetMapping("buckets.test", MetricTypeTimer); present {
+			got = m.Buckets
+		}
+		if !reflect.DeepEqual(got, s.buckets) {
+			t.Fatalf("%d: Expected buckets %v, got %v", i, s.buckets, got)
+		}
+	}
+}
+
+func TestDefaultQuantiles(t *testing.T) {
+	quantiles, err := ParseQuantiles("0.5,0.9, 0.99:0.005")
+	if err != nil {
+		t.Fatalf("Unexpected error parsing quantiles: %v", err)
+	}
+	expected := []metricObjective{{Quantile: 0.5, Error: 0.05}, {Quantile: 0.9, Error: 0.01}, {Quantile: 0.99, Error: 0.005}}
+	if !reflect.DeepEqual(quantiles, expected) {
+		t.Fatalf("Expected quantiles %v, got %v", expected, quantiles)
+	}
+	for _, bad := range []string{"", "1", "0.5:", "0.5:1", "a"} {
+		if _, err := ParseQuantiles(bad); err == nil {
+			t.Fatalf("Expected quantiles %q to be rejected", bad)
+		}
+	}
+
+	scenarios := []struct {
+		config    string
+		quantiles []metricObjective
+	}{
+		{"", expected},
+		{"defaults:\n  quantiles:\n  - quantile: 0.75\n    error: 0.02", []metricObjective{{Quantile: 0.75, Error: 0.02}}},
+	}
+	for i, s := range scenarios {
+		mapper := MetricMapper{DefaultQuantiles: expected}
+		if err := mapper.InitFromYAMLString(s.config, 0); err != nil {
+			t.Fatalf("%d: Config load error: %s %s", i, s.config, err)
+		}
+		if !reflect.DeepEqual(mapper.Defaults.Quantiles, s.quantiles) {
+			t.Fatalf("%d: Expected quantiles %v, got %v", i, s.quantiles, mapper.Defaults.Quantiles)
+		}
+	}
+}
+
+func TestSummaryOptions(t *testing.T) {
+	config := `defaults:
+  summary_options:
+    max_age: 30m
+    buf_cap: 1000
+mappings:
+- match: summary.default
+  name: "summary_default"
+- match: summary.custom
+  name: "summary_custom"
+  summary_options:
+    max_age: 1h
+    age_buckets: 3
+  fan_out:
+  - name: "summary_custom_output"
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	scenarios := []struct {
+		statsdMetric string
+		options      SummaryOptions
+	}{
+		{"summary.default", SummaryOptions{MaxAge: 30 * time.Minute, BufCap: 1000}},
+		{"summary.custom", SummaryOptions{MaxAge: time.Hour, AgeBuckets: 3, BufCap: 1000}},
+	}
+	for i, s := range scenarios {
+		m, _, present := mapper.GetMapping(s.statsdMetric, MetricTypeTimer)
+		if !present {
+			t.Fatalf("%d: Expected %s to match", i, s.statsdMetric)
+		}
+		if m.SummaryOptions != s.options {
+			t.Fatalf("%d: Expected summary options %+v, got %+v", i, s.options, m.SummaryOptions)
+		}
+		for _, output := range m.FanOut {
+			if output.SummaryOptions != s.options {
+				t.Fatalf("%d: Expected fan-out summary options %+v, got %+v", i, s.options, output.SummaryOptions)
+			}
+		}
+	}
+
+	bad := `mappings:
+- match: summary.negative
+  name: "summary_negative"
+  summary_options:
+    max_age: -1m`
+	if err := mapper.InitFromYAMLString(bad, 0); err == nil {
+		t.Fatalf("Expected negative max_age to be rejected")
+	}
+}
+
+func TestHistogramOptions(t *testing.T) {
+	config := `defaults:
+  histogram_options:
+    native_bucket_factor: 1.1
+    native_max_buckets: 100
+mappings:
+- match: histogram.default
+  name: "histogram_default"
+- match: histogram.custom
+  name: "histogram_custom"
+  histogram_options:
+    native_zero_threshold: 0.001
+    native_only: true
+  fan_out:
+  - name: "histogram_custom_output"
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	scenarios := []struct {
+		statsdMetric string
+		options      HistogramOptions
+	}{
+		{"histogram.default", HistogramOptions{NativeBucketFactor: 1.1, NativeMaxBuckets: 100}},
+		{"histogram.custom", HistogramOptions{NativeBucketFactor: 1.1, NativeZeroThreshold: 0.001, NativeMaxBuckets: 100, NativeOnly: true}},
+	}
+	for i, s := range scenarios {
+		m, _, present := mapper.GetMapping(s.statsdMetric, MetricTypeTimer)
+		if !present {
+			t.Fatalf("%d: Expected %s to match", i, s.statsdMetric)
+		}
+		if m.HistogramOptions != s.options {
+			t.Fatalf("%d: Expected histogram options %+v, got %+v", i, s.options, m.HistogramOptions)
+		}
+		for _, output := range m.FanOut {
+			if output.HistogramOptions != s.options {
+				t.Fatalf("%d: Expected fan-out histogram options %+v, got %+v", i, s.options, output.HistogramOptions)
+			}
+		}
+	}
+
+	for _, bad := range []string{
+		"mappings:\n- match: histogram.flat\n  name: histogram_flat\n  histogram_options:\n    native_bucket_factor: 1",
+		"mappings:\n- match: histogram.negative\n  name: histogram_negative\n  histogram_options:\n    native_bucket_factor: 2\n    native_zero_threshold: -1",
+	} {
+		if err := mapper.InitFromYAMLString(bad, 0); err == nil {
+			t.Fatalf("Expected %q to be rejected", bad)
+		}
+	}
+}
+
 func TestAction(t *testing.T) {
 	scenarios := []struct {
 		config         string
@@ -862,3 +1649,178 @@ mappings:
 		}
 	}
 }
+
+func TestBucketSpec(t *testing.T) {
+	config := `defaults:
+  bucket_spec:
+    type: exponential
+    min: 0.001
+    max: 0.01
+mappings:
+- match: buckets.default
+  name: "buckets_default"
+- match: buckets.log_linear
+  name: "buckets_log_linear"
+  bucket_spec:
+    type: log_linear
+    min: 0.1
+    max: 3
+  fan_out:
+  - name: "buckets_output"
+- match: buckets.steps
+  name: "buckets_steps"
+  bucket_spec:
+    type: log_linear
+    min: 1
+    max: 100
+    steps: 2
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	scenarios := []struct {
+		statsdMetric string
+		buckets      []float64
+	}{
+		{"buckets.default", []float64{0.001, 0.002, 0.004, 0.008, 0.016}},
+		{"buckets.log_linear", []float64{0.1, 0.2, 0.3, 0.4, 0.5, 0.6, 0.7, 0.8, 0.9, 1, 2, 3}},
+		{"buckets.steps", []float64{1, 5.5, 10, 55, 100}},
+	}
+	for i, s := range scenarios {
+		m, _, present := mapper.GetMapping(s.statsdMetric, MetricTypeTimer)
+		if !present {
+			t.Fatalf("%d: Expected %s to match", i, s.statsdMetric)
+		}
+		if !reflect.DeepEqual(m.Buckets, s.buckets) {
+			t.Fatalf("%d: Expected buckets %v, got %v", i, s.buckets, m.Buckets)
+		}
+		for _, output := range m.FanOut {
+			if !reflect.DeepEqual(output.Buckets, s.buckets) {
+				t.Fatalf("%d: Expected fan-out buckets %v, got %v", i, s.buckets, output.Buckets)
+			}
+		}
+	}
+
+	for i, config := range []string{
+		"mappings:\n- match: buckets.*\n  name: \"buckets\"\n  buckets: [1]\n  bucket_spec: {type: exponential, min: 1, max: 2}",
+		"mappings:\n- match: buckets.*\n  name: \"buckets\"\n  bucket_spec: {type: linear, min: 1, max: 2}",
+		"mappings:\n- match: buckets.*\n  name: \"buckets\"\n  bucket_spec: {type: exponential, min: 0, max: 2}",
+		"mappings:\n- match: buckets.*\n  name: \"buckets\"\n  bucket_spec: {type: exponential, min: 1, max: 2, factor: 1}",
+		"mappings:\n- match: buckets.*\n  name: \"buckets\"\n  bucket_spec: {type: exponential, min: 0.000001, max: 1000000, factor: 1.01}",
+	} {
+		if err := mapper.InitFromYAMLString(config, 0); err == nil {
+			t.Fatalf("%d: Expected config to be rejected: %s", i, config)
+		}
+	}
+}
+
+func TestRules(t *testing.T) {
+	config := `---
+mappings:
+- match: rules.low
+  name: "low"
+groups:
+- name: team
+  labels:
+    team: "rules"
+  mappings:
+  - match: "rules.*.high"
+    name: "high"
+    priority: 10
+`
+	mapper := MetricMapper{}
+	if err := mapper.InitFromYAMLString(config, 0); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	rules, err := mapper.Rules()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rules) != 2 {
+		t.Fatalf("Expected 2 rules, got %v", rules)
+	}
+	if rules[0].Key != "rules.*.high" || rules[1].Key != "rules.low" {
+		t.Fatalf("Expected the grouped rule with a higher priority first, got %v", rules)
+	}
+	if !strings.Contains(rules[0].Config, "name: high") || !strings.Contains(rules[0].Config, "team: rules") {
+		t.Fatalf("Expected the rule config to contain its name and group labels, got %s", rules[0].Config)
+	}
+
+	for _, s := range []struct {
+		statsdMetric string
+		position     int
+	}{
+		{"rules.x.high", 0},
+		{"rules.low", 1},
+	} {
+		m, _, present := mapper.GetMapping(s.statsdMetric, MetricTypeCounter)
+		if !present {
+			t.Fatalf("Expected %s to match", s.statsdMetric)
+		}
+		if m.Position() != s.position {
+			t.Fatalf("Expected %s to match rule %d, got %d", s.statsdMetric, s.position, m.Position())
+		}
+	}
+
+	defaults, err := mapper.DefaultsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(defaults, "match_type: glob") {
+		t.Fatalf("Expected the effective match type in the defaults, got %s", defaults)
+	}
+}
+
+func TestCacheTelemetry(t *testing.T) {
+	config := `
+mappings:
+- match: test.*
+  name: test_total
+- match: regex\.(.*)
+  match_type: regex
+  name: regex_total
+`
+	m := &MetricMapper{}
+	if err := m.InitFromYAMLString(config, 1); err != nil {
+		t.Fatalf("Config load error: %s %s", config, err)
+	}
+
+	counterValue := func(c prometheus.Counter) float64 {
+		var metric dto.Metric
+		if err := c.Write(&metric); err != nil {
+			t.Fatalf("Error writing counter: %v", err)
+		}
+		return metric.GetCounter().GetValue()
+	}
+	sampleCount := func(matchType string) uint64 {
+		var metric dto.Metric
+		if err := matchDuration.WithLabelValues(matchType).(prometheus.Histogram).Write(&metric); err != nil {
+			t.Fatalf("Error writing histogram: %v", err)
+		}
+		return metric.GetHistogram().GetSampleCount()
+	}
+	hits, misses := counterValue(cacheLookups.WithLabelValues("hit")), counterValue(cacheLookups.WithLabelValues("miss"))
+	evictions := counterValue(cacheEvictions)
+	globs, regexes, nones := sampleCount("glob"), sampleCount("regex"), sampleCount("none")
+
+	m.GetMapping("test.a", MetricTypeCounter)
+	m.GetMapping("test.a", MetricTypeCounter)
+	m.GetMapping("regex.a", MetricTypeCounter)
+	m.GetMapping("other", MetricTypeCounter)
+
+	if v := counterValue(cacheLookups.WithLabelValues("hit")) - hits; v != 1 {
+		t.Errorf("Expected 1 cache hit, got %v", v)
+	}
+	if v := counterValue(cacheLookups.WithLabelValues("miss")) - misses; v != 3 {
+		t.Errorf("Expected 3 cache misses, got %v", v)
+	}
+	if v := counterValue(cacheEvictions) - evictions; v != 2 {
+		t.Errorf("Expected 2 cache evictions, got %v", v)
+	}
+	if sampleCount("glob")-globs != 1 || sampleCount("regex")-regexes != 1 || sampleCount("none")-nones != 1 {
+		t.Errorf("Expected 1 uncached match of each type")
+	}
+}
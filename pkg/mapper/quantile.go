@@ -0,0 +1,72 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// QuantileAlgorithm selects how summaries estimate their quantiles.
+type QuantileAlgorithm string
+
+const (
+	// The targeted quantiles algorithm of the client library, whose error
+	// is bounded in rank for each configured quantile.
+	QuantileAlgorithmCKMS QuantileAlgorithm = "ckms"
+	// DDSketch, whose error is bounded relative to the value of any
+	// quantile, which suits heavy-tailed distributions.
+	QuantileAlgorithmDDSketch QuantileAlgorithm = "ddsketch"
+	QuantileAlgorithmDefault  QuantileAlgorithm = ""
+)
+
+func (a *QuantileAlgorithm) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch QuantileAlgorithm(v) {
+	case QuantileAlgorithmCKMS, QuantileAlgorithmDDSketch:
+		*a = QuantileAlgorithm(v)
+	case QuantileAlgorithmDefault:
+		*a = QuantileAlgorithmCKMS
+	default:
+		return fmt.Errorf("invalid quantile algorithm '%s'", v)
+	}
+	return nil
+}
+
+// ParseQuantiles parses a comma separated list of quantile objectives, each a
+// quantile optionally followed by a colon and its allowed error, like
+// "0.5,0.99:0.001". The error defaults to a tenth of the distance to 1.
+func ParseQuantiles(list string) ([]metricObjective, error) {
+	var quantiles []metricObjective
+	for _, field := range strings.Split(list, ",") {
+		parts := strings.SplitN(strings.TrimSpace(field), ":", 2)
+		q, err := strconv.ParseFloat(parts[0], 64)
+		if err != nil || q <= 0 || q >= 1 {
+			return nil, fmt.Errorf("invalid quantile %q", field)
+		}
+		e := roundBound((1 - q) / 10)
+		if len(parts) == 2 {
+			if e, err = strconv.ParseFloat(parts[1], 64); err != nil || e <= 0 || e >= 1 {
+				return nil, fmt.Errorf("invalid quantile error %q", field)
+			}
+		}
+		quantiles = append(quantiles, metricObjective{Quantile: q, Error: e})
+	}
+	return quantiles, nil
+}
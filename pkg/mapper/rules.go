@@ -0,0 +1,71 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Rule is a loaded mapping rule, rendered in the configuration format.
+type Rule struct {
+	// Position is the position of the rule in the order rules are tried,
+	// once groups are flattened and rules sorted by priority.
+	Position int    `json:"position"`
+	Key      string `json:"key"`
+	Config   string `json:"config"`
+}
+
+// Rules returns the loaded mapping rules, in the order they are tried.
+func (m *MetricMapper) Rules() ([]Rule, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	rules := make([]Rule, 0, len(m.Mappings))
+	for i := range m.Mappings {
+		config, err := yaml.Marshal(&m.Mappings[i])
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, Rule{Position: i, Key: RuleKey(&m.Mappings[i]), Config: string(config)})
+	}
+	return rules, nil
+}
+
+// DefaultsConfig returns the loaded defaults, including those set by flags,
+// rendered in the configuration format.
+func (m *MetricMapper) DefaultsConfig() (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	config, err := yaml.Marshal(&m.Defaults)
+	return string(config), err
+}
+
+// Config returns the loaded configuration, with groups flattened into the
+// mappings and the defaults set by flags, rendered in the configuration
+// format.
+func (m *MetricMapper) Config() (string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	config, err := yaml.Marshal(&struct {
+		Defaults mapperConfigDefaults `yaml:"defaults"`
+		Mappings []MetricMapping      `yaml:"mappings"`
+	}{m.Defaults, m.Mappings})
+	return string(config), err
+}
+
+// Position returns the position of the rule a mapping returned by GetMapping
+// was expanded from, as in Rules.
+func (m *MetricMapping) Position() int {
+	return m.order
+}
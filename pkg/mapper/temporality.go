@@ -0,0 +1,72 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import "fmt"
+
+// Temporality decides whether counters report their running total or only
+// the increments since the previous collection.
+type Temporality string
+
+const (
+	TemporalityCumulative Temporality = "cumulative"
+	TemporalityDelta      Temporality = "delta"
+	TemporalityDefault    Temporality = ""
+)
+
+func (t *Temporality) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch Temporality(v) {
+	case TemporalityDelta:
+		*t = TemporalityDelta
+	case TemporalityCumulative, TemporalityDefault:
+		*t = TemporalityCumulative
+	default:
+		return fmt.Errorf("invalid temporality '%s'", v)
+	}
+	return nil
+}
+
+// CounterMode tells how to interpret the values of StatsD counters.
+type CounterMode string
+
+const (
+	// Counter values are increments, as StatsD intends.
+	CounterModeIncrement CounterMode = "increment"
+	// Counter values are running totals kept by the client, which start
+	// over when the client restarts.
+	CounterModeCumulative CounterMode = "cumulative"
+	CounterModeDefault    CounterMode = ""
+)
+
+func (m *CounterMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	switch CounterMode(v) {
+	case CounterModeCumulative:
+		*m = CounterModeCumulative
+	case CounterModeIncrement, CounterModeDefault:
+		*m = CounterModeIncrement
+	default:
+		return fmt.Errorf("invalid counter mode '%s'", v)
+	}
+	return nil
+}
@@ -20,7 +20,10 @@ type TimerType string
 const (
 	TimerTypeHistogram TimerType = "histogram"
 	TimerTypeSummary   TimerType = "summary"
-	TimerTypeDefault   TimerType = ""
+	// Timers are exposed as the classic StatsD statistics over each scrape
+	// interval.
+	TimerTypeStatistics TimerType = "statistics"
+	TimerTypeDefault    TimerType = ""
 )
 
 func (t *TimerType) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -32,6 +35,8 @@ func (t *TimerType) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	switch TimerType(v) {
 	case TimerTypeHistogram:
 		*t = TimerTypeHistogram
+	case TimerTypeStatistics:
+		*t = TimerTypeStatistics
 	case TimerTypeSummary, TimerTypeDefault:
 		*t = TimerTypeSummary
 	default:
@@ -0,0 +1,86 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"strings"
+)
+
+type UnitType string
+
+const (
+	UnitTypeMicroseconds UnitType = "us"
+	UnitTypeMilliseconds UnitType = "ms"
+	UnitTypeSeconds      UnitType = "s"
+	UnitTypeBytes        UnitType = "bytes"
+	UnitTypeKibibytes    UnitType = "KiB"
+	UnitTypeMebibytes    UnitType = "MiB"
+	UnitTypePercent      UnitType = "percent"
+	UnitTypeDefault      UnitType = ""
+)
+
+type unit struct {
+	scale  float64
+	suffix string
+}
+
+// units maps every unit to the factor converting it into the Prometheus base
+// unit, and the metric name suffix of that base unit.
+var units = map[UnitType]unit{
+	UnitTypeMicroseconds: {scale: 1e-6, suffix: "_seconds"},
+	UnitTypeMilliseconds: {scale: 1e-3, suffix: "_seconds"},
+	UnitTypeSeconds:      {scale: 1, suffix: "_seconds"},
+	UnitTypeBytes:        {scale: 1, suffix: "_bytes"},
+	UnitTypeKibibytes:    {scale: 1024, suffix: "_bytes"},
+	UnitTypeMebibytes:    {scale: 1024 * 1024, suffix: "_bytes"},
+	UnitTypePercent:      {scale: 0.01, suffix: "_ratio"},
+}
+
+func (t *UnitType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	if _, ok := units[UnitType(v)]; !ok && UnitType(v) != UnitTypeDefault {
+		return fmt.Errorf("invalid unit '%s'", v)
+	}
+	*t = UnitType(v)
+	return nil
+}
+
+// Scale returns the factor converting a value in this unit into the base
+// unit. It is 1 if no unit is set.
+func (t UnitType) Scale() float64 {
+	if u, ok := units[t]; ok {
+		return u.scale
+	}
+	return 1
+}
+
+// withUnitSuffix appends the base unit suffix of the given unit to a metric
+// name, keeping a trailing "_total" at the end. Names that already carry the
+// suffix are left unchanged.
+func withUnitSuffix(name string, t UnitType) string {
+	u, ok := units[t]
+	if !ok {
+		return name
+	}
+	base := strings.TrimSuffix(name, "_total")
+	if strings.HasSuffix(base, u.suffix) {
+		return name
+	}
+	return base + u.suffix + name[len(base):]
+}
@@ -0,0 +1,86 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mapper
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper/fsm"
+)
+
+// ValueRule drops or renames samples whose value satisfies a condition.
+type ValueRule struct {
+	When          ValueCondition `yaml:"when"`
+	Action        ActionType     `yaml:"action"`
+	Name          string         `yaml:"name"`
+	nameFormatter *fsm.TemplateFormatter
+}
+
+// ValueCondition compares a sample value against a constant, e.g. ">= 100".
+type ValueCondition struct {
+	op    string
+	value float64
+}
+
+var valueConditionOps = []string{"<=", ">=", "==", "!=", "<", ">"}
+
+func (c *ValueCondition) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var v string
+	if err := unmarshal(&v); err != nil {
+		return err
+	}
+
+	s := strings.TrimSpace(v)
+	for _, op := range valueConditionOps {
+		if strings.HasPrefix(s, op) {
+			value, err := strconv.ParseFloat(strings.TrimSpace(s[len(op):]), 64)
+			if err != nil {
+				return fmt.Errorf("invalid value condition '%s': %v", v, err)
+			}
+			c.op = op
+			c.value = value
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid value condition '%s'", v)
+}
+
+// Matches reports whether the given value satisfies the condition.
+func (c ValueCondition) Matches(v float64) bool {
+	switch c.op {
+	case "<":
+		return v < c.value
+	case "<=":
+		return v <= c.value
+	case ">":
+		return v > c.value
+	case ">=":
+		return v >= c.value
+	case "==":
+		return v == c.value
+	case "!=":
+		return v != c.value
+	}
+	return false
+}
+
+func (c ValueCondition) String() string {
+	return fmt.Sprintf("%s %g", c.op, c.value)
+}
+
+func (c ValueCondition) MarshalYAML() (interface{}, error) {
+	return c.String(), nil
+}
@@ -0,0 +1,292 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: subscription.proto
+
+package subscription
+
+import (
+	context "context"
+	fmt "fmt"
+	proto "github.com/golang/protobuf/proto"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+	math "math"
+)
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion3 // please upgrade the proto package
+
+type SubscribeRequest struct {
+	// The names of the metrics to stream, or all metrics if empty.
+	Names []string `protobuf:"bytes,1,rep,name=names,proto3" json:"names,omitempty"`
+	// The labels the streamed series must have.
+	Labels               map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	XXX_NoUnkeyedLiteral struct{}          `json:"-"`
+	XXX_unrecognized     []byte            `json:"-"`
+	XXX_sizecache        int32             `json:"-"`
+}
+
+func (m *SubscribeRequest) Reset()         { *m = SubscribeRequest{} }
+func (m *SubscribeRequest) String() string { return proto.CompactTextString(m) }
+func (*SubscribeRequest) ProtoMessage()    {}
+func (*SubscribeRequest) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c4f8ad1a64b2bad6, []int{0}
+}
+
+func (m *SubscribeRequest) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_SubscribeRequest.Unmarshal(m, b)
+}
+func (m *SubscribeRequest) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_SubscribeRequest.Marshal(b, m, deterministic)
+}
+func (m *SubscribeRequest) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_SubscribeRequest.Merge(m, src)
+}
+func (m *SubscribeRequest) XXX_Size() int {
+	return xxx_messageInfo_SubscribeRequest.Size(m)
+}
+func (m *SubscribeRequest) XXX_DiscardUnknown() {
+	xxx_messageInfo_SubscribeRequest.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_SubscribeRequest proto.InternalMessageInfo
+
+func (m *SubscribeRequest) GetNames() []string {
+	if m != nil {
+		return m.Names
+	}
+	return nil
+}
+
+func (m *SubscribeRequest) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+// MetricUpdate is an event after mapping.
+type MetricUpdate struct {
+	// The name, labels and type the event was mapped to.
+	Name   string            `protobuf:"bytes,1,opt,name=name,proto3" json:"name,omitempty"`
+	Labels map[string]string `protobuf:"bytes,2,rep,name=labels,proto3" json:"labels,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	Type   string            `protobuf:"bytes,3,opt,name=type,proto3" json:"type,omitempty"`
+	// The value of the sample, and its time in milliseconds since the epoch,
+	// which is the time it was received unless the line was timestamped.
+	Value                float64  `protobuf:"fixed64,4,opt,name=value,proto3" json:"value,omitempty"`
+	TimestampMs          int64    `protobuf:"varint,5,opt,name=timestamp_ms,json=timestampMs,proto3" json:"timestamp_ms,omitempty"`
+	XXX_NoUnkeyedLiteral struct{} `json:"-"`
+	XXX_unrecognized     []byte   `json:"-"`
+	XXX_sizecache        int32    `json:"-"`
+}
+
+func (m *MetricUpdate) Reset()         { *m = MetricUpdate{} }
+func (m *MetricUpdate) String() string { return proto.CompactTextString(m) }
+func (*MetricUpdate) ProtoMessage()    {}
+func (*MetricUpdate) Descriptor() ([]byte, []int) {
+	return fileDescriptor_c4f8ad1a64b2bad6, []int{1}
+}
+
+func (m *MetricUpdate) XXX_Unmarshal(b []byte) error {
+	return xxx_messageInfo_MetricUpdate.Unmarshal(m, b)
+}
+func (m *MetricUpdate) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	return xxx_messageInfo_MetricUpdate.Marshal(b, m, deterministic)
+}
+func (m *MetricUpdate) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_MetricUpdate.Merge(m, src)
+}
+func (m *MetricUpdate) XXX_Size() int {
+	return xxx_messageInfo_MetricUpdate.Size(m)
+}
+func (m *MetricUpdate) XXX_DiscardUnknown() {
+	xxx_messageInfo_MetricUpdate.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_MetricUpdate proto.InternalMessageInfo
+
+func (m *MetricUpdate) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *MetricUpdate) GetLabels() map[string]string {
+	if m != nil {
+		return m.Labels
+	}
+	return nil
+}
+
+func (m *MetricUpdate) GetType() string {
+	if m != nil {
+		return m.Type
+	}
+	return ""
+}
+
+func (m *MetricUpdate) GetValue() float64 {
+	if m != nil {
+		return m.Value
+	}
+	return 0
+}
+
+func (m *MetricUpdate) GetTimestampMs() int64 {
+	if m != nil {
+		return m.TimestampMs
+	}
+	return 0
+}
+
+func init() {
+	proto.RegisterType((*SubscribeRequest)(nil), "statsd_exporter.subscription.SubscribeRequest")
+	proto.RegisterMapType((map[string]string)(nil), "statsd_exporter.subscription.SubscribeRequest.LabelsEntry")
+	proto.RegisterType((*MetricUpdate)(nil), "statsd_exporter.subscription.MetricUpdate")
+	proto.RegisterMapType((map[string]string)(nil), "statsd_exporter.subscription.MetricUpdate.LabelsEntry")
+}
+
+func init() { proto.RegisterFile("subscription.proto", fileDescriptor_c4f8ad1a64b2bad6) }
+
+var fileDescriptor_c4f8ad1a64b2bad6 = []byte{
+	// 294 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xa4, 0x92, 0x4f, 0x4b, 0xc3, 0x40,
+	0x10, 0xc5, 0xd9, 0xa6, 0x2d, 0x74, 0x1b, 0xa5, 0x0c, 0x1e, 0x96, 0xe2, 0x21, 0xf6, 0x14, 0x3c,
+	0x2c, 0x52, 0x41, 0xb4, 0x47, 0xc1, 0x9b, 0xf5, 0xb0, 0xc5, 0x8b, 0x97, 0xb2, 0x69, 0xe7, 0x10,
+	0xcc, 0x9f, 0x75, 0x77, 0x22, 0xc6, 0x2f, 0xe6, 0x77, 0xf3, 0x24, 0xf9, 0x43, 0x0d, 0x45, 0x8a,
+	0xe2, 0xed, 0xcd, 0x4b, 0xe6, 0xcd, 0x6f, 0x67, 0x97, 0x83, 0x2b, 0x22, 0xb7, 0xb1, 0xb1, 0xa1,
+	0x38, 0xcf, 0xa4, 0xb1, 0x39, 0xe5, 0x70, 0xea, 0x48, 0x93, 0xdb, 0xae, 0xf1, 0xcd, 0xe4, 0x96,
+	0xd0, 0xca, 0xee, 0x3f, 0xb3, 0x0f, 0xc6, 0x27, 0xab, 0xc6, 0x88, 0x50, 0xe1, 0x4b, 0x81, 0x8e,
+	0xe0, 0x84, 0x0f, 0x32, 0x9d, 0xa2, 0x13, 0x2c, 0xf0, 0xc2, 0x91, 0x6a, 0x0a, 0x50, 0x7c, 0x98,
+	0xe8, 0x08, 0x13, 0x27, 0x7a, 0x81, 0x17, 0x8e, 0xe7, 0x0b, 0x79, 0x28, 0x59, 0xee, 0xa7, 0xca,
+	0xfb, 0xba, 0xf9, 0x2e, 0x23, 0x5b, 0xaa, 0x36, 0x69, 0x7a, 0xc3, 0xc7, 0x1d, 0x1b, 0x26, 0xdc,
+	0x7b, 0xc6, 0x52, 0xb0, 0x80, 0x85, 0x23, 0x55, 0xc9, 0x0a, 0xe5, 0x55, 0x27, 0x05, 0x8a, 0x5e,
+	0xed, 0x35, 0xc5, 0xa2, 0x77, 0xcd, 0x66, 0x9f, 0x8c, 0xfb, 0x4b, 0x24, 0x1b, 0x6f, 0x1e, 0xcd,
+	0x56, 0x13, 0x02, 0xf0, 0x7e, 0x05, 0xda, 0x76, 0xd7, 0x1a, 0x1e, 0xf6, 0x98, 0xaf, 0x0e, 0x33,
+	0x77, 0xf3, 0x7e, 0xe2, 0xad, 0x66, 0x50, 0x69, 0x50, 0x78, 0xcd, 0x8c, 0x4a, 0x7f, 0x23, 0xf6,
+	0x03, 0x16, 0xb2, 0x16, 0x11, 0xce, 0xb8, 0x4f, 0x71, 0x8a, 0x8e, 0x74, 0x6a, 0xd6, 0xa9, 0x13,
+	0x83, 0x80, 0x85, 0x9e, 0x1a, 0xef, 0xbc, 0xe5, 0x7f, 0x0e, 0x3f, 0x7f, 0xe7, 0x47, 0xab, 0x0e,
+	0xb8, 0x83, 0x98, 0x8f, 0x76, 0x0b, 0x07, 0xf9, 0xb7, 0x9b, 0x99, 0x9e, 0xff, 0x7e, 0x2b, 0x17,
+	0xec, 0xf6, 0xf8, 0xc9, 0xef, 0x7e, 0x8e, 0x86, 0xf5, 0x3b, 0xbb, 0xfc, 0x1a, 0x00, 0xf4, 0xd4,
+	0x8c, 0xdf, 0x7d, 0x02, 0x00, 0x00,
+}
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ context.Context
+var _ grpc.ClientConn
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion4
+
+// SubscriptionsClient is the client API for Subscriptions service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://godoc.org/google.golang.org/grpc#ClientConn.NewStream.
+type SubscriptionsClient interface {
+	// Subscribe streams the updates of the metrics selected by the request,
+	// until the client cancels it.
+	Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Subscriptions_SubscribeClient, error)
+}
+
+type subscriptionsClient struct {
+	cc *grpc.ClientConn
+}
+
+func NewSubscriptionsClient(cc *grpc.ClientConn) SubscriptionsClient {
+	return &subscriptionsClient{cc}
+}
+
+func (c *subscriptionsClient) Subscribe(ctx context.Context, in *SubscribeRequest, opts ...grpc.CallOption) (Subscriptions_SubscribeClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_Subscriptions_serviceDesc.Streams[0], "/statsd_exporter.subscription.Subscriptions/Subscribe", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &subscriptionsSubscribeClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Subscriptions_SubscribeClient interface {
+	Recv() (*MetricUpdate, error)
+	grpc.ClientStream
+}
+
+type subscriptionsSubscribeClient struct {
+	grpc.ClientStream
+}
+
+func (x *subscriptionsSubscribeClient) Recv() (*MetricUpdate, error) {
+	m := new(MetricUpdate)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// SubscriptionsServer is the server API for Subscriptions service.
+type SubscriptionsServer interface {
+	// Subscribe streams the updates of the metrics selected by the request,
+	// until the client cancels it.
+	Subscribe(*SubscribeRequest, Subscriptions_SubscribeServer) error
+}
+
+// UnimplementedSubscriptionsServer can be embedded to have forward compatible implementations.
+type UnimplementedSubscriptionsServer struct {
+}
+
+func (*UnimplementedSubscriptionsServer) Subscribe(req *SubscribeRequest, srv Subscriptions_SubscribeServer) error {
+	return status.Errorf(codes.Unimplemented, "method Subscribe not implemented")
+}
+
+func RegisterSubscriptionsServer(s *grpc.Server, srv SubscriptionsServer) {
+	s.RegisterService(&_Subscriptions_serviceDesc, srv)
+}
+
+func _Subscriptions_Subscribe_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(SubscribeRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(SubscriptionsServer).Subscribe(m, &subscriptionsSubscribeServer{stream})
+}
+
+type Subscriptions_SubscribeServer interface {
+	Send(*MetricUpdate) error
+	grpc.ServerStream
+}
+
+type subscriptionsSubscribeServer struct {
+	grpc.ServerStream
+}
+
+func (x *subscriptionsSubscribeServer) Send(m *MetricUpdate) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+var _Subscriptions_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "statsd_exporter.subscription.Subscriptions",
+	HandlerType: (*SubscriptionsServer)(nil),
+	Methods:     []grpc.MethodDesc{},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "Subscribe",
+			Handler:       _Subscriptions_Subscribe_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "subscription.proto",
+}
@@ -0,0 +1,92 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// preregisterMetrics creates the metrics of the mappings that match a single
+// StatsD metric, so that they are exposed with zero values before the first
+// sample arrives. Mappings that don't set a metric type, or match one, are
+// skipped as the type of their metric isn't known in advance.
+func (b *Exporter) preregisterMetrics() {
+	b.registry.mtx.Lock()
+	defer b.registry.mtx.Unlock()
+
+	for _, mapping := range b.mapper.StaticMappings() {
+		metricType := mapping.MetricType
+		if metricType == "" {
+			metricType = mapping.MatchMetricType
+		}
+		if metricType != "" {
+			b.preregisterMetric(&mapping, mapping.Name, mapping.Labels, metricType)
+		}
+		for i := range mapping.FanOut {
+			output := &mapping.FanOut[i]
+			outputType := output.MetricType
+			if outputType == "" {
+				outputType = metricType
+			}
+			if outputType != "" {
+				b.preregisterMetric(output, output.Name, output.Labels, outputType)
+			}
+		}
+	}
+}
+
+func (b *Exporter) preregisterMetric(mapping *mapper.MetricMapping, metricName string, mappingLabels prometheus.Labels, metricType mapper.MetricType) {
+	labels := make(prometheus.Labels, len(mappingLabels))
+	for k, v := range mappingLabels {
+		labels[k] = v
+	}
+	for i := range mapping.LabelTransforms {
+		transform := &mapping.LabelTransforms[i]
+		if value, ok := labels[transform.Label]; ok {
+			labels[transform.Label] = transform.Apply(value)
+		}
+	}
+	labels = b.addSourceLabels(labels)
+	help := defaultHelp
+	if mapping.HelpText != "" {
+		help = mapping.HelpText
+	}
+
+	var err error
+	switch metricType {
+	case mapper.MetricTypeCounter:
+		if mapping.Temporality == mapper.TemporalityDelta {
+			_, err = b.registry.getGauge(metricName, labels, help, mapping, true)
+		} else {
+			_, err = b.registry.getCounter(metricName, labels, help, mapping, true)
+		}
+	case mapper.MetricTypeGauge:
+		_, err = b.registry.getGauge(metricName, labels, help, mapping, true)
+	case mapper.MetricTypeTimer:
+		switch mapping.TimerType {
+		case mapper.TimerTypeHistogram:
+			_, err = b.registry.getHistogram(metricName, labels, help, mapping, true)
+		case mapper.TimerTypeStatistics:
+			// The statistics are only meaningful once samples arrive.
+		default:
+			_, err = b.registry.getSummary(metricName, labels, help, mapping, true)
+		}
+	}
+	if err != nil {
+		log.Warnf("Error preregistering metric %s: %v", metricName, err)
+	}
+}
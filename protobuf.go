@@ -0,0 +1,61 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The helpers below encode fields of protobuf messages by hand, for the push
+// protocols whose generated code isn't vendored.
+
+func pbString(b *proto.Buffer, field uint64, s string) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeStringBytes(s)
+}
+
+func pbBytes(b *proto.Buffer, field uint64, v []byte) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeRawBytes(v)
+}
+
+func pbMessage(b *proto.Buffer, field uint64, m *proto.Buffer) {
+	b.EncodeVarint(field<<3 | proto.WireBytes)
+	b.EncodeRawBytes(m.Bytes())
+}
+
+func pbVarint(b *proto.Buffer, field, v uint64) {
+	b.EncodeVarint(field<<3 | proto.WireVarint)
+	b.EncodeVarint(v)
+}
+
+func pbFixed64(b *proto.Buffer, field, v uint64) {
+	b.EncodeVarint(field<<3 | proto.WireFixed64)
+	b.EncodeFixed64(v)
+}
+
+func pbDouble(b *proto.Buffer, field uint64, f float64) {
+	pbFixed64(b, field, math.Float64bits(f))
+}
+
+// pbPackedFixed64 encodes a packed repeated fixed64 or double field.
+func pbPackedFixed64(b *proto.Buffer, field uint64, values []uint64) {
+	packed := proto.NewBuffer(make([]byte, 0, 8*len(values)))
+	for _, v := range values {
+		packed.EncodeFixed64(v)
+	}
+	pbMessage(b, field, packed)
+}
@@ -0,0 +1,132 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+)
+
+// pushgatewayTimeout is the timeout of pushes to the Pushgateway.
+const pushgatewayTimeout = 10 * time.Second
+
+// pushgatewayPusher periodically replaces the metrics of a group on a
+// Pushgateway with those of the exporter, for batch jobs that exit before
+// they are scraped.
+type pushgatewayPusher struct {
+	// The URL of the group, including the job and grouping labels.
+	url      string
+	interval time.Duration
+	client   *http.Client
+	exporter *Exporter
+	gatherer prometheus.Gatherer
+}
+
+// pushgatewayGroupURL returns the URL of the group with the given job and
+// grouping labels on the Pushgateway at baseURL.
+func pushgatewayGroupURL(baseURL, job string, grouping map[string]string) (string, error) {
+	if job == "" {
+		return "", fmt.Errorf("the Pushgateway job must not be empty")
+	}
+	groupURL := strings.TrimSuffix(baseURL, "/") + "/metrics/" + pushgatewayPathSegment("job", job)
+
+	names := make([]string, 0, len(grouping))
+	for name := range grouping {
+		if name == "job" || !model.LabelName(name).IsValid() {
+			return "", fmt.Errorf("invalid grouping label %q", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		groupURL += "/" + pushgatewayPathSegment(name, grouping[name])
+	}
+	return groupURL, nil
+}
+
+// pushgatewayPathSegment returns a label as path segments, with the value
+// base64 encoded if it would otherwise be misread.
+func pushgatewayPathSegment(name, value string) string {
+	if value == "" || strings.Contains(value, "/") {
+		encoded := base64.RawURLEncoding.EncodeToString([]byte(value))
+		if encoded == "" {
+			encoded = "="
+		}
+		return name + "@base64/" + encoded
+	}
+	return name + "/" + url.PathEscape(value)
+}
+
+// run pushes the metrics every interval.
+func (p *pushgatewayPusher) run() {
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := p.push(); err != nil {
+			log.Warnln("Error pushing to the Pushgateway:", err)
+		}
+	}
+}
+
+// push replaces the metrics of the group with the current ones.
+func (p *pushgatewayPusher) push() error {
+	p.exporter.prepareCollection()
+	families, err := p.gatherer.Gather()
+	if err != nil {
+		log.Warnln("Error gathering metrics to push:", err)
+	}
+
+	var body bytes.Buffer
+	enc := expfmt.NewEncoder(&body, expfmt.FmtText)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest(http.MethodPut, p.url, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", string(expfmt.FmtText))
+	resp, err := p.client.Do(req)
+	if err != nil {
+		pushgatewayPushes.WithLabelValues("failed").Inc()
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		pushgatewayPushes.WithLabelValues("failed").Inc()
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	pushgatewayPushes.WithLabelValues("succeeded").Inc()
+	return nil
+}
@@ -15,10 +15,16 @@ package main
 
 import (
 	"bytes"
+	"container/list"
+	"errors"
 	"fmt"
 	"hash"
 	"hash/fnv"
+	"math"
+	"reflect"
 	"sort"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -48,17 +54,102 @@ type labelHash struct {
 type metricHolder interface{}
 
 type registeredMetric struct {
-	lastRegisteredAt time.Time
-	labels           prometheus.Labels
-	ttl              time.Duration
-	metric           metricHolder
-	vecKey           nameHash
+	// The time of the latest update in nanoseconds, set atomically since
+	// events update series under the registry's read lock.
+	lastRegistered int64
+	createdAt      time.Time
+	labels         prometheus.Labels
+	ttl            time.Duration
+	metric         metricHolder
+	vecKey         nameHash
+	// Position in the registry's lru list, if it keeps one.
+	lruElement *list.Element
+}
+
+// lastRegisteredAt returns the time of the latest update of the series.
+func (rm *registeredMetric) lastRegisteredAt() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&rm.lastRegistered))
+}
+
+func (rm *registeredMetric) touch(now time.Time) {
+	atomic.StoreInt64(&rm.lastRegistered, now.UnixNano())
+}
+
+// seriesRef identifies a series in the registry.
+type seriesRef struct {
+	metricName string
+	hash       valueHash
+}
+
+// seriesLimitPolicy decides what happens to new series once the registry
+// holds the maximum number of series.
+type seriesLimitPolicy string
+
+const (
+	seriesLimitReject seriesLimitPolicy = "reject"
+	seriesLimitEvict  seriesLimitPolicy = "evict"
+)
+
+var errSeriesLimit = errors.New("maximum number of series reached")
+
+// errNeedsWriteLock is returned when recording an event would create a
+// series, which needs the registry's write lock, under its read lock.
+var errNeedsWriteLock = errors.New("registry write lock needed")
+
+// gaugeWindow aggregates the samples of a gauge until the next publication,
+// or until its minimum update interval has passed.
+type gaugeWindow struct {
+	aggregation mapper.GaugeAggregation
+	interval    time.Duration
+	published   time.Time
+	// The value of the gauge after the latest sample, which relative
+	// samples apply to.
+	current float64
+	count   int
+	value   float64
+}
+
+func (w *gaugeWindow) observe(value float64) {
+	switch {
+	case w.count == 0, w.aggregation == mapper.GaugeAggregationLast, w.aggregation == mapper.GaugeAggregationDefault:
+		w.value = value
+	case w.aggregation == mapper.GaugeAggregationMin:
+		w.value = math.Min(w.value, value)
+	case w.aggregation == mapper.GaugeAggregationMax:
+		w.value = math.Max(w.value, value)
+	default:
+		w.value += value
+	}
+	w.count++
+}
+
+// due reports whether the window has samples to publish.
+func (w *gaugeWindow) due(now time.Time) bool {
+	return w.count > 0 && !now.Before(w.published.Add(w.interval))
+}
+
+func (w *gaugeWindow) publish(g prometheus.Gauge, now time.Time) {
+	value := w.value
+	if w.aggregation == mapper.GaugeAggregationMean {
+		value /= float64(w.count)
+	}
+	g.Set(value)
+	w.count = 0
+	w.published = now
 }
 
 type vectorHolder interface {
 	Delete(label prometheus.Labels) bool
 }
 
+// observerVec is implemented by the vectors of summaries, whichever
+// algorithm estimates their quantiles, and of histograms.
+type observerVec interface {
+	prometheus.Collector
+	vectorHolder
+	GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error)
+}
+
 type vector struct {
 	holder   vectorHolder
 	refCount uint64
@@ -66,28 +157,236 @@ type vector struct {
 
 type metric struct {
 	metricType metricType
+	help       string
 	// Vectors key is the hash of the label names
 	vectors map[nameHash]*vector
 	// Metrics key is a hash of the label names + label values
 	metrics map[valueHash]*registeredMetric
 }
 
+// metricOrigin describes the StatsD metric that first produced a metric.
+type metricOrigin struct {
+	name       string
+	metricType mapper.MetricType
+	tags       map[string]string
+}
+
+// registryStripeBits sets the number of stripes of a registry, 2^6.
+const registryStripeBits = 6
+
+// registryStripe holds the state that events update besides the metrics
+// themselves, for the series and metric names hashed to it, so that events
+// recorded in parallel seldom wait for each other. Its lock is taken after
+// the registry's, if at all.
+type registryStripe struct {
+	mtx sync.Mutex
+	// How often each metric is updated.
+	updates map[string]*updateRate
+	// Increments of delta counters since the previous publication, by the
+	// gauge exposing them.
+	deltas map[prometheus.Gauge]float64
+	// Samples of gauges aggregated over the time since the previous
+	// publication.
+	gaugeWindows map[prometheus.Gauge]*gaugeWindow
+	// Samples of timers exposed as statistics, by the gauge of their count.
+	timerWindows map[prometheus.Gauge]*timerWindow
+	// Increases of counters since the previous publication, by the gauge
+	// exposing their rate.
+	rates map[prometheus.Gauge]*rateWindow
+	// The last value received for series fed by cumulative client counters.
+	clientTotals map[metricHolder]float64
+	// The latest exemplars of counters and histograms, by the upper bound of
+	// their bucket, or +Inf for counters.
+	exemplars map[metricHolder]map[float64]exemplar
+}
+
 type registry struct {
+	// Guards the metrics and their series. Events are recorded into
+	// existing series under the read lock, along with the lock of the
+	// stripes holding their state. Creating and removing series, and
+	// publishing, take the write lock.
+	mtx     sync.RWMutex
 	metrics map[string]metric
+	origins map[string]metricOrigin
+	stripes [1 << registryStripeBits]registryStripe
 	mapper  *mapper.MetricMapper
-	// The below value and label variables are allocated in the registry struct
-	// so that we don't have to allocate them every time have to compute a label
-	// hash.
-	valueBuf, nameBuf bytes.Buffer
-	hasher            hash.Hash64
+	// Where the vectors of metrics are registered.
+	registerer prometheus.Registerer
+	// The number of series across all metrics, limited to maxSeries unless
+	// it is 0.
+	seriesCount int
+	maxSeries   int
+	limitPolicy seriesLimitPolicy
+	// Series ordered from most to least recently updated, only kept when
+	// least recently updated series are evicted. Moving series to the front
+	// under the read lock takes lruMtx.
+	lru    *list.List
+	lruMtx sync.Mutex
+	// Series with a ttl, spread over shards checked one per periodic sweep.
+	// Only kept when expiry is scanned incrementally.
+	expiryShards []map[seriesRef]struct{}
+	// The next shard to check.
+	expiryCursor int
+	// Measures to take against memory usage, set by the memory watcher.
+	pressure memoryPressure
+	// The start of the current publish interval, set by the first events,
+	// and the bounds of the last published one.
+	windowStart                  time.Time
+	publishedStart, publishedEnd time.Time
 }
 
 func newRegistry(mapper *mapper.MetricMapper) *registry {
-	return &registry{
-		metrics: make(map[string]metric),
-		mapper:  mapper,
-		hasher:  fnv.New64a(),
+	r := &registry{
+		metrics:    make(map[string]metric),
+		origins:    make(map[string]metricOrigin),
+		mapper:     mapper,
+		registerer: prometheus.DefaultRegisterer,
+	}
+	for i := range r.stripes {
+		s := &r.stripes[i]
+		s.updates = make(map[string]*updateRate)
+		s.deltas = make(map[prometheus.Gauge]float64)
+		s.gaugeWindows = make(map[prometheus.Gauge]*gaugeWindow)
+		s.timerWindows = make(map[prometheus.Gauge]*timerWindow)
+		s.rates = make(map[prometheus.Gauge]*rateWindow)
+		s.clientTotals = make(map[metricHolder]float64)
+		s.exemplars = make(map[metricHolder]map[float64]exemplar)
 	}
+	return r
+}
+
+// seriesStripe returns the stripe holding the state of a series, picked by
+// the address of its metric.
+func (r *registry) seriesStripe(mh metricHolder) *registryStripe {
+	// Fibonacci hashing spreads the aligned addresses over the stripes.
+	p := uint64(reflect.ValueOf(mh).Pointer())
+	return &r.stripes[(p*11400714819323198485)>>(64-registryStripeBits)]
+}
+
+// nameStripe returns the stripe holding the state of a metric name.
+func (r *registry) nameStripe(metricName string) *registryStripe {
+	// FNV-1a, inlined to hash the name without allocating.
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(metricName); i++ {
+		h ^= uint64(metricName[i])
+		h *= 1099511628211
+	}
+	return &r.stripes[h&(1<<registryStripeBits-1)]
+}
+
+// forEachStripe calls f with each stripe, holding its lock.
+func (r *registry) forEachStripe(f func(s *registryStripe)) {
+	for i := range r.stripes {
+		s := &r.stripes[i]
+		s.mtx.Lock()
+		f(s)
+		s.mtx.Unlock()
+	}
+}
+
+// updateRateWindow is the time constant of the decay of update rates, which
+// roughly cover the updates of the last minute.
+const updateRateWindow = time.Minute
+
+// updateRate is an exponentially decaying count of the updates of a metric.
+type updateRate struct {
+	count float64
+	last  time.Time
+}
+
+func (u *updateRate) decayed(now time.Time) float64 {
+	elapsed := now.Sub(u.last)
+	if elapsed <= 0 {
+		return u.count
+	}
+	return u.count * math.Exp(-elapsed.Seconds()/updateRateWindow.Seconds())
+}
+
+// perSecond returns the approximate number of updates per second.
+func (u *updateRate) perSecond(now time.Time) float64 {
+	return u.decayed(now) / updateRateWindow.Seconds()
+}
+
+// countUpdate counts an update of a metric. It needs no registry lock.
+func (r *registry) countUpdate(metricName string, now time.Time) {
+	s := r.nameStripe(metricName)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	u, ok := s.updates[metricName]
+	if !ok {
+		u = &updateRate{}
+		s.updates[metricName] = u
+	}
+	u.count = u.decayed(now) + 1
+	u.last = now
+}
+
+// recordOrigin remembers the StatsD metric behind a metric the first time it
+// is seen, which needs the write lock unless create is false.
+func (r *registry) recordOrigin(metricName string, event Event, create bool) error {
+	if _, ok := r.origins[metricName]; ok {
+		return nil
+	}
+	if !create {
+		return errNeedsWriteLock
+	}
+	tags := make(map[string]string, len(event.Labels()))
+	for k, v := range event.Labels() {
+		tags[k] = v
+	}
+	r.origins[metricName] = metricOrigin{
+		name:       event.MetricName(),
+		metricType: event.MetricType(),
+		tags:       tags,
+	}
+	return nil
+}
+
+// setSeriesLimit limits the number of series, applying the policy to new
+// series beyond the limit.
+func (r *registry) setSeriesLimit(maxSeries int, policy seriesLimitPolicy) {
+	r.maxSeries = maxSeries
+	r.limitPolicy = policy
+	if maxSeries > 0 && policy == seriesLimitEvict {
+		r.lru = list.New()
+	}
+}
+
+// setExpiryShards spreads the series with a ttl over the given number of
+// shards, so that the periodic sweep checks one shard at a time rather than
+// every series.
+func (r *registry) setExpiryShards(shards int) {
+	if shards <= 1 {
+		r.expiryShards = nil
+		return
+	}
+	r.expiryShards = make([]map[seriesRef]struct{}, shards)
+	for i := range r.expiryShards {
+		r.expiryShards[i] = make(map[seriesRef]struct{})
+	}
+}
+
+// expiryShard returns the shard tracking the given series.
+func (r *registry) expiryShard(hash valueHash) map[seriesRef]struct{} {
+	return r.expiryShards[uint64(hash)%uint64(len(r.expiryShards))]
+}
+
+// reserveSeries makes room for a new series, evicting the least recently
+// updated one if needed.
+func (r *registry) reserveSeries() error {
+	if r.pressure >= memoryPressureExceeded {
+		return errMemoryLimit
+	}
+	if r.maxSeries <= 0 || r.seriesCount < r.maxSeries {
+		return nil
+	}
+	if r.lru == nil || r.lru.Len() == 0 {
+		return errSeriesLimit
+	}
+	ref := r.lru.Back().Value.(seriesRef)
+	r.remove(ref.metricName, ref.hash)
+	seriesRemoved.WithLabelValues("evicted").Inc()
+	return nil
 }
 
 func (r *registry) metricConflicts(metricName string, metricType metricType) bool {
@@ -108,26 +407,27 @@ func (r *registry) metricConflicts(metricName string, metricType metricType) boo
 	return true
 }
 
-func (r *registry) storeCounter(metricName string, hash labelHash, labels prometheus.Labels, vec *prometheus.CounterVec, c prometheus.Counter, ttl time.Duration) {
-	r.store(metricName, hash, labels, vec, c, CounterMetricType, ttl)
+func (r *registry) storeCounter(metricName, help string, hash labelHash, labels prometheus.Labels, vec *prometheus.CounterVec, c prometheus.Counter, ttl time.Duration) {
+	r.store(metricName, help, hash, labels, vec, c, CounterMetricType, ttl)
 }
 
-func (r *registry) storeGauge(metricName string, hash labelHash, labels prometheus.Labels, vec *prometheus.GaugeVec, g prometheus.Counter, ttl time.Duration) {
-	r.store(metricName, hash, labels, vec, g, GaugeMetricType, ttl)
+func (r *registry) storeGauge(metricName, help string, hash labelHash, labels prometheus.Labels, vec *prometheus.GaugeVec, g prometheus.Counter, ttl time.Duration) {
+	r.store(metricName, help, hash, labels, vec, g, GaugeMetricType, ttl)
 }
 
-func (r *registry) storeHistogram(metricName string, hash labelHash, labels prometheus.Labels, vec *prometheus.HistogramVec, o prometheus.Observer, ttl time.Duration) {
-	r.store(metricName, hash, labels, vec, o, HistogramMetricType, ttl)
+func (r *registry) storeHistogram(metricName, help string, hash labelHash, labels prometheus.Labels, vec observerVec, o prometheus.Observer, ttl time.Duration) {
+	r.store(metricName, help, hash, labels, vec, o, HistogramMetricType, ttl)
 }
 
-func (r *registry) storeSummary(metricName string, hash labelHash, labels prometheus.Labels, vec *prometheus.SummaryVec, o prometheus.Observer, ttl time.Duration) {
-	r.store(metricName, hash, labels, vec, o, SummaryMetricType, ttl)
+func (r *registry) storeSummary(metricName, help string, hash labelHash, labels prometheus.Labels, vec observerVec, o prometheus.Observer, ttl time.Duration) {
+	r.store(metricName, help, hash, labels, vec, o, SummaryMetricType, ttl)
 }
 
-func (r *registry) store(metricName string, hash labelHash, labels prometheus.Labels, vh vectorHolder, mh metricHolder, metricType metricType, ttl time.Duration) {
+func (r *registry) store(metricName, help string, hash labelHash, labels prometheus.Labels, vh vectorHolder, mh metricHolder, metricType metricType, ttl time.Duration) {
 	metric, hasMetric := r.metrics[metricName]
 	if !hasMetric {
 		metric.metricType = metricType
+		metric.help = help
 		metric.vectors = make(map[nameHash]*vector)
 		metric.metrics = make(map[valueHash]*registeredMetric)
 
@@ -143,18 +443,31 @@ func (r *registry) store(metricName string, hash labelHash, labels prometheus.La
 	rm, ok := metric.metrics[hash.values]
 	if !ok {
 		rm = &registeredMetric{
-			labels: labels,
-			ttl:    ttl,
-			metric: mh,
-			vecKey: hash.names,
+			createdAt: clock.Now(),
+			labels:    labels,
+			ttl:       ttl,
+			metric:    mh,
+			vecKey:    hash.names,
 		}
 		metric.metrics[hash.values] = rm
 		v.refCount++
+		r.seriesCount++
+		seriesCreated.Inc()
+		if r.lru != nil {
+			rm.lruElement = r.lru.PushFront(seriesRef{metricName: metricName, hash: hash.values})
+		}
 	}
-	now := clock.Now()
-	rm.lastRegisteredAt = now
+	rm.touch(clock.Now())
 	// Update ttl from mapping
 	rm.ttl = ttl
+	if r.expiryShards != nil {
+		ref := seriesRef{metricName: metricName, hash: hash.values}
+		if ttl != 0 {
+			r.expiryShard(hash.values)[ref] = struct{}{}
+		} else {
+			delete(r.expiryShard(hash.values), ref)
+		}
+	}
 }
 
 func (r *registry) get(metricName string, hash labelHash, metricType metricType) (vectorHolder, metricHolder) {
@@ -169,8 +482,12 @@ func (r *registry) get(metricName string, hash labelHash, metricType metricType)
 
 	rm, ok := metric.metrics[hash.values]
 	if ok {
-		now := clock.Now()
-		rm.lastRegisteredAt = now
+		rm.touch(clock.Now())
+		if rm.lruElement != nil {
+			r.lruMtx.Lock()
+			r.lru.MoveToFront(rm.lruElement)
+			r.lruMtx.Unlock()
+		}
 		return metric.vectors[hash.names].holder, rm.metric
 	}
 
@@ -182,26 +499,36 @@ func (r *registry) get(metricName string, hash labelHash, metricType metricType)
 	return nil, nil
 }
 
-func (r *registry) getCounter(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping) (prometheus.Counter, error) {
-	hash, labelNames := r.hashLabels(labels)
+// getCounter returns the counter of a series. Unless create is set, which
+// needs the write lock, a series that doesn't exist yet yields
+// errNeedsWriteLock. The other getters work the same way.
+func (r *registry) getCounter(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, create bool) (prometheus.Counter, error) {
+	hash := r.hashLabels(labels)
 	vh, mh := r.get(metricName, hash, CounterMetricType)
 	if mh != nil {
 		return mh.(prometheus.Counter), nil
 	}
+	if !create {
+		return nil, errNeedsWriteLock
+	}
 
 	if r.metricConflicts(metricName, CounterMetricType) {
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
 	}
 
+	if err := r.reserveSeries(); err != nil {
+		return nil, err
+	}
+
 	var counterVec *prometheus.CounterVec
 	if vh == nil {
 		metricsCount.WithLabelValues("counter").Inc()
 		counterVec = prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: metricName,
 			Help: help,
-		}, labelNames)
+		}, sortedLabelNames(labels))
 
-		if err := prometheus.Register(uncheckedCollector{counterVec}); err != nil {
+		if err := r.registerer.Register(uncheckedCollector{counterVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -213,31 +540,38 @@ func (r *registry) getCounter(metricName string, labels prometheus.Labels, help
 	if counter, err = counterVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.storeCounter(metricName, hash, labels, counterVec, counter, mapping.Ttl)
+	r.storeCounter(metricName, help, hash, labels, counterVec, counter, mapping.Ttl)
 
 	return counter, nil
 }
 
-func (r *registry) getGauge(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping) (prometheus.Gauge, error) {
-	hash, labelNames := r.hashLabels(labels)
+func (r *registry) getGauge(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, create bool) (prometheus.Gauge, error) {
+	hash := r.hashLabels(labels)
 	vh, mh := r.get(metricName, hash, GaugeMetricType)
 	if mh != nil {
 		return mh.(prometheus.Gauge), nil
 	}
+	if !create {
+		return nil, errNeedsWriteLock
+	}
 
 	if r.metricConflicts(metricName, GaugeMetricType) {
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
 	}
 
+	if err := r.reserveSeries(); err != nil {
+		return nil, err
+	}
+
 	var gaugeVec *prometheus.GaugeVec
 	if vh == nil {
 		metricsCount.WithLabelValues("gauge").Inc()
 		gaugeVec = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: metricName,
 			Help: help,
-		}, labelNames)
+		}, sortedLabelNames(labels))
 
-		if err := prometheus.Register(uncheckedCollector{gaugeVec}); err != nil {
+		if err := r.registerer.Register(uncheckedCollector{gaugeVec}); err != nil {
 			return nil, err
 		}
 	} else {
@@ -249,17 +583,20 @@ func (r *registry) getGauge(metricName string, labels prometheus.Labels, help st
 	if gauge, err = gaugeVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.storeGauge(metricName, hash, labels, gaugeVec, gauge, mapping.Ttl)
+	r.storeGauge(metricName, help, hash, labels, gaugeVec, gauge, mapping.Ttl)
 
 	return gauge, nil
 }
 
-func (r *registry) getHistogram(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping) (prometheus.Observer, error) {
-	hash, labelNames := r.hashLabels(labels)
+func (r *registry) getHistogram(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, create bool) (prometheus.Observer, error) {
+	hash := r.hashLabels(labels)
 	vh, mh := r.get(metricName, hash, HistogramMetricType)
 	if mh != nil {
 		return mh.(prometheus.Observer), nil
 	}
+	if !create {
+		return nil, errNeedsWriteLock
+	}
 
 	if r.metricConflicts(metricName, HistogramMetricType) {
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
@@ -274,24 +611,28 @@ func (r *registry) getHistogram(metricName string, labels prometheus.Labels, hel
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
 	}
 
-	var histogramVec *prometheus.HistogramVec
+	if err := r.reserveSeries(); err != nil {
+		return nil, err
+	}
+
+	var histogramVec observerVec
 	if vh == nil {
 		metricsCount.WithLabelValues("histogram").Inc()
-		buckets := r.mapper.Defaults.Buckets
-		if mapping.Buckets != nil && len(mapping.Buckets) > 0 {
-			buckets = mapping.Buckets
+		if options := r.histogramOptions(mapping); options.Native() {
+			histogramVec = newNativeHistogramVec(metricName, help, sortedLabelNames(labels), r.histogramBuckets(mapping), options)
+		} else {
+			histogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+				Name:    metricName,
+				Help:    help,
+				Buckets: r.histogramBuckets(mapping),
+			}, sortedLabelNames(labels))
 		}
-		histogramVec = prometheus.NewHistogramVec(prometheus.HistogramOpts{
-			Name:    metricName,
-			Help:    help,
-			Buckets: buckets,
-		}, labelNames)
 
-		if err := prometheus.Register(uncheckedCollector{histogramVec}); err != nil {
+		if err := r.registerer.Register(uncheckedCollector{histogramVec}); err != nil {
 			return nil, err
 		}
 	} else {
-		histogramVec = vh.(*prometheus.HistogramVec)
+		histogramVec = vh.(observerVec)
 	}
 
 	var observer prometheus.Observer
@@ -299,17 +640,40 @@ func (r *registry) getHistogram(metricName string, labels prometheus.Labels, hel
 	if observer, err = histogramVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.storeHistogram(metricName, hash, labels, histogramVec, observer, mapping.Ttl)
+	r.storeHistogram(metricName, help, hash, labels, histogramVec, observer, mapping.Ttl)
 
 	return observer, nil
 }
 
-func (r *registry) getSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping) (prometheus.Observer, error) {
-	hash, labelNames := r.hashLabels(labels)
+// histogramBuckets returns the classic buckets of the histograms of a
+// mapping, none if they only have native buckets.
+func (r *registry) histogramBuckets(mapping *mapper.MetricMapping) []float64 {
+	if options := r.histogramOptions(mapping); options.Native() && options.NativeOnly {
+		return nil
+	}
+	if mapping.Buckets != nil && len(mapping.Buckets) > 0 {
+		return mapping.Buckets
+	}
+	return r.mapper.Defaults.Buckets
+}
+
+// histogramOptions returns the options of the histograms of a mapping.
+func (r *registry) histogramOptions(mapping *mapper.MetricMapping) mapper.HistogramOptions {
+	if mapping != nil && mapping.HistogramOptions != (mapper.HistogramOptions{}) {
+		return mapping.HistogramOptions
+	}
+	return r.mapper.Defaults.HistogramOptions
+}
+
+func (r *registry) getSummary(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, create bool) (prometheus.Observer, error) {
+	hash := r.hashLabels(labels)
 	vh, mh := r.get(metricName, hash, SummaryMetricType)
 	if mh != nil {
 		return mh.(prometheus.Observer), nil
 	}
+	if !create {
+		return nil, errNeedsWriteLock
+	}
 
 	if r.metricConflicts(metricName, SummaryMetricType) {
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
@@ -321,7 +685,11 @@ func (r *registry) getSummary(metricName string, labels prometheus.Labels, help
 		return nil, fmt.Errorf("metric with name %s is already registered", metricName)
 	}
 
-	var summaryVec *prometheus.SummaryVec
+	if err := r.reserveSeries(); err != nil {
+		return nil, err
+	}
+
+	var summaryVec observerVec
 	if vh == nil {
 		metricsCount.WithLabelValues("summary").Inc()
 		quantiles := r.mapper.Defaults.Quantiles
@@ -336,17 +704,46 @@ func (r *registry) getSummary(metricName string, labels prometheus.Labels, help
 		if len(objectives) == 0 {
 			objectives = map[float64]float64{0.5: 0.05, 0.9: 0.01, 0.99: 0.001}
 		}
-		summaryVec = prometheus.NewSummaryVec(prometheus.SummaryOpts{
-			Name:       metricName,
-			Help:       help,
-			Objectives: objectives,
-		}, labelNames)
+		// Quantiles are computed over a sliding window, so that old
+		// observations decay gradually instead of being reset at once.
+		options := r.mapper.Defaults.SummaryOptions
+		if mapping != nil && mapping.SummaryOptions != (mapper.SummaryOptions{}) {
+			options = mapping.SummaryOptions
+		}
+		maxAge := prometheus.DefMaxAge
+		if options.MaxAge > 0 {
+			maxAge = options.MaxAge
+		}
+		ageBuckets := uint32(prometheus.DefAgeBuckets)
+		if options.AgeBuckets > 0 {
+			ageBuckets = options.AgeBuckets
+		}
+		if options.Algorithm == mapper.QuantileAlgorithmDDSketch {
+			targets := make([]float64, 0, len(objectives))
+			for q := range objectives {
+				targets = append(targets, q)
+			}
+			accuracy := defaultRelativeAccuracy
+			if options.RelativeAccuracy > 0 {
+				accuracy = options.RelativeAccuracy
+			}
+			summaryVec = newSketchSummaryVec(metricName, help, sortedLabelNames(labels), targets, accuracy, maxAge, ageBuckets)
+		} else {
+			summaryVec = prometheus.NewSummaryVec(prometheus.SummaryOpts{
+				Name:       metricName,
+				Help:       help,
+				Objectives: objectives,
+				MaxAge:     maxAge,
+				AgeBuckets: ageBuckets,
+				BufCap:     options.BufCap,
+			}, sortedLabelNames(labels))
+		}
 
-		if err := prometheus.Register(uncheckedCollector{summaryVec}); err != nil {
+		if err := r.registerer.Register(uncheckedCollector{summaryVec}); err != nil {
 			return nil, err
 		}
 	} else {
-		summaryVec = vh.(*prometheus.SummaryVec)
+		summaryVec = vh.(observerVec)
 	}
 
 	var observer prometheus.Observer
@@ -354,56 +751,336 @@ func (r *registry) getSummary(metricName string, labels prometheus.Labels, help
 	if observer, err = summaryVec.GetMetricWith(labels); err != nil {
 		return nil, err
 	}
-	r.storeSummary(metricName, hash, labels, summaryVec, observer, mapping.Ttl)
+	r.storeSummary(metricName, help, hash, labels, summaryVec, observer, mapping.Ttl)
 
 	return observer, nil
 }
 
+// addDelta accumulates an increment of a delta counter until the next
+// publication.
+func (r *registry) addDelta(g prometheus.Gauge, value float64) {
+	s := r.seriesStripe(g)
+	s.mtx.Lock()
+	s.deltas[g] += value
+	s.mtx.Unlock()
+}
+
+// clientIncrement converts the running total of a client counter into the
+// increase since its previous value. A total lower than the previous one
+// means that the client restarted and counts from zero again.
+func (r *registry) clientIncrement(mh metricHolder, total float64) float64 {
+	s := r.seriesStripe(mh)
+	s.mtx.Lock()
+	last, ok := s.clientTotals[mh]
+	s.clientTotals[mh] = total
+	s.mtx.Unlock()
+	if !ok || total < last {
+		if ok {
+			counterResets.Inc()
+		}
+		return total
+	}
+	return total - last
+}
+
+// clientTotal returns the latest running total of a client counter, if any.
+func (r *registry) clientTotal(mh metricHolder) (float64, bool) {
+	s := r.seriesStripe(mh)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	total, ok := s.clientTotals[mh]
+	return total, ok
+}
+
+// setClientTotal sets the running total of a client counter.
+func (r *registry) setClientTotal(mh metricHolder, total float64) {
+	s := r.seriesStripe(mh)
+	s.mtx.Lock()
+	s.clientTotals[mh] = total
+	s.mtx.Unlock()
+}
+
+// observeGauge records a gauge sample, to be aggregated with the other
+// samples received until the next publication. With a minimum update interval,
+// the gauge is updated as soon as the interval has passed instead.
+func (r *registry) observeGauge(g prometheus.Gauge, mapping *mapper.MetricMapping, value float64, relative bool) {
+	s := r.seriesStripe(g)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, ok := s.gaugeWindows[g]
+	if !ok {
+		w = &gaugeWindow{
+			aggregation: mapping.GaugeAggregation,
+			interval:    mapping.MinUpdateInterval,
+		}
+		s.gaugeWindows[g] = w
+	}
+	if relative {
+		w.current += value
+	} else {
+		w.current = value
+	}
+	w.observe(w.current)
+	if w.interval > 0 {
+		if now := clock.Now(); w.due(now) {
+			w.publish(g, now)
+		}
+	}
+}
+
+// publishGauges exposes the aggregated gauge samples received since the
+// previous publication, unless their minimum update interval hasn't passed yet.
+// Gauges without new samples keep their value.
+func (r *registry) publishGauges() {
+	now := clock.Now()
+	r.forEachStripe(func(s *registryStripe) {
+		for g, w := range s.gaugeWindows {
+			if w.due(now) {
+				w.publish(g, now)
+			}
+		}
+	})
+}
+
+// rateWindow accumulates the increase of a counter since a point in time.
+type rateWindow struct {
+	increase float64
+	since    time.Time
+}
+
+// addRate accounts for an increase of the counter whose rate the gauge
+// exposes.
+func (r *registry) addRate(g prometheus.Gauge, increase float64) {
+	s := r.seriesStripe(g)
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, ok := s.rates[g]
+	if !ok {
+		w = &rateWindow{since: clock.Now()}
+		s.rates[g] = w
+	}
+	w.increase += increase
+}
+
+// publishRates exposes the per-second rates of counters since the previous
+// publication.
+func (r *registry) publishRates() {
+	now := clock.Now()
+	r.forEachStripe(func(s *registryStripe) {
+		for g, w := range s.rates {
+			elapsed := now.Sub(w.since).Seconds()
+			if elapsed <= 0 {
+				continue
+			}
+			g.Set(w.increase / elapsed)
+			w.increase = 0
+			w.since = now
+		}
+	})
+}
+
+// startWindow starts the first publish interval, unless it has started. It
+// takes the registry's lock, which only needs to be written once.
+func (r *registry) startWindow() {
+	r.mtx.RLock()
+	started := !r.windowStart.IsZero()
+	r.mtx.RUnlock()
+	if started {
+		return
+	}
+	r.mtx.Lock()
+	if r.windowStart.IsZero() {
+		r.windowStart = clock.Now()
+	}
+	r.mtx.Unlock()
+}
+
+// publishWindows publishes the values covering the interval since the
+// previous publication, and starts a new interval.
+func (r *registry) publishWindows() {
+	now := clock.Now()
+	if r.windowStart.IsZero() {
+		r.windowStart = now
+	}
+	r.publishedStart, r.publishedEnd = r.windowStart, now
+	r.windowStart = now
+	r.publishDeltas()
+	r.publishGauges()
+	r.publishTimerStatistics()
+	r.publishRates()
+}
+
+// publishDeltas exposes the increments accumulated since the previous
+// publication and starts a new interval.
+func (r *registry) publishDeltas() {
+	r.forEachStripe(func(s *registryStripe) {
+		for g, value := range s.deltas {
+			g.Set(value)
+			s.deltas[g] = 0
+		}
+	})
+}
+
 func (r *registry) removeStaleMetrics() {
 	now := clock.Now()
 	// delete timeseries with expired ttl
-	for _, metric := range r.metrics {
+	for name, metric := range r.metrics {
 		for hash, rm := range metric.metrics {
-			if rm.ttl == 0 {
-				continue
-			}
-			if rm.lastRegisteredAt.Add(rm.ttl).Before(now) {
-				metric.vectors[rm.vecKey].holder.Delete(rm.labels)
-				metric.vectors[rm.vecKey].refCount--
-				delete(metric.metrics, hash)
-			}
+			r.expire(name, hash, rm, now)
+		}
+	}
+}
+
+// removeStaleShard removes the expired series of the next expiry shard, or of
+// all series if expiry isn't scanned incrementally.
+func (r *registry) removeStaleShard() {
+	if r.expiryShards == nil {
+		r.removeStaleMetrics()
+		return
+	}
+	now := clock.Now()
+	for ref := range r.expiryShards[r.expiryCursor] {
+		r.expire(ref.metricName, ref.hash, r.metrics[ref.metricName].metrics[ref.hash], now)
+	}
+	r.expiryCursor = (r.expiryCursor + 1) % len(r.expiryShards)
+}
+
+// expire removes the series if its ttl has passed.
+func (r *registry) expire(metricName string, hash valueHash, rm *registeredMetric, now time.Time) {
+	if rm.ttl == 0 {
+		return
+	}
+	ttl := rm.ttl
+	if r.pressure >= memoryPressureCritical {
+		ttl /= 2
+	}
+	if rm.lastRegisteredAt().Add(ttl).Before(now) {
+		r.remove(metricName, hash)
+		seriesRemoved.WithLabelValues("expired").Inc()
+	}
+}
+
+// deleteSeries removes the series of a metric whose labels include the given
+// ones, and returns how many were removed.
+func (r *registry) deleteSeries(metricName string, labels prometheus.Labels) int {
+	metric, ok := r.metrics[metricName]
+	if !ok {
+		return 0
+	}
+
+	deleted := 0
+	for hash, rm := range metric.metrics {
+		if !hasLabels(rm.labels, labels) {
+			continue
+		}
+		r.remove(metricName, hash)
+		seriesRemoved.WithLabelValues("deleted").Inc()
+		deleted++
+	}
+	return deleted
+}
+
+// remove deletes a series from the metric and its vector.
+func (r *registry) remove(metricName string, hash valueHash) {
+	m := r.metrics[metricName]
+	rm := m.metrics[hash]
+	m.vectors[rm.vecKey].holder.Delete(rm.labels)
+	m.vectors[rm.vecKey].refCount--
+	delete(m.metrics, hash)
+	r.seriesCount--
+	if rm.lruElement != nil {
+		r.lru.Remove(rm.lruElement)
+	}
+	s := r.seriesStripe(rm.metric)
+	s.mtx.Lock()
+	if g, ok := rm.metric.(prometheus.Gauge); ok {
+		delete(s.deltas, g)
+		delete(s.gaugeWindows, g)
+		delete(s.timerWindows, g)
+		delete(s.rates, g)
+	}
+	delete(s.clientTotals, rm.metric)
+	delete(s.exemplars, rm.metric)
+	s.mtx.Unlock()
+	if r.expiryShards != nil {
+		delete(r.expiryShard(hash), seriesRef{metricName: metricName, hash: hash})
+	}
+}
+
+// hasLabels reports whether labels contains all of the wanted labels.
+func hasLabels(labels, wanted prometheus.Labels) bool {
+	for name, value := range wanted {
+		if v, ok := labels[name]; !ok || v != value {
+			return false
 		}
 	}
+	return true
 }
 
 // Calculates a hash of both the label names and the label names and values.
-func (r *registry) hashLabels(labels prometheus.Labels) (labelHash, []string) {
-	r.hasher.Reset()
-	r.nameBuf.Reset()
-	r.valueBuf.Reset()
-	labelNames := make([]string, 0, len(labels))
+func (r *registry) hashLabels(labels prometheus.Labels) labelHash {
+	h := labelHashers.Get().(*labelHasher)
+	hash := h.hash(labels)
+	labelHashers.Put(h)
+	return hash
+}
+
+// labelHasher computes label hashes with buffers reused across calls. It is
+// not safe for concurrent use.
+type labelHasher struct {
+	valueBuf, nameBuf bytes.Buffer
+	labelNames        []string
+	hasher            hash.Hash64
+}
 
+func newLabelHasher() *labelHasher {
+	return &labelHasher{hasher: fnv.New64a()}
+}
+
+// labelHashers hold the hashers of lookups, which may run concurrently under
+// the registry's read lock.
+var labelHashers = sync.Pool{
+	New: func() interface{} { return newLabelHasher() },
+}
+
+func (h *labelHasher) hash(labels prometheus.Labels) labelHash {
+	h.hasher.Reset()
+	h.nameBuf.Reset()
+	h.valueBuf.Reset()
+	// The names are sorted in a buffer reused across calls.
+	h.labelNames = h.labelNames[:0]
 	for labelName := range labels {
-		labelNames = append(labelNames, labelName)
+		h.labelNames = append(h.labelNames, labelName)
 	}
-	sort.Strings(labelNames)
+	sort.Strings(h.labelNames)
 
-	r.valueBuf.WriteByte(model.SeparatorByte)
-	for _, labelName := range labelNames {
-		r.valueBuf.WriteString(labels[labelName])
-		r.valueBuf.WriteByte(model.SeparatorByte)
+	h.valueBuf.WriteByte(model.SeparatorByte)
+	for _, labelName := range h.labelNames {
+		h.valueBuf.WriteString(labels[labelName])
+		h.valueBuf.WriteByte(model.SeparatorByte)
 
-		r.nameBuf.WriteString(labelName)
-		r.nameBuf.WriteByte(model.SeparatorByte)
+		h.nameBuf.WriteString(labelName)
+		h.nameBuf.WriteByte(model.SeparatorByte)
 	}
 
 	lh := labelHash{}
-	r.hasher.Write(r.nameBuf.Bytes())
-	lh.names = nameHash(r.hasher.Sum64())
+	h.hasher.Write(h.nameBuf.Bytes())
+	lh.names = nameHash(h.hasher.Sum64())
 
 	// Now add the values to the names we've already hashed.
-	r.hasher.Write(r.valueBuf.Bytes())
-	lh.values = valueHash(r.hasher.Sum64())
+	h.hasher.Write(h.valueBuf.Bytes())
+	lh.values = valueHash(h.hasher.Sum64())
+
+	return lh
+}
 
-	return lh, labelNames
+// sortedLabelNames returns the names of labels in order, for the vectors of
+// new metrics.
+func sortedLabelNames(labels prometheus.Labels) []string {
+	labelNames := make([]string, 0, len(labels))
+	for labelName := range labels {
+		labelNames = append(labelNames, labelName)
+	}
+	sort.Strings(labelNames)
+	return labelNames
 }
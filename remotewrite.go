@@ -0,0 +1,330 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/version"
+
+	"github.com/prometheus/statsd_exporter/pkg/clock"
+)
+
+const maxErrorMessage = 512
+
+// remoteWriter periodically pushes the samples of the exporter to a
+// Prometheus remote write endpoint, for exporters that can't be scraped.
+// The samples are split into batches, which are queued and sent one at a
+// time, so that a slow endpoint doesn't delay collecting the next samples.
+type remoteWriter struct {
+	url      string
+	interval time.Duration
+	client   *http.Client
+	// The value of the Authorization header of requests, if any.
+	authorization string
+	exporter      *Exporter
+	gatherer      prometheus.Gatherer
+
+	// The number of samples sent in a single request.
+	batchSize int
+	// The number of samples waiting to be sent, beyond which the oldest
+	// batches are dropped.
+	queueCapacity int
+	// The number of times a batch is retried after a recoverable error,
+	// with exponential backoff between minBackoff and maxBackoff.
+	maxRetries int
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	// Whether requests are compressed, rather than only framed in the
+	// snappy format the protocol requires.
+	compress bool
+
+	queue chan remoteWriteBatch
+	// Closed to stop collecting samples, and once the queue is sent.
+	stop, sent chan struct{}
+}
+
+// remoteWriteSeries is a time series with a single sample.
+type remoteWriteSeries struct {
+	labels []*dto.LabelPair
+	value  float64
+}
+
+// remoteWriteBatch is the samples of a single request, all collected at the
+// same time.
+type remoteWriteBatch struct {
+	series    []remoteWriteSeries
+	timestamp int64
+}
+
+// remoteWriteAuthorization returns the Authorization header of remote write
+// requests, from a bearer token or the credentials of basic authentication.
+func remoteWriteAuthorization(bearerTokenFile, username, passwordFile string) (string, error) {
+	switch {
+	case bearerTokenFile != "" && username != "":
+		return "", fmt.Errorf("bearer token and basic authentication are mutually exclusive")
+	case bearerTokenFile != "":
+		token, err := readTokenFile(bearerTokenFile)
+		if err != nil {
+			return "", err
+		}
+		return "Bearer " + token, nil
+	case username != "":
+		var password string
+		if passwordFile != "" {
+			var err error
+			if password, err = readTokenFile(passwordFile); err != nil {
+				return "", err
+			}
+		}
+		return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password)), nil
+	}
+	return "", nil
+}
+
+// newQueue creates the queue of the batches waiting to be sent.
+func (rw *remoteWriter) newQueue() {
+	batches := rw.queueCapacity / rw.batchSize
+	if batches < 1 {
+		batches = 1
+	}
+	remoteWriteQueueCapacity.Set(float64(batches * rw.batchSize))
+	rw.queue = make(chan remoteWriteBatch, batches)
+	rw.stop = make(chan struct{})
+	rw.sent = make(chan struct{})
+}
+
+// run collects the samples every interval, and sends them in the background,
+// until stopped by close.
+func (rw *remoteWriter) run() {
+	go rw.sendQueued()
+	ticker := time.NewTicker(rw.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			rw.push()
+		case <-rw.stop:
+			rw.push()
+			close(rw.queue)
+			return
+		}
+	}
+}
+
+// close collects the samples one last time, and returns once they and the
+// batches queued before them are sent.
+func (rw *remoteWriter) close() {
+	close(rw.stop)
+	<-rw.sent
+}
+
+// push queues the current value of every series, in batches. When the queue
+// is full, the oldest batches are dropped, as newer samples supersede them.
+func (rw *remoteWriter) push() {
+	rw.exporter.prepareCollection()
+	families, err := rw.gatherer.Gather()
+	if err != nil {
+		log.Warnln("Error gathering metrics to remote write:", err)
+	}
+	timestamp := clock.Now().UnixNano() / int64(time.Millisecond)
+
+	series := flattenFamilies(families)
+	for len(series) > 0 {
+		n := len(series)
+		if n > rw.batchSize {
+			n = rw.batchSize
+		}
+		batch := remoteWriteBatch{series: series[:n], timestamp: timestamp}
+		series = series[n:]
+
+		for queued := false; !queued; {
+			select {
+			case rw.queue <- batch:
+				remoteWritePendingSamples.Add(float64(len(batch.series)))
+				queued = true
+			default:
+				select {
+				case dropped := <-rw.queue:
+					remoteWritePendingSamples.Sub(float64(len(dropped.series)))
+					remoteWriteSamples.WithLabelValues("dropped").Add(float64(len(dropped.series)))
+				default:
+				}
+			}
+		}
+	}
+}
+
+// sendQueued sends the queued batches until the queue is closed.
+func (rw *remoteWriter) sendQueued() {
+	defer close(rw.sent)
+	for batch := range rw.queue {
+		remoteWritePendingSamples.Sub(float64(len(batch.series)))
+		rw.sendBatch(batch)
+	}
+}
+
+// sendBatch sends a batch of samples, and accounts for the result.
+func (rw *remoteWriter) sendBatch(batch remoteWriteBatch) {
+	body := snappyEncode(encodeWriteRequest(batch.series, batch.timestamp), rw.compress)
+	if err := rw.send(body, len(batch.series)); err != nil {
+		log.Warnf("Error remote writing %d samples: %v", len(batch.series), err)
+		remoteWriteSamples.WithLabelValues("failed").Add(float64(len(batch.series)))
+		return
+	}
+	remoteWriteSamples.WithLabelValues("sent").Add(float64(len(batch.series)))
+	remoteWriteSentBytes.Add(float64(len(body)))
+	remoteWriteHighestSentTimestamp.Set(float64(batch.timestamp) / 1000)
+}
+
+// send posts an encoded write request of the given number of samples,
+// retrying recoverable errors.
+func (rw *remoteWriter) send(body []byte, samples int) error {
+	backoff := rw.minBackoff
+	for attempt := 0; ; attempt++ {
+		start := time.Now()
+		recoverable, err := rw.sendOnce(body)
+		remoteWriteBatchDuration.Observe(time.Since(start).Seconds())
+		if err == nil || !recoverable || attempt == rw.maxRetries {
+			return err
+		}
+		remoteWriteRetriedSamples.Add(float64(samples))
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > rw.maxBackoff {
+			backoff = rw.maxBackoff
+		}
+	}
+}
+
+// sendOnce posts an encoded write request, and reports whether a failure is
+// worth retrying.
+func (rw *remoteWriter) sendOnce(body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, rw.url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "statsd_exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+	if rw.authorization != "" {
+		req.Header.Set("Authorization", rw.authorization)
+	}
+
+	resp, err := rw.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+	err = fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	return resp.StatusCode/100 == 5 || resp.StatusCode == http.StatusTooManyRequests, err
+}
+
+// flattenFamilies turns metric families into the series of the text format,
+// with the metric name in the __name__ label and the labels sorted by name.
+func flattenFamilies(families []*dto.MetricFamily) []remoteWriteSeries {
+	var series []remoteWriteSeries
+	add := func(name string, pairs []*dto.LabelPair, extraLabel, extraValue string, value float64) {
+		labels := make([]*dto.LabelPair, 0, len(pairs)+2)
+		labels = append(labels, &dto.LabelPair{Name: proto.String(model.MetricNameLabel), Value: proto.String(name)})
+		labels = append(labels, pairs...)
+		if extraLabel != "" {
+			labels = append(labels, &dto.LabelPair{Name: proto.String(extraLabel), Value: proto.String(extraValue)})
+		}
+		sort.Slice(labels, func(i, j int) bool { return labels[i].GetName() < labels[j].GetName() })
+		series = append(series, remoteWriteSeries{labels: labels, value: value})
+	}
+
+	for _, family := range families {
+		name := family.GetName()
+		for _, m := range family.Metric {
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				add(name, m.Label, "", "", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add(name, m.Label, "", "", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add(name, m.Label, model.QuantileLabel, formatFloat(q.GetQuantile()), q.GetValue())
+				}
+				add(name+"_sum", m.Label, "", "", s.GetSampleSum())
+				add(name+"_count", m.Label, "", "", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.Bucket {
+					if math.IsInf(b.GetUpperBound(), 1) {
+						continue
+					}
+					add(name+"_bucket", m.Label, model.BucketLabel, formatFloat(b.GetUpperBound()), float64(b.GetCumulativeCount()))
+				}
+				add(name+"_bucket", m.Label, model.BucketLabel, "+Inf", float64(h.GetSampleCount()))
+				add(name+"_sum", m.Label, "", "", h.GetSampleSum())
+				add(name+"_count", m.Label, "", "", float64(h.GetSampleCount()))
+			default:
+				add(name, m.Label, "", "", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series
+}
+
+// encodeWriteRequest encodes series in the protobuf WriteRequest message of
+// the remote write protocol, all with a sample at the given timestamp.
+func encodeWriteRequest(series []remoteWriteSeries, timestamp int64) []byte {
+	request := proto.NewBuffer(nil)
+	ts := proto.NewBuffer(nil)
+	field := proto.NewBuffer(nil)
+	for _, s := range series {
+		ts.Reset()
+		// TimeSeries: labels = 1, samples = 2.
+		for _, label := range s.labels {
+			// Label: name = 1, value = 2.
+			field.Reset()
+			pbString(field, 1, label.GetName())
+			pbString(field, 2, label.GetValue())
+			pbMessage(ts, 1, field)
+		}
+		// Sample: value = 1, timestamp = 2.
+		field.Reset()
+		pbDouble(field, 1, s.value)
+		pbVarint(field, 2, uint64(timestamp))
+		pbMessage(ts, 2, field)
+
+		// WriteRequest: timeseries = 1.
+		pbMessage(request, 1, ts)
+	}
+	return request.Bytes()
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/heap"
+	"time"
+)
+
+// maxReorderedEvents bounds the number of events held back by the reorder
+// buffer. Beyond it, the oldest events are released before their window has
+// passed.
+const maxReorderedEvents = 1000000
+
+// reorderBuffer holds back timestamped events for a window of time, and
+// releases them ordered by timestamp. Events arriving after the window of
+// their timestamp has passed are dropped. Timestamps ahead of the time events
+// arrive at are taken as that time, so that clients with clocks running
+// ahead don't have their events held back for longer than the window.
+type reorderBuffer struct {
+	window    time.Duration
+	events    reorderHeap
+	maxEvents int
+	// Keeps events with the same timestamp in the order they arrived.
+	seq uint64
+}
+
+type reorderEntry struct {
+	event Event
+	// The timestamp of the event, or the time it arrived at if earlier.
+	at  time.Time
+	seq uint64
+}
+
+type reorderHeap []reorderEntry
+
+func (h reorderHeap) Len() int { return len(h) }
+func (h reorderHeap) Less(i, j int) bool {
+	if h[i].at.Equal(h[j].at) {
+		return h[i].seq < h[j].seq
+	}
+	return h[i].at.Before(h[j].at)
+}
+func (h reorderHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *reorderHeap) Push(x interface{}) { *h = append(*h, x.(reorderEntry)) }
+func (h *reorderHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+func newReorderBuffer(window time.Duration) *reorderBuffer {
+	return &reorderBuffer{window: window, maxEvents: maxReorderedEvents}
+}
+
+// add holds back the event if it is timestamped, and reports whether it was
+// taken, either held back or dropped for being too old.
+func (b *reorderBuffer) add(event Event, now time.Time) bool {
+	ts := event.Timestamp()
+	if ts.IsZero() {
+		return false
+	}
+	if ts.Before(now.Add(-b.window)) {
+		lateSamplesDropped.Inc()
+		return true
+	}
+	if ts.After(now) {
+		ts = now
+	}
+	b.seq++
+	heap.Push(&b.events, reorderEntry{event: event, at: ts, seq: b.seq})
+	return true
+}
+
+// release returns, ordered by timestamp, the events whose window has passed,
+// and the oldest events beyond the maximum held back.
+func (b *reorderBuffer) release(now time.Time) Events {
+	var events Events
+	for len(b.events) > b.maxEvents {
+		events = append(events, heap.Pop(&b.events).(reorderEntry).event)
+		earlySamplesReleased.Inc()
+	}
+	cutoff := now.Add(-b.window)
+	for len(b.events) > 0 && !b.events[0].at.After(cutoff) {
+		events = append(events, heap.Pop(&b.events).(reorderEntry).event)
+	}
+	return events
+}
+
+// drain returns all the events held back, ordered by timestamp.
+func (b *reorderBuffer) drain() Events {
+	events := make(Events, 0, len(b.events))
+	for len(b.events) > 0 {
+		events = append(events, heap.Pop(&b.events).(reorderEntry).event)
+	}
+	return events
+}
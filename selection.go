@@ -0,0 +1,215 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/model"
+)
+
+// selection is the subset of the metrics a scrape asks for with query
+// parameters.
+type selection struct {
+	// The metric names selected, or all if empty.
+	names map[string]bool
+	// The matchers the labels of selected series must satisfy.
+	matchers []labelMatcher
+	// The shard selected, from 0 to shards-1, if shards isn't 0. Metrics are
+	// assigned to shards by a hash of their name, so that several scrapers
+	// can split a large exposition between them.
+	shard  uint32
+	shards uint32
+}
+
+// labelMatcher matches the value of a label, which is empty for series
+// without the label.
+type labelMatcher struct {
+	name   string
+	negate bool
+	// Matches the value if set, or else value must be equal to it.
+	re    *regexp.Regexp
+	value string
+}
+
+func (m labelMatcher) matches(value string) bool {
+	if m.re != nil {
+		return m.re.MatchString(value) != m.negate
+	}
+	return (value == m.value) != m.negate
+}
+
+// labelMatcherRE parses matchers like code="200", code!="200", code=~"5.."
+// and code!~"5..", with the value optionally quoted.
+var labelMatcherRE = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+func parseLabelMatcher(param string) (labelMatcher, error) {
+	parts := labelMatcherRE.FindStringSubmatch(param)
+	if parts == nil {
+		return labelMatcher{}, fmt.Errorf("invalid label matcher %q", param)
+	}
+	value := parts[3]
+	if strings.HasPrefix(value, `"`) {
+		var err error
+		if value, err = strconv.Unquote(value); err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid value in label matcher %q: %v", param, err)
+		}
+	}
+	m := labelMatcher{name: parts[1], negate: strings.HasPrefix(parts[2], "!"), value: value}
+	if strings.HasSuffix(parts[2], "~") {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("invalid regular expression in label matcher %q: %v", param, err)
+		}
+		m.re = re
+	}
+	return m, nil
+}
+
+// parseSelection parses the name[], match[] and shard parameters of a
+// scrape. It returns nil if the scrape asks for all metrics.
+func parseSelection(query url.Values) (*selection, error) {
+	s := &selection{names: make(map[string]bool)}
+	for _, name := range query["name[]"] {
+		s.names[name] = true
+	}
+	for _, param := range query["match[]"] {
+		m, err := parseLabelMatcher(param)
+		if err != nil {
+			return nil, err
+		}
+		s.matchers = append(s.matchers, m)
+	}
+	if param := query.Get("shard"); param != "" {
+		var err error
+		if s.shard, s.shards, err = parseShard(param); err != nil {
+			return nil, err
+		}
+	}
+	if len(s.names) == 0 && len(s.matchers) == 0 && s.shards == 0 {
+		return nil, nil
+	}
+	return s, nil
+}
+
+// selectsFamily reports whether the metrics of a family may be selected.
+func (s *selection) selectsFamily(name string) bool {
+	if len(s.names) > 0 && !s.names[name] {
+		return false
+	}
+	return s.shards == 0 || shardOf(name, s.shards) == s.shard
+}
+
+// selectsMetric reports whether a series of the named family is selected.
+func (s *selection) selectsMetric(name string, m *dto.Metric) bool {
+	for _, matcher := range s.matchers {
+		value := ""
+		if matcher.name == model.MetricNameLabel {
+			value = name
+		}
+		for _, pair := range m.Label {
+			if pair.GetName() == matcher.name {
+				value = pair.GetValue()
+				break
+			}
+		}
+		if !matcher.matches(value) {
+			return false
+		}
+	}
+	return true
+}
+
+// selectionGatherer only passes on the selected metrics of a gatherer.
+type selectionGatherer struct {
+	gatherer  prometheus.Gatherer
+	selection *selection
+}
+
+func (g selectionGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	selected := families[:0]
+	for _, family := range families {
+		if !g.selection.selectsFamily(family.GetName()) {
+			continue
+		}
+		metrics := family.Metric[:0]
+		for _, m := range family.Metric {
+			if g.selection.selectsMetric(family.GetName(), m) {
+				metrics = append(metrics, m)
+			}
+		}
+		if len(metrics) == 0 {
+			continue
+		}
+		family.Metric = metrics
+		selected = append(selected, family)
+	}
+	return selected, err
+}
+
+// shardOf returns the shard of a metric.
+func shardOf(metricName string, shards uint32) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(metricName))
+	return h.Sum32() % shards
+}
+
+// parseShard parses a shard given as "2of8", numbered from 1, into the shard
+// numbered from 0 and the number of shards.
+func parseShard(param string) (uint32, uint32, error) {
+	parts := strings.SplitN(param, "of", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected a shard like 2of8", param)
+	}
+	shard, err := strconv.ParseUint(parts[0], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q: %v", param, err)
+	}
+	shards, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid shard %q: %v", param, err)
+	}
+	if shard < 1 || shard > shards {
+		return 0, 0, fmt.Errorf("invalid shard %q, expected a shard between 1 and %d", param, shards)
+	}
+	return uint32(shard - 1), uint32(shards), nil
+}
+
+// selectionHandler serves the metrics of the gatherer with the handler
+// expose returns for it, restricted to those a scrape selects with query
+// parameters.
+func selectionHandler(g prometheus.Gatherer, expose func(prometheus.Gatherer) http.Handler) http.Handler {
+	all := expose(g)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s, err := parseSelection(r.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s == nil {
+			all.ServeHTTP(w, r)
+			return
+		}
+		expose(selectionGatherer{gatherer: g, selection: s}).ServeHTTP(w, r)
+	})
+}
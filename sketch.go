@@ -0,0 +1,274 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// defaultRelativeAccuracy bounds the error of DDSketch quantiles unless the
+// summary options set it.
+const defaultRelativeAccuracy = 0.01
+
+// ddSketch estimates quantiles with an error bounded relative to their
+// value. Values fall into buckets growing exponentially by a factor of
+// gamma, see https://arxiv.org/abs/1908.10693.
+type ddSketch struct {
+	logGamma  float64
+	positive  map[int]uint64
+	negative  map[int]uint64
+	zeroCount uint64
+	count     uint64
+}
+
+func newDDSketch(relativeAccuracy float64) *ddSketch {
+	return &ddSketch{
+		logGamma: math.Log((1 + relativeAccuracy) / (1 - relativeAccuracy)),
+		positive: make(map[int]uint64),
+		negative: make(map[int]uint64),
+	}
+}
+
+func (s *ddSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.logGamma))
+}
+
+// value returns the estimate for the values of a bucket.
+func (s *ddSketch) value(index int) float64 {
+	return 2 * math.Exp(float64(index)*s.logGamma) / (1 + math.Exp(s.logGamma))
+}
+
+func (s *ddSketch) add(v float64) {
+	switch {
+	case v > 0:
+		s.positive[s.index(v)]++
+	case v < 0:
+		s.negative[s.index(-v)]++
+	default:
+		s.zeroCount++
+	}
+	s.count++
+}
+
+func (s *ddSketch) merge(o *ddSketch) {
+	for i, c := range o.positive {
+		s.positive[i] += c
+	}
+	for i, c := range o.negative {
+		s.negative[i] += c
+	}
+	s.zeroCount += o.zeroCount
+	s.count += o.count
+}
+
+func (s *ddSketch) reset() {
+	s.positive = make(map[int]uint64)
+	s.negative = make(map[int]uint64)
+	s.zeroCount = 0
+	s.count = 0
+}
+
+// quantile returns the estimate of the q-quantile, or NaN if the sketch is
+// empty.
+func (s *ddSketch) quantile(q float64) float64 {
+	if s.count == 0 {
+		return math.NaN()
+	}
+	rank := uint64(q * float64(s.count-1))
+
+	var seen uint64
+	negative := sortedIndexes(s.negative)
+	for i := len(negative) - 1; i >= 0; i-- {
+		seen += s.negative[negative[i]]
+		if seen > rank {
+			return -s.value(negative[i])
+		}
+	}
+	seen += s.zeroCount
+	if seen > rank {
+		return 0
+	}
+	positive := sortedIndexes(s.positive)
+	for _, i := range positive {
+		seen += s.positive[i]
+		if seen > rank {
+			return s.value(i)
+		}
+	}
+	return s.value(positive[len(positive)-1])
+}
+
+func sortedIndexes(bins map[int]uint64) []int {
+	indexes := make([]int, 0, len(bins))
+	for i := range bins {
+		indexes = append(indexes, i)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// sketchSummary is a summary whose quantiles are estimated by DDSketch over
+// a sliding window, made of ageBuckets sketches rotated in turn like the
+// client library does. Its sum and count are never reset.
+type sketchSummary struct {
+	mtx         sync.Mutex
+	labelValues []string
+	sketches    []*ddSketch
+	head        int
+	// The time the head sketch is due to be reset.
+	headExpires time.Time
+	rotation    time.Duration
+	sum         float64
+	count       uint64
+}
+
+func (s *sketchSummary) Observe(v float64) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.rotate(time.Now())
+	for _, sk := range s.sketches {
+		sk.add(v)
+	}
+	s.sum += v
+	s.count++
+}
+
+// rotate resets the sketches whose time in the window is over. Each sketch
+// holds the observations of the whole window when it becomes the head.
+func (s *sketchSummary) rotate(now time.Time) {
+	if now.Sub(s.headExpires) >= s.rotation*time.Duration(len(s.sketches)) {
+		// The whole window expired.
+		for _, sk := range s.sketches {
+			sk.reset()
+		}
+		s.headExpires = now.Add(s.rotation)
+		return
+	}
+	for !now.Before(s.headExpires) {
+		s.sketches[s.head].reset()
+		s.head = (s.head + 1) % len(s.sketches)
+		s.headExpires = s.headExpires.Add(s.rotation)
+	}
+}
+
+// sketchSummaryVec is the counterpart of a SummaryVec for summaries using
+// DDSketch.
+type sketchSummaryVec struct {
+	desc             *prometheus.Desc
+	labelNames       []string
+	quantiles        []float64
+	relativeAccuracy float64
+	maxAge           time.Duration
+	ageBuckets       uint32
+
+	mtx       sync.Mutex
+	summaries map[string]*sketchSummary
+}
+
+func newSketchSummaryVec(name, help string, labelNames []string, quantiles []float64, relativeAccuracy float64, maxAge time.Duration, ageBuckets uint32) *sketchSummaryVec {
+	sort.Float64s(quantiles)
+	return &sketchSummaryVec{
+		desc:             prometheus.NewDesc(name, help, labelNames, nil),
+		labelNames:       labelNames,
+		quantiles:        quantiles,
+		relativeAccuracy: relativeAccuracy,
+		maxAge:           maxAge,
+		ageBuckets:       ageBuckets,
+		summaries:        make(map[string]*sketchSummary),
+	}
+}
+
+// vecLabelValues returns the values of the labels in the order of the label
+// names of a vector.
+func vecLabelValues(labelNames []string, labels prometheus.Labels) ([]string, error) {
+	if len(labels) != len(labelNames) {
+		return nil, fmt.Errorf("expected %d labels, got %d", len(labelNames), len(labels))
+	}
+	values := make([]string, len(labelNames))
+	for i, name := range labelNames {
+		value, ok := labels[name]
+		if !ok {
+			return nil, fmt.Errorf("label %q missing", name)
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+func (v *sketchSummaryVec) GetMetricWith(labels prometheus.Labels) (prometheus.Observer, error) {
+	values, err := vecLabelValues(v.labelNames, labels)
+	if err != nil {
+		return nil, err
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if s, ok := v.summaries[key]; ok {
+		return s, nil
+	}
+	s := &sketchSummary{
+		labelValues: values,
+		sketches:    make([]*ddSketch, v.ageBuckets),
+		rotation:    v.maxAge / time.Duration(v.ageBuckets),
+	}
+	for i := range s.sketches {
+		s.sketches[i] = newDDSketch(v.relativeAccuracy)
+	}
+	s.headExpires = time.Now().Add(s.rotation)
+	v.summaries[key] = s
+	return s, nil
+}
+
+func (v *sketchSummaryVec) Delete(labels prometheus.Labels) bool {
+	values, err := vecLabelValues(v.labelNames, labels)
+	if err != nil {
+		return false
+	}
+	key := strings.Join(values, "\xff")
+
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	if _, ok := v.summaries[key]; !ok {
+		return false
+	}
+	delete(v.summaries, key)
+	return true
+}
+
+func (v *sketchSummaryVec) Describe(ch chan<- *prometheus.Desc) {
+	ch <- v.desc
+}
+
+func (v *sketchSummaryVec) Collect(ch chan<- prometheus.Metric) {
+	v.mtx.Lock()
+	defer v.mtx.Unlock()
+	for _, s := range v.summaries {
+		s.mtx.Lock()
+		s.rotate(time.Now())
+		quantiles := make(map[float64]float64, len(v.quantiles))
+		for _, q := range v.quantiles {
+			quantiles[q] = s.sketches[s.head].quantile(q)
+		}
+		ch <- prometheus.MustNewConstSummary(v.desc, s.count, s.sum, quantiles, s.labelValues...)
+		s.mtx.Unlock()
+	}
+}
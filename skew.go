@@ -0,0 +1,154 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// maxSkewedSources bounds the sources flagged for clock skew.
+	maxSkewedSources = 1000
+	// skewedSourceExpiry is how long a source stays flagged after its last
+	// skewed sample.
+	skewedSourceExpiry = time.Hour
+)
+
+// clockSkew flags the sources sending samples with timestamps too far from
+// the local time, if enabled.
+var clockSkew *skewTracker
+
+// skewedSource is a source whose timestamps are off by more than the
+// threshold.
+type skewedSource struct {
+	Listener string `json:"listener"`
+	Source   string `json:"source"`
+	// Skew is the difference between the timestamp of the last skewed
+	// sample and the time it was received, in seconds. It is positive for
+	// clocks ahead.
+	Skew     float64   `json:"skew_seconds"`
+	Samples  uint64    `json:"samples"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// skewTracker keeps the sources whose clock is skewed by more than a
+// threshold.
+type skewTracker struct {
+	threshold time.Duration
+
+	mtx     sync.Mutex
+	sources map[string]*skewedSource
+}
+
+func newSkewTracker(threshold time.Duration) *skewTracker {
+	return &skewTracker{threshold: threshold, sources: map[string]*skewedSource{}}
+}
+
+// observeSkew accounts for the difference between the timestamps of the
+// events of a line and the time it was received.
+func observeSkew(listener, source string, events Events) {
+	var received time.Time
+	for _, event := range events {
+		timestamp := event.Timestamp()
+		if timestamp.IsZero() {
+			continue
+		}
+		if received.IsZero() {
+			received = time.Now()
+		}
+		skew := timestamp.Sub(received)
+		timestampSkew.Observe(skew.Seconds())
+		if clockSkew != nil && (skew > clockSkew.threshold || skew < -clockSkew.threshold) {
+			skewedSamples.WithLabelValues(listener).Inc()
+			clockSkew.flag(listener, source, skew, received)
+		}
+	}
+}
+
+// flag records a sample whose timestamp is skewed by more than the
+// threshold.
+func (t *skewTracker) flag(listener, source string, skew time.Duration, now time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	key := listener + "/" + source
+	s, ok := t.sources[key]
+	if !ok {
+		t.expire(now)
+		if len(t.sources) >= maxSkewedSources {
+			return
+		}
+		log.With("listener", listener).With("source", source).With("skew", skew).Warnln("Received timestamps skewed beyond the threshold")
+		s = &skewedSource{Listener: listener, Source: source}
+		t.sources[key] = s
+	}
+	s.Skew = skew.Seconds()
+	s.Samples++
+	s.LastSeen = now
+}
+
+// expire forgets the sources without skewed samples for a while. The
+// tracker must be locked.
+func (t *skewTracker) expire(now time.Time) {
+	for key, s := range t.sources {
+		if now.Sub(s.LastSeen) > skewedSourceExpiry {
+			delete(t.sources, key)
+		}
+	}
+}
+
+// skewed returns the flagged sources, the most skewed first.
+func (t *skewTracker) skewed(now time.Time) []skewedSource {
+	t.mtx.Lock()
+	t.expire(now)
+	sources := make([]skewedSource, 0, len(t.sources))
+	for _, s := range t.sources {
+		sources = append(sources, *s)
+	}
+	t.mtx.Unlock()
+	sort.Slice(sources, func(i, j int) bool {
+		if a, b := math.Abs(sources[i].Skew), math.Abs(sources[j].Skew); a != b {
+			return a > b
+		}
+		return sources[i].Listener+sources[i].Source < sources[j].Listener+sources[j].Source
+	})
+	return sources
+}
+
+// skewHandler serves the sources flagged for clock skew as JSON.
+type skewHandler struct {
+	tracker *skewTracker
+}
+
+func (h *skewHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]interface{}{
+		"threshold_seconds": h.tracker.threshold.Seconds(),
+		"sources":           h.tracker.skewed(time.Now()),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
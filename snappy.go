@@ -0,0 +1,111 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "encoding/binary"
+
+const (
+	// maxSnappyLiteral is the longest literal a single snappy element holds
+	// with a two byte length. It is also the size of the blocks matches are
+	// searched in, so that their offsets fit in two bytes.
+	maxSnappyLiteral = 1 << 16
+	// snappyTableBits is the size of the hash table of recent positions.
+	snappyTableBits = 14
+	// minSnappyMatch is the shortest repetition worth a copy element.
+	minSnappyMatch = 4
+)
+
+// snappyEncode returns src in the snappy block format remote write receivers
+// expect. Unless compress is set, the data is stored as literals, which is
+// cheaper but larger.
+func snappyEncode(src []byte, compress bool) []byte {
+	dst := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+len(src)+len(src)/maxSnappyLiteral*3+3)
+	dst = dst[:binary.PutUvarint(dst, uint64(len(src)))]
+	for len(src) > 0 {
+		n := len(src)
+		if n > maxSnappyLiteral {
+			n = maxSnappyLiteral
+		}
+		if compress {
+			dst = appendSnappyBlock(dst, src[:n])
+		} else {
+			dst = appendSnappyLiteral(dst, src[:n])
+		}
+		src = src[n:]
+	}
+	return dst
+}
+
+// appendSnappyBlock appends a block of up to maxSnappyLiteral bytes,
+// replacing repetitions with copies of earlier data. Recent positions are
+// looked up by a hash of the four bytes at them, and matches extended as far
+// as they go.
+func appendSnappyBlock(dst, src []byte) []byte {
+	var table [1 << snappyTableBits]uint16
+	literal := 0
+	for s := 0; s+minSnappyMatch <= len(src); {
+		u := binary.LittleEndian.Uint32(src[s:])
+		h := (u * 0x1e35a7bd) >> (32 - snappyTableBits)
+		candidate := int(table[h])
+		table[h] = uint16(s)
+		if candidate >= s || binary.LittleEndian.Uint32(src[candidate:]) != u {
+			s++
+			continue
+		}
+
+		if literal < s {
+			dst = appendSnappyLiteral(dst, src[literal:s])
+		}
+		length := minSnappyMatch
+		for s+length < len(src) && src[candidate+length] == src[s+length] {
+			length++
+		}
+		dst = appendSnappyCopy(dst, s-candidate, length)
+		s += length
+		literal = s
+	}
+	if literal < len(src) {
+		dst = appendSnappyLiteral(dst, src[literal:])
+	}
+	return dst
+}
+
+// appendSnappyCopy appends copy elements with a two byte offset, each
+// repeating up to 64 bytes.
+func appendSnappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|2, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+// appendSnappyLiteral appends a literal element of up to maxSnappyLiteral
+// bytes.
+func appendSnappyLiteral(dst, literal []byte) []byte {
+	n := len(literal) - 1
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n<<2))
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	default:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(dst, literal...)
+}
@@ -0,0 +1,261 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+const snapshotVersion = 1
+
+// snapshot holds the state of counters and gauges, so that it survives
+// restarts. Histograms and summaries can't be restored and are left out.
+type snapshot struct {
+	Version int              `json:"version"`
+	Series  []snapshotSeries `json:"series"`
+}
+
+type snapshotSeries struct {
+	Name   string            `json:"name"`
+	Type   string            `json:"type"`
+	Help   string            `json:"help"`
+	Labels prometheus.Labels `json:"labels"`
+	Value  float64           `json:"value"`
+	Ttl    time.Duration     `json:"ttl,omitempty"`
+	// The creation time of counters, kept so that restoring them isn't
+	// mistaken for a reset.
+	Created time.Time `json:"created,omitempty"`
+	// The last running total received for series fed by a cumulative client
+	// counter, so that the next one only adds its increase.
+	ClientTotal *float64 `json:"client_total,omitempty"`
+}
+
+// snapshot returns the current state of all counters and gauges.
+func (r *registry) snapshot() snapshot {
+	s := snapshot{Version: snapshotVersion, Series: []snapshotSeries{}}
+	for metricName, metric := range r.metrics {
+		var metricType string
+		switch metric.metricType {
+		case CounterMetricType:
+			metricType = "counter"
+		case GaugeMetricType:
+			metricType = "gauge"
+		default:
+			continue
+		}
+
+		for _, rm := range metric.metrics {
+			var m dto.Metric
+			if err := rm.metric.(prometheus.Metric).Write(&m); err != nil {
+				log.Debugf("Failed to snapshot metric %q: %s", metricName, err)
+				continue
+			}
+			series := snapshotSeries{
+				Name:   metricName,
+				Type:   metricType,
+				Help:   metric.help,
+				Labels: rm.labels,
+				Value:  m.GetGauge().GetValue(),
+				Ttl:    rm.ttl,
+			}
+			if metric.metricType == CounterMetricType {
+				series.Value = m.GetCounter().GetValue()
+				series.Created = rm.createdAt
+			}
+			if total, ok := r.clientTotal(rm.metric); ok {
+				series.ClientTotal = &total
+			}
+			s.Series = append(s.Series, series)
+		}
+	}
+	return s
+}
+
+// checkRestore reports whether all the series of a snapshot can be restored,
+// so that a snapshot is either restored entirely or not at all.
+func (r *registry) checkRestore(s snapshot) error {
+	if s.Version != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	types := make(map[string]metricType)
+	var newSeries int
+	for _, series := range s.Series {
+		var t metricType
+		switch series.Type {
+		case "counter":
+			t = CounterMetricType
+		case "gauge":
+			t = GaugeMetricType
+		default:
+			return fmt.Errorf("unsupported metric type %q in snapshot", series.Type)
+		}
+		if !model.IsValidMetricName(model.LabelValue(series.Name)) {
+			return fmt.Errorf("invalid metric name %q in snapshot", series.Name)
+		}
+		for name := range series.Labels {
+			if !model.LabelName(name).IsValid() {
+				return fmt.Errorf("invalid label name %q of metric %s in snapshot", name, series.Name)
+			}
+		}
+		if seen, ok := types[series.Name]; ok && seen != t {
+			return fmt.Errorf("metric %s has several types in snapshot", series.Name)
+		}
+		types[series.Name] = t
+		if r.metricConflicts(series.Name, t) {
+			return fmt.Errorf("metric with name %s is already registered", series.Name)
+		}
+		if r.series(series.Name, series.Labels) == nil {
+			newSeries++
+		}
+	}
+	if r.pressure >= memoryPressureExceeded {
+		return errMemoryLimit
+	}
+	if r.maxSeries > 0 && r.lru == nil && r.seriesCount+newSeries > r.maxSeries {
+		return errSeriesLimit
+	}
+	return nil
+}
+
+// restore recreates the counters and gauges of a snapshot, once checked by
+// checkRestore.
+func (r *registry) restore(s snapshot) error {
+	for _, series := range s.Series {
+		mapping := &mapper.MetricMapping{Ttl: series.Ttl}
+		switch series.Type {
+		case "counter":
+			counter, err := r.getCounter(series.Name, series.Labels, series.Help, mapping, true)
+			if err != nil {
+				return err
+			}
+			counter.Add(series.Value)
+			if rm := r.series(series.Name, series.Labels); rm != nil && !series.Created.IsZero() {
+				rm.createdAt = series.Created
+			}
+			if series.ClientTotal != nil {
+				r.setClientTotal(counter, *series.ClientTotal)
+			}
+		case "gauge":
+			gauge, err := r.getGauge(series.Name, series.Labels, series.Help, mapping, true)
+			if err != nil {
+				return err
+			}
+			gauge.Set(series.Value)
+			if series.ClientTotal != nil {
+				r.setClientTotal(gauge, *series.ClientTotal)
+			}
+		default:
+			return fmt.Errorf("unsupported metric type %q in snapshot", series.Type)
+		}
+	}
+	return nil
+}
+
+// writeSnapshot saves the state of counters and gauges to a file. The file
+// is replaced atomically, so that it always holds a complete snapshot.
+func (b *Exporter) writeSnapshot(fileName string) error {
+	start := time.Now()
+	err := b.doWriteSnapshot(fileName)
+	snapshotDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		snapshotWrites.WithLabelValues("failure").Inc()
+		return err
+	}
+	snapshotWrites.WithLabelValues("success").Inc()
+	snapshotLastSuccess.SetToCurrentTime()
+	return nil
+}
+
+func (b *Exporter) doWriteSnapshot(fileName string) error {
+	b.registry.mtx.RLock()
+	s := b.registry.snapshot()
+	b.registry.mtx.RUnlock()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(fileName), filepath.Base(fileName)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// loadSnapshot restores the state of counters and gauges from a file, if it
+// exists.
+func (b *Exporter) loadSnapshot(fileName string) error {
+	data, err := ioutil.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var s snapshot
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("invalid snapshot %s: %v", fileName, err)
+	}
+
+	b.registry.mtx.Lock()
+	defer b.registry.mtx.Unlock()
+	if err := b.registry.checkRestore(s); err != nil {
+		return fmt.Errorf("snapshot %s can't be restored: %v", fileName, err)
+	}
+	if err := b.registry.restore(s); err != nil {
+		return err
+	}
+	log.Infof("Restored %d series from snapshot %s", len(s.Series), fileName)
+	return nil
+}
+
+// snapshotLoop saves a snapshot to the given file at every interval.
+func (b *Exporter) snapshotLoop(fileName string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := b.writeSnapshot(fileName); err != nil {
+			log.Errorln("Error writing snapshot:", err)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/common/log"
+)
+
+// topSources accounts the lines received from each source address, if
+// enabled.
+var topSources *sourceCounter
+
+// sourceCount is the traffic received from a source address. Addresses
+// tracked after others were evicted may be overestimated by up to Error
+// lines.
+type sourceCount struct {
+	Source string `json:"source"`
+	Lines  uint64 `json:"lines"`
+	Bytes  uint64 `json:"bytes"`
+	Error  uint64 `json:"error"`
+}
+
+// sourceCounter keeps the sources that sent the most lines, with bounded
+// memory, using the Space-Saving algorithm: once it tracks as many sources
+// as it can, a new source replaces the one that sent the fewest lines, and
+// inherits its counts as an upper bound of what it may have sent before.
+type sourceCounter struct {
+	mtx     sync.Mutex
+	size    int
+	sources map[string]*sourceCount
+}
+
+func newSourceCounter(size int) *sourceCounter {
+	return &sourceCounter{size: size, sources: make(map[string]*sourceCount, size)}
+}
+
+func (c *sourceCounter) add(source string, lines, bytes int) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	sc, ok := c.sources[source]
+	if !ok {
+		if len(c.sources) < c.size {
+			sc = &sourceCount{Source: source}
+		} else {
+			var min *sourceCount
+			for _, s := range c.sources {
+				if min == nil || s.Lines < min.Lines {
+					min = s
+				}
+			}
+			delete(c.sources, min.Source)
+			sc = &sourceCount{Source: source, Lines: min.Lines, Bytes: min.Bytes, Error: min.Lines}
+		}
+		c.sources[source] = sc
+	}
+	sc.Lines += uint64(lines)
+	sc.Bytes += uint64(bytes)
+}
+
+// top returns the n sources that sent the most lines.
+func (c *sourceCounter) top(n int) []sourceCount {
+	c.mtx.Lock()
+	top := make([]sourceCount, 0, len(c.sources))
+	for _, sc := range c.sources {
+		top = append(top, *sc)
+	}
+	c.mtx.Unlock()
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Lines != top[j].Lines {
+			return top[i].Lines > top[j].Lines
+		}
+		return top[i].Source < top[j].Source
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+// sourcesHandler serves the sources that sent the most lines as JSON, as
+// many as the limit parameter asks for, 10 by default.
+type sourcesHandler struct {
+	counter *sourceCounter
+}
+
+func (h *sourcesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "Only GET or HEAD requests allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		if limit, err = strconv.Atoi(v); err != nil || limit < 1 {
+			http.Error(w, fmt.Sprintf("Invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string][]sourceCount{"sources": h.counter.top(limit)}); err != nil {
+		log.Errorln("Error writing response:", err)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+	"github.com/prometheus/statsd_exporter/pkg/subscription"
+)
+
+// subscriptionBuffer is the number of updates held for a subscriber that
+// doesn't keep up, beyond which they are dropped.
+const subscriptionBuffer = 1000
+
+// subscriptions passes the updates of metrics on to the gRPC clients
+// streaming them, as events are recorded.
+type subscriptions struct {
+	mtx         sync.RWMutex
+	subscribers map[*subscriber]struct{}
+	// The number of subscribers, checked without locking for every event.
+	count int32
+}
+
+// subscriber is a client streaming the updates of some metrics.
+type subscriber struct {
+	// The metric names streamed, or all if empty.
+	names map[string]bool
+	// The labels streamed series must have.
+	labels  prometheus.Labels
+	updates chan *subscription.MetricUpdate
+}
+
+func newSubscriptions() *subscriptions {
+	return &subscriptions{subscribers: make(map[*subscriber]struct{})}
+}
+
+// active reports whether any client is subscribed.
+func (s *subscriptions) active() bool {
+	return atomic.LoadInt32(&s.count) > 0
+}
+
+func (s *subscriptions) subscribe(sub *subscriber) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.subscribers[sub] = struct{}{}
+	atomic.StoreInt32(&s.count, int32(len(s.subscribers)))
+	subscribersCount.Set(float64(len(s.subscribers)))
+}
+
+func (s *subscriptions) unsubscribe(sub *subscriber) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	delete(s.subscribers, sub)
+	atomic.StoreInt32(&s.count, int32(len(s.subscribers)))
+	subscribersCount.Set(float64(len(s.subscribers)))
+}
+
+// publish passes the update of a metric by an event on to the subscribers it
+// matches, without waiting for those that don't keep up.
+func (s *subscriptions) publish(event Event, metricName string, metricType mapper.MetricType, labels prometheus.Labels) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	// Built once the event matches a subscriber, and shared by all of them.
+	var update *subscription.MetricUpdate
+	for sub := range s.subscribers {
+		if len(sub.names) > 0 && !sub.names[metricName] || !hasLabels(labels, sub.labels) {
+			continue
+		}
+		if update == nil {
+			update = newMetricUpdate(newMappedEvent(event, metricName, metricType, labels))
+		}
+		select {
+		case sub.updates <- update:
+		default:
+			subscriptionUpdatesDropped.Inc()
+		}
+	}
+}
+
+// newMetricUpdate returns the message streaming a mapped event.
+func newMetricUpdate(e mappedEvent) *subscription.MetricUpdate {
+	return &subscription.MetricUpdate{
+		Name:        e.Name,
+		Labels:      e.Labels,
+		Type:        e.Type,
+		Value:       e.Value,
+		TimestampMs: e.Timestamp.UnixNano() / 1e6,
+	}
+}
+
+// subscriptionServer serves the gRPC API streaming the updates of metrics.
+type subscriptionServer struct {
+	subscriptions *subscriptions
+}
+
+func (s *subscriptionServer) Subscribe(req *subscription.SubscribeRequest, stream subscription.Subscriptions_SubscribeServer) error {
+	sub := &subscriber{
+		names:   make(map[string]bool, len(req.Names)),
+		labels:  req.Labels,
+		updates: make(chan *subscription.MetricUpdate, subscriptionBuffer),
+	}
+	for _, name := range req.Names {
+		sub.names[name] = true
+	}
+
+	s.subscriptions.subscribe(sub)
+	defer s.subscriptions.unsubscribe(sub)
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case update := <-sub.updates:
+			if err := stream.Send(update); err != nil {
+				log.Debugln("Error streaming to subscriber:", err)
+				return err
+			}
+		}
+	}
+}
@@ -14,6 +14,8 @@
 package main
 
 import (
+	"sync"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -41,23 +43,40 @@ var (
 			Help: "The total number of StatsD packets received over UDP.",
 		},
 	)
-	tcpConnections = prometheus.NewCounter(
+	tcpConnections = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_tcp_connections_total",
-			Help: "The total number of TCP connections handled.",
+			Help: "The total number of TCP connections accepted by each listener.",
+		},
+		[]string{"listener"},
+	)
+	tcpOpenConnections = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_tcp_open_connections",
+			Help: "The number of TCP connections currently open on each listener.",
 		},
+		[]string{"listener"},
 	)
-	tcpErrors = prometheus.NewCounter(
+	tcpErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_tcp_connection_errors_total",
-			Help: "The number of errors encountered reading from TCP.",
+			Help: "The number of errors encountered reading from TCP, by listener.",
 		},
+		[]string{"listener"},
 	)
-	tcpLineTooLong = prometheus.NewCounter(
+	tcpIdleTimeouts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tcp_idle_timeouts_total",
+			Help: "The number of TCP connections closed by each listener for being idle for longer than the timeout.",
+		},
+		[]string{"listener"},
+	)
+	tcpLineTooLong = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_tcp_too_long_lines_total",
-			Help: "The number of lines discarded due to being too long.",
+			Help: "The number of lines discarded due to being too long, by listener.",
 		},
+		[]string{"listener"},
 	)
 	unixgramPackets = prometheus.NewCounter(
 		prometheus.CounterOpts{
@@ -65,36 +84,40 @@ var (
 			Help: "The total number of StatsD packets received over Unixgram.",
 		},
 	)
-	linesReceived = prometheus.NewCounter(
+	linesReceived = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_lines_total",
-			Help: "The total number of StatsD lines received.",
+			Help: "The total number of StatsD lines received, by listener.",
 		},
+		[]string{"listener"},
 	)
-	samplesReceived = prometheus.NewCounter(
+	samplesReceived = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_samples_total",
-			Help: "The total number of StatsD samples received.",
+			Help: "The total number of StatsD samples received, by listener.",
 		},
+		[]string{"listener"},
 	)
 	sampleErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_sample_errors_total",
-			Help: "The total number of errors parsing StatsD samples.",
+			Help: "The total number of errors parsing StatsD samples, by listener.",
 		},
-		[]string{"reason"},
+		[]string{"listener", "reason"},
 	)
-	tagsReceived = prometheus.NewCounter(
+	tagsReceived = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_tags_total",
-			Help: "The total number of DogStatsD tags processed.",
+			Help: "The total number of DogStatsD tags processed, by listener.",
 		},
+		[]string{"listener"},
 	)
-	tagErrors = prometheus.NewCounter(
+	tagErrors = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "statsd_exporter_tag_errors_total",
-			Help: "The number of errors parsing DogStatsD tags.",
+			Help: "The number of errors parsing DogStatsD tags, by listener.",
 		},
+		[]string{"listener"},
 	)
 	configLoads = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
@@ -103,6 +126,14 @@ var (
 		},
 		[]string{"outcome"},
 	)
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configLastReloadSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "statsd_exporter_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
 	mappingsCount = prometheus.NewGauge(prometheus.GaugeOpts{
 		Name: "statsd_exporter_loaded_mappings",
 		Help: "The current number of configured metric mappings.",
@@ -128,6 +159,288 @@ var (
 		},
 		[]string{"action"},
 	)
+	seriesCreated = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_created_total",
+			Help: "The total number of series added to the exported metrics.",
+		},
+	)
+	seriesRemoved = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_series_removed_total",
+			Help: "The total number of series removed from the exported metrics.",
+		},
+		[]string{"reason"},
+	)
+	snapshotWrites = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_snapshot_writes_total",
+			Help: "The number of snapshots written.",
+		},
+		[]string{"outcome"},
+	)
+	snapshotDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "statsd_exporter_snapshot_duration_seconds",
+			Help: "Time taken to write snapshots.",
+		},
+	)
+	snapshotLastSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_snapshot_last_success_timestamp_seconds",
+			Help: "Timestamp of the last successfully written snapshot.",
+		},
+	)
+	counterResets = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_client_counter_resets_total",
+			Help: "The number of resets detected in cumulative client counters.",
+		},
+	)
+	lateSamplesDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_late_samples_dropped_total",
+			Help: "The number of timestamped samples dropped for arriving after the reorder window.",
+		},
+	)
+	earlySamplesReleased = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_early_samples_released_total",
+			Help: "The number of timestamped samples released before the end of the reorder window because too many were held back.",
+		},
+	)
+	memoryLimitBytes = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_memory_limit_bytes",
+			Help: "The heap size the exporter tries to stay under, 0 if unlimited.",
+		},
+	)
+	memoryPressureLevel = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_memory_pressure_level",
+			Help: "The memory pressure: 0 for none, 1 for high, 2 for critical and 3 when the limit is exceeded.",
+		},
+	)
+	ingestionPaused = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_ingestion_paused",
+			Help: "Whether ingestion is paused through the admin API.",
+		},
+	)
+	pausedEventsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_paused_events_dropped_total",
+			Help: "The number of events dropped while ingestion was paused.",
+		},
+	)
+	aggregatedTimersDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_aggregated_timers_dropped_total",
+			Help: "The number of timer events dropped because too many were held back during an aggregation interval.",
+		},
+	)
+	remoteWriteSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_remote_write_samples_total",
+			Help: "The number of samples pushed to the remote write endpoint, by result.",
+		},
+		[]string{"result"},
+	)
+	remoteWriteRetriedSamples = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_remote_write_retried_samples_total",
+			Help: "The number of samples whose sending to the remote write endpoint was retried after a recoverable error.",
+		},
+	)
+	remoteWritePendingSamples = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_remote_write_pending_samples",
+			Help: "The number of samples queued to be sent to the remote write endpoint.",
+		},
+	)
+	remoteWriteQueueCapacity = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_remote_write_queue_capacity_samples",
+			Help: "The number of samples the remote write queue holds before dropping the oldest.",
+		},
+	)
+	remoteWriteSentBytes = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_remote_write_sent_bytes_total",
+			Help: "The number of bytes of compressed samples sent to the remote write endpoint.",
+		},
+	)
+	remoteWriteBatchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "statsd_exporter_remote_write_sent_batch_duration_seconds",
+			Help: "The duration of requests to the remote write endpoint.",
+		},
+	)
+	remoteWriteHighestSentTimestamp = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_remote_write_highest_sent_timestamp_seconds",
+			Help: "The timestamp of the newest sample successfully sent to the remote write endpoint.",
+		},
+	)
+	pushgatewayPushes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_pushgateway_pushes_total",
+			Help: "The number of pushes to the Pushgateway, by result.",
+		},
+		[]string{"result"},
+	)
+	otlpExports = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_otlp_exports_total",
+			Help: "The number of exports to the OTLP endpoint, by result.",
+		},
+		[]string{"result"},
+	)
+	graphiteSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_graphite_samples_total",
+			Help: "The number of samples written to Graphite, by result.",
+		},
+		[]string{"result"},
+	)
+	tenantsCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_tenants",
+			Help: "The number of tenants with metrics of their own.",
+		},
+	)
+	tenantEventsDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tenant_events_dropped_total",
+			Help: "The number of events dropped because their tenant would have exceeded the maximum number of tenants.",
+		},
+	)
+	influxDBSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_influxdb_samples_total",
+			Help: "The number of samples written to InfluxDB, by result.",
+		},
+		[]string{"result"},
+	)
+	kafkaRESTRecords = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_kafka_rest_proxy_events_total",
+			Help: "The number of mapped events published to Kafka through the REST proxy, by result.",
+		},
+		[]string{"result"},
+	)
+	subscribersCount = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_subscribers",
+			Help: "The number of gRPC clients streaming the updates of metrics.",
+		},
+	)
+	subscriptionUpdatesDropped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_subscription_updates_dropped_total",
+			Help: "The number of updates of metrics not streamed to a subscriber that didn't keep up.",
+		},
+	)
+	listenerLines = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_listener_lines_total",
+			Help: "The number of non-empty StatsD lines received by each listener, by whether any of their samples could be parsed.",
+		},
+		[]string{"listener", "result"},
+	)
+	timestampSkew = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "statsd_exporter_sample_timestamp_skew_seconds",
+			Help:    "The difference between the timestamps of samples and the time they were received, positive for timestamps ahead.",
+			Buckets: []float64{-3600, -600, -60, -10, -1, 1, 10, 60, 600, 3600},
+		},
+	)
+	skewedSamples = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_skewed_samples_total",
+			Help: "The number of samples received by each listener with a timestamp skewed beyond the threshold.",
+		},
+		[]string{"listener"},
+	)
+	eventsQueued = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_queued_total",
+			Help: "The number of events queued for processing.",
+		},
+	)
+	eventsMapped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_events_mapped_total",
+			Help: "The total number of StatsD events matching a mapping.",
+		},
+	)
+	eventQueueBlocks = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_event_queue_blocked_flushes_total",
+			Help: "The number of times events were flushed to a full event queue, blocking listeners until it had room.",
+		},
+	)
+	eventQueueBlockedTime = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_event_queue_blocked_seconds_total",
+			Help: "Time listeners spent blocked on a full event queue.",
+		},
+	)
+	workerPanics = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_worker_panics_total",
+			Help: "The number of panics recovered from, by the listener or processing worker that panicked.",
+		},
+		[]string{"worker"},
+	)
+	pipelineStalled = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_pipeline_stalled",
+			Help: "Whether no event batch was processed for the stall timeout while lines were received.",
+		},
+	)
+	httpRequests = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_http_requests_total",
+			Help: "The number of HTTP requests served, by handler and status code.",
+		},
+		[]string{"handler", "code"},
+	)
+	httpRequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "statsd_exporter_http_request_duration_seconds",
+			Help:    "Time taken to serve HTTP requests, by handler.",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"handler"},
+	)
+	tracingTraces = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_tracing_traces_total",
+			Help: "The number of traces of sampled lines, by whether they were exported, failed to be, or were dropped or expired before.",
+		},
+		[]string{"result"},
+	)
+	eventBatchDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "statsd_exporter_event_batch_processing_seconds",
+			Help:    "Time taken to process a batch of events taken from the event queue.",
+			Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+		},
+	)
+	internedLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "statsd_exporter_interned_string_lookups_total",
+			Help: "The number of metric names, label names and label values of parsed lines looked up among the interned strings, by whether they were found.",
+		},
+		[]string{"result"},
+	)
+	eventWorkersActive = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_workers_active",
+			Help: "The number of event workers events are dispatched to, 0 when they are handled without workers.",
+		},
+	)
 	metricsCount = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "statsd_exporter_metrics_total",
@@ -138,12 +451,20 @@ var (
 )
 
 func init() {
+	// Expose every reason from the start, so that alerts on removals work
+	// before the first one.
+	for _, reason := range []string{"expired", "evicted", "deleted"} {
+		seriesRemoved.WithLabelValues(reason)
+	}
+
 	prometheus.MustRegister(eventStats)
 	prometheus.MustRegister(eventsFlushed)
 	prometheus.MustRegister(eventsUnmapped)
 	prometheus.MustRegister(udpPackets)
 	prometheus.MustRegister(tcpConnections)
+	prometheus.MustRegister(tcpOpenConnections)
 	prometheus.MustRegister(tcpErrors)
+	prometheus.MustRegister(tcpIdleTimeouts)
 	prometheus.MustRegister(tcpLineTooLong)
 	prometheus.MustRegister(unixgramPackets)
 	prometheus.MustRegister(linesReceived)
@@ -152,9 +473,131 @@ func init() {
 	prometheus.MustRegister(tagsReceived)
 	prometheus.MustRegister(tagErrors)
 	prometheus.MustRegister(configLoads)
+	prometheus.MustRegister(configLastReloadSuccessful)
+	prometheus.MustRegister(configLastReloadSuccess)
 	prometheus.MustRegister(mappingsCount)
 	prometheus.MustRegister(conflictingEventStats)
 	prometheus.MustRegister(errorEventStats)
 	prometheus.MustRegister(eventsActions)
+	prometheus.MustRegister(seriesCreated)
+	prometheus.MustRegister(seriesRemoved)
+	prometheus.MustRegister(snapshotWrites)
+	prometheus.MustRegister(snapshotDuration)
+	prometheus.MustRegister(snapshotLastSuccess)
+	prometheus.MustRegister(counterResets)
+	prometheus.MustRegister(lateSamplesDropped)
+	prometheus.MustRegister(earlySamplesReleased)
+	prometheus.MustRegister(memoryLimitBytes)
+	prometheus.MustRegister(memoryPressureLevel)
+	prometheus.MustRegister(ingestionPaused)
+	prometheus.MustRegister(pausedEventsDropped)
+	prometheus.MustRegister(aggregatedTimersDropped)
+	prometheus.MustRegister(remoteWriteSamples)
+	prometheus.MustRegister(remoteWriteRetriedSamples)
+	prometheus.MustRegister(remoteWritePendingSamples)
+	prometheus.MustRegister(remoteWriteQueueCapacity)
+	prometheus.MustRegister(remoteWriteSentBytes)
+	prometheus.MustRegister(remoteWriteBatchDuration)
+	prometheus.MustRegister(remoteWriteHighestSentTimestamp)
+	prometheus.MustRegister(pushgatewayPushes)
+	prometheus.MustRegister(otlpExports)
+	prometheus.MustRegister(graphiteSamples)
+	prometheus.MustRegister(tenantsCount)
+	prometheus.MustRegister(tenantEventsDropped)
+	prometheus.MustRegister(influxDBSamples)
+	prometheus.MustRegister(kafkaRESTRecords)
+	prometheus.MustRegister(subscribersCount)
+	prometheus.MustRegister(subscriptionUpdatesDropped)
 	prometheus.MustRegister(metricsCount)
+	prometheus.MustRegister(listenerLines)
+	prometheus.MustRegister(timestampSkew)
+	prometheus.MustRegister(skewedSamples)
+	prometheus.MustRegister(eventsQueued)
+	prometheus.MustRegister(eventsMapped)
+	prometheus.MustRegister(eventBatchDuration)
+	prometheus.MustRegister(eventWorkersActive)
+	prometheus.MustRegister(internedLookups)
+	prometheus.MustRegister(tracingTraces)
+	prometheus.MustRegister(httpRequests)
+	prometheus.MustRegister(httpRequestDuration)
+	prometheus.MustRegister(pipelineStalled)
+	prometheus.MustRegister(workerPanics)
+	prometheus.MustRegister(eventQueueBlocks)
+	prometheus.MustRegister(eventQueueBlockedTime)
+}
+
+// registerQueueMetrics exposes the fill of the channel of event batches
+// waiting to be processed, and the events not yet flushed to it.
+func registerQueueMetrics(events chan Events, eq *eventQueue) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_queue_length",
+			Help: "The number of event batches waiting to be processed.",
+		},
+		func() float64 { return float64(len(events)) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_queue_capacity",
+			Help: "The number of event batches the event queue holds before listeners block.",
+		},
+		func() float64 { return float64(cap(events)) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_queue_high_watermark",
+			Help: "The most event batches seen waiting to be processed over the last one to two minutes.",
+		},
+		func() float64 { return float64(eq.maxDepth()) },
+	))
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_event_queue_pending_events",
+			Help: "The number of events waiting to be flushed to the event queue.",
+		},
+		func() float64 { return float64(eq.len()) },
+	))
+}
+
+// registerInternerMetrics exposes the number of strings held by an interner.
+func registerInternerMetrics(i *stringInterner) {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "statsd_exporter_interned_strings",
+			Help: "The number of metric names, label names and label values held to be shared.",
+		},
+		func() float64 { return float64(i.len()) },
+	))
+}
+
+// lineCounters are the counters of the lines parsed for a listener, looked up
+// once rather than for each line, as looking up label values allocates.
+type lineCounters struct {
+	lines, samples, tags, parsed, errored prometheus.Counter
+}
+
+var (
+	lineCountersMtx sync.RWMutex
+	lineCountersBy  = map[string]*lineCounters{}
+)
+
+// lineCountersFor returns the counters of the lines of a listener.
+func lineCountersFor(listener string) *lineCounters {
+	lineCountersMtx.RLock()
+	c, ok := lineCountersBy[listener]
+	lineCountersMtx.RUnlock()
+	if ok {
+		return c
+	}
+	c = &lineCounters{
+		lines:   linesReceived.WithLabelValues(listener),
+		samples: samplesReceived.WithLabelValues(listener),
+		tags:    tagsReceived.WithLabelValues(listener),
+		parsed:  listenerLines.WithLabelValues(listener, "parsed"),
+		errored: listenerLines.WithLabelValues(listener, "error"),
+	}
+	lineCountersMtx.Lock()
+	lineCountersBy[listener] = c
+	lineCountersMtx.Unlock()
+	return c
 }
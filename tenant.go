@@ -0,0 +1,210 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// listenerLabel is the label events are routed to the registry of their
+// listener by, when listeners are isolated.
+const listenerLabel = "__listener__"
+
+// tenants keeps the metrics of each tenant in an isolated registry, exposed
+// on an endpoint of its own.
+type tenants struct {
+	mtx sync.RWMutex
+	// The exporter of each tenant, sharing the mapper and options of the
+	// main exporter, but not its registry.
+	exporters map[string]*Exporter
+	gatherers map[string]*prometheus.Registry
+	// The number of tenants beyond which the events of new ones are
+	// dropped, unless 0.
+	max int
+}
+
+func newTenants() *tenants {
+	return &tenants{
+		exporters: make(map[string]*Exporter),
+		gatherers: make(map[string]*prometheus.Registry),
+	}
+}
+
+// tenant returns the exporter of a tenant, creating it on first use, or false
+// if the maximum number of tenants was reached.
+func (b *Exporter) tenant(name string) (*Exporter, bool) {
+	b.tenants.mtx.RLock()
+	t, ok := b.tenants.exporters[name]
+	b.tenants.mtx.RUnlock()
+	if ok {
+		return t, true
+	}
+
+	// Event workers may race to create the same tenant.
+	b.tenants.mtx.Lock()
+	defer b.tenants.mtx.Unlock()
+	if t, ok := b.tenants.exporters[name]; ok {
+		return t, true
+	}
+	if b.tenants.max > 0 && len(b.tenants.exporters) >= b.tenants.max {
+		return nil, false
+	}
+
+	gatherer := prometheus.NewRegistry()
+	t = &Exporter{
+		mapper:          b.mapper,
+		registry:        newRegistry(b.mapper),
+		unmappedAsLabel: b.unmappedAsLabel,
+		gate:            b.gate,
+		exemplarTags:    b.exemplarTags,
+		kafkaREST:       b.kafkaREST,
+		subscriptions:   b.subscriptions,
+		sourceLabels:    b.sourceLabels,
+	}
+	t.registry.registerer = gatherer
+	t.registry.setSeriesLimit(b.registry.maxSeries, b.registry.limitPolicy)
+	t.registry.setExpiryShards(len(b.registry.expiryShards))
+
+	b.tenants.exporters[name] = t
+	b.tenants.gatherers[name] = gatherer
+	tenantsCount.Set(float64(len(b.tenants.exporters)))
+	return t, true
+}
+
+// tenantOf returns the tenant of an event, named by the listener that
+// received it if listeners are isolated, or else by its tenant tag, and the
+// event without the label naming it. The label is removed from a copy, as
+// the events of a line share their labels.
+func (b *Exporter) tenantOf(event Event) (string, Event, bool) {
+	if name, ok := event.Labels()[listenerLabel]; ok {
+		return name, withoutLabel(event, listenerLabel), true
+	}
+	name, ok := b.tenantName(event)
+	if !ok {
+		return "", event, false
+	}
+	return name, withoutLabel(event, b.tenantTag), true
+}
+
+// tenantName returns the tenant an event is recorded for, if any.
+func (b *Exporter) tenantName(event Event) (string, bool) {
+	if name, ok := event.Labels()[listenerLabel]; ok {
+		return name, true
+	}
+	if b.tenantTag == "" {
+		return "", false
+	}
+	name, ok := event.Labels()[b.tenantTag]
+	return name, ok
+}
+
+// listenerTagger labels the events of a listener with its name, so that
+// they are recorded into the isolated registry of the listener.
+type listenerTagger struct {
+	listener     string
+	eventHandler eventHandler
+}
+
+func (t *listenerTagger) queue(events Events) {
+	for i, event := range events {
+		if len(event.Labels()) == 0 {
+			events[i] = withLabels(event, map[string]string{listenerLabel: t.listener})
+			continue
+		}
+		event.Labels()[listenerLabel] = t.listener
+	}
+	t.eventHandler.queue(events)
+}
+
+// tenantSeriesCollector exposes the number of series of each tenant.
+type tenantSeriesCollector struct {
+	exporter *Exporter
+}
+
+var tenantSeriesDesc = prometheus.NewDesc(
+	"statsd_exporter_tenant_series",
+	"The number of series in the isolated registry of a tenant or listener.",
+	[]string{"tenant"}, nil,
+)
+
+func (c tenantSeriesCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- tenantSeriesDesc
+}
+
+func (c tenantSeriesCollector) Collect(ch chan<- prometheus.Metric) {
+	c.exporter.tenants.mtx.RLock()
+	defer c.exporter.tenants.mtx.RUnlock()
+	for name, t := range c.exporter.tenants.exporters {
+		t.registry.mtx.RLock()
+		series := t.registry.seriesCount
+		t.registry.mtx.RUnlock()
+		ch <- prometheus.MustNewConstMetric(tenantSeriesDesc, prometheus.GaugeValue, float64(series), name)
+	}
+}
+
+// forEachTenant calls f with the exporter of every tenant.
+func (b *Exporter) forEachTenant(f func(*Exporter)) {
+	b.tenants.mtx.RLock()
+	exporters := make([]*Exporter, 0, len(b.tenants.exporters))
+	for _, t := range b.tenants.exporters {
+		exporters = append(exporters, t)
+	}
+	b.tenants.mtx.RUnlock()
+	for _, t := range exporters {
+		f(t)
+	}
+}
+
+// tenantNames returns the names of the tenants seen so far, sorted.
+func (b *Exporter) tenantNames() []string {
+	b.tenants.mtx.RLock()
+	defer b.tenants.mtx.RUnlock()
+	names := make([]string, 0, len(b.tenants.exporters))
+	for name := range b.tenants.exporters {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// tenantsHandler serves the metrics of the tenant named by the path below
+// prefix, or the list of endpoints of the tenants at prefix itself.
+func (b *Exporter) tenantsHandler(prefix string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		if name == "" {
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			for _, name := range b.tenantNames() {
+				w.Write([]byte(prefix + name + "\n"))
+			}
+			return
+		}
+		b.tenants.mtx.RLock()
+		t, ok := b.tenants.exporters[name]
+		gatherer := b.tenants.gatherers[name]
+		b.tenants.mtx.RUnlock()
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		h := promhttp.HandlerFor(gatherer, promhttp.HandlerOpts{})
+		t.metricsHandler(t.protobufHandler(gatherer, t.openMetricsHandler(gatherer, h))).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/statsd_exporter/pkg/mapper"
+)
+
+// timerStatistics are the values of the stat label of timers exposed as
+// classic StatsD statistics.
+var timerStatistics = []string{"count", "sum", "min", "max", "mean", "stddev"}
+
+// timerWindow accumulates the samples of a timer between two publications.
+type timerWindow struct {
+	// The gauges exposing the statistics, in the order of timerStatistics.
+	gauges     []prometheus.Gauge
+	count      int
+	sum, sumSq float64
+	min, max   float64
+}
+
+func (w *timerWindow) observe(value float64) {
+	if w.count == 0 || value < w.min {
+		w.min = value
+	}
+	if w.count == 0 || value > w.max {
+		w.max = value
+	}
+	w.count++
+	w.sum += value
+	w.sumSq += value * value
+}
+
+// publish sets the statistics of the samples received since the previous
+// publication. Without samples, the count and sum drop to zero while the other
+// statistics keep their values.
+func (w *timerWindow) publish() {
+	w.gauges[0].Set(float64(w.count))
+	w.gauges[1].Set(w.sum)
+	if w.count > 0 {
+		mean := w.sum / float64(w.count)
+		w.gauges[2].Set(w.min)
+		w.gauges[3].Set(w.max)
+		w.gauges[4].Set(mean)
+		w.gauges[5].Set(math.Sqrt(math.Max(w.sumSq/float64(w.count)-mean*mean, 0)))
+	}
+	w.count = 0
+	w.sum, w.sumSq = 0, 0
+}
+
+// timerStatisticsGauges returns the gauges exposing the statistics of a
+// timer, one per value of the stat label.
+func (r *registry) timerStatisticsGauges(metricName string, labels prometheus.Labels, help string, mapping *mapper.MetricMapping, create bool) ([]prometheus.Gauge, error) {
+	gauges := make([]prometheus.Gauge, len(timerStatistics))
+	for i, stat := range timerStatistics {
+		statLabels := make(prometheus.Labels, len(labels)+1)
+		for k, v := range labels {
+			statLabels[k] = v
+		}
+		statLabels["stat"] = stat
+		g, err := r.getGauge(metricName, statLabels, help, mapping, create)
+		if err != nil {
+			return nil, err
+		}
+		gauges[i] = g
+	}
+	return gauges, nil
+}
+
+// observeTimerStatistics records a timer sample into the gauges exposing its
+// statistics.
+func (r *registry) observeTimerStatistics(gauges []prometheus.Gauge, value float64) {
+	s := r.seriesStripe(gauges[0])
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	w, ok := s.timerWindows[gauges[0]]
+	if !ok {
+		w = &timerWindow{}
+		s.timerWindows[gauges[0]] = w
+	}
+	w.gauges = gauges
+	w.observe(value)
+}
+
+// publishTimerStatistics exposes the statistics of the timer samples
+// received since the previous publication.
+func (r *registry) publishTimerStatistics() {
+	r.forEachStripe(func(s *registryStripe) {
+		for _, w := range s.timerWindows {
+			w.publish()
+		}
+	})
+}
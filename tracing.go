@@ -0,0 +1,305 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/version"
+)
+
+const (
+	// traceTimeout is how long the events of a traced line can take to be
+	// recorded. Events held back by the aggregator or the reorder buffer
+	// usually take longer, and their trace is dropped.
+	traceTimeout = time.Minute
+	// maxFinishedTraces bounds the traces kept between two exports.
+	maxFinishedTraces = 10000
+
+	otlpSpanKindInternal = 1
+)
+
+// ingestTracer traces sampled lines through the exporter, if enabled.
+var ingestTracer *tracer
+
+// span is an operation of the ingest pipeline.
+type span struct {
+	name       string
+	id         [8]byte
+	start, end time.Time
+	attributes map[string]string
+}
+
+// ingestTrace follows a line from the time it is parsed until all its events
+// are recorded. Each step is a child span of the root one.
+type ingestTrace struct {
+	id     [16]byte
+	root   span
+	parsed time.Time
+	spans  []span
+	// The number of events of the line not recorded yet.
+	remaining int
+}
+
+// tracer samples lines and exports their traces to an OpenTelemetry
+// collector, with the OTLP/HTTP protocol.
+type tracer struct {
+	ratio float64
+	// The URL traces are posted to, ending in /v1/traces.
+	url      string
+	interval time.Duration
+	client   *http.Client
+	headers  map[string]string
+	resource map[string]string
+
+	mtx      sync.Mutex
+	rand     *rand.Rand
+	pending  map[Event]*ingestTrace
+	finished []*ingestTrace
+	// The length of pending, read without the lock so that events are
+	// only looked up while some are traced.
+	npending int32
+}
+
+func newTracer(endpoint string, ratio float64, headers, resource map[string]string) *tracer {
+	attributes := map[string]string{"service.name": "statsd_exporter"}
+	for k, v := range resource {
+		attributes[k] = v
+	}
+	return &tracer{
+		ratio:    ratio,
+		url:      strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		interval: 5 * time.Second,
+		client:   &http.Client{Timeout: otlpTimeout},
+		headers:  headers,
+		resource: attributes,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+		pending:  map[Event]*ingestTrace{},
+	}
+}
+
+// sample reports whether a line is to be traced.
+func (t *tracer) sample() bool {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.rand.Float64() < t.ratio
+}
+
+func (t *tracer) newSpan(name string, start, end time.Time, attributes map[string]string) span {
+	s := span{name: name, start: start, end: end, attributes: attributes}
+	t.rand.Read(s.id[:])
+	return s
+}
+
+// begin starts the trace of a line received at the given time and parsed
+// into events, which are followed until they are recorded.
+func (t *tracer) begin(listener, line string, events Events, received time.Time) {
+	parsed := time.Now()
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	trace := &ingestTrace{parsed: parsed, remaining: len(events)}
+	t.rand.Read(trace.id[:])
+	trace.root = t.newSpan("statsd.ingest", received, time.Time{}, map[string]string{
+		"statsd.listener": listener,
+		"statsd.line":     line,
+		"statsd.events":   strconv.Itoa(len(events)),
+	})
+	trace.spans = append(trace.spans, t.newSpan("parse", received, parsed, nil))
+	for _, event := range events {
+		t.pending[event] = trace
+	}
+	atomic.StoreInt32(&t.npending, int32(len(t.pending)))
+}
+
+// take returns the trace an event belongs to, if it is traced.
+func (t *tracer) take(event Event) *ingestTrace {
+	if atomic.LoadInt32(&t.npending) == 0 {
+		return nil
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	trace, ok := t.pending[event]
+	if !ok {
+		return nil
+	}
+	delete(t.pending, event)
+	atomic.StoreInt32(&t.npending, int32(len(t.pending)))
+	return trace
+}
+
+// add adds a step of an event to its trace. The last step of the last event
+// of the line completes the trace.
+func (t *tracer) add(trace *ingestTrace, s span, last bool) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rand.Read(s.id[:])
+	trace.spans = append(trace.spans, s)
+	if !last {
+		return
+	}
+	trace.remaining--
+	if trace.remaining > 0 {
+		return
+	}
+	trace.root.end = s.end
+	if len(t.finished) >= maxFinishedTraces {
+		tracingTraces.WithLabelValues("dropped").Inc()
+		return
+	}
+	t.finished = append(t.finished, trace)
+}
+
+// handleTracedEvent handles an event of a traced line, adding the time it
+// waited to be processed, mapped and recorded to the trace of the line.
+func (b *Exporter) handleTracedEvent(event Event, trace *ingestTrace) {
+	dequeued := time.Now()
+	attributes := map[string]string{
+		"statsd.metric": event.MetricName(),
+		"statsd.type":   string(event.MetricType()),
+	}
+	ingestTracer.add(trace, span{name: "queue", start: trace.parsed, end: dequeued, attributes: attributes}, false)
+
+	mapping, _, present := b.mapper.GetMappingWithTags(event.MetricName(), event.MetricType(), event.Labels())
+	mapped := time.Now()
+	mapAttributes := map[string]string{"statsd.metric": event.MetricName(), "statsd.mapped": strconv.FormatBool(present)}
+	if present && mapping != nil {
+		mapAttributes["statsd.mapping.name"] = mapping.Name
+		mapAttributes["statsd.mapping.rule"] = strconv.Itoa(mapping.Position())
+	}
+	ingestTracer.add(trace, span{name: "map", start: dequeued, end: mapped, attributes: mapAttributes}, false)
+
+	b.handleEvent(event)
+	ingestTracer.add(trace, span{name: "record", start: mapped, end: time.Now(), attributes: attributes}, true)
+}
+
+// run exports the finished traces every interval.
+func (t *tracer) run() {
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := t.export(); err != nil {
+			log.Warnln("Error exporting traces to OTLP:", err)
+		}
+	}
+}
+
+// expire drops the traces of lines whose events weren't all recorded in
+// time. The tracer must be locked.
+func (t *tracer) expire(now time.Time) {
+	expired := map[*ingestTrace]struct{}{}
+	for event, trace := range t.pending {
+		if now.Sub(trace.root.start) > traceTimeout {
+			delete(t.pending, event)
+			expired[trace] = struct{}{}
+		}
+	}
+	atomic.StoreInt32(&t.npending, int32(len(t.pending)))
+	tracingTraces.WithLabelValues("expired").Add(float64(len(expired)))
+}
+
+// export sends the traces finished since the last export.
+func (t *tracer) export() error {
+	t.mtx.Lock()
+	t.expire(time.Now())
+	traces := t.finished
+	t.finished = nil
+	t.mtx.Unlock()
+	if len(traces) == 0 {
+		return nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, t.url, bytes.NewReader(t.encode(traces)))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "statsd_exporter/"+version.Version)
+	for k, v := range t.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := t.client.Do(req)
+	if err != nil {
+		tracingTraces.WithLabelValues("failed").Add(float64(len(traces)))
+		return err
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+	}()
+	if resp.StatusCode/100 != 2 {
+		tracingTraces.WithLabelValues("failed").Add(float64(len(traces)))
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorMessage))
+		return fmt.Errorf("server returned HTTP status %s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+	tracingTraces.WithLabelValues("exported").Add(float64(len(traces)))
+	return nil
+}
+
+// encode translates traces into an ExportTraceServiceRequest.
+func (t *tracer) encode(traces []*ingestTrace) []byte {
+	// ScopeSpans: scope = 1, spans = 2.
+	scopeSpans := proto.NewBuffer(nil)
+	scope := proto.NewBuffer(nil)
+	pbString(scope, 1, "statsd_exporter")
+	pbString(scope, 2, version.Version)
+	pbMessage(scopeSpans, 1, scope)
+	for _, trace := range traces {
+		pbMessage(scopeSpans, 2, otlpSpan(trace.id, trace.root, nil))
+		for _, s := range trace.spans {
+			pbMessage(scopeSpans, 2, otlpSpan(trace.id, s, trace.root.id[:]))
+		}
+	}
+
+	// ResourceSpans: resource = 1, scope_spans = 2.
+	resourceSpans := proto.NewBuffer(nil)
+	pbMessage(resourceSpans, 1, otlpResource(t.resource))
+	pbMessage(resourceSpans, 2, scopeSpans)
+
+	// ExportTraceServiceRequest: resource_spans = 1.
+	request := proto.NewBuffer(nil)
+	pbMessage(request, 1, resourceSpans)
+	return request.Bytes()
+}
+
+// otlpSpan encodes a Span: trace_id = 1, span_id = 2, parent_span_id = 4,
+// name = 5, kind = 6, start_time_unix_nano = 7, end_time_unix_nano = 8,
+// attributes = 9.
+func otlpSpan(traceID [16]byte, s span, parent []byte) *proto.Buffer {
+	b := proto.NewBuffer(nil)
+	pbBytes(b, 1, traceID[:])
+	pbBytes(b, 2, s.id[:])
+	if parent != nil {
+		pbBytes(b, 4, parent)
+	}
+	pbString(b, 5, s.name)
+	pbVarint(b, 6, otlpSpanKindInternal)
+	pbFixed64(b, 7, uint64(s.start.UnixNano()))
+	pbFixed64(b, 8, uint64(s.end.UnixNano()))
+	for k, v := range s.attributes {
+		pbMessage(b, 9, otlpAttribute(k, v))
+	}
+	return b
+}
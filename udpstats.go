@@ -0,0 +1,148 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// The socket tables of the kernel, in which the UDP socket is looked up.
+var udpSocketTables = []string{"/proc/net/udp", "/proc/net/udp6"}
+
+var (
+	udpKernelDropsDesc = prometheus.NewDesc(
+		"statsd_exporter_udp_kernel_drops_total",
+		"The number of datagrams dropped by the kernel before the exporter read them, mostly because the receive buffer was full.",
+		nil, prometheus.Labels{"listener": "udp"},
+	)
+	udpReceiveQueueDesc = prometheus.NewDesc(
+		"statsd_exporter_udp_receive_queue_bytes",
+		"The number of bytes waiting in the receive buffer of the UDP socket.",
+		nil, prometheus.Labels{"listener": "udp"},
+	)
+)
+
+// udpSocketCollector exposes the drops and receive queue of the UDP socket,
+// as accounted by the kernel. It only works on Linux.
+type udpSocketCollector struct {
+	inode  string
+	tables []string
+}
+
+func newUDPSocketCollector(conn syscall.Conn) (*udpSocketCollector, error) {
+	inode, err := socketInode(conn)
+	if err != nil {
+		return nil, err
+	}
+	if _, _, err := findUDPSocket(udpSocketTables, inode); err != nil {
+		return nil, err
+	}
+	return &udpSocketCollector{inode: inode, tables: udpSocketTables}, nil
+}
+
+// socketInode returns the inode of a socket, which identifies it in the
+// socket tables.
+func socketInode(conn syscall.Conn) (string, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return "", err
+	}
+	var link string
+	var linkErr error
+	err = raw.Control(func(fd uintptr) {
+		link, linkErr = os.Readlink(fmt.Sprintf("/proc/self/fd/%d", fd))
+	})
+	if err != nil {
+		return "", err
+	}
+	if linkErr != nil {
+		return "", linkErr
+	}
+	if !strings.HasPrefix(link, "socket:[") || !strings.HasSuffix(link, "]") {
+		return "", fmt.Errorf("unexpected socket file %q", link)
+	}
+	return link[len("socket:[") : len(link)-1], nil
+}
+
+// findUDPSocket returns the receive queue and drops of the socket with the
+// given inode, from the first of the tables listing it.
+func findUDPSocket(tables []string, inode string) (rxQueue, drops uint64, err error) {
+	for _, table := range tables {
+		var found bool
+		rxQueue, drops, found, err = readUDPSocket(table, inode)
+		if err != nil && !os.IsNotExist(err) {
+			return 0, 0, err
+		}
+		if found {
+			return rxQueue, drops, nil
+		}
+	}
+	return 0, 0, fmt.Errorf("socket %s not found in %s", inode, strings.Join(tables, ", "))
+}
+
+// readUDPSocket reads the line of a socket in a table with the format of
+// /proc/net/udp.
+func readUDPSocket(table, inode string) (rxQueue, drops uint64, found bool, err error) {
+	f, err := os.Open(table)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	// Skip the header.
+	scanner.Scan()
+	for scanner.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ref pointer drops
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || fields[9] != inode {
+			continue
+		}
+		queues := strings.Split(fields[4], ":")
+		if len(queues) != 2 {
+			return 0, 0, false, fmt.Errorf("malformed queues %q in %s", fields[4], table)
+		}
+		if rxQueue, err = strconv.ParseUint(queues[1], 16, 64); err != nil {
+			return 0, 0, false, err
+		}
+		if drops, err = strconv.ParseUint(fields[12], 10, 64); err != nil {
+			return 0, 0, false, err
+		}
+		return rxQueue, drops, true, nil
+	}
+	return 0, 0, false, scanner.Err()
+}
+
+func (c *udpSocketCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- udpKernelDropsDesc
+	ch <- udpReceiveQueueDesc
+}
+
+func (c *udpSocketCollector) Collect(ch chan<- prometheus.Metric) {
+	rxQueue, drops, err := findUDPSocket(c.tables, c.inode)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(udpKernelDropsDesc, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(udpKernelDropsDesc, prometheus.CounterValue, float64(drops))
+	ch <- prometheus.MustNewConstMetric(udpReceiveQueueDesc, prometheus.GaugeValue, float64(rxQueue))
+}
@@ -0,0 +1,103 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"runtime/debug"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// workerRestartDelay is the time waited before restarting a worker that
+// panicked, so that one failing right away doesn't spin.
+var workerRestartDelay = 100 * time.Millisecond
+
+// runWorker runs the loop of a listener or of the processing of events,
+// restarting it if it panics, so that an unexpected input doesn't take the
+// whole process down. It returns once the loop does.
+func runWorker(name string, loop func()) {
+	for !runRecovered(name, loop) {
+		time.Sleep(workerRestartDelay)
+		log.With("worker", name).Warnln("Restarting worker")
+	}
+}
+
+// runRecovered runs f, and reports whether it returned rather than
+// panicked. Panics are counted and logged with their stack.
+func runRecovered(name string, f func()) (returned bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			workerPanics.WithLabelValues(name).Inc()
+			log.With("worker", name).With("stack", string(debug.Stack())).Errorf("Recovered from panic: %v", r)
+		}
+	}()
+	f()
+	return true
+}
+
+// The progress of the pipeline, watched for stalls: the lines received by the
+// listeners, and the event batches taken from the event queue.
+var linesRead, batchesTaken uint64
+
+// stallWatchdog detects when no event batch has been taken from the event
+// queue for a while, although the listeners kept receiving lines, such as
+// when processing is deadlocked.
+type stallWatchdog struct {
+	timeout time.Duration
+	// Whether to exit, for the process to be restarted, on a stall.
+	exit bool
+
+	lines, batches uint64
+	lastProgress   time.Time
+	stalled        bool
+}
+
+func newStallWatchdog(timeout time.Duration, exit bool) *stallWatchdog {
+	return &stallWatchdog{timeout: timeout, exit: exit, lastProgress: time.Now()}
+}
+
+// run checks for a stall every second.
+func (w *stallWatchdog) run() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		w.check(atomic.LoadUint64(&linesRead), atomic.LoadUint64(&batchesTaken), now)
+	}
+}
+
+// check updates the state of the pipeline with the current progress, and
+// reports whether it is stalled.
+func (w *stallWatchdog) check(lines, batches uint64, now time.Time) bool {
+	// Without new lines there is nothing to process.
+	if batches != w.batches || lines == w.lines {
+		w.lastProgress = now
+	}
+	w.lines, w.batches = lines, batches
+
+	stalled := now.Sub(w.lastProgress) >= w.timeout
+	if stalled && !w.stalled {
+		pipelineStalled.Set(1)
+		if w.exit {
+			log.Fatalf("No events processed for %s while receiving lines, exiting", w.timeout)
+		}
+		log.Errorf("No events processed for %s while receiving lines", w.timeout)
+	} else if !stalled && w.stalled {
+		pipelineStalled.Set(0)
+		log.Infoln("Events are processed again")
+	}
+	w.stalled = stalled
+	return stalled
+}